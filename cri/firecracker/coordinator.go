@@ -35,8 +35,13 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vhive-serverless/vhive/ctriface"
+	"github.com/vhive-serverless/vhive/ctriface/image"
+	"github.com/vhive-serverless/vhive/devmapper"
 )
 
+// maxMemLayers is the length of the memory layer chain of a snapshot above which it is compacted
+const maxMemLayers = 4
+
 type coordinator struct {
 	sync.Mutex
 	orch   *ctriface.Orchestrator
@@ -67,10 +72,18 @@ func newFirecrackerCoordinator(orch *ctriface.Orchestrator, opts ...coordinatorO
 	}
 
 	snapshotsDir := "/fccd/test/snapshots"
+	var snapshotOpts []snapshotting.SnapshotManagerOption
 	if !c.withoutOrchestrator {
 		snapshotsDir = orch.GetSnapshotsDir()
+		snapshotOpts = orch.GetSnapshotManagerOptions()
+	}
+	c.snapshotManager = snapshotting.NewSnapshotManager(snapshotsDir, snapshotOpts...)
+	if !c.withoutOrchestrator {
+		// Previous versions hold their images, which the orchestrator evicts next to free space in the thin pool
+		orch.AddThinPoolHook(func(context.Context, devmapper.ThinPoolUsage) {
+			c.snapshotManager.EvictPreviousVersions()
+		})
 	}
-	c.snapshotManager = snapshotting.NewSnapshotManager(snapshotsDir)
 
 	return c
 }
@@ -80,14 +93,45 @@ func (c *coordinator) startVM(ctx context.Context, image, revision string) (*fun
 }
 
 func (c *coordinator) startVMWithEnvironment(ctx context.Context, image, revision string, environment []string) (*funcInstance, error) {
+	return c.startVMWithDrives(ctx, image, revision, environment, nil)
+}
+
+func (c *coordinator) startVMWithDrives(ctx context.Context, image, revision string, environment []string, drives []ctriface.DriveSpec) (*funcInstance, error) {
 	if c.orch != nil && c.orch.GetSnapshotsEnabled() {
 		// Check if snapshot is available
-		if snap, err := c.snapshotManager.AcquireSnapshot(revision); err == nil {
-			return c.orchLoadInstance(ctx, snap)
+		if snap, err := c.snapshotManager.PinSnapshot(ctx, revision); err == nil {
+			// Snapshots kept from a previous run may be of another image of the revision
+			invalidErr := fmt.Errorf("snapshot of image %s", snap.GetImage())
+			if snap.GetImage() == image {
+				tStart := time.Now()
+				fi, err := c.orchLoadInstance(ctx, snap)
+				loadTime := time.Since(tStart)
+				if err != nil {
+					loadTime = 0
+				}
+				c.snapshotManager.UnpinSnapshot(snap, loadTime)
+				if !ctriface.IsSnapshotInvalid(err) {
+					return fi, err
+				}
+				invalidErr = err
+			} else {
+				c.snapshotManager.UnpinSnapshot(snap, 0)
+			}
+
+			// The image of the revision changed or the snapshot is corrupted, boot it from scratch and snapshot it again
+			log.WithFields(log.Fields{"revision": revision, "image": image}).WithError(invalidErr).Info("Invalidating snapshot")
+			if errors.Is(invalidErr, ctriface.ErrCorruptSnapshot) {
+				err = c.snapshotManager.InvalidateCorruptSnapshot(ctx, snap)
+			} else {
+				err = c.snapshotManager.InvalidateSnapshot(revision)
+			}
+			if err != nil {
+				log.WithError(err).Warn("failed to invalidate snapshot")
+			}
 		}
 	}
 
-	return c.orchStartVM(ctx, image, revision, environment)
+	return c.orchStartVM(ctx, image, revision, environment, drives)
 }
 
 func (c *coordinator) stopVM(ctx context.Context, containerID string) error {
@@ -102,8 +146,13 @@ func (c *coordinator) stopVM(ctx context.Context, containerID string) error {
 		return nil
 	}
 
-	if c.orch != nil && c.orch.GetSnapshotsEnabled() && !fi.SnapBooted {
-		err := c.orchCreateSnapshot(ctx, fi)
+	if c.orch != nil && c.orch.GetSnapshotsEnabled() {
+		var err error
+		if !fi.SnapBooted {
+			err = c.orchCreateSnapshot(ctx, fi)
+		} else if c.shouldResnapshot(fi) {
+			err = c.orchCreateDiffSnapshot(ctx, fi)
+		}
 		if err != nil {
 			log.Printf("Err creating snapshot %s\n", err)
 		}
@@ -135,7 +184,7 @@ func (c *coordinator) insertActive(containerID string, fi *funcInstance) error {
 	return nil
 }
 
-func (c *coordinator) orchStartVM(ctx context.Context, image, revision string, envVariables []string) (*funcInstance, error) {
+func (c *coordinator) orchStartVM(ctx context.Context, image, revision string, envVariables []string, drives []ctriface.DriveSpec) (*funcInstance, error) {
 	vmID := c.getVMID()
 	logger := log.WithFields(
 		log.Fields{
@@ -152,17 +201,19 @@ func (c *coordinator) orchStartVM(ctx context.Context, image, revision string, e
 		err  error
 	)
 
-	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*40)
+	ctxTimeout, cancel := context.WithTimeout(ctx, c.getTimeoutProfile().StartVM(ctriface.DefaultStartBudget))
 	defer cancel()
 
+	tStart := time.Now()
 	if !c.withoutOrchestrator {
-		resp, _, err = c.orch.StartVMWithEnvironment(ctxTimeout, vmID, image, envVariables)
+		resp, _, err = c.orch.StartVMWithDrives(ctxTimeout, vmID, image, envVariables, drives)
 		if err != nil {
 			logger.WithError(err).Error("coordinator failed to start VM")
 		}
 	}
 
 	fi := newFuncInstance(vmID, image, revision, false, resp)
+	fi.BootTime = time.Since(tStart)
 	logger.Debug("successfully created fresh instance")
 	return fi, err
 }
@@ -178,7 +229,7 @@ func (c *coordinator) orchLoadInstance(ctx context.Context, snap *snapshotting.S
 
 	logger.Debug("loading instance from snapshot")
 
-	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	ctxTimeout, cancel := context.WithTimeout(ctx, c.getTimeoutProfile().LoadVM(ctriface.DefaultLoadBudget))
 	defer cancel()
 
 	resp, _, err := c.orch.LoadSnapshot(ctxTimeout, vmID, snap)
@@ -193,25 +244,79 @@ func (c *coordinator) orchLoadInstance(ctx context.Context, snap *snapshotting.S
 	}
 
 	fi := newFuncInstance(vmID, snap.GetImage(), snap.GetId(), true, resp)
+	fi.BootTime = snap.BootTime
+	fi.SnapGeneration = snap.GetGeneration()
 	logger.Debug("successfully loaded instance from snapshot")
 	return fi, nil
 }
 
 func (c *coordinator) orchCreateSnapshot(ctx context.Context, fi *funcInstance) error {
-	var err error
+	// Instances booted from scratch while the revision was being snapshotted would replace the new snapshot
+	if snap, err := c.snapshotManager.PinSnapshot(ctx, fi.Revision); err == nil {
+		c.snapshotManager.UnpinSnapshot(snap, 0)
+		fi.Logger.Debug("revision already has a snapshot")
+		return nil
+	}
 
 	snap, err := c.snapshotManager.InitSnapshot(fi.Revision, fi.Image)
 	if err != nil {
 		fi.Logger.WithError(err).Error("failed to initialize snapshot")
 		return nil
 	}
+	snap.BootTime = fi.BootTime
+
+	return c.snapshotInstance(ctx, fi, snap)
+}
+
+// shouldResnapshot Returns whether the instance was loaded from the current snapshot of its revision after that
+// snapshot served enough loads to be refreshed with the warmer memory of the instance
+func (c *coordinator) shouldResnapshot(fi *funcInstance) bool {
+	loads := c.orch.GetResnapshotLoads()
+	if loads <= 0 {
+		return false
+	}
+
+	for _, stats := range c.snapshotManager.GetSnapshotVersions(fi.Revision) {
+		if stats.Current {
+			return stats.Generation == fi.SnapGeneration && stats.Loads >= uint64(loads)
+		}
+	}
+	return false
+}
+
+// orchCreateDiffSnapshot Refreshes the snapshot of the revision with a diff snapshot of the instance, which only
+// stores the memory pages the instance changed since it was loaded
+func (c *coordinator) orchCreateDiffSnapshot(ctx context.Context, fi *funcInstance) error {
+	snap, err := c.snapshotManager.InitDiffSnapshot(ctx, fi.Revision, fi.Revision, fi.Image)
+	if err != nil {
+		// Another instance of the revision is refreshing the snapshot
+		fi.Logger.WithError(err).Debug("failed to initialize diff snapshot")
+		return nil
+	}
+	snap.BootTime = fi.BootTime
+
+	if err := c.snapshotInstance(ctx, fi, snap); err != nil {
+		return err
+	}
+
+	if len(snap.MemLayers) > maxMemLayers {
+		// Loads merge the whole chain, which is squashed once it grows too long
+		if err := c.snapshotManager.CompactSnapshot(ctx, fi.Revision); err != nil {
+			fi.Logger.WithError(err).Warn("failed to compact snapshot")
+		}
+	}
+
+	return nil
+}
 
-	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*60)
+// snapshotInstance Creates the initialized snapshot of the instance and commits it
+func (c *coordinator) snapshotInstance(ctx context.Context, fi *funcInstance, snap *snapshotting.Snapshot) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, c.getTimeoutProfile().SnapshotVM(ctriface.DefaultSnapshotBudget))
 	defer cancel()
 
 	fi.Logger.Debug("creating instance snapshot before stopping")
 
-	err = c.orch.PauseVM(ctxTimeout, fi.VmID)
+	err := c.orch.PauseVM(ctxTimeout, fi.VmID)
 	if err != nil {
 		fi.Logger.WithError(err).Error("failed to pause VM")
 		return err
@@ -228,7 +333,7 @@ func (c *coordinator) orchCreateSnapshot(ctx context.Context, fi *funcInstance)
 		return err
 	}
 
-	if err := c.snapshotManager.CommitSnapshot(fi.VmID); err != nil {
+	if err := c.snapshotManager.CommitSnapshot(fi.Revision); err != nil {
 		fi.Logger.WithError(err).Error("failed to commit snapshot")
 		return err
 	}
@@ -249,6 +354,34 @@ func (c *coordinator) orchStopVM(ctx context.Context, fi *funcInstance) error {
 	return nil
 }
 
+func (c *coordinator) getTimeoutProfile() ctriface.TimeoutProfile {
+	if c.withoutOrchestrator {
+		return ctriface.DefaultTimeoutProfile()
+	}
+	return c.orch.GetTimeoutProfile()
+}
+
 func (c *coordinator) getVMID() string {
 	return fmt.Sprintf("%s-%s", strconv.Itoa(int(atomic.AddUint64(&c.nextID, 1))), (uuid.New()).String()[:16])
 }
+
+// getDriveImageRoot Returns the directory the image drives of the workloads are confined to
+func (c *coordinator) getDriveImageRoot() string {
+	if c.withoutOrchestrator {
+		return ""
+	}
+	return c.orch.GetDriveImageRoot()
+}
+
+func (c *coordinator) getPrePullStatus() (image.PrePullStatus, bool) {
+	if c.withoutOrchestrator {
+		return image.PrePullStatus{}, false
+	}
+	return c.orch.GetPrePullStatus(), true
+}
+
+func (c *coordinator) setPullCredentials(imageName string, creds image.Credentials) {
+	if !c.withoutOrchestrator {
+		c.orch.SetPullCredentials(imageName, creds)
+	}
+}
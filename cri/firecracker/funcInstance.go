@@ -23,6 +23,8 @@
 package firecracker
 
 import (
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/vhive-serverless/vhive/ctriface"
 )
@@ -34,6 +36,10 @@ type funcInstance struct {
 	Logger          *log.Entry
 	SnapBooted      bool
 	StartVMResponse *ctriface.StartVMResponse
+	// BootTime is the time the instance took to boot from scratch, recorded in its snapshot
+	BootTime time.Duration
+	// SnapGeneration is the version of the snapshot the instance was loaded from
+	SnapGeneration uint64
 }
 
 func newFuncInstance(vmID, image, revision string, snapBooted bool, startVMResponse *ctriface.StartVMResponse) *funcInstance {
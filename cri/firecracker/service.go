@@ -25,6 +25,7 @@ package firecracker
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -40,6 +41,7 @@ const (
 	guestPortEnv      = "GUEST_PORT"
 	guestImageEnv     = "GUEST_IMAGE"
 	revisionEnv       = "K_REVISION"
+	guestDrivesEnv    = "GUEST_DRIVES"
 )
 
 type FirecrackerService struct {
@@ -71,6 +73,26 @@ func NewFirecrackerService(orch *ctriface.Orchestrator) (*FirecrackerService, er
 	return fs, nil
 }
 
+// RecordPullAuth uses the credentials passed by the kubelet for the function images of the same registry
+func (fs *FirecrackerService) RecordPullAuth(imageName string, auth *criapi.AuthConfig) {
+	creds, err := cri.ToCredentials(auth)
+	if err != nil {
+		log.WithError(err).Warnf("Ignoring invalid credentials for image %s", imageName)
+		return
+	}
+	fs.coordinator.setPullCredentials(imageName, creds)
+}
+
+// Ready reports the node as not ready until the images of the warm set are local
+func (fs *FirecrackerService) Ready() (bool, string) {
+	status, ok := fs.coordinator.getPrePullStatus()
+	if !ok || status.Ready() {
+		return true, ""
+	}
+
+	return false, fmt.Sprintf("warm set not ready: %d/%d images pulled, %d failed", status.Pulled, status.Total, status.Failed)
+}
+
 // CreateContainer starts a container or a VM, depending on the name
 // if the name matches "user-container", the cri plugin starts a VM, assigning it an IP,
 // otherwise starts a regular container
@@ -117,11 +139,20 @@ func (fs *FirecrackerService) createUserContainer(ctx context.Context, r *criapi
 		return nil, err
 	}
 
+	// Extra drives are optional
+	var drives []ctriface.DriveSpec
+	if drivesStr, err := getEnvVal(guestDrivesEnv, config); err == nil {
+		if drives, err = ctriface.ParseDriveSpecs(drivesStr, fs.coordinator.getDriveImageRoot()); err != nil {
+			log.WithError(err).Error("invalid drives")
+			return nil, err
+		}
+	}
+
 	environment := cri.ToStringArray(config.GetEnvs())
-	funcInst, err := fs.coordinator.startVMWithEnvironment(context.Background(), guestImage, revision, environment)
+	funcInst, err := fs.coordinator.startVMWithDrives(context.Background(), guestImage, revision, environment, drives)
 	if err != nil {
 		log.WithError(err).Error("failed to start VM")
-		return nil, err
+		return nil, cri.ToStatusErr(err)
 	}
 
 	guestPort, err := getEnvVal(guestPortEnv, config)
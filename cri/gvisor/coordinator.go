@@ -25,11 +25,7 @@ package gvisor
 import (
 	"context"
 	"fmt"
-	"net"
-	"net/http"
-	"net/url"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -38,9 +34,9 @@ import (
 	"github.com/containerd/containerd/cio"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
-	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/go-cni"
 	log "github.com/sirupsen/logrus"
+	"github.com/vhive-serverless/vhive/ctriface/image"
 )
 
 const (
@@ -56,7 +52,12 @@ type coordinator struct {
 	client           *containerd.Client
 	activeContainers map[string]*gvContainer
 	network          cni.CNI
-	cachedImages     map[string]containerd.Image
+	snapshotter      string
+	imageManager     *image.ImageManager
+	imageOpts        []image.ImageManagerOption
+	imageGCPolicy    *image.GCPolicy
+	warmSet          []string
+	prePullWorkers   int
 }
 
 type gvContainer struct {
@@ -64,14 +65,21 @@ type gvContainer struct {
 	task      containerd.Task
 	taskC     <-chan containerd.ExitStatus
 	ip        string
+	imageName string
 }
 
-func newCoordinator() (*coordinator, error) {
+func newCoordinator(opts ...Option) (*coordinator, error) {
+	c := new(coordinator)
+	c.snapshotter = containerd.DefaultSnapshotter
+	c.prePullWorkers = 4
+	for _, opt := range opts {
+		opt(c)
+	}
+
 	client, err := containerd.New(gvisorContainerdAddress, containerd.WithDefaultRuntime(gvisorRuntime))
 	if err != nil {
 		return nil, fmt.Errorf("failed to start containerd client: %v", err)
 	}
-	c := new(coordinator)
 	c.client = client
 	c.activeContainers = make(map[string]*gvContainer)
 	network, err := cni.New(cni.WithConfFile(bridgeConfFile))
@@ -79,24 +87,44 @@ func newCoordinator() (*coordinator, error) {
 		return nil, fmt.Errorf("failed to init cni: %v", err)
 	}
 	c.network = network
-	c.cachedImages = make(map[string]containerd.Image)
+	c.imageManager = image.NewImageManager(client, c.snapshotter, c.imageOpts...)
+
+	if c.imageGCPolicy != nil {
+		c.imageGCPolicy.Namespace = namespaceName
+		if err := c.imageManager.StartGC(*c.imageGCPolicy); err != nil {
+			return nil, fmt.Errorf("failed to start image GC: %v", err)
+		}
+	}
+
+	if len(c.warmSet) > 0 {
+		ctx := namespaces.WithNamespace(context.Background(), namespaceName)
+		c.imageManager.PrePull(ctx, c.warmSet, c.prePullWorkers)
+	}
+
 	return c, nil
 }
 
 func (c *coordinator) startContainer(ctx context.Context, imageName string, environment []string) (_ *gvContainer, retErr error) {
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 	ctrID := strconv.Itoa(int(atomic.AddUint64(&c.nextID, 1)))
-	image, err := c.getImage(ctx, imageName)
+	// The image is protected from garbage collection until the container is stopped
+	ctrImage, err := c.imageManager.AcquireImage(ctx, imageName)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if retErr != nil {
+			c.imageManager.ReleaseImage(imageName)
+		}
+	}()
 	container, err := c.client.NewContainer(
 		ctx,
 		ctrID,
-		containerd.WithImage(*image),
-		containerd.WithNewSnapshot(ctrID, *image),
+		containerd.WithImage(*ctrImage),
+		containerd.WithSnapshotter(c.snapshotter),
+		containerd.WithNewSnapshot(ctrID, *ctrImage),
 		containerd.WithNewSpec(
-			oci.WithImageConfig(*image),
+			oci.WithImageConfig(*ctrImage),
 			oci.WithEnv(environment),
 		),
 	)
@@ -156,17 +184,21 @@ func (c *coordinator) startContainer(ctx context.Context, imageName string, envi
 		}
 	}()
 
-	return &gvContainer{ip: ip, container: container, task: task, taskC: exitStatusC}, nil
+	return &gvContainer{ip: ip, container: container, task: task, taskC: exitStatusC, imageName: imageName}, nil
 }
 
 func (c *coordinator) stopContainer(ctx context.Context, containerID string) error {
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 	c.Lock()
 	ctr, ok := c.activeContainers[containerID]
+	delete(c.activeContainers, containerID)
 	c.Unlock()
 	if !ok {
 		return fmt.Errorf("failed to find a active container with id %v", containerID)
 	}
+	// The container no longer uses its image, even if it fails to stop
+	defer c.imageManager.ReleaseImage(ctr.imageName)
+
 	container := ctr.container
 	task := ctr.task
 
@@ -197,71 +229,3 @@ func (c *coordinator) insertActive(containerID string, ctr *gvContainer) {
 	c.activeContainers[containerID] = ctr
 	c.Unlock()
 }
-
-// Checks whether a URL has a .local domain
-func isLocalDomain(s string) (bool, error) {
-	if !strings.Contains(s, "://") {
-		s = "dummy://" + s
-	}
-
-	u, err := url.Parse(s)
-	if err != nil {
-		return false, err
-	}
-
-	host, _, err := net.SplitHostPort(u.Host)
-	if err != nil {
-		host = u.Host
-	}
-
-	i := strings.LastIndex(host, ".")
-	tld := host[i+1:]
-
-	return tld == "local", nil
-}
-
-// Converts an image name to a url if it is not a URL
-func getImageURL(image string) string {
-	// Pull from dockerhub by default if not specified (default k8s behavior)
-	if strings.Contains(image, ".") {
-		return image
-	}
-	return "docker.io/" + image
-
-}
-
-func (c *coordinator) getImage(ctx context.Context, imageName string) (*containerd.Image, error) {
-	image, found := c.cachedImages[imageName]
-	if !found {
-		var err error
-		log.Debug(fmt.Sprintf("Pulling image %s", imageName))
-
-		imageURL := getImageURL(imageName)
-		local, _ := isLocalDomain(imageURL)
-		if local {
-			// Pull local image using HTTP
-			resolver := docker.NewResolver(docker.ResolverOptions{
-				Client: http.DefaultClient,
-				Hosts: docker.ConfigureDefaultRegistries(
-					docker.WithPlainHTTP(docker.MatchAllHosts),
-				),
-			})
-			image, err = c.client.Pull(ctx, imageURL,
-				containerd.WithPullUnpack,
-				containerd.WithResolver(resolver),
-			)
-		} else {
-			// Pull remote image
-			image, err = c.client.Pull(ctx, imageURL,
-				containerd.WithPullUnpack,
-			)
-		}
-
-		if err != nil {
-			return &image, err
-		}
-		c.cachedImages[imageName] = image
-	}
-
-	return &image, nil
-}
@@ -0,0 +1,60 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gvisor
+
+import (
+	"github.com/vhive-serverless/vhive/ctriface/image"
+)
+
+// Option Options to pass to the gVisor service
+type Option func(*coordinator)
+
+// WithSnapshotter Sets the snapshotter the images of the containers are unpacked into
+func WithSnapshotter(snapshotter string) Option {
+	return func(c *coordinator) {
+		c.snapshotter = snapshotter
+	}
+}
+
+// WithImageManagerOptions Sets the options of the image manager, e.g., the registries and the pull policy
+func WithImageManagerOptions(opts ...image.ImageManagerOption) Option {
+	return func(c *coordinator) {
+		c.imageOpts = append(c.imageOpts, opts...)
+	}
+}
+
+// WithImageGC Evicts unused images according to the policy
+func WithImageGC(policy image.GCPolicy) Option {
+	return func(c *coordinator) {
+		c.imageGCPolicy = &policy
+	}
+}
+
+// WithWarmSet Pulls the images of the warm set in the background at startup,
+// at most parallelism at a time
+func WithWarmSet(imageNames []string, parallelism int) Option {
+	return func(c *coordinator) {
+		c.warmSet = imageNames
+		c.prePullWorkers = parallelism
+	}
+}
@@ -55,14 +55,14 @@ type ctrConfig struct {
 	guestPort string
 }
 
-func NewGVisorService() (*GVisorService, error) {
+func NewGVisorService(opts ...Option) (*GVisorService, error) {
 	gs := new(GVisorService)
 	stockRC, err := cri.NewStockRuntimeServiceClient()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new stock runtime service client: %v", err)
 	}
 	gs.stockRuntimeClient = stockRC
-	coor, err := newCoordinator()
+	coor, err := newCoordinator(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gvisor-coordinator: %v", err)
 	}
@@ -71,6 +71,16 @@ func NewGVisorService() (*GVisorService, error) {
 	return gs, nil
 }
 
+// RecordPullAuth uses the credentials passed by the kubelet for the function images of the same registry
+func (gs *GVisorService) RecordPullAuth(imageName string, auth *criapi.AuthConfig) {
+	creds, err := cri.ToCredentials(auth)
+	if err != nil {
+		log.WithError(err).Warnf("Ignoring invalid credentials for image %s", imageName)
+		return
+	}
+	gs.coor.imageManager.SetPullCredentials(imageName, creds)
+}
+
 func (gs *GVisorService) CreateContainer(ctx context.Context, r *criapi.CreateContainerRequest) (*criapi.CreateContainerResponse, error) {
 	log.Debugf("CreateContainer within sandbox %q for container %+v",
 		r.GetPodSandboxId(), r.GetConfig().GetMetadata())
@@ -123,6 +123,12 @@ func (s *Service) UpdateContainerResources(ctx context.Context, r *criapi.Update
 // PullImage pulls an image with authentication config.
 func (s *Service) PullImage(ctx context.Context, r *criapi.PullImageRequest) (*criapi.PullImageResponse, error) {
 	log.Debugf("PullImage %q", r.GetImage().GetImage())
+
+	// Function images are pulled from the same registries as the images of their pods
+	if rec, ok := s.serv.(PullAuthRecorder); ok && r.GetAuth() != nil {
+		rec.RecordPullAuth(r.GetImage().GetImage(), r.GetAuth())
+	}
+
 	return s.stockImageClient.PullImage(ctx, r)
 }
 
@@ -168,7 +174,19 @@ func (s *Service) ListContainerStats(ctx context.Context, r *criapi.ListContaine
 // Status returns the status of the runtime.
 func (s *Service) Status(ctx context.Context, r *criapi.StatusRequest) (*criapi.StatusResponse, error) {
 	log.Tracef("Status")
-	return s.stockRuntimeClient.Status(ctx, r)
+	resp, err := s.stockRuntimeClient.Status(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The node is only reported ready once the service is
+	if rr, ok := s.serv.(ReadinessReporter); ok {
+		if ready, reason := rr.Ready(); !ready {
+			setRuntimeNotReady(resp.GetStatus(), reason)
+		}
+	}
+
+	return resp, nil
 }
 
 // Version returns the runtime name, runtime version, and runtime API version.
@@ -32,3 +32,15 @@ type ServiceInterface interface {
 	CreateContainer(ctx context.Context, r *criapi.CreateContainerRequest) (*criapi.CreateContainerResponse, error)
 	RemoveContainer(ctx context.Context, r *criapi.RemoveContainerRequest) (*criapi.RemoveContainerResponse, error)
 }
+
+// PullAuthRecorder is implemented by the services that pull function images with the credentials
+// the kubelet passes along with image pulls
+type PullAuthRecorder interface {
+	RecordPullAuth(imageName string, auth *criapi.AuthConfig)
+}
+
+// ReadinessReporter is implemented by the services that need some setup before the node can run functions
+type ReadinessReporter interface {
+	// Ready returns false and the reason while the service is not ready
+	Ready() (bool, string)
+}
@@ -1,9 +1,14 @@
 package cri
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vhive-serverless/vhive/ctriface/image"
+	"google.golang.org/grpc/status"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
@@ -19,3 +24,58 @@ func ToStringArray(envVariables []*criapi.KeyValue) []string {
 	log.Debugf("Converted '%v' to '%v'\n", envVariables, result)
 	return result
 }
+
+// setRuntimeNotReady overrides the RuntimeReady condition of the status reported to the kubelet
+func setRuntimeNotReady(status *criapi.RuntimeStatus, reason string) {
+	if status == nil {
+		return
+	}
+
+	for _, cond := range status.GetConditions() {
+		if cond.GetType() == criapi.RuntimeReady {
+			cond.Status = false
+			cond.Reason = "VHiveNotReady"
+			cond.Message = reason
+			return
+		}
+	}
+
+	status.Conditions = append(status.Conditions, &criapi.RuntimeCondition{
+		Type:    criapi.RuntimeReady,
+		Status:  false,
+		Reason:  "VHiveNotReady",
+		Message: reason,
+	})
+}
+
+// ToCredentials converts the auth config passed by the kubelet to registry credentials
+func ToCredentials(auth *criapi.AuthConfig) (image.Credentials, error) {
+	creds := image.Credentials{
+		Username:      auth.GetUsername(),
+		Password:      auth.GetPassword(),
+		IdentityToken: auth.GetIdentityToken(),
+	}
+
+	if auth.GetAuth() != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.GetAuth())
+		if err != nil {
+			return creds, err
+		}
+		username, password, found := strings.Cut(string(decoded), ":")
+		if !found {
+			return creds, errors.New("auth must be formatted as username:password")
+		}
+		creds.Username, creds.Password = username, password
+	}
+
+	return creds, nil
+}
+
+// ToStatusErr reports the failures of image pulls to the kubelet with the matching gRPC code
+func ToStatusErr(err error) error {
+	var pullErr *image.PullErr
+	if errors.As(err, &pullErr) {
+		return status.Error(pullErr.Code(), err.Error())
+	}
+	return err
+}
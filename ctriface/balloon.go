@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+const (
+	// balloonStatsPeriodSeconds is how often the guest driver refreshes the balloon statistics
+	balloonStatsPeriodSeconds = 1
+	// balloonPollPeriod is how often the balloon size is checked while waiting for a deflation
+	balloonPollPeriod = 5 * time.Millisecond
+)
+
+// BalloonStats Describes the state of the balloon device of a VM
+type BalloonStats struct {
+	// TargetMib is the size the balloon was last asked to reach
+	TargetMib int64
+	// ActualMib is the guest memory currently held by the balloon, i.e., reclaimed from the guest
+	ActualMib int64
+	// FreeMemory is the memory (in bytes) the guest does not use
+	FreeMemory int64
+}
+
+func getBalloonDevice() *proto.FirecrackerBalloonDevice {
+	return &proto.FirecrackerBalloonDevice{
+		AmountMib:             0,
+		DeflateOnOom:          true,
+		StatsPollingIntervals: balloonStatsPeriodSeconds,
+	}
+}
+
+// GetBalloonEnabled Returns whether VMs are booted with a balloon device
+func (o *Orchestrator) GetBalloonEnabled() bool {
+	return o.isBalloonEnabled
+}
+
+// InflateBalloon Inflates the balloon of a VM to amountMib, returning the guest memory to the host
+func (o *Orchestrator) InflateBalloon(ctx context.Context, vmID string, amountMib int64) (*metrics.Metric, error) {
+	var (
+		inflateMetric *metrics.Metric = metrics.NewMetric()
+		tStart        time.Time
+	)
+
+	logger := log.WithFields(log.Fields{"vmID": vmID, "amountMib": amountMib})
+	logger.Debug("Orchestrator received InflateBalloon")
+
+	if !o.isBalloonEnabled {
+		return nil, errors.New("VMs are not booted with a balloon device")
+	}
+
+	vm, err := o.vmPool.GetVM(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = namespaces.WithNamespace(ctx, namespaceName)
+
+	tStart = time.Now()
+	if _, err := o.fcClient.UpdateBalloon(ctx, &proto.UpdateBalloonRequest{VMID: vmID, AmountMib: amountMib}); err != nil {
+		logger.WithError(err).Error("failed to inflate the balloon")
+		return nil, err
+	}
+	inflateMetric.MetricMap[metrics.InflateBalloon] = metrics.ToUS(time.Since(tStart))
+
+	vm.BalloonMib = amountMib
+
+	return inflateMetric, nil
+}
+
+// DeflateBalloon Deflates the balloon of a VM and waits until the guest got its memory back
+func (o *Orchestrator) DeflateBalloon(ctx context.Context, vmID string) (*metrics.Metric, error) {
+	var (
+		deflateMetric *metrics.Metric = metrics.NewMetric()
+		tStart        time.Time
+	)
+
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+	logger.Debug("Orchestrator received DeflateBalloon")
+
+	if !o.isBalloonEnabled {
+		return nil, errors.New("VMs are not booted with a balloon device")
+	}
+
+	vm, err := o.vmPool.GetVM(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = namespaces.WithNamespace(ctx, namespaceName)
+
+	tStart = time.Now()
+	if _, err := o.fcClient.UpdateBalloon(ctx, &proto.UpdateBalloonRequest{VMID: vmID, AmountMib: 0}); err != nil {
+		logger.WithError(err).Error("failed to deflate the balloon")
+		return nil, err
+	}
+	vm.BalloonMib = 0
+
+	for {
+		stats, err := o.GetBalloonStats(ctx, vmID)
+		if err != nil {
+			return nil, err
+		}
+		if stats.ActualMib == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "waiting for the balloon to deflate, %d MiB left", stats.ActualMib)
+		case <-time.After(balloonPollPeriod):
+		}
+	}
+	deflateMetric.MetricMap[metrics.DeflateBalloon] = metrics.ToUS(time.Since(tStart))
+
+	return deflateMetric, nil
+}
+
+// GetBalloonStats Returns the balloon statistics reported by the guest
+func (o *Orchestrator) GetBalloonStats(ctx context.Context, vmID string) (*BalloonStats, error) {
+	ctx = namespaces.WithNamespace(ctx, namespaceName)
+
+	resp, err := o.fcClient.GetBalloonStats(ctx, &proto.GetBalloonStatsRequest{VMID: vmID})
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting balloon statistics")
+	}
+
+	return &BalloonStats{
+		TargetMib:  resp.GetTargetMib(),
+		ActualMib:  resp.GetActualMib(),
+		FreeMemory: resp.GetFreeMemory(),
+	}, nil
+}
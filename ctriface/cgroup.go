@@ -0,0 +1,243 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+const (
+	// cgroupRoot is the mount point of the unified (v2) cgroup hierarchy
+	cgroupRoot = "/sys/fs/cgroup"
+	// vhiveCgroup is the parent of the cgroups of all VMs
+	vhiveCgroup = "vhive"
+	// cgroupControllers are the controllers enabled for the cgroups of VMs
+	cgroupControllers = "+cpu +cpuset +memory +io"
+)
+
+// VMResources Resources used by a VM since its Firecracker process was spawned
+type VMResources struct {
+	// CPUUsageUs is the CPU time consumed by the VM, split into user and system time
+	CPUUsageUs  uint64
+	CPUUserUs   uint64
+	CPUSystemUs uint64
+	// MemoryCurrent and MemoryPeak are the current and the highest memory usage in bytes. The peak is only
+	// reported by kernels that support memory.peak (5.19+)
+	MemoryCurrent uint64
+	MemoryPeak    uint64
+	// IO counters summed over all devices
+	IOReadBytes  uint64
+	IOWriteBytes uint64
+	IOReadOps    uint64
+	IOWriteOps   uint64
+}
+
+// ToMap Converts the resources to the format of metrics.Metric
+func (r *VMResources) ToMap() map[string]float64 {
+	return map[string]float64{
+		metrics.CPUUsageUs:    float64(r.CPUUsageUs),
+		metrics.MemoryCurrent: float64(r.MemoryCurrent),
+		metrics.MemoryPeak:    float64(r.MemoryPeak),
+		metrics.IOReadBytes:   float64(r.IOReadBytes),
+		metrics.IOWriteBytes:  float64(r.IOWriteBytes),
+	}
+}
+
+// GetCgroupsEnabled Returns whether VMs are accounted in dedicated cgroups
+func (o *Orchestrator) GetCgroupsEnabled() bool {
+	return o.isCgroupsEnabled
+}
+
+func getVMCgroupPath(vmID string) string {
+	return filepath.Join(cgroupRoot, vhiveCgroup, vmID)
+}
+
+// setupCgroups Creates the vHive cgroup and enables the controllers needed to account VMs. The cgroup of each VM is
+// created by runc, which spawns the jailed Firecracker process in it, so that all its memory is charged to the VM
+func setupCgroups() error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return errors.Wrapf(err, "cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+
+	vhivePath := filepath.Join(cgroupRoot, vhiveCgroup)
+	if err := os.MkdirAll(vhivePath, 0755); err != nil {
+		return err
+	}
+
+	for _, path := range []string{cgroupRoot, vhivePath} {
+		if err := os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte(cgroupControllers), 0644); err != nil {
+			return errors.Wrapf(err, "enabling controllers in %s", path)
+		}
+	}
+
+	return nil
+}
+
+// setVMCPUs Restricts all the threads of the Firecracker process of a VM, including the ones it creates later on,
+// to the given CPUs through the cpuset of the cgroup of the VM
+func setVMCPUs(vmID string, cpus []int) error {
+	if err := writeCgroupCPUs(getVMCgroupPath(vmID), cpus); err != nil {
+		return errors.Wrapf(err, "setting cpuset of VM %s", vmID)
+	}
+	return nil
+}
+
+func writeCgroupCPUs(path string, cpus []int) error {
+	list := make([]string, len(cpus))
+	for i, cpu := range cpus {
+		list[i] = strconv.Itoa(cpu)
+	}
+	return os.WriteFile(filepath.Join(path, "cpuset.cpus"), []byte(strings.Join(list, ",")), 0644)
+}
+
+// removeVMCgroup Removes the cgroup of a stopped VM, waiting for its Firecracker process to exit
+func (o *Orchestrator) removeVMCgroup(vmID string) {
+	if !o.isCgroupsEnabled {
+		return
+	}
+
+	path := getVMCgroupPath(vmID)
+	logger := log.WithFields(log.Fields{"vmID": vmID, "cgroup": path})
+
+	for i := 0; i < 100; i++ {
+		err := os.Remove(path)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			logger.WithError(err).Warn("failed to remove VM cgroup")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	logger.Warn("VM cgroup is still in use, leaving it behind")
+}
+
+// GetVMResources Returns the resources used by a VM, read from its cgroup
+func (o *Orchestrator) GetVMResources(vmID string) (*VMResources, error) {
+	if !o.isCgroupsEnabled {
+		return nil, errors.New("VMs are not accounted in cgroups")
+	}
+
+	return readCgroupResources(getVMCgroupPath(vmID))
+}
+
+func readCgroupResources(path string) (*VMResources, error) {
+	res := &VMResources{}
+
+	cpuStat, err := readKeyValues(filepath.Join(path, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	res.CPUUsageUs = cpuStat["usage_usec"]
+	res.CPUUserUs = cpuStat["user_usec"]
+	res.CPUSystemUs = cpuStat["system_usec"]
+
+	if res.MemoryCurrent, err = readUint(filepath.Join(path, "memory.current")); err != nil {
+		return nil, err
+	}
+	if res.MemoryPeak, err = readUint(filepath.Join(path, "memory.peak")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(path, "io.stat"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Each line holds the counters of a device, e.g., "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			key, val, _ := strings.Cut(field, "=")
+			n, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				res.IOReadBytes += n
+			case "wbytes":
+				res.IOWriteBytes += n
+			case "rios":
+				res.IOReadOps += n
+			case "wios":
+				res.IOWriteOps += n
+			}
+		}
+	}
+
+	return res, scanner.Err()
+}
+
+// readKeyValues Parses a flat-keyed cgroup file, e.g., cpu.stat
+func readKeyValues(path string) (map[string]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]uint64)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = n
+		}
+	}
+
+	return values, nil
+}
+
+func readUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing %s", path)
+	}
+
+	return n, nil
+}
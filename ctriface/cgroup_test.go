@@ -0,0 +1,75 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCgroupResources(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"cpu.stat":       "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\nnr_periods 0\n",
+		"memory.current": "134217728\n",
+		"io.stat":        "253:1 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n253:2 rbytes=4096 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	res, err := readCgroupResources(dir)
+	require.NoError(t, err, "Failed to read cgroup resources")
+	require.Equal(t, &VMResources{
+		CPUUsageUs:    1500,
+		CPUUserUs:     1000,
+		CPUSystemUs:   500,
+		MemoryCurrent: 134217728,
+		IOReadBytes:   8192,
+		IOWriteBytes:  8192,
+		IOReadOps:     2,
+		IOWriteOps:    2,
+	}, res, "Resources without memory.peak are wrong")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.peak"), []byte("268435456\n"), 0644))
+	res, err = readCgroupResources(dir)
+	require.NoError(t, err, "Failed to read cgroup resources")
+	require.Equal(t, uint64(268435456), res.MemoryPeak, "Memory peak is wrong")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "cpu.stat")))
+	_, err = readCgroupResources(dir)
+	require.Error(t, err, "Reading a cgroup without cpu.stat should fail")
+}
+
+func TestWriteCgroupCPUs(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, writeCgroupCPUs(dir, []int{2, 3, 10}))
+	data, err := os.ReadFile(filepath.Join(dir, "cpuset.cpus"))
+	require.NoError(t, err)
+	require.Equal(t, "2,3,10", string(data), "Wrong cpuset list")
+}
@@ -0,0 +1,424 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/vhive-serverless/vhive/profile"
+)
+
+// CPUPolicy Selects how the vCPU threads of VMs are placed on host CPUs
+type CPUPolicy string
+
+const (
+	// CPUPolicyNone Lets VMs float over all host CPUs
+	CPUPolicyNone CPUPolicy = ""
+	// CPUPolicyPacked Fills the logical CPUs of a core, then of a socket, before moving to the next one
+	CPUPolicyPacked CPUPolicy = "packed"
+	// CPUPolicySpread Balances VMs across sockets and physical cores
+	CPUPolicySpread CPUPolicy = "spread"
+	// CPUPolicyIsolated Gives every vCPU a dedicated physical core whose SMT siblings are left idle
+	CPUPolicyIsolated CPUPolicy = "isolated"
+)
+
+// ParseCPUPolicy Converts a command line value to a CPU placement policy
+func ParseCPUPolicy(s string) (CPUPolicy, error) {
+	switch p := CPUPolicy(s); p {
+	case CPUPolicyNone, CPUPolicyPacked, CPUPolicySpread, CPUPolicyIsolated:
+		return p, nil
+	case "none":
+		return CPUPolicyNone, nil
+	default:
+		return CPUPolicyNone, errors.Errorf("unknown CPU placement policy %q", s)
+	}
+}
+
+// CPUPlacement Describes the host CPUs assigned to a VM
+type CPUPlacement struct {
+	// CPUs holds the logical CPU of every vCPU, in vCPU order
+	CPUs []int
+	// Reserved holds all logical CPUs taken by the VM, including idle siblings of isolated cores
+	Reserved []int
+	// Socket is the socket (NUMA node) the CPUs belong to
+	Socket int
+}
+
+// cpuAllocator Assigns host CPUs to VMs according to a placement policy. The topology lists
+// the logical CPUs of every physical core of every socket
+type cpuAllocator struct {
+	sync.Mutex
+	policy     CPUPolicy
+	sockets    [][][]int
+	used       map[int]bool
+	placements map[string]*CPUPlacement
+}
+
+func newCPUAllocator(policy CPUPolicy, sockets [][][]int) *cpuAllocator {
+	return &cpuAllocator{
+		policy:     policy,
+		sockets:    sockets,
+		used:       make(map[int]bool),
+		placements: make(map[string]*CPUPlacement),
+	}
+}
+
+// cpuTopology Groups the logical CPUs reported by the profiler by socket and physical core
+func cpuTopology(info profile.CPUInfo) ([][][]int, error) {
+	sockets := make([][][]int, info.NumSocket())
+
+	for s := range sockets {
+		cpus, err := info.SocketCPUs(s)
+		if err != nil {
+			return nil, err
+		}
+
+		cores := make(map[int][]int)
+		coreIDs := make([]int, 0)
+		for _, cpu := range cpus {
+			coreID, err := info.GetCoreID(cpu)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := cores[coreID]; !ok {
+				coreIDs = append(coreIDs, coreID)
+			}
+			cores[coreID] = append(cores[coreID], cpu)
+		}
+
+		sort.Ints(coreIDs)
+		for _, coreID := range coreIDs {
+			sockets[s] = append(sockets[s], cores[coreID])
+		}
+	}
+
+	return sockets, nil
+}
+
+// allocate Reserves CPUs for the vCPUs of a VM
+func (a *cpuAllocator) allocate(vmID string, vcpus int) (*CPUPlacement, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, ok := a.placements[vmID]; ok {
+		return nil, errors.Errorf("CPUs are already allocated to VM %s", vmID)
+	}
+
+	var placement *CPUPlacement
+	switch a.policy {
+	case CPUPolicyPacked:
+		placement = a.allocatePacked(vcpus)
+	case CPUPolicySpread:
+		placement = a.allocateSpread(vcpus)
+	case CPUPolicyIsolated:
+		placement = a.allocateIsolated(vcpus)
+	default:
+		return nil, errors.Errorf("unknown CPU placement policy %q", a.policy)
+	}
+
+	if placement == nil {
+		return nil, errors.Errorf("no free CPUs for %d vCPUs with the %s policy", vcpus, a.policy)
+	}
+
+	for _, cpu := range placement.Reserved {
+		a.used[cpu] = true
+	}
+	a.placements[vmID] = placement
+
+	return placement, nil
+}
+
+// release Returns the CPUs of a VM to the allocator
+func (a *cpuAllocator) release(vmID string) {
+	a.Lock()
+	defer a.Unlock()
+
+	placement, ok := a.placements[vmID]
+	if !ok {
+		return
+	}
+
+	for _, cpu := range placement.Reserved {
+		delete(a.used, cpu)
+	}
+	delete(a.placements, vmID)
+}
+
+func (a *cpuAllocator) getPlacement(vmID string) *CPUPlacement {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.placements[vmID]
+}
+
+func (a *cpuAllocator) freeCPUs(cpus []int) []int {
+	free := make([]int, 0, len(cpus))
+	for _, cpu := range cpus {
+		if !a.used[cpu] {
+			free = append(free, cpu)
+		}
+	}
+	return free
+}
+
+func (a *cpuAllocator) socketFreeCPUs(socket int) int {
+	n := 0
+	for _, core := range a.sockets[socket] {
+		n += len(a.freeCPUs(core))
+	}
+	return n
+}
+
+// allocatePacked Takes the first free CPUs of the first socket that can hold the whole VM
+func (a *cpuAllocator) allocatePacked(vcpus int) *CPUPlacement {
+	for s, cores := range a.sockets {
+		var cpus []int
+		for _, core := range cores {
+			cpus = append(cpus, a.freeCPUs(core)...)
+		}
+		if len(cpus) >= vcpus {
+			return &CPUPlacement{CPUs: cpus[:vcpus], Reserved: cpus[:vcpus], Socket: s}
+		}
+	}
+	return nil
+}
+
+// allocateSpread Picks the socket with the most free CPUs and the least loaded cores within it
+func (a *cpuAllocator) allocateSpread(vcpus int) *CPUPlacement {
+	socket, most := -1, 0
+	for s := range a.sockets {
+		if free := a.socketFreeCPUs(s); free > most {
+			socket, most = s, free
+		}
+	}
+	if socket < 0 || most < vcpus {
+		return nil
+	}
+
+	cores := append([][]int{}, a.sockets[socket]...)
+	sort.SliceStable(cores, func(i, j int) bool {
+		return len(cores[i])-len(a.freeCPUs(cores[i])) < len(cores[j])-len(a.freeCPUs(cores[j]))
+	})
+
+	// Take one CPU per core first, then go round again over the siblings
+	var cpus []int
+	taken := make(map[int]bool)
+	for len(cpus) < vcpus {
+		for _, core := range cores {
+			for _, cpu := range a.freeCPUs(core) {
+				if !taken[cpu] {
+					taken[cpu] = true
+					cpus = append(cpus, cpu)
+					break
+				}
+			}
+			if len(cpus) == vcpus {
+				break
+			}
+		}
+	}
+
+	return &CPUPlacement{CPUs: cpus, Reserved: cpus, Socket: socket}
+}
+
+// allocateIsolated Reserves whole idle physical cores of a single socket
+func (a *cpuAllocator) allocateIsolated(vcpus int) *CPUPlacement {
+	for s, cores := range a.sockets {
+		var cpus, reserved []int
+		for _, core := range cores {
+			if len(a.freeCPUs(core)) != len(core) {
+				continue
+			}
+			cpus = append(cpus, core[0])
+			reserved = append(reserved, core...)
+			if len(cpus) == vcpus {
+				return &CPUPlacement{CPUs: cpus, Reserved: reserved, Socket: s}
+			}
+		}
+	}
+	return nil
+}
+
+// pinVM Confines a running VM to the CPUs of its placement through the cpuset of its cgroup, which also holds the
+// threads Firecracker creates later on, and binds each vCPU thread to its CPU. The remaining Firecracker threads
+// (VMM, API server) may run on any CPU of the placement
+func (o *Orchestrator) pinVM(ctx context.Context, vmID string, placement *CPUPlacement) error {
+	if err := setVMCPUs(vmID, placement.Reserved); err != nil {
+		return err
+	}
+
+	pid, err := o.getFirecrackerPid(ctx, vmID)
+	if err != nil {
+		return err
+	}
+
+	taskDir := filepath.Join("/proc", strconv.Itoa(pid), "task")
+	tasks, err := os.ReadDir(taskDir)
+	if err != nil {
+		return errors.Wrapf(err, "listing threads of firecracker process %d", pid)
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		comm, err := os.ReadFile(filepath.Join(taskDir, task.Name(), "comm"))
+		if err != nil {
+			// The thread may have exited in the meantime
+			continue
+		}
+
+		cpus := placement.Reserved
+		if name := strings.TrimSpace(string(comm)); strings.HasPrefix(name, "fc_vcpu") {
+			idx, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(name, "fc_vcpu")))
+			if err == nil {
+				cpus = []int{placement.CPUs[idx%len(placement.CPUs)]}
+			}
+		}
+
+		if err := setAffinity(tid, cpus); err != nil {
+			return errors.Wrapf(err, "setting CPU affinity of thread %d", tid)
+		}
+	}
+
+	return nil
+}
+
+func setAffinity(tid int, cpus []int) error {
+	var set unix.CPUSet
+	set.Zero()
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(tid, &set)
+}
+
+// getFirecrackerPid Finds the Firecracker process of a VM by the API socket it was started with
+func (o *Orchestrator) getFirecrackerPid(ctx context.Context, vmID string) (int, error) {
+	info, err := o.fcClient.GetVMInfo(ctx, &proto.GetVMInfoRequest{VMID: vmID})
+	if err != nil {
+		return 0, errors.Wrapf(err, "getting VM info")
+	}
+
+	// Jailed Firecracker processes are started with a relative socket path, but have a cgroup of their own
+	if info.CgroupPath != "" {
+		return findPidInCgroup(info.CgroupPath)
+	}
+
+	return findPidByArg(info.SocketPath)
+}
+
+// findPidInCgroup Returns the PID of the first process of the cgroup
+func findPidInCgroup(cgroupPath string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, cgroupPath, "cgroup.procs"))
+	if err != nil {
+		return 0, err
+	}
+
+	procs := strings.Fields(string(data))
+	if len(procs) == 0 {
+		return 0, errors.Errorf("no process in cgroup %s", cgroupPath)
+	}
+
+	return strconv.Atoi(procs[0])
+}
+
+// findPidByArg Returns the PID of the first process whose command line contains arg
+func findPidByArg(arg string) (int, error) {
+	if arg == "" {
+		return 0, errors.New("empty process argument")
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+
+		for _, a := range strings.Split(string(cmdline), "\x00") {
+			if a == arg || strings.HasSuffix(a, "="+arg) {
+				return pid, nil
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{"arg": arg}).Debug("no process found")
+	return 0, errors.Errorf("no process started with %s", arg)
+}
+
+// placeVM Allocates CPUs to a freshly created VM and pins its threads. When the host runs out of CPUs, VMs
+// fall back to floating over all CPUs, unless the isolated policy is used
+func (o *Orchestrator) placeVM(ctx context.Context, vmID string, vcpus int) error {
+	if o.cpuAllocator == nil {
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{"vmID": vmID, "policy": o.cpuAllocator.policy})
+
+	placement, err := o.cpuAllocator.allocate(vmID, vcpus)
+	if err != nil {
+		if o.cpuAllocator.policy == CPUPolicyIsolated {
+			return err
+		}
+		logger.WithError(err).Warn("VM is not pinned")
+		return nil
+	}
+
+	if err := o.pinVM(ctx, vmID, placement); err != nil {
+		o.cpuAllocator.release(vmID)
+		return errors.Wrapf(err, "pinning VM to CPUs %v", placement.CPUs)
+	}
+
+	logger.Debugf("Pinned VM to CPUs %v on socket %d", placement.CPUs, placement.Socket)
+	return nil
+}
+
+// unplaceVM Releases the CPUs of a VM
+func (o *Orchestrator) unplaceVM(vmID string) {
+	if o.cpuAllocator != nil {
+		o.cpuAllocator.release(vmID)
+	}
+}
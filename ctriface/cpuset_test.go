@@ -0,0 +1,110 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testTopology has 2 sockets with 2 physical cores each, every core has 2 SMT siblings
+func testTopology() [][][]int {
+	return [][][]int{
+		{{0, 4}, {1, 5}},
+		{{2, 6}, {3, 7}},
+	}
+}
+
+func TestCPUAllocatorPacked(t *testing.T) {
+	a := newCPUAllocator(CPUPolicyPacked, testTopology())
+
+	p1, err := a.allocate("1", 1)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	require.Equal(t, []int{0}, p1.CPUs, "Packed policy should take the first CPU")
+
+	p2, err := a.allocate("2", 1)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	require.Equal(t, []int{4}, p2.CPUs, "Packed policy should fill the sibling first")
+
+	p3, err := a.allocate("3", 3)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	require.Equal(t, 1, p3.Socket, "VM that does not fit in the first socket should go to the second")
+
+	_, err = a.allocate("1", 1)
+	require.Error(t, err, "Allocating twice for the same VM should fail")
+
+	a.release("1")
+	p4, err := a.allocate("4", 1)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	require.Equal(t, []int{0}, p4.CPUs, "Released CPU should be reused")
+}
+
+func TestCPUAllocatorSpread(t *testing.T) {
+	a := newCPUAllocator(CPUPolicySpread, testTopology())
+
+	p1, err := a.allocate("1", 1)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	p2, err := a.allocate("2", 1)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	require.NotEqual(t, p1.Socket, p2.Socket, "Spread policy should balance sockets")
+
+	p3, err := a.allocate("3", 1)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	require.Equal(t, p1.Socket, p3.Socket, "Third VM should go back to the first socket")
+	require.NotEqual(t, p1.CPUs[0]%4, p3.CPUs[0]%4, "Spread policy should prefer idle physical cores")
+
+	p4, err := a.allocate("4", 2)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	require.Len(t, p4.CPUs, 2, "Should allocate one CPU per vCPU")
+}
+
+func TestCPUAllocatorIsolated(t *testing.T) {
+	a := newCPUAllocator(CPUPolicyIsolated, testTopology())
+
+	p1, err := a.allocate("1", 1)
+	require.NoError(t, err, "Failed to allocate CPUs")
+	require.Equal(t, []int{0}, p1.CPUs, "Isolated policy should take a whole core")
+	require.ElementsMatch(t, []int{0, 4}, p1.Reserved, "Sibling should be reserved")
+
+	for _, vmID := range []string{"2", "3", "4"} {
+		_, err := a.allocate(vmID, 1)
+		require.NoError(t, err, "Failed to allocate CPUs")
+	}
+
+	_, err = a.allocate("5", 1)
+	require.Error(t, err, "All cores are taken")
+
+	a.release("2")
+	_, err = a.allocate("5", 1)
+	require.NoError(t, err, "Released core should be reused")
+}
+
+func TestParseCPUPolicy(t *testing.T) {
+	p, err := ParseCPUPolicy("none")
+	require.NoError(t, err)
+	require.Equal(t, CPUPolicyNone, p)
+
+	_, err = ParseCPUPolicy("random")
+	require.Error(t, err, "Unknown policies should be rejected")
+}
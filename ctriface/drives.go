@@ -0,0 +1,566 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// DriveType is the kind of storage backing an extra drive of a VM
+type DriveType string
+
+const (
+	// DriveImage is an ext4 image file on the host
+	DriveImage DriveType = "image"
+	// DriveThin is a devmapper thin snapshot of the rootfs of a container image
+	DriveThin DriveType = "thin"
+	// DriveScratch is an empty ext4 file on tmpfs, lost when the VM is stopped
+	DriveScratch DriveType = "scratch"
+)
+
+const (
+	// scratchDrivesDir is the tmpfs directory holding the scratch drives
+	scratchDrivesDir = "/dev/shm/vhive-drives"
+	// defaultScratchSizeMib is the size of scratch drives that do not specify one
+	defaultScratchSizeMib = 64
+)
+
+// DriveSpec Declares an extra drive to attach to a VM
+type DriveSpec struct {
+	Type DriveType
+	// Source is the image file of image drives, relative to the drive image root of the orchestrator, or the
+	// container image of thin drives
+	Source string
+	// SizeMib is the size of scratch drives
+	SizeMib int64
+	// VMPath is where the drive is mounted in the guest
+	VMPath string
+	// ReadOnly drives cannot be written by the guest
+	ReadOnly bool
+}
+
+// vmDrive is an extra drive attached to a running VM
+type vmDrive struct {
+	spec DriveSpec
+	// hostPath is the path handed to Firecracker, a symlink to backingPath. It is recorded in the snapshots of
+	// the VM, so VMs loaded from them reuse the path of the VM the snapshot was taken from
+	hostPath string
+	// backingPath is the file or device holding the data of the drive
+	backingPath string
+	// snapKey is the devmapper snapshot of thin drives
+	snapKey string
+	// isOwned is set if backingPath was created for the VM and has to be removed with it
+	isOwned bool
+	// image is the container image of thin drives, protected from garbage collection until the drive is released
+	image string
+	img   *containerd.Image
+}
+
+// ParseDriveSpecs Parses a list of drives separated by semicolons, each drive being a comma-separated list of
+// options, e.g., "type=scratch,path=/scratch,size=256;type=image,source=set.img,path=/data,ro". The image files of
+// image drives must be regular files under imageRoot, image drives being refused if it is empty
+func ParseDriveSpecs(s, imageRoot string) ([]DriveSpec, error) {
+	var drives []DriveSpec
+
+	for _, driveStr := range strings.Split(s, ";") {
+		if strings.TrimSpace(driveStr) == "" {
+			continue
+		}
+
+		drive := DriveSpec{}
+		for _, opt := range strings.Split(driveStr, ",") {
+			key, val, _ := strings.Cut(strings.TrimSpace(opt), "=")
+			switch key {
+			case "type":
+				drive.Type = DriveType(val)
+			case "source":
+				drive.Source = val
+			case "path":
+				drive.VMPath = val
+			case "size":
+				size, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || size <= 0 {
+					return nil, errors.Errorf("invalid drive size %q", val)
+				}
+				drive.SizeMib = size
+			case "ro":
+				drive.ReadOnly = true
+			case "rw":
+				drive.ReadOnly = false
+			default:
+				return nil, errors.Errorf("unknown drive option %q", opt)
+			}
+		}
+
+		if err := drive.validate(imageRoot); err != nil {
+			return nil, err
+		}
+		drives = append(drives, drive)
+	}
+
+	return drives, nil
+}
+
+func (d *DriveSpec) validate(imageRoot string) error {
+	if !filepath.IsAbs(d.VMPath) {
+		return errors.Errorf("drive mount path %q is not absolute", d.VMPath)
+	}
+
+	switch d.Type {
+	case DriveImage:
+		// The source is chosen by the workload, which must not reach any other file of the host
+		source, err := resolveDriveImage(imageRoot, d.Source)
+		if err != nil {
+			return errors.Wrapf(err, "image drive mounted at %s", d.VMPath)
+		}
+		d.Source = source
+	case DriveThin:
+		if d.Source == "" {
+			return errors.Errorf("%s drive mounted at %s has no source", d.Type, d.VMPath)
+		}
+	case DriveScratch:
+		if d.SizeMib == 0 {
+			d.SizeMib = defaultScratchSizeMib
+		}
+	default:
+		return errors.Errorf("unknown drive type %q", d.Type)
+	}
+
+	return nil
+}
+
+// resolveDriveImage Returns the absolute path of the image file of an image drive, which must be a regular file under
+// imageRoot once symlinks are resolved. Sources already resolved are returned as they are
+func resolveDriveImage(imageRoot, source string) (string, error) {
+	if imageRoot == "" {
+		return "", errors.New("image drives are disabled, no drive image root is configured")
+	}
+	if source == "" {
+		return "", errors.New("no source")
+	}
+
+	root, err := filepath.EvalSymlinks(imageRoot)
+	if err != nil {
+		return "", errors.Wrap(err, "resolving drive image root")
+	}
+	path := source
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", errors.Wrapf(err, "resolving source %q", source)
+	}
+
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.Errorf("source %q is not under the drive image root %s", source, imageRoot)
+	}
+	if info, err := os.Stat(path); err != nil {
+		return "", err
+	} else if !info.Mode().IsRegular() {
+		return "", errors.Errorf("source %q is not a regular file", source)
+	}
+
+	return path, nil
+}
+
+func (o *Orchestrator) getDriveHostPath(vmID string, idx int) string {
+	return filepath.Join(o.drivesDir, fmt.Sprintf("%s-drive%d", vmID, idx))
+}
+
+func getDriveMounts(drives []*vmDrive) []*proto.FirecrackerDriveMount {
+	var mounts []*proto.FirecrackerDriveMount
+
+	for _, drive := range drives {
+		mountOpt := "rw"
+		if drive.spec.ReadOnly {
+			mountOpt = "ro"
+		}
+
+		mounts = append(mounts, &proto.FirecrackerDriveMount{
+			HostPath:       drive.hostPath,
+			VMPath:         drive.spec.VMPath,
+			FilesystemType: "ext4",
+			Options:        []string{mountOpt},
+			IsWritable:     !drive.spec.ReadOnly,
+		})
+	}
+
+	return mounts
+}
+
+// prepareDrives Provisions the backing storage of the drives of a VM and links it at the host path of each drive
+func (o *Orchestrator) prepareDrives(ctx context.Context, vmID string, specs []DriveSpec) (_ []*vmDrive, retErr error) {
+	var drives []*vmDrive
+
+	defer func() {
+		if retErr != nil {
+			o.releaseDrives(ctx, drives)
+		}
+	}()
+
+	for i, spec := range specs {
+		if err := spec.validate(o.driveImageRoot); err != nil {
+			return nil, err
+		}
+
+		drive, err := o.provisionDrive(ctx, vmID, i, spec, "", "")
+		if err != nil {
+			return nil, errors.Wrapf(err, "provisioning %s drive mounted at %s", spec.Type, spec.VMPath)
+		}
+		drives = append(drives, drive)
+
+		drive.hostPath = o.getDriveHostPath(vmID, i)
+		if err := linkDrive(drive.backingPath, drive.hostPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return drives, nil
+}
+
+// provisionDrive Creates the backing storage of a drive. Writable drives are initialized with the contents of seed
+// if set, which is how the drives of a snapshot are restored. The seed of a thin drive is a block patch on top of
+// its image, whose checksum is seedDigest
+func (o *Orchestrator) provisionDrive(ctx context.Context, vmID string, idx int, spec DriveSpec, seed, seedDigest string) (*vmDrive, error) {
+	drive := &vmDrive{spec: spec}
+	name := fmt.Sprintf("%s-drive%d.img", vmID, idx)
+
+	switch spec.Type {
+	case DriveImage:
+		if spec.ReadOnly {
+			drive.backingPath = spec.Source
+			return drive, nil
+		}
+
+		// The guest must not modify the image shared by all instances
+		if seed == "" {
+			seed = spec.Source
+		}
+		drive.backingPath = filepath.Join(o.drivesDir, name)
+		drive.isOwned = true
+		if err := copyFile(seed, drive.backingPath); err != nil {
+			return nil, err
+		}
+	case DriveScratch:
+		if err := os.MkdirAll(scratchDrivesDir, 0755); err != nil {
+			return nil, err
+		}
+		drive.backingPath = filepath.Join(scratchDrivesDir, name)
+		drive.isOwned = true
+		if seed != "" {
+			if err := copyFile(seed, drive.backingPath); err != nil {
+				return nil, err
+			}
+		} else if err := createScratchFile(drive.backingPath, spec.SizeMib); err != nil {
+			return nil, err
+		}
+	case DriveThin:
+		img, err := o.imageManager.AcquireImage(ctx, spec.Source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting image %s", spec.Source)
+		}
+
+		drive.snapKey = fmt.Sprintf("vm%s-drive%d", vmID, idx)
+		if err := o.devMapper.CreateDeviceSnapshotFromImage(ctx, drive.snapKey, *img); err != nil {
+			o.imageManager.ReleaseImage(spec.Source)
+			return nil, errors.Wrapf(err, "creating thin snapshot of image %s", spec.Source)
+		}
+		drive.image = spec.Source
+		drive.img = img
+		dsnp, err := o.devMapper.GetDeviceSnapshot(ctx, drive.snapKey)
+		if err != nil {
+			o.releaseDrives(ctx, []*vmDrive{drive})
+			return nil, err
+		}
+		drive.backingPath = dsnp.GetDevicePath()
+
+		if seed != "" && !spec.ReadOnly {
+			if err := o.devMapper.RestorePatch(ctx, drive.snapKey, seed, seedDigest); err != nil {
+				o.releaseDrives(ctx, []*vmDrive{drive})
+				return nil, errors.Wrapf(err, "restoring changes of thin drive")
+			}
+		}
+	}
+
+	return drive, nil
+}
+
+// releaseDrives Removes the backing storage of drives. The host path of a drive is left in place if it has been
+// linked to another VM in the meantime
+func (o *Orchestrator) releaseDrives(ctx context.Context, drives []*vmDrive) {
+	for _, drive := range drives {
+		logger := log.WithFields(log.Fields{"hostPath": drive.hostPath, "backingPath": drive.backingPath})
+
+		if drive.hostPath != "" {
+			if target, err := os.Readlink(drive.hostPath); err == nil && target == drive.backingPath {
+				if err := os.Remove(drive.hostPath); err != nil {
+					logger.WithError(err).Warn("failed to remove drive link")
+				}
+			}
+		}
+
+		if drive.isOwned {
+			if err := os.Remove(drive.backingPath); err != nil && !os.IsNotExist(err) {
+				logger.WithError(err).Warn("failed to remove drive")
+			}
+		}
+
+		if drive.snapKey != "" {
+			if err := o.devMapper.RemoveDeviceSnapshot(ctx, drive.snapKey); err != nil {
+				logger.WithError(err).Warn("failed to remove thin snapshot of drive")
+			}
+		}
+
+		if drive.image != "" {
+			o.imageManager.ReleaseImage(drive.image)
+		}
+	}
+}
+
+// cleanupDrives Releases the drives of a VM
+func (o *Orchestrator) cleanupDrives(ctx context.Context, vmID string) {
+	if drives, ok := o.vmDrives.LoadAndDelete(vmID); ok {
+		o.releaseDrives(ctx, drives.([]*vmDrive))
+	}
+}
+
+// snapshotDrives Records the drives of a paused VM in the snapshot, along with the contents of the writable ones.
+// Only the blocks that thin drives changed in their image are stored, and drive files are copied sparsely
+func (o *Orchestrator) snapshotDrives(ctx context.Context, vmID string, snap *snapshotting.Snapshot) error {
+	snap.Drives = nil
+
+	drives, ok := o.vmDrives.Load(vmID)
+	if !ok {
+		return nil
+	}
+
+	for i, drive := range drives.([]*vmDrive) {
+		snap.Drives = append(snap.Drives, snapshotting.SnapshotDrive{
+			Type:     string(drive.spec.Type),
+			Source:   drive.spec.Source,
+			SizeMib:  drive.spec.SizeMib,
+			VMPath:   drive.spec.VMPath,
+			ReadOnly: drive.spec.ReadOnly,
+			HostPath: drive.hostPath,
+		})
+
+		if drive.spec.ReadOnly {
+			continue
+		}
+		if drive.spec.Type == DriveThin {
+			patchDigest, err := o.devMapper.CreateBlockPatch(ctx, snap.GetDriveFilePath(i), drive.snapKey, *drive.img)
+			if err != nil {
+				return errors.Wrapf(err, "saving changes of drive mounted at %s", drive.spec.VMPath)
+			}
+			snap.Drives[i].PatchDigest = patchDigest
+			continue
+		}
+		if err := copyFile(drive.backingPath, snap.GetDriveFilePath(i)); err != nil {
+			return errors.Wrapf(err, "saving contents of drive mounted at %s", drive.spec.VMPath)
+		}
+	}
+
+	return nil
+}
+
+// lockDrivePaths Locks the host paths of the drives of a snapshot, which all VMs loaded from the snapshot share, while
+// loads of other snapshots proceed. It returns the function unlocking them, which can be called more than once
+func (o *Orchestrator) lockDrivePaths(snap *snapshotting.Snapshot) func() {
+	var paths []string
+	for _, drive := range snap.Drives {
+		paths = append(paths, drive.HostPath)
+	}
+	// Versions of a snapshot share the paths, which are locked in the same order to avoid deadlocks
+	sort.Strings(paths)
+
+	var locks []*sync.Mutex
+	for _, path := range paths {
+		lock, _ := o.drivePathLocks.LoadOrStore(path, new(sync.Mutex))
+		lock.(*sync.Mutex).Lock()
+		locks = append(locks, lock.(*sync.Mutex))
+	}
+
+	return sync.OnceFunc(func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	})
+}
+
+// restoreDrives Provisions the drives recorded in a snapshot, links them at the host paths Firecracker expects and
+// stages them into the jail of the VM. The caller must hold the locks of lockDrivePaths until Firecracker has opened
+// the drives, since VMs loaded from the same snapshot share these paths
+func (o *Orchestrator) restoreDrives(ctx context.Context, vmID string, snap *snapshotting.Snapshot, stage *jailStage) (_ []*vmDrive, retErr error) {
+	var drives []*vmDrive
+
+	defer func() {
+		if retErr != nil {
+			o.releaseDrives(ctx, drives)
+		}
+	}()
+
+	for i, snapDrive := range snap.Drives {
+		spec := DriveSpec{
+			Type:     DriveType(snapDrive.Type),
+			Source:   snapDrive.Source,
+			SizeMib:  snapDrive.SizeMib,
+			VMPath:   snapDrive.VMPath,
+			ReadOnly: snapDrive.ReadOnly,
+		}
+
+		seed := ""
+		if !spec.ReadOnly {
+			seed = snap.GetDriveFilePath(i)
+		}
+
+		drive, err := o.provisionDrive(ctx, vmID, i, spec, seed, snapDrive.PatchDigest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "restoring %s drive mounted at %s", spec.Type, spec.VMPath)
+		}
+		drives = append(drives, drive)
+
+		// Running VMs already opened their drives, so the link can be taken over
+		drive.hostPath = snapDrive.HostPath
+		if err := linkDrive(drive.backingPath, drive.hostPath); err != nil {
+			return nil, err
+		}
+
+		if err := stage.add(!spec.ReadOnly, drive.hostPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return drives, nil
+}
+
+// linkDrive Atomically points the host path of a drive to its backing storage
+func linkDrive(backingPath, hostPath string) error {
+	tmpPath := hostPath + ".tmp"
+	_ = os.Remove(tmpPath)
+
+	if err := os.Symlink(backingPath, tmpPath); err != nil {
+		return errors.Wrapf(err, "linking drive %s", backingPath)
+	}
+	if err := os.Rename(tmpPath, hostPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return errors.Wrapf(err, "linking drive %s", backingPath)
+	}
+
+	return nil
+}
+
+func createScratchFile(path string, sizeMib int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(sizeMib * 1024 * 1024); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", path).CombinedOutput(); err != nil {
+		_ = os.Remove(path)
+		return errors.Wrapf(err, "formatting scratch drive: %s", strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// sparseBlockSize is the granularity at which copyFile skips the zero blocks of drives
+const sparseBlockSize = 4096
+
+// copyFile Copies the contents of src to the file dst, leaving holes in place of the blocks of zeroes, so that
+// mostly empty drives take little space
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := copySparse(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "copying %s to %s", src, dst)
+	}
+
+	return out.Close()
+}
+
+func copySparse(out *os.File, in io.Reader) error {
+	var (
+		buf  = make([]byte, 256*sparseBlockSize)
+		zero = make([]byte, sparseBlockSize)
+		size int64
+	)
+
+	for {
+		n, err := io.ReadFull(in, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		for off := 0; off < n; off += sparseBlockSize {
+			end := off + sparseBlockSize
+			if end > n {
+				end = n
+			}
+			if bytes.Equal(buf[off:end], zero[:end-off]) {
+				continue
+			}
+			if _, err := out.WriteAt(buf[off:end], size+int64(off)); err != nil {
+				return err
+			}
+		}
+		size += int64(n)
+	}
+
+	// Trailing zero blocks are holes as well
+	return out.Truncate(size)
+}
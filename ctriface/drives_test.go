@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+func TestParseDriveSpecs(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "set.img"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), nil, 0600))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "link.img")))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "dir.img"), 0755))
+
+	drives, err := ParseDriveSpecs("type=scratch,path=/scratch; type=image,source=set.img,path=/data,ro", root)
+	require.NoError(t, err, "Failed to parse drives")
+	require.Equal(t, []DriveSpec{
+		{Type: DriveScratch, SizeMib: defaultScratchSizeMib, VMPath: "/scratch"},
+		{Type: DriveImage, Source: filepath.Join(root, "set.img"), VMPath: "/data", ReadOnly: true},
+	}, drives)
+
+	// Resolved sources are accepted again when the drives are prepared
+	require.NoError(t, drives[1].validate(root), "Resolved source should be accepted")
+
+	drives, err = ParseDriveSpecs("", root)
+	require.NoError(t, err, "Failed to parse empty drives")
+	require.Empty(t, drives)
+
+	for _, s := range []string{
+		"type=tape,path=/tape",
+		"type=image,path=/data",
+		"type=image,source=missing.img,path=/data",
+		"type=image,source=/etc/shadow,path=/data",
+		"type=image,source=../" + filepath.Base(outside) + "/secret,path=/data",
+		"type=image,source=link.img,path=/data",
+		"type=image,source=dir.img,path=/data",
+		"type=image,source=/dev/null,path=/data",
+		"type=thin,source=ghcr.io/ease-lab/helloworld:var_workload,path=data",
+		"type=scratch,path=/scratch,size=-1",
+		"type=scratch,path=/scratch,noexec",
+	} {
+		_, err := ParseDriveSpecs(s, root)
+		require.Error(t, err, "Parsing %q should fail", s)
+	}
+
+	_, err = ParseDriveSpecs("type=image,source=set.img,path=/data", "")
+	require.Error(t, err, "Image drives should be refused without a drive image root")
+}
+
+func TestLinkDrive(t *testing.T) {
+	dir := t.TempDir()
+	hostPath := filepath.Join(dir, "drive0")
+
+	for _, backing := range []string{"a.img", "b.img"} {
+		backingPath := filepath.Join(dir, backing)
+		require.NoError(t, os.WriteFile(backingPath, []byte(backing), 0644))
+		require.NoError(t, linkDrive(backingPath, hostPath), "Failed to link drive")
+
+		data, err := os.ReadFile(hostPath)
+		require.NoError(t, err, "Failed to read drive through its link")
+		require.Equal(t, backing, string(data), "Drive link points to the wrong backing file")
+	}
+
+	require.NoError(t, copyFile(hostPath, filepath.Join(dir, "copy.img")), "Failed to copy drive")
+	data, err := os.ReadFile(filepath.Join(dir, "copy.img"))
+	require.NoError(t, err)
+	require.Equal(t, "b.img", string(data), "Copied drive has wrong contents")
+}
+
+func TestCopyFileSparse(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.img")
+
+	// A 16MiB drive with data in a single block and a partial trailing block
+	data := make([]byte, 16<<20+100)
+	copy(data[8<<20:], "written by the guest")
+	data[len(data)-1] = 1
+	require.NoError(t, os.WriteFile(src, data, 0644))
+
+	dst := filepath.Join(dir, "dst.img")
+	require.NoError(t, copyFile(src, dst), "Failed to copy drive")
+
+	copied, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, data, copied, "Copied drive has wrong contents")
+
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Stat(dst, &st))
+	require.Less(t, st.Blocks*512, int64(1<<20), "Zero blocks should not be allocated in the copy")
+}
+
+func TestLockDrivePaths(t *testing.T) {
+	o := &Orchestrator{}
+	snapshotWithDrives := func(paths ...string) *snapshotting.Snapshot {
+		snap := &snapshotting.Snapshot{}
+		for _, path := range paths {
+			snap.Drives = append(snap.Drives, snapshotting.SnapshotDrive{HostPath: path})
+		}
+		return snap
+	}
+
+	unlock := o.lockDrivePaths(snapshotWithDrives("/drives/a-drive1", "/drives/a-drive0"))
+
+	// Snapshots with other drives are loaded concurrently
+	o.lockDrivePaths(snapshotWithDrives("/drives/b-drive0"))()
+
+	locked := make(chan struct{})
+	go func() {
+		o.lockDrivePaths(snapshotWithDrives("/drives/a-drive0"))()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Drive paths of a snapshot being loaded should stay locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	unlock()
+	<-locked
+}
@@ -28,6 +28,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -37,8 +38,11 @@ import (
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/firecracker-microvm/firecracker-containerd/proto" // note: from the original repo
 	"github.com/firecracker-microvm/firecracker-containerd/runtime/firecrackeroci"
@@ -48,6 +52,8 @@ import (
 	_ "google.golang.org/grpc/status" //tmp
 
 	"github.com/go-multierror/multierror"
+	"github.com/vhive-serverless/vhive/ctriface/image"
+	"github.com/vhive-serverless/vhive/devmapper"
 	"github.com/vhive-serverless/vhive/memory/manager"
 	"github.com/vhive-serverless/vhive/metrics"
 	"github.com/vhive-serverless/vhive/misc"
@@ -66,12 +72,32 @@ const (
 	testImageName = "ghcr.io/ease-lab/helloworld:var_workload"
 )
 
+// ErrStaleSnapshot is returned when loading a snapshot of an image that has since been updated. The digest of an
+// image only changes while vHive runs under the Always pull policy, under the other policies only snapshots kept
+// from a previous run or downloaded from the store can be stale
+var ErrStaleSnapshot = errors.New("snapshot image digest changed")
+
+// ErrCorruptSnapshot is returned when loading a snapshot whose files fail verification, e.g., after a crash while
+// snapshotting
+var ErrCorruptSnapshot = errors.New("snapshot corrupted")
+
+// IsSnapshotInvalid Returns whether a snapshot failed to load because it must be invalidated and taken again
+func IsSnapshotInvalid(err error) bool {
+	return errors.Is(err, ErrStaleSnapshot) || errors.Is(err, ErrCorruptSnapshot)
+}
+
 // StartVM Boots a VM if it does not exist
 func (o *Orchestrator) StartVM(ctx context.Context, vmID, imageName string) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
 	return o.StartVMWithEnvironment(ctx, vmID, imageName, []string{})
 }
 
 func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageName string, environmentVariables []string) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
+	return o.StartVMWithDrives(ctx, vmID, imageName, environmentVariables, nil)
+}
+
+// StartVMWithDrives Boots a VM with extra drives, which are provisioned by the orchestrator and released when
+// the VM is stopped
+func (o *Orchestrator) StartVMWithDrives(ctx context.Context, vmID, imageName string, environmentVariables []string, drives []DriveSpec) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
 	var (
 		startVMMetric *metrics.Metric = metrics.NewMetric()
 		tStart        time.Time
@@ -80,6 +106,11 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	logger := log.WithFields(log.Fields{"vmID": vmID, "image": imageName})
 	logger.Debug("StartVM: Received StartVM")
 
+	if err := o.devMapper.CheckThinPool(); err != nil {
+		logger.WithError(err).Error("refusing to start VM")
+		return nil, nil, err
+	}
+
 	vm, err := o.vmPool.Allocate(vmID)
 	if err != nil {
 		logger.Error("failed to allocate VM in VM pool")
@@ -89,6 +120,8 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	defer func() {
 		// Free the VM from the pool if function returns error
 		if retErr != nil {
+			o.releaseImage(vm)
+			o.releaseJailUser(vmID)
 			if err := o.vmPool.Free(vmID); err != nil {
 				logger.WithError(err).Errorf("failed to free VM from pool after failure")
 			}
@@ -97,17 +130,61 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 	tStart = time.Now()
-	if vm.Image, err = o.getImage(ctx, imageName); err != nil {
-		return nil, nil, errors.Wrapf(err, "Failed to get/pull image")
+	pullCtx, cancelPull := o.stageContext(ctx, StageImagePull)
+	lazyImage, err := o.acquireLazyImage(pullCtx, vm, imageName)
+	if errors.Is(err, image.ErrNotLazy) {
+		vm.Image, err = o.acquireImage(pullCtx, vm, imageName)
+	}
+	cancelPull()
+	if err != nil {
+		return nil, nil, errors.Wrapf(o.stageErr(pullCtx, StageImagePull, vmID, err), "Failed to get/pull image")
 	}
+	// Lazily loaded images only take the time until the first byte of the root file system can be served
 	startVMMetric.MetricMap[metrics.GetImage] = metrics.ToUS(time.Since(tStart))
 
+	var overlay *image.LazyOverlay
+	if lazyImage != nil {
+		// The guest writes to an overlay private to the VM, while the image is shared by the VMs using it
+		if overlay, err = o.createLazyOverlay(vmID, lazyImage, "", ""); err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			if retErr != nil {
+				o.removeLazyOverlay(vmID)
+			}
+		}()
+	}
+
+	if len(drives) > 0 {
+		tStart = time.Now()
+		vmDrives, err := o.prepareDrives(ctx, vmID, drives)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to prepare the drives")
+		}
+		startVMMetric.MetricMap[metrics.PrepareDrives] = metrics.ToUS(time.Since(tStart))
+		o.vmDrives.Store(vmID, vmDrives)
+
+		defer func() {
+			if retErr != nil {
+				o.cleanupDrives(ctx, vmID)
+			}
+		}()
+	}
+
 	tStart = time.Now()
-	conf := o.getVMConfig(vm)
-	_, err = o.fcClient.CreateVM(ctx, conf)
+	conf, err := o.getVMConfig(vm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if vmDrives, ok := o.vmDrives.Load(vmID); ok {
+		conf.DriveMounts = getDriveMounts(vmDrives.([]*vmDrive))
+	}
+	createCtx, cancelCreate := o.stageContext(ctx, StageCreateVM)
+	_, err = o.fcClient.CreateVM(createCtx, conf)
+	cancelCreate()
 	startVMMetric.MetricMap[metrics.FcCreateVM] = metrics.ToUS(time.Since(tStart))
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create the microVM in firecracker-containerd")
+		return nil, nil, errors.Wrap(o.stageErr(createCtx, StageCreateVM, vmID, err), "failed to create the microVM in firecracker-containerd")
 	}
 
 	defer func() {
@@ -115,28 +192,58 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 			if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: vmID}); err != nil {
 				logger.WithError(err).Errorf("failed to stop firecracker-containerd VM after failure")
 			}
+			o.removeVMCgroup(vmID)
 		}
 	}()
 
+	if err := o.placeVM(ctx, vmID, int(conf.MachineCfg.VcpuCount)); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to place the microVM on host CPUs")
+	}
+
+	defer func() {
+		if retErr != nil {
+			o.unplaceVM(vmID)
+		}
+	}()
+
+	// The task wait channel outlives the start of the task, hence it uses ctx
+	taskCtx, cancelTask := o.stageContext(ctx, StageTaskStart)
+	defer cancelTask()
+
 	logger.Debug("StartVM: Creating a new container")
 	tStart = time.Now()
-	container, err := o.client.NewContainer(
-		ctx,
-		vm.ContainerSnapKey,
-		containerd.WithSnapshotter(o.snapshotter),
-		containerd.WithNewSnapshot(vm.ContainerSnapKey, *vm.Image),
+	var (
+		containerOpts []containerd.NewContainerOpts
+		taskOpts      []containerd.NewTaskOpts
+		imageConfig   oci.SpecOpts
+	)
+	if lazyImage != nil {
+		imageConfig = withLazyImageConfig(lazyImage.Config())
+		taskOpts = append(taskOpts, containerd.WithRootFS([]mount.Mount{{
+			Type:   "ext4",
+			Source: overlay.Path(),
+		}}))
+	} else {
+		imageConfig = oci.WithImageConfig(*vm.Image)
+		containerOpts = append(containerOpts,
+			containerd.WithSnapshotter(o.snapshotter),
+			containerd.WithNewSnapshot(vm.ContainerSnapKey, *vm.Image),
+		)
+	}
+	containerOpts = append(containerOpts,
 		containerd.WithNewSpec(
-			oci.WithImageConfig(*vm.Image),
+			imageConfig,
 			firecrackeroci.WithVMID(vmID),
 			firecrackeroci.WithVMNetwork,
 			oci.WithEnv(environmentVariables),
 		),
 		containerd.WithRuntime("aws.firecracker", nil),
 	)
+	container, err := o.client.NewContainer(taskCtx, vm.ContainerSnapKey, containerOpts...)
 	startVMMetric.MetricMap[metrics.NewContainer] = metrics.ToUS(time.Since(tStart))
 	vm.Container = &container
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create a container")
+		return nil, nil, errors.Wrap(o.stageErr(taskCtx, StageTaskStart, vmID, err), "failed to create a container")
 	}
 
 	defer func() {
@@ -151,11 +258,11 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	o.workloadIo.Store(vmID, &iologger)
 	logger.Debug("StartVM: Creating a new task")
 	tStart = time.Now()
-	task, err := container.NewTask(ctx, cio.NewCreator(cio.WithStreams(os.Stdin, iologger, iologger)))
+	task, err := container.NewTask(taskCtx, cio.NewCreator(cio.WithStreams(os.Stdin, iologger, iologger)), taskOpts...)
 	startVMMetric.MetricMap[metrics.NewTask] = metrics.ToUS(time.Since(tStart))
 	vm.Task = &task
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "failed to create a task")
+		return nil, nil, errors.Wrapf(o.stageErr(taskCtx, StageTaskStart, vmID, err), "failed to create a task")
 	}
 
 	defer func() {
@@ -185,8 +292,8 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 
 	logger.Debug("StartVM: Starting the task")
 	tStart = time.Now()
-	if err := task.Start(ctx); err != nil {
-		return nil, nil, errors.Wrap(err, "failed to start a task")
+	if err := task.Start(taskCtx); err != nil {
+		return nil, nil, errors.Wrap(o.stageErr(taskCtx, StageTaskStart, vmID, err), "failed to start a task")
 	}
 	startVMMetric.MetricMap[metrics.TaskStart] = metrics.ToUS(time.Since(tStart))
 
@@ -198,6 +305,19 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 		}
 	}()
 
+	if o.readinessProbe != nil {
+		logger.Debug("StartVM: Waiting for the guest to pass the readiness probe")
+		tStart = time.Now()
+		probeCtx, cancel := o.stageContext(ctx, StageProbe)
+		err := o.stageErr(probeCtx, StageProbe, vmID, o.readinessProbe.waitReady(probeCtx, vm.GetIP()))
+		cancel()
+		startVMMetric.MetricMap[metrics.ProbeReady] = metrics.ToUS(time.Since(tStart))
+		if err != nil {
+			logger.WithError(err).Error("guest did not become ready, tearing down the VM")
+			return nil, nil, &BootFailureErr{VMID: vmID, Err: err}
+		}
+	}
+
 	if err := os.MkdirAll(o.getVMBaseDir(vmID), 0777); err != nil {
 		logger.Error("Failed to create VM base dir")
 		return nil, nil, err
@@ -270,18 +390,28 @@ func (o *Orchestrator) StopSingleVM(ctx context.Context, vmID string) error {
 	//	}
 	//}
 
-	if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: vmID}); err != nil {
-		logger.WithError(err).Error("failed to stop firecracker-containerd VM")
+	stopCtx, cancelStop := o.stageContext(ctx, StageStop)
+	if _, err := o.fcClient.StopVM(stopCtx, &proto.StopVMRequest{VMID: vmID}); err != nil {
+		logger.WithError(o.stageErr(stopCtx, StageStop, vmID, err)).Error("failed to stop firecracker-containerd VM")
 	}
+	cancelStop()
 
 	if err := o.vmPool.Free(vmID); err != nil {
 		logger.Error("failed to free VM from VM pool")
 		return err
 	}
 
+	isLazy := vm.IsLazy
 	o.workloadIo.Delete(vmID)
-
-	if vm.SnapBooted {
+	// The overlay is on top of the device of the lazily loaded image
+	o.removeLazyOverlay(vmID)
+	o.releaseImage(vm)
+	o.unplaceVM(vmID)
+	o.cleanupDrives(ctx, vmID)
+	o.removeVMCgroup(vmID)
+	o.releaseJailUser(vmID)
+
+	if vm.SnapBooted && !isLazy {
 		if err := o.devMapper.RemoveDeviceSnapshot(ctx, vm.ContainerSnapKey); err != nil {
 			logger.Error("failed to deactivate container snapshot")
 			return err
@@ -297,6 +427,130 @@ func (o *Orchestrator) getImage(ctx context.Context, imageName string) (*contain
 	return o.imageManager.GetImage(ctx, imageName)
 }
 
+// acquireImage fetches the image of a VM and protects it from garbage collection until the VM is stopped
+func (o *Orchestrator) acquireImage(ctx context.Context, vm *misc.VM, imageName string) (*containerd.Image, error) {
+	image, err := o.imageManager.AcquireImage(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	vm.ImageName = imageName
+
+	return image, nil
+}
+
+// acquireLazyImage attaches the root file system of the image of a VM if lazy pulls are enabled and the image is in
+// the eStargz format, returning image.ErrNotLazy otherwise
+func (o *Orchestrator) acquireLazyImage(ctx context.Context, vm *misc.VM, imageName string) (*image.LazyImage, error) {
+	if !o.isLazyPull {
+		return nil, image.ErrNotLazy
+	}
+
+	lazyImage, err := o.imageManager.AcquireLazyImage(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	vm.ImageName = imageName
+	vm.IsLazy = true
+
+	return lazyImage, nil
+}
+
+// createLazyOverlay creates the writable root file system of a VM of a lazily loaded image, starting from the blocks
+// saved in a snapshot at statePath, unless it is empty
+func (o *Orchestrator) createLazyOverlay(vmID string, lazyImage *image.LazyImage, statePath, stateDigest string) (*image.LazyOverlay, error) {
+	overlay, err := lazyImage.NewOverlay(vmID, statePath, stateDigest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating root file system overlay")
+	}
+	o.lazyOverlays.Store(vmID, overlay)
+
+	return overlay, nil
+}
+
+// restoreLazyOverlay attaches the lazily loaded image a snapshot was taken from, and restores the root file system
+// overlay of the VM from the snapshot, returning the path of the overlay
+func (o *Orchestrator) restoreLazyOverlay(ctx context.Context, vm *misc.VM, snap *snapshotting.Snapshot) (string, error) {
+	lazyImage, err := o.acquireLazyImage(ctx, vm, snap.GetImage())
+	if errors.Is(err, image.ErrNotLazy) {
+		// The overlay only applies on top of the root file system of the lazily loaded image
+		return "", errors.Wrapf(ErrStaleSnapshot, "snapshot of lazily loaded image %s: %v", snap.GetImage(), err)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get/pull image")
+	}
+
+	if digest := lazyImage.Digest().String(); snap.ImageDigest != digest {
+		return "", errors.Wrapf(ErrStaleSnapshot, "snapshot of %s@%s, image is now %s", snap.GetImage(), snap.ImageDigest, digest)
+	}
+
+	overlay, err := o.createLazyOverlay(vm.ID, lazyImage, snap.GetPatchFilePath(), snap.PatchDigest)
+	if errors.Is(err, image.ErrCorruptOverlay) {
+		return "", errors.Wrapf(ErrCorruptSnapshot, "%v", err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return overlay.Path(), nil
+}
+
+// removeLazyOverlay removes the root file system overlay of a VM of a lazily loaded image, if any
+func (o *Orchestrator) removeLazyOverlay(vmID string) {
+	overlay, ok := o.lazyOverlays.LoadAndDelete(vmID)
+	if !ok {
+		return
+	}
+	if err := overlay.(*image.LazyOverlay).Remove(); err != nil {
+		log.WithError(err).WithField("vmID", vmID).Error("failed to remove root file system overlay")
+	}
+}
+
+func (o *Orchestrator) releaseImage(vm *misc.VM) {
+	if vm.ImageName == "" {
+		return
+	}
+
+	if vm.IsLazy {
+		o.imageManager.ReleaseLazyImage(vm.ImageName)
+	} else {
+		o.imageManager.ReleaseImage(vm.ImageName)
+	}
+	vm.ImageName = ""
+	vm.IsLazy = false
+}
+
+// withLazyImageConfig configures the process of a container from the config of a lazily loaded image, like
+// oci.WithImageConfig. Named users are looked up in the root file system, which is not mounted on the host, hence
+// only numeric users are supported
+func withLazyImageConfig(config ocispec.ImageConfig) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, s *oci.Spec) error {
+		if len(config.Env) > 0 {
+			s.Process.Env = config.Env
+		}
+		s.Process.Args = append(config.Entrypoint, config.Cmd...)
+		s.Process.Cwd = config.WorkingDir
+		if s.Process.Cwd == "" {
+			s.Process.Cwd = "/"
+		}
+
+		if config.User == "" {
+			return nil
+		}
+		user, group, hasGroup := strings.Cut(config.User, ":")
+		uid, err := strconv.ParseUint(user, 10, 32)
+		if err != nil {
+			return errors.Errorf("user %q of a lazily loaded image is not numeric", config.User)
+		}
+		gid := uid
+		if hasGroup {
+			if gid, err = strconv.ParseUint(group, 10, 32); err != nil {
+				return errors.Errorf("group %q of a lazily loaded image is not numeric", config.User)
+			}
+		}
+		return oci.WithUIDGID(uint32(uid), uint32(gid))(ctx, client, c, s)
+	}
+}
+
 func getK8sDNS() []string {
 	//using googleDNS as a backup
 	dnsIPs := []string{"8.8.8.8"}
@@ -315,12 +569,12 @@ func getK8sDNS() []string {
 	return dnsIPs
 }
 
-func (o *Orchestrator) getVMConfig(vm *misc.VM) *proto.CreateVMRequest {
+func (o *Orchestrator) getVMConfig(vm *misc.VM) (*proto.CreateVMRequest, error) {
 	kernelArgs := "ro noapic reboot=k panic=1 pci=off nomodules systemd.log_color=false systemd.unit=firecracker.target init=/sbin/overlay-init tsc=reliable quiet 8250.nr_uarts=0 ipv6.disable=1"
 
-	return &proto.CreateVMRequest{
+	req := &proto.CreateVMRequest{
 		VMID:           vm.ID,
-		TimeoutSeconds: 100,
+		TimeoutSeconds: uint32(o.timeouts.CreateVM / time.Second),
 		KernelArgs:     kernelArgs,
 		MachineCfg: &proto.FirecrackerMachineConfiguration{
 			VcpuCount:  1,
@@ -339,6 +593,19 @@ func (o *Orchestrator) getVMConfig(vm *misc.VM) *proto.CreateVMRequest {
 		}},
 		NetNS: vm.GetNetworkNamespace(),
 	}
+
+	if o.isBalloonEnabled {
+		req.BalloonDevice = getBalloonDevice()
+	}
+
+	if o.jailerConfig != nil {
+		var err error
+		if req.JailerConfig, err = o.getJailerConfig(vm); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
 }
 
 // StopActiveVMs Shuts down all active VMs
@@ -374,10 +641,12 @@ func (o *Orchestrator) PauseVM(ctx context.Context, vmID string) error {
 	logger.Debug("Orchestrator received PauseVM")
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
+	ctx, cancel := o.stageContext(ctx, StagePause)
+	defer cancel()
 
 	if _, err := o.fcClient.PauseVM(ctx, &proto.PauseVMRequest{VMID: vmID}); err != nil {
 		logger.WithError(err).Error("failed to pause the VM")
-		return err
+		return o.stageErr(ctx, StagePause, vmID, err)
 	}
 
 	return nil
@@ -394,11 +663,13 @@ func (o *Orchestrator) ResumeVM(ctx context.Context, vmID string) (*metrics.Metr
 	logger.Debug("Orchestrator received ResumeVM")
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
+	ctx, cancel := o.stageContext(ctx, StageResume)
+	defer cancel()
 
 	tStart = time.Now()
 	if _, err := o.fcClient.ResumeVM(ctx, &proto.ResumeVMRequest{VMID: vmID}); err != nil {
 		logger.WithError(err).Error("failed to resume the VM")
-		return nil, err
+		return nil, o.stageErr(ctx, StageResume, vmID, err)
 	}
 	resumeVMMetric.MetricMap[metrics.FcResume] = metrics.ToUS(time.Since(tStart))
 
@@ -406,11 +677,25 @@ func (o *Orchestrator) ResumeVM(ctx context.Context, vmID string) (*metrics.Metr
 }
 
 // CreateSnapshot Creates a snapshot of a VM
-func (o *Orchestrator) CreateSnapshot(ctx context.Context, vmID string, snap *snapshotting.Snapshot) error {
+func (o *Orchestrator) CreateSnapshot(ctx context.Context, vmID string, snap *snapshotting.Snapshot) (retErr error) {
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 	logger.Debug("Orchestrator received CreateSnapshot")
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
+	ctx, cancel := o.stageContext(ctx, StageSnapshot)
+	defer cancel()
+	defer func() { retErr = o.stageErr(ctx, StageSnapshot, vmID, retErr) }()
+
+	snapDir := filepath.Dir(snap.GetSnapshotFilePath())
+	stage, err := o.newJailStage(vmID)
+	if err != nil {
+		return err
+	}
+	if err := stage.add(true, snapDir); err != nil {
+		stage.unstage()
+		logger.WithError(err).Error("failed to stage snapshot directory into the jail")
+		return err
+	}
 
 	req := &proto.CreateSnapshotRequest{
 		VMID:         vmID,
@@ -418,22 +703,60 @@ func (o *Orchestrator) CreateSnapshot(ctx context.Context, vmID string, snap *sn
 		MemFilePath:  snap.GetMemFilePath(),
 	}
 
-	if _, err := o.fcClient.CreateSnapshot(ctx, req); err != nil {
+	_, err = o.fcClient.CreateSnapshot(ctx, req)
+	stage.unstage()
+	if stage != nil {
+		// VMs loaded from the snapshot run as other users
+		if err := reclaimFromJail(snapDir, int(o.jailerConfig.GID)); err != nil {
+			logger.WithError(err).Error("failed to reclaim snapshot directory from the jail")
+			return err
+		}
+	}
+	if err != nil {
 		logger.WithError(err).Error("failed to create snapshot of the VM")
 		return err
 	}
 
+	if snap.IsDiff() {
+		logger.Debug("Replacing guest memory with a diff layer against the parent snapshot")
+		if err := snap.CreateMemLayer(); err != nil {
+			logger.WithError(err).Error("failed to create memory diff layer")
+			return err
+		}
+	}
+
 	vm, err := o.vmPool.GetVM(vmID)
 	if err != nil {
 		return err
 	}
 
+	logger.Debug("Saving extra drives")
+	if err := o.snapshotDrives(ctx, vmID, snap); err != nil {
+		logger.WithError(err).Error("failed to save extra drives")
+		return err
+	}
+
 	patchFilePath := snap.GetPatchFilePath()
 	logger = log.WithFields(log.Fields{"vmID": vmID, "patchFilePath": patchFilePath})
-	logger.Debug("Creating patch file with disk state difference")
-	if err := o.devMapper.CreatePatch(ctx, patchFilePath, vm.ContainerSnapKey, *vm.Image); err != nil {
-		logger.WithError(err).Error("failed to create container patch file")
-		return err
+	if overlay, ok := o.lazyOverlays.Load(vmID); ok {
+		logger.Debug("Saving the blocks the VM changed in its root file system overlay")
+		patchDigest, err := overlay.(*image.LazyOverlay).Save(patchFilePath)
+		if err != nil {
+			logger.WithError(err).Error("failed to save root file system overlay")
+			return err
+		}
+		snap.PatchDigest = patchDigest
+		snap.ImageDigest = overlay.(*image.LazyOverlay).ImageDigest()
+		snap.Lazy = true
+	} else {
+		logger.Debug("Creating patch file with disk state difference")
+		patchDigest, err := o.devMapper.CreatePatch(ctx, patchFilePath, vm.ContainerSnapKey, *vm.Image)
+		if err != nil {
+			logger.WithError(err).Error("failed to create container patch file")
+			return err
+		}
+		snap.PatchDigest = patchDigest
+		snap.ImageDigest = (*vm.Image).Target().Digest.String()
 	}
 
 	logger = log.WithFields(log.Fields{"vmID": vmID})
@@ -459,6 +782,15 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 	logger.Debug("Orchestrator received LoadSnapshot")
 
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
+	// Cleanups after failures use ctx, since loadCtx may have expired
+	loadCtx, cancel := o.stageContext(ctx, StageLoad)
+	defer cancel()
+	defer func() { retErr = o.stageErr(loadCtx, StageLoad, vmID, retErr) }()
+
+	if err := o.devMapper.CheckThinPool(); err != nil {
+		logger.WithError(err).Error("refusing to load snapshot")
+		return nil, nil, err
+	}
 
 	vm, err := o.vmPool.Allocate(vmID)
 	if err != nil {
@@ -468,34 +800,110 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 
 	defer func() {
 		if retErr != nil {
+			o.releaseImage(vm)
+			o.releaseJailUser(vmID)
 			if err := o.vmPool.Free(vmID); err != nil {
 				logger.WithError(err).Errorf("failed to free VM from pool after failure")
 			}
 		}
 	}()
 
-	if vm.Image, err = o.getImage(ctx, snap.GetImage()); err != nil {
-		return nil, nil, errors.Wrapf(err, "Failed to get/pull image")
+	var rootfsPath string
+	if snap.Lazy {
+		tStart = time.Now()
+		if rootfsPath, err = o.restoreLazyOverlay(loadCtx, vm, snap); err != nil {
+			return nil, nil, err
+		}
+		loadSnapshotMetric.MetricMap[metrics.PrepareDevice] = metrics.ToUS(time.Since(tStart))
+
+		defer func() {
+			if retErr != nil {
+				o.removeLazyOverlay(vmID)
+			}
+		}()
+	} else {
+		if vm.Image, err = o.acquireImage(loadCtx, vm, snap.GetImage()); err != nil {
+			return nil, nil, errors.Wrapf(err, "Failed to get/pull image")
+		}
+
+		// The patch of the container device only applies on top of the image the snapshot was taken from
+		if digest := (*vm.Image).Target().Digest.String(); snap.ImageDigest != "" && snap.ImageDigest != digest {
+			return nil, nil, errors.Wrapf(ErrStaleSnapshot, "snapshot of %s@%s, image is now %s", snap.GetImage(), snap.ImageDigest, digest)
+		}
+
+		tStart = time.Now()
+		if err := o.devMapper.CreatePatchedDeviceSnapshot(loadCtx, vm.ContainerSnapKey, *vm.Image, snap.GetPatchFilePath(), snap.PatchDigest); err != nil {
+			if errors.Is(err, devmapper.ErrCorruptPatch) {
+				return nil, nil, errors.Wrapf(ErrCorruptSnapshot, "%v", err)
+			}
+			return nil, nil, errors.Wrapf(err, "creating container snapshot")
+		}
+		loadSnapshotMetric.MetricMap[metrics.PrepareDevice] = metrics.ToUS(time.Since(tStart))
+
+		defer func() {
+			if retErr != nil {
+				if err := o.devMapper.RemoveDeviceSnapshot(ctx, vm.ContainerSnapKey); err != nil {
+					logger.WithError(err).Error("failed to remove container snapshot after failure")
+				}
+			}
+		}()
+
+		containerSnap, err := o.devMapper.GetDeviceSnapshot(loadCtx, vm.ContainerSnapKey)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "previously created container device does not exist")
+		}
+		rootfsPath = containerSnap.GetDevicePath()
 	}
 
-	if err := o.devMapper.CreateDeviceSnapshotFromImage(ctx, vm.ContainerSnapKey, *vm.Image); err != nil {
-		return nil, nil, errors.Wrapf(err, "creating container snapshot")
+	tStart = time.Now()
+	memFilePath, err := snap.PrepareMemFile()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "merging memory layers of diff snapshot")
+	}
+	if snap.IsDiff() {
+		loadSnapshotMetric.MetricMap[metrics.MergeMemLayers] = metrics.ToUS(time.Since(tStart))
 	}
 
-	containerSnap, err := o.devMapper.GetDeviceSnapshot(ctx, vm.ContainerSnapKey)
+	// Only the files of the snapshot and the devices of the VM are reachable from its jail
+	stage, err := o.newJailStage(vmID)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "previously created container device does not exist")
+		return nil, nil, err
 	}
+	defer stage.unstage()
+
+	unlockDrives := func() {}
+	defer func() { unlockDrives() }()
+	if len(snap.Drives) > 0 {
+		// VMs loaded from the same snapshot expect their drives at the same paths
+		unlockDrives = o.lockDrivePaths(snap)
+
+		tStart = time.Now()
+		vmDrives, err := o.restoreDrives(loadCtx, vmID, snap, stage)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "restoring drives")
+		}
+		loadSnapshotMetric.MetricMap[metrics.PrepareDrives] = metrics.ToUS(time.Since(tStart))
+		o.vmDrives.Store(vmID, vmDrives)
 
-	if err := o.devMapper.RestorePatch(ctx, vm.ContainerSnapKey, snap.GetPatchFilePath()); err != nil {
-		return nil, nil, errors.Wrapf(err, "unpacking patch into container snapshot")
+		defer func() {
+			if retErr != nil {
+				o.cleanupDrives(ctx, vmID)
+			}
+		}()
 	}
 
-	conf := o.getVMConfig(vm)
+	conf, err := o.getVMConfig(vm)
+	if err != nil {
+		return nil, nil, err
+	}
 	conf.LoadSnapshot = true
 	conf.SnapshotPath = snap.GetSnapshotFilePath()
-	conf.MemFilePath = snap.GetMemFilePath()
-	conf.ContainerSnapshotPath = containerSnap.GetDevicePath()
+	conf.MemFilePath = memFilePath
+	conf.ContainerSnapshotPath = rootfsPath
+
+	if err := stage.add(false, conf.SnapshotPath, conf.MemFilePath, conf.ContainerSnapshotPath); err != nil {
+		return nil, nil, err
+	}
 
 	if o.GetUPFEnabled() {
 		if err := o.memoryManager.FetchState(vmID); err != nil {
@@ -508,9 +916,9 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 	go func() {
 		defer close(loadDone)
 
-		if _, loadErr = o.fcClient.CreateVM(ctx, conf); loadErr != nil {
+		if _, loadErr = o.fcClient.CreateVM(loadCtx, conf); loadErr != nil {
 			logger.Error("Failed to load snapshot of the VM: ", loadErr)
-			logger.Errorf("snapFilePath: %s, memFilePath: %s, newSnapshotPath: %s", snap.GetSnapshotFilePath(), snap.GetMemFilePath(), containerSnap.GetDevicePath())
+			logger.Errorf("snapFilePath: %s, memFilePath: %s, newSnapshotPath: %s", snap.GetSnapshotFilePath(), memFilePath, rootfsPath)
 			files, err := os.ReadDir(filepath.Dir(snap.GetSnapshotFilePath()))
 			if err != nil {
 				logger.Error(err)
@@ -523,7 +931,7 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 
 			logger.Error(snapFiles)
 
-			files, _ = os.ReadDir(filepath.Dir(containerSnap.GetDevicePath()))
+			files, _ = os.ReadDir(filepath.Dir(rootfsPath))
 			if err != nil {
 				logger.Error(err)
 			}
@@ -543,6 +951,9 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 	}
 
 	<-loadDone
+	// Firecracker opened the drives, whose paths can be linked to the drives of the next VM
+	unlockDrives()
+	stage.unstage()
 
 	loadSnapshotMetric.MetricMap[metrics.LoadVMM] = metrics.ToUS(time.Since(tStart))
 
@@ -551,6 +962,14 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 		return nil, nil, multierr
 	}
 
+	if err := o.placeVM(loadCtx, vmID, int(conf.MachineCfg.VcpuCount)); err != nil {
+		if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: vmID}); err != nil {
+			logger.WithError(err).Errorf("failed to stop firecracker-containerd VM after failure")
+		}
+		o.removeVMCgroup(vmID)
+		return nil, nil, errors.Wrap(err, "failed to place the microVM on host CPUs")
+	}
+
 	vm.SnapBooted = true
 
 	return &StartVMResponse{GuestIP: vm.GetIP()}, loadSnapshotMetric, nil
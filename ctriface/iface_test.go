@@ -139,6 +139,48 @@ func TestStartStopSerial(t *testing.T) {
 	orch.Cleanup()
 }
 
+func TestBalloonInflateDeflate(t *testing.T) {
+	log.SetFormatter(&log.TextFormatter{
+		TimestampFormat: ctrdlog.RFC3339NanoFixed,
+		FullTimestamp:   true,
+	})
+
+	log.SetOutput(os.Stdout)
+
+	log.SetLevel(log.InfoLevel)
+
+	testTimeout := 120 * time.Second
+	ctx, cancel := context.WithTimeout(namespaces.WithNamespace(context.Background(), namespaceName), testTimeout)
+	defer cancel()
+
+	orch := NewOrchestrator(
+		"devmapper",
+		"",
+		WithTestModeOn(true),
+		WithBalloon(true),
+	)
+
+	vmID := "6"
+
+	_, _, err := orch.StartVM(ctx, vmID, testImageName)
+	require.NoError(t, err, "Failed to start VM")
+
+	_, err = orch.InflateBalloon(ctx, vmID, 64)
+	require.NoError(t, err, "Failed to inflate the balloon")
+
+	stats, err := orch.GetBalloonStats(ctx, vmID)
+	require.NoError(t, err, "Failed to get balloon stats")
+	require.Equal(t, int64(64), stats.TargetMib, "Balloon target is wrong")
+
+	_, err = orch.DeflateBalloon(ctx, vmID)
+	require.NoError(t, err, "Failed to deflate the balloon")
+
+	err = orch.StopSingleVM(ctx, vmID)
+	require.NoError(t, err, "Failed to stop VM")
+
+	orch.Cleanup()
+}
+
 func TestPauseResumeSerial(t *testing.T) {
 	log.SetFormatter(&log.TextFormatter{
 		TimestampFormat: ctrdlog.RFC3339NanoFixed,
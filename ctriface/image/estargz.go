@@ -0,0 +1,316 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TOCDigestAnnotation is set on the layers of eStargz images to the digest of their table of contents
+	TOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// maxFooterSize is the size of the footers written by eStargz, other compressors write shorter ones
+	maxFooterSize = 51
+	tocTarName    = "stargz.index.json"
+)
+
+// tocEntry is an entry of the table of contents of an eStargz layer. Regular files larger than the chunk size of
+// the layer are followed by one entry per additional chunk
+type tocEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size,omitempty"`
+	ModTime3339 string `json:"modtime,omitempty"`
+	LinkName    string `json:"linkName,omitempty"`
+	Mode        int64  `json:"mode,omitempty"`
+	UID         int    `json:"uid,omitempty"`
+	GID         int    `json:"gid,omitempty"`
+	DevMajor    int    `json:"devMajor,omitempty"`
+	DevMinor    int    `json:"devMinor,omitempty"`
+	Offset      int64  `json:"offset,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+	ChunkSize   int64  `json:"chunkSize,omitempty"`
+	ChunkDigest string `json:"chunkDigest,omitempty"`
+}
+
+// toc is the table of contents of an eStargz layer
+type toc struct {
+	Version int         `json:"version"`
+	Entries []*tocEntry `json:"entries"`
+}
+
+// remoteBlob reads byte ranges of a blob from its registry
+type remoteBlob struct {
+	url        string
+	size       int64
+	client     *http.Client
+	authorizer docker.Authorizer
+	retries    RetryPolicy
+	imageName  string
+	fetched    *int64 // bytes fetched from the registry, shared by the blobs of an image
+}
+
+// readRange fetches length bytes of the blob starting at offset, retrying transient failures
+func (b *remoteBlob) readRange(ctx context.Context, offset, length int64) ([]byte, error) {
+	if offset < 0 || length <= 0 || offset+length > b.size {
+		return nil, errors.Errorf("range %d+%d out of blob of %d bytes", offset, length, b.size)
+	}
+
+	var data []byte
+	err := b.retries.withRetries(ctx, b.imageName, func() error {
+		var err error
+		data, err = b.fetchRange(ctx, offset, length)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(b.fetched, length)
+
+	return data, nil
+}
+
+func (b *remoteBlob) fetchRange(ctx context.Context, offset, length int64) ([]byte, error) {
+	for authorized := false; ; authorized = true {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		if err := b.authorizer.Authorize(ctx, req); err != nil {
+			return nil, err
+		}
+
+		resp, err := b.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// The first request answers with the challenge of the registry, which the authorizer needs to get a token
+		if resp.StatusCode == http.StatusUnauthorized && !authorized {
+			err := b.authorizer.AddResponses(ctx, []*http.Response{resp})
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data, err := readRangeResponse(resp, offset, length)
+		resp.Body.Close()
+		return data, err
+	}
+}
+
+func readRangeResponse(resp *http.Response, offset, length int64) ([]byte, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The registry ignored the range and sent the whole blob
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, remoteserrors.NewUnexpectedStatusErr(resp)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// estargzLayer is a layer in the eStargz format, whose files are fetched from the registry one chunk at a time
+type estargzLayer struct {
+	blob    *remoteBlob
+	entries []*tocEntry
+	// ends maps the offset of each chunk in the blob to the offset of the next one
+	ends map[int64]int64
+}
+
+// openEStargz fetches the footer and the table of contents of an eStargz layer
+func openEStargz(ctx context.Context, blob *remoteBlob, tocDigest digest.Digest) (*estargzLayer, error) {
+	footerSize := int64(maxFooterSize)
+	if blob.size < footerSize {
+		footerSize = blob.size
+	}
+	footer, err := blob.readRange(ctx, blob.size-footerSize, footerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	tocOffset, footerSize, err := parseFooter(footer)
+	if err != nil {
+		return nil, err
+	}
+	if tocOffset <= 0 || tocOffset >= blob.size-footerSize {
+		return nil, errors.Errorf("invalid offset %d of the table of contents", tocOffset)
+	}
+
+	tocData, err := blob.readRange(ctx, tocOffset, blob.size-footerSize-tocOffset)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseTOC(tocData, tocDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunks are compressed separately, so each one ends where the next one, or the table of contents, starts
+	offsets := []int64{tocOffset}
+	for _, e := range t.Entries {
+		if (e.Type == "reg" || e.Type == "chunk") && e.Offset > 0 {
+			offsets = append(offsets, e.Offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	layer := &estargzLayer{
+		blob:    blob,
+		entries: t.Entries,
+		ends:    make(map[int64]int64),
+	}
+	for i := 0; i < len(offsets)-1; i++ {
+		if offsets[i] != offsets[i+1] {
+			layer.ends[offsets[i]] = offsets[i+1]
+		}
+	}
+
+	return layer, nil
+}
+
+// readChunk fetches and decompresses a chunk of a file, size being the uncompressed size of the chunk
+func (l *estargzLayer) readChunk(ctx context.Context, e *tocEntry, size int64) ([]byte, error) {
+	end, ok := l.ends[e.Offset]
+	if !ok {
+		return nil, errors.Errorf("chunk of %s at offset %d not found", e.Name, e.Offset)
+	}
+
+	raw, err := l.blob.readRange(ctx, e.Offset, end-e.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing chunk of %s", e.Name)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, errors.Wrapf(err, "decompressing chunk of %s", e.Name)
+	}
+
+	if e.ChunkDigest != "" && digest.FromBytes(data).String() != e.ChunkDigest {
+		return nil, errors.Errorf("digest of chunk of %s at offset %d does not match", e.Name, e.ChunkOffset)
+	}
+
+	return data, nil
+}
+
+// parseFooter returns the offset of the table of contents and the size of the footer at the end of p. The footer is
+// an empty gzip stream, whose size depends on the compressor, with the offset in its extra field
+func parseFooter(p []byte) (int64, int64, error) {
+	for i := 0; i+2 <= len(p); i++ {
+		if p[i] != 0x1f || p[i+1] != 0x8b {
+			continue
+		}
+		if offset, err := parseFooterExtra(p[i:]); err == nil {
+			return offset, int64(len(p) - i), nil
+		}
+	}
+
+	return 0, 0, errors.New("not an eStargz blob: invalid footer")
+}
+
+// parseFooterExtra parses the offset out of the extra field of a footer. The field is "%016xSTARGZ", which eStargz
+// wraps in a subfield with ID "SG" while legacy stargz does not
+func parseFooterExtra(p []byte) (int64, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return 0, err
+	}
+	if data, err := io.ReadAll(zr); err != nil || len(data) != 0 {
+		return 0, errors.New("footer is not an empty gzip stream")
+	}
+
+	extra := zr.Header.Extra
+	if len(extra) == 4+22 && extra[0] == 'S' && extra[1] == 'G' && binary.LittleEndian.Uint16(extra[2:4]) == 22 {
+		extra = extra[4:]
+	}
+	if len(extra) != 22 || string(extra[16:]) != "STARGZ" {
+		return 0, errors.New("footer has no offset of the table of contents")
+	}
+
+	return strconv.ParseInt(string(extra[:16]), 16, 64)
+}
+
+// parseTOC decompresses the table of contents of an eStargz layer and checks its digest
+func parseTOC(p []byte, tocDigest digest.Digest) (*toc, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing table of contents")
+	}
+
+	tr := tar.NewReader(zr)
+	h, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading table of contents")
+	}
+	if h.Name != tocTarName {
+		return nil, errors.Errorf("unexpected %s in place of the table of contents", h.Name)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading table of contents")
+	}
+
+	if tocDigest != "" && digest.FromBytes(data) != tocDigest {
+		return nil, errors.Errorf("digest of table of contents does not match %s", tocDigest)
+	}
+
+	t := new(toc)
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, errors.Wrap(err, "parsing table of contents")
+	}
+
+	return t, nil
+}
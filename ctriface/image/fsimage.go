@@ -0,0 +1,823 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"encoding/binary"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The root file systems of lazily loaded images are ext2 file systems with 4KiB blocks and no journal, which the
+// guest mounts read-only
+const (
+	fsBlockSize      = 4096
+	fsInodeSize      = 128
+	fsBlocksPerGroup = 8 * fsBlockSize
+	fsAddrsPerBlock  = fsBlockSize / 4
+	fsDirectBlocks   = 12
+	fsRootIno        = 2
+	fsFirstIno       = 11
+	fsSpareBlocks    = 64
+	fsMaxNameLen     = 255
+	fsFastLinkLen    = 60
+
+	fsFeatureIncompatFiletype  = 0x0002
+	fsFeatureROCompatLargeFile = 0x0002
+
+	whiteoutPrefix     = ".wh."
+	whiteoutOpaque     = ".wh..wh..opq"
+	prefetchLandmark   = ".prefetch.landmark"
+	noPrefetchLandmark = ".no.prefetch.landmark"
+)
+
+const (
+	sIFIFO   = 0010000
+	sIFCHR   = 0020000
+	sIFDIR   = 0040000
+	sIFBLK   = 0060000
+	sIFREG   = 0100000
+	sIFLNK   = 0120000
+	sIFMT    = 0170000
+	permMask = 07777
+)
+
+// fsNode is a file of the merged layers of an image
+type fsNode struct {
+	mode     uint32 // file type and permissions, as in stat(2)
+	uid      uint32
+	gid      uint32
+	mtime    int64
+	size     int64
+	link     string
+	devMajor uint32
+	devMinor uint32
+	children map[string]*fsNode
+	layerIdx int // layer that last declared the file, for opaque whiteouts
+
+	// layer and chunks are where the contents of regular files are fetched from, chunks being ordered by offset
+	layer  *estargzLayer
+	chunks []fsChunk
+
+	// Set by the layout of the file system
+	ino     uint32
+	nlink   uint16
+	extents []fsExtent // data blocks of regular files, ordered by file block
+}
+
+// fsChunk is a chunk of a regular file in an eStargz layer
+type fsChunk struct {
+	entry  *tocEntry
+	offset int64
+	size   int64
+}
+
+// fsExtent maps consecutive blocks of a file to consecutive blocks of the file system
+type fsExtent struct {
+	fileBlock int64
+	devBlock  uint32
+	count     uint32
+	node      *fsNode
+}
+
+func newDirNode(layerIdx int) *fsNode {
+	return &fsNode{
+		mode:     sIFDIR | 0755,
+		children: make(map[string]*fsNode),
+		layerIdx: layerIdx,
+	}
+}
+
+func (n *fsNode) isDir() bool {
+	return n.mode&sIFMT == sIFDIR
+}
+
+// setAttrs sets the metadata of a file from its entry in a table of contents
+func (n *fsNode) setAttrs(e *tocEntry) {
+	n.mode = n.mode&sIFMT | uint32(e.Mode)&permMask
+	n.uid = uint32(e.UID)
+	n.gid = uint32(e.GID)
+	if t, err := time.Parse(time.RFC3339, e.ModTime3339); err == nil {
+		n.mtime = t.Unix()
+	}
+}
+
+// devBlock returns the block of the file system holding a block of a regular file
+func (n *fsNode) devBlock(fileBlock int64) (uint32, bool) {
+	i := sort.Search(len(n.extents), func(i int) bool {
+		return n.extents[i].fileBlock+int64(n.extents[i].count) > fileBlock
+	})
+	if i == len(n.extents) || n.extents[i].fileBlock > fileBlock {
+		return 0, false
+	}
+	return n.extents[i].devBlock + uint32(fileBlock-n.extents[i].fileBlock), true
+}
+
+// newFileNode creates the file an entry of a table of contents declares, or returns nil for unsupported types
+func newFileNode(e *tocEntry, layer *estargzLayer, layerIdx int) *fsNode {
+	n := &fsNode{layerIdx: layerIdx}
+
+	switch e.Type {
+	case "dir":
+		n = newDirNode(layerIdx)
+	case "reg":
+		n.mode = sIFREG
+		n.size = e.Size
+		n.layer = layer
+		if e.Size > 0 {
+			n.chunks = []fsChunk{{entry: e, offset: 0, size: e.ChunkSize}}
+		}
+	case "symlink":
+		n.mode = sIFLNK
+		n.link = e.LinkName
+		n.size = int64(len(e.LinkName))
+	case "char", "block":
+		n.mode = sIFCHR
+		if e.Type == "block" {
+			n.mode = sIFBLK
+		}
+		n.devMajor = uint32(e.DevMajor)
+		n.devMinor = uint32(e.DevMinor)
+	case "fifo":
+		n.mode = sIFIFO
+	default:
+		return nil
+	}
+	n.setAttrs(e)
+
+	return n
+}
+
+// cleanEntryName turns the name of an entry into a path relative to the root, the root being the empty path
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// lookup returns the file at a path relative to n
+func (n *fsNode) lookup(p string) *fsNode {
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		if n.children == nil {
+			return nil
+		}
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// mkdirAll returns the directory at a path relative to n, creating the missing directories
+func (n *fsNode) mkdirAll(p string, layerIdx int) *fsNode {
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		child := n.children[name]
+		if child == nil || !child.isDir() {
+			child = newDirNode(layerIdx)
+			n.children[name] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// mergeLayers merges the tables of contents of the layers of an image, lowest layer first, applying the whiteouts
+func mergeLayers(layers []*estargzLayer) *fsNode {
+	root := newDirNode(0)
+
+	for idx, layer := range layers {
+		// Chunk entries belong to the regular file declared before them
+		var last *fsNode
+
+		for _, e := range layer.entries {
+			if e.Type == "chunk" {
+				if last != nil {
+					last.chunks = append(last.chunks, fsChunk{entry: e, offset: e.ChunkOffset, size: e.ChunkSize})
+				}
+				continue
+			}
+			last = nil
+
+			name := cleanEntryName(e.Name)
+			if name == "" {
+				if e.Type == "dir" {
+					root.setAttrs(e)
+				}
+				continue
+			}
+
+			dir, base := path.Split(name)
+			switch {
+			case len(base) > fsMaxNameLen:
+				log.WithField("name", name).Warn("Skipping file with a name too long for the root file system")
+				continue
+			case dir == "" && (base == prefetchLandmark || base == noPrefetchLandmark):
+				continue
+			}
+
+			parent := root.mkdirAll(dir, idx)
+			switch {
+			case base == whiteoutOpaque:
+				for childName, child := range parent.children {
+					if child.layerIdx < idx {
+						delete(parent.children, childName)
+					}
+				}
+				continue
+			case strings.HasPrefix(base, whiteoutPrefix):
+				delete(parent.children, strings.TrimPrefix(base, whiteoutPrefix))
+				continue
+			}
+
+			if e.Type == "hardlink" {
+				target := root.lookup(cleanEntryName(e.LinkName))
+				if target == nil || target.isDir() {
+					log.WithFields(log.Fields{"name": name, "target": e.LinkName}).Warn("Skipping hard link to a missing file")
+					continue
+				}
+				parent.children[base] = target
+				continue
+			}
+
+			if existing := parent.children[base]; e.Type == "dir" && existing != nil && existing.isDir() {
+				existing.setAttrs(e)
+				existing.layerIdx = idx
+				continue
+			}
+
+			node := newFileNode(e, layer, idx)
+			if node == nil {
+				log.WithFields(log.Fields{"name": name, "type": e.Type}).Warn("Skipping file of unsupported type")
+				continue
+			}
+			parent.children[base] = node
+			if e.Type == "reg" {
+				last = node
+			}
+		}
+	}
+
+	return root
+}
+
+// fsImage is an ext2 file system holding the merged layers of an image. Its metadata is built from the tables of
+// contents of the layers, while the contents of regular files are read on demand
+type fsImage struct {
+	size int64
+	// meta holds the blocks of the superblocks, group descriptors, bitmaps, inodes, directories, indirect blocks and
+	// symlinks. Blocks that are neither in meta nor in extents are zero
+	meta map[uint32][]byte
+	// extents holds the blocks of regular files, ordered by block
+	extents []fsExtent
+}
+
+// locate returns the contents of a metadata block, or the extent of the file a data block belongs to
+func (img *fsImage) locate(blk uint32) ([]byte, *fsExtent) {
+	if data, ok := img.meta[blk]; ok {
+		return data, nil
+	}
+
+	i := sort.Search(len(img.extents), func(i int) bool {
+		return img.extents[i].devBlock+img.extents[i].count > blk
+	})
+	if i == len(img.extents) || img.extents[i].devBlock > blk {
+		return nil, nil
+	}
+	return nil, &img.extents[i]
+}
+
+// fsBuilder lays out an ext2 file system. Every group holds a copy of the superblock and of the group descriptors,
+// followed by its block bitmap, inode bitmap and inode table, and then by data blocks
+type fsBuilder struct {
+	img    *fsImage
+	nodes  []*fsNode // in inode order, starting at the first non-reserved inode
+	dirs   map[*fsNode][][]byte
+	parent map[*fsNode]*fsNode
+
+	blocks      uint32
+	groups      uint32
+	inodesPerGp uint32
+	itableLen   uint32
+	gdtLen      uint32
+	overhead    uint32
+
+	next   uint32 // next data block to allocate
+	bitmap []byte // used blocks
+	uuid   [16]byte
+}
+
+// buildFSImage lays out the file system of the files under root
+func buildFSImage(root *fsNode, uuid [16]byte) (*fsImage, error) {
+	b := &fsBuilder{
+		img:    &fsImage{meta: make(map[uint32][]byte)},
+		dirs:   make(map[*fsNode][][]byte),
+		parent: make(map[*fsNode]*fsNode),
+		uuid:   uuid,
+	}
+
+	// fsck expects lost+found in the root directory
+	if _, ok := root.children["lost+found"]; !ok {
+		lostFound := newDirNode(0)
+		lostFound.mode = sIFDIR | 0700
+		root.children["lost+found"] = lostFound
+	}
+
+	root.ino = fsRootIno
+	b.parent[root] = root
+	b.numberInodes(root)
+
+	var dataBlocks int64
+	for _, n := range append([]*fsNode{root}, b.nodes...) {
+		count := b.dataBlocks(n)
+		dataBlocks += count + indirectBlocks(count)
+	}
+	if err := b.layoutGroups(dataBlocks); err != nil {
+		return nil, err
+	}
+
+	for _, n := range append([]*fsNode{root}, b.nodes...) {
+		b.writeFile(n)
+	}
+	if b.next > b.blocks {
+		return nil, errors.Errorf("file system layout overflows %d blocks", b.blocks)
+	}
+	b.writeGroups(root)
+
+	return b.img, nil
+}
+
+// numberInodes assigns inode numbers to the files under dir, depth-first and in name order, and counts their links
+func (b *fsBuilder) numberInodes(dir *fsNode) {
+	dir.nlink = 2
+	for _, name := range sortedNames(dir) {
+		child := dir.children[name]
+		if child.isDir() {
+			dir.nlink++
+		}
+		if child.ino != 0 {
+			// Hard link to a file that already has an inode
+			child.nlink++
+			continue
+		}
+
+		child.ino = uint32(fsFirstIno + len(b.nodes))
+		child.nlink = 1
+		b.nodes = append(b.nodes, child)
+		if child.isDir() {
+			b.parent[child] = dir
+			b.numberInodes(child)
+		}
+	}
+}
+
+func sortedNames(dir *fsNode) []string {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dataBlocks returns the number of data blocks of a file, serializing the entries of directories
+func (b *fsBuilder) dataBlocks(n *fsNode) int64 {
+	switch n.mode & sIFMT {
+	case sIFDIR:
+		b.dirs[n] = b.dirBlocks(n)
+		return int64(len(b.dirs[n]))
+	case sIFREG:
+		return (n.size + fsBlockSize - 1) / fsBlockSize
+	case sIFLNK:
+		if len(n.link) >= fsFastLinkLen {
+			return 1
+		}
+	}
+	return 0
+}
+
+// indirectBlocks returns the number of indirect blocks mapping the given number of data blocks
+func indirectBlocks(count int64) int64 {
+	var indirect int64
+
+	// Single, double and triple indirect blocks map up to a, a^2 and a^3 blocks, a being fsAddrsPerBlock
+	count -= fsDirectBlocks
+	for level, capacity := 1, int64(fsAddrsPerBlock); level <= 3 && count > 0; level, capacity = level+1, capacity*fsAddrsPerBlock {
+		mapped := count
+		if mapped > capacity {
+			mapped = capacity
+		}
+		// Each level of the tree has one block per fsAddrsPerBlock blocks of the level below
+		for l, below := 0, mapped; l < level; l++ {
+			below = (below + fsAddrsPerBlock - 1) / fsAddrsPerBlock
+			indirect += below
+		}
+		count -= mapped
+	}
+
+	return indirect
+}
+
+// dirBlocks serializes the entries of a directory, which must have inode numbers
+func (b *fsBuilder) dirBlocks(dir *fsNode) [][]byte {
+	var (
+		blocks [][]byte
+		cur    []byte
+		pos    int
+		last   int
+	)
+
+	add := func(name string, ino uint32, fileType byte) {
+		recLen := 8 + (len(name)+3)&^3
+		if cur == nil || pos+recLen > fsBlockSize {
+			if cur != nil {
+				// The last entry of a block spans the rest of it
+				binary.LittleEndian.PutUint16(cur[last+4:], uint16(fsBlockSize-last))
+			}
+			cur = make([]byte, fsBlockSize)
+			blocks = append(blocks, cur)
+			pos = 0
+		}
+
+		binary.LittleEndian.PutUint32(cur[pos:], ino)
+		binary.LittleEndian.PutUint16(cur[pos+4:], uint16(recLen))
+		cur[pos+6] = byte(len(name))
+		cur[pos+7] = fileType
+		copy(cur[pos+8:], name)
+		last = pos
+		pos += recLen
+	}
+
+	add(".", dir.ino, dirFileType(dir))
+	add("..", b.parent[dir].ino, dirFileType(dir))
+	for _, name := range sortedNames(dir) {
+		child := dir.children[name]
+		add(name, child.ino, dirFileType(child))
+	}
+	binary.LittleEndian.PutUint16(cur[last+4:], uint16(fsBlockSize-last))
+
+	return blocks
+}
+
+// dirFileType returns the file type recorded in directory entries
+func dirFileType(n *fsNode) byte {
+	switch n.mode & sIFMT {
+	case sIFREG:
+		return 1
+	case sIFDIR:
+		return 2
+	case sIFCHR:
+		return 3
+	case sIFBLK:
+		return 4
+	case sIFIFO:
+		return 5
+	case sIFLNK:
+		return 7
+	}
+	return 0
+}
+
+// layoutGroups sizes the block groups to hold the inodes and the given number of data and indirect blocks
+func (b *fsBuilder) layoutGroups(dataBlocks int64) error {
+	inodes := uint32(fsFirstIno - 1 + len(b.nodes))
+	inodesPerBlock := uint32(fsBlockSize / fsInodeSize)
+
+	groups := uint32(1)
+	for {
+		ipg := (inodes + groups - 1) / groups
+		ipg = (ipg + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+		if ipg > fsBlocksPerGroup {
+			groups = (inodes + fsBlocksPerGroup - 1) / fsBlocksPerGroup
+			continue
+		}
+
+		b.inodesPerGp = ipg
+		b.itableLen = ipg / inodesPerBlock
+		b.gdtLen = (groups*32 + fsBlockSize - 1) / fsBlockSize
+		b.overhead = 1 + b.gdtLen + 2 + b.itableLen
+
+		total := dataBlocks + int64(groups)*int64(b.overhead) + fsSpareBlocks
+		if total > 1<<32-1 {
+			return errors.New("image too large for the root file system")
+		}
+		if need := uint32((total + fsBlocksPerGroup - 1) / fsBlocksPerGroup); need > groups {
+			groups = need
+			continue
+		}
+
+		b.groups = groups
+		b.blocks = uint32(total)
+		// The last group must at least hold its metadata
+		if last := b.blocks - (groups-1)*fsBlocksPerGroup; last < b.overhead+fsSpareBlocks {
+			b.blocks += b.overhead + fsSpareBlocks - last
+		}
+		break
+	}
+
+	b.img.size = int64(b.blocks) * fsBlockSize
+	b.bitmap = make([]byte, (b.blocks+7)/8)
+	for g := uint32(0); g < b.groups; g++ {
+		for i := uint32(0); i < b.overhead; i++ {
+			b.markUsed(g*fsBlocksPerGroup + i)
+		}
+	}
+	b.next = b.overhead
+
+	return nil
+}
+
+func (b *fsBuilder) markUsed(blk uint32) {
+	b.bitmap[blk/8] |= 1 << (blk % 8)
+}
+
+// alloc allocates the next data block, skipping the metadata at the start of each group
+func (b *fsBuilder) alloc() uint32 {
+	blk := b.next
+	b.next++
+	if b.next%fsBlocksPerGroup == 0 {
+		b.next += b.overhead
+	}
+	if blk < b.blocks {
+		b.markUsed(blk)
+	}
+	return blk
+}
+
+// writeFile allocates the blocks of a file and writes its inode
+func (b *fsBuilder) writeFile(n *fsNode) {
+	var (
+		iblock [15]uint32
+		blocks []uint32
+		size   = n.size
+	)
+
+	switch n.mode & sIFMT {
+	case sIFDIR:
+		for _, data := range b.dirs[n] {
+			blk := b.alloc()
+			b.img.meta[blk] = data
+			blocks = append(blocks, blk)
+		}
+		delete(b.dirs, n)
+		size = int64(len(blocks)) * fsBlockSize
+	case sIFREG:
+		// Files made of a single chunk do not record its size
+		for i := range n.chunks {
+			if n.chunks[i].size == 0 {
+				end := n.size
+				if i+1 < len(n.chunks) {
+					end = n.chunks[i+1].offset
+				}
+				n.chunks[i].size = end - n.chunks[i].offset
+			}
+		}
+
+		count := (n.size + fsBlockSize - 1) / fsBlockSize
+		for fileBlock := int64(0); fileBlock < count; fileBlock++ {
+			blk := b.alloc()
+			blocks = append(blocks, blk)
+
+			if ext := len(n.extents) - 1; ext >= 0 && n.extents[ext].devBlock+n.extents[ext].count == blk {
+				n.extents[ext].count++
+			} else {
+				n.extents = append(n.extents, fsExtent{fileBlock: fileBlock, devBlock: blk, count: 1, node: n})
+			}
+		}
+		b.img.extents = append(b.img.extents, n.extents...)
+	case sIFLNK:
+		if len(n.link) >= fsFastLinkLen {
+			blk := b.alloc()
+			data := make([]byte, fsBlockSize)
+			copy(data, n.link)
+			b.img.meta[blk] = data
+			blocks = append(blocks, blk)
+		}
+	}
+
+	dataCount := len(blocks)
+	if dataCount > 0 {
+		iblock = b.mapBlocks(blocks)
+	}
+	sectors := uint32((int64(dataCount) + indirectBlocks(int64(dataCount))) * fsBlockSize / 512)
+
+	inode := make([]byte, fsInodeSize)
+	le := binary.LittleEndian
+	le.PutUint16(inode[0:], uint16(n.mode))
+	le.PutUint16(inode[2:], uint16(n.uid))
+	le.PutUint32(inode[4:], uint32(size))
+	le.PutUint32(inode[8:], uint32(n.mtime))
+	le.PutUint32(inode[12:], uint32(n.mtime))
+	le.PutUint32(inode[16:], uint32(n.mtime))
+	le.PutUint16(inode[24:], uint16(n.gid))
+	le.PutUint16(inode[26:], n.nlink)
+	le.PutUint32(inode[28:], sectors)
+
+	switch {
+	case n.mode&sIFMT == sIFLNK && len(n.link) < fsFastLinkLen:
+		// Short symlinks are stored in place of the block map
+		copy(inode[40:100], n.link)
+	case n.mode&sIFMT == sIFCHR || n.mode&sIFMT == sIFBLK:
+		if n.devMajor < 256 && n.devMinor < 256 {
+			le.PutUint32(inode[40:], n.devMajor<<8|n.devMinor)
+		} else {
+			le.PutUint32(inode[44:], n.devMinor&0xff|n.devMajor<<8|(n.devMinor&^0xff)<<12)
+		}
+	default:
+		for i, blk := range iblock {
+			le.PutUint32(inode[40+4*i:], blk)
+		}
+	}
+
+	if n.mode&sIFMT == sIFREG {
+		le.PutUint32(inode[108:], uint32(size>>32))
+	}
+	le.PutUint16(inode[120:], uint16(n.uid>>16))
+	le.PutUint16(inode[122:], uint16(n.gid>>16))
+
+	group := (n.ino - 1) / b.inodesPerGp
+	offset := int64((n.ino-1)%b.inodesPerGp) * fsInodeSize
+	blk := group*fsBlocksPerGroup + 1 + b.gdtLen + 2 + uint32(offset/fsBlockSize)
+	copy(b.metaBlock(blk)[offset%fsBlockSize:], inode)
+}
+
+func (b *fsBuilder) metaBlock(blk uint32) []byte {
+	data, ok := b.img.meta[blk]
+	if !ok {
+		data = make([]byte, fsBlockSize)
+		b.img.meta[blk] = data
+	}
+	return data
+}
+
+// mapBlocks returns the block map of an inode, allocating the indirect blocks it needs
+func (b *fsBuilder) mapBlocks(blocks []uint32) [15]uint32 {
+	var iblock [15]uint32
+
+	n := copy(iblock[:fsDirectBlocks], blocks)
+	blocks = blocks[n:]
+	for level := 1; level <= 3 && len(blocks) > 0; level++ {
+		iblock[fsDirectBlocks-1+level], blocks = b.indirect(level, blocks)
+	}
+
+	return iblock
+}
+
+// indirect allocates an indirect block of the given depth mapping as many of blocks as it can, and returns the
+// blocks that remain
+func (b *fsBuilder) indirect(level int, blocks []uint32) (uint32, []uint32) {
+	blk := b.alloc()
+	data := make([]byte, fsBlockSize)
+	b.img.meta[blk] = data
+
+	for i := 0; i < fsAddrsPerBlock && len(blocks) > 0; i++ {
+		var ptr uint32
+		if level == 1 {
+			ptr, blocks = blocks[0], blocks[1:]
+		} else {
+			ptr, blocks = b.indirect(level-1, blocks)
+		}
+		binary.LittleEndian.PutUint32(data[4*i:], ptr)
+	}
+
+	return blk, blocks
+}
+
+// writeGroups writes the superblocks, the group descriptors and the bitmaps of all groups
+func (b *fsBuilder) writeGroups(root *fsNode) {
+	le := binary.LittleEndian
+	inodes := uint32(fsFirstIno - 1 + len(b.nodes))
+
+	dirsPerGroup := make([]uint16, b.groups)
+	dirsPerGroup[(root.ino-1)/b.inodesPerGp]++
+	for _, n := range b.nodes {
+		if n.isDir() {
+			dirsPerGroup[(n.ino-1)/b.inodesPerGp]++
+		}
+	}
+
+	gdt := make([]byte, b.gdtLen*fsBlockSize)
+	var freeBlocks, freeInodes uint32
+	for g := uint32(0); g < b.groups; g++ {
+		start := g * fsBlocksPerGroup
+		end := start + fsBlocksPerGroup
+		if end > b.blocks {
+			end = b.blocks
+		}
+
+		blockBitmap := make([]byte, fsBlockSize)
+		var groupFreeBlocks uint32
+		for i := uint32(0); i < fsBlocksPerGroup; i++ {
+			blk := start + i
+			if blk >= end || b.bitmap[blk/8]&(1<<(blk%8)) != 0 {
+				blockBitmap[i/8] |= 1 << (i % 8)
+			} else {
+				groupFreeBlocks++
+			}
+		}
+
+		inodeBitmap := make([]byte, fsBlockSize)
+		var groupFreeInodes uint32
+		for i := uint32(0); i < fsBlockSize*8; i++ {
+			if i >= b.inodesPerGp || g*b.inodesPerGp+i+1 <= inodes {
+				inodeBitmap[i/8] |= 1 << (i % 8)
+			} else {
+				groupFreeInodes++
+			}
+		}
+
+		bitmapBlk := start + 1 + b.gdtLen
+		b.img.meta[bitmapBlk] = blockBitmap
+		b.img.meta[bitmapBlk+1] = inodeBitmap
+
+		desc := gdt[g*32:]
+		le.PutUint32(desc[0:], bitmapBlk)
+		le.PutUint32(desc[4:], bitmapBlk+1)
+		le.PutUint32(desc[8:], bitmapBlk+2)
+		le.PutUint16(desc[12:], uint16(groupFreeBlocks))
+		le.PutUint16(desc[14:], uint16(groupFreeInodes))
+		le.PutUint16(desc[16:], dirsPerGroup[g])
+
+		freeBlocks += groupFreeBlocks
+		freeInodes += groupFreeInodes
+	}
+
+	for g := uint32(0); g < b.groups; g++ {
+		start := g * fsBlocksPerGroup
+
+		sbBlock := make([]byte, fsBlockSize)
+		sb := sbBlock
+		if g == 0 {
+			// The first 1KiB of the file system is left for the boot loader
+			sb = sbBlock[1024:]
+		}
+		b.writeSuperblock(sb, uint16(g), freeBlocks, freeInodes)
+		b.img.meta[start] = sbBlock
+
+		for i := uint32(0); i < b.gdtLen; i++ {
+			b.img.meta[start+1+i] = gdt[i*fsBlockSize : (i+1)*fsBlockSize]
+		}
+	}
+}
+
+func (b *fsBuilder) writeSuperblock(sb []byte, groupNr uint16, freeBlocks, freeInodes uint32) {
+	le := binary.LittleEndian
+	// The layout only depends on the image, since the overlays saved in snapshots are restored on top of it
+	var now uint32
+	for _, n := range b.nodes {
+		if uint32(n.mtime) > now {
+			now = uint32(n.mtime)
+		}
+	}
+
+	le.PutUint32(sb[0:], b.inodesPerGp*b.groups)
+	le.PutUint32(sb[4:], b.blocks)
+	le.PutUint32(sb[12:], freeBlocks)
+	le.PutUint32(sb[16:], freeInodes)
+	le.PutUint32(sb[24:], 2) // log2(block size) - 10
+	le.PutUint32(sb[28:], 2)
+	le.PutUint32(sb[32:], fsBlocksPerGroup)
+	le.PutUint32(sb[36:], fsBlocksPerGroup)
+	le.PutUint32(sb[40:], b.inodesPerGp)
+	le.PutUint32(sb[48:], now)
+	le.PutUint16(sb[54:], 0xffff) // no mount count limit
+	le.PutUint16(sb[56:], 0xef53)
+	le.PutUint16(sb[58:], 1) // clean
+	le.PutUint16(sb[60:], 1) // continue on errors
+	le.PutUint32(sb[64:], now)
+	le.PutUint32(sb[76:], 1) // dynamic revision
+	le.PutUint32(sb[84:], fsFirstIno)
+	le.PutUint16(sb[88:], fsInodeSize)
+	le.PutUint16(sb[90:], groupNr)
+	le.PutUint32(sb[96:], fsFeatureIncompatFiletype)
+	le.PutUint32(sb[100:], fsFeatureROCompatLargeFile)
+	copy(sb[104:120], b.uuid[:])
+}
@@ -0,0 +1,289 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/devmapper"
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+// GCPolicy configures the garbage collection of the images that are not used by any VM or snapshot
+type GCPolicy struct {
+	// Namespace of the images in containerd
+	Namespace string
+	// Interval between two checks of the disk usage
+	Interval time.Duration
+	// HighWatermark is the usage (between 0 and 1) above which images are evicted, least recently used first,
+	// until the usage falls below LowWatermark
+	HighWatermark float64
+	LowWatermark  float64
+	// ContentQuota is the size of the content store in bytes, 0 to ignore its usage
+	ContentQuota int64
+	// ThinPool is the name of the devmapper thin pool, empty to ignore its usage
+	ThinPool string
+}
+
+// GCStats Statistics of the image garbage collection
+type GCStats struct {
+	// Runs counts the collections, i.e., the times the usage exceeded the high watermark or EvictImages was called
+	Runs uint64
+	// EvictedImages and EvictedBytes count the images removed and the size of their content
+	EvictedImages uint64
+	EvictedBytes  uint64
+	// Failures counts the images that could not be removed
+	Failures uint64
+}
+
+// ToMap Returns the statistics as metrics
+func (s GCStats) ToMap() map[string]float64 {
+	return map[string]float64{
+		metrics.ImageGCRuns:          float64(s.Runs),
+		metrics.ImageGCEvictedImages: float64(s.EvictedImages),
+		metrics.ImageGCEvictedBytes:  float64(s.EvictedBytes),
+		metrics.ImageGCFailures:      float64(s.Failures),
+	}
+}
+
+func (p *GCPolicy) validate() error {
+	if p.Interval <= 0 {
+		return errors.New("GC interval must be positive")
+	}
+	if p.LowWatermark <= 0 || p.LowWatermark > p.HighWatermark || p.HighWatermark > 1 {
+		return errors.Errorf("GC watermarks must satisfy 0 < low (%.2f) <= high (%.2f) <= 1", p.LowWatermark, p.HighWatermark)
+	}
+	if p.ContentQuota <= 0 && p.ThinPool == "" {
+		return errors.New("GC needs a content store quota or a thin pool to watch")
+	}
+	return nil
+}
+
+// StartGC starts evicting unused images whenever the disk usage exceeds the high watermark of the policy
+func (mgr *ImageManager) StartGC(policy GCPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	if mgr.gcStop != nil {
+		return errors.New("image GC is already running")
+	}
+	mgr.gcPolicy = &policy
+	mgr.gcStop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(policy.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ctx := namespaces.WithNamespace(context.Background(), policy.Namespace)
+				if err := mgr.CollectGarbage(ctx); err != nil {
+					log.WithError(err).Warn("Image GC failed")
+				}
+			}
+		}
+	}(mgr.gcStop)
+
+	return nil
+}
+
+// StopGC stops the periodic image garbage collection
+func (mgr *ImageManager) StopGC() {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	if mgr.gcStop != nil {
+		close(mgr.gcStop)
+		mgr.gcStop = nil
+	}
+}
+
+// GetGCStats returns the statistics of the image garbage collection
+func (mgr *ImageManager) GetGCStats() GCStats {
+	return GCStats{
+		Runs:          atomic.LoadUint64(&mgr.gcStats.Runs),
+		EvictedImages: atomic.LoadUint64(&mgr.gcStats.EvictedImages),
+		EvictedBytes:  atomic.LoadUint64(&mgr.gcStats.EvictedBytes),
+		Failures:      atomic.LoadUint64(&mgr.gcStats.Failures),
+	}
+}
+
+// CollectGarbage evicts the least recently used unreferenced images while the usage is above the high watermark
+// of the GC policy
+func (mgr *ImageManager) CollectGarbage(ctx context.Context) error {
+	mgr.Lock()
+	policy := mgr.gcPolicy
+	mgr.Unlock()
+	if policy == nil {
+		return errors.New("image GC is not configured")
+	}
+
+	usage, err := mgr.getUsage(ctx, policy)
+	if err != nil {
+		return err
+	}
+	if usage <= policy.HighWatermark {
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{"usage": fmt.Sprintf("%.2f", usage)})
+	logger.Info("Disk usage above the high watermark, evicting unused images")
+
+	freed, err := mgr.EvictImages(ctx, func(ctx context.Context) (bool, error) {
+		usage, err = mgr.getUsage(ctx, policy)
+		return usage <= policy.LowWatermark, err
+	})
+	if err != nil {
+		return err
+	}
+	if !freed {
+		logger.Warn("Disk usage still above the low watermark, all unused images have been evicted")
+	}
+
+	return nil
+}
+
+// EvictImages evicts the least recently used unreferenced images until freed reports that enough space is available,
+// regardless of the watermarks of the GC policy, e.g., when the thin pool runs short of space. It returns whether
+// enough space was freed
+func (mgr *ImageManager) EvictImages(ctx context.Context, freed func(ctx context.Context) (bool, error)) (bool, error) {
+	atomic.AddUint64(&mgr.gcStats.Runs, 1)
+
+	for _, imageName := range mgr.getEvictionCandidates() {
+		if done, err := freed(ctx); err != nil || done {
+			return done, err
+		}
+
+		size, evicted, err := mgr.evictImage(ctx, imageName)
+		if err != nil {
+			atomic.AddUint64(&mgr.gcStats.Failures, 1)
+			log.WithError(err).WithField("image", imageName).Warn("Failed to evict image")
+			continue
+		}
+		if !evicted {
+			continue
+		}
+
+		atomic.AddUint64(&mgr.gcStats.EvictedImages, 1)
+		atomic.AddUint64(&mgr.gcStats.EvictedBytes, uint64(size))
+		log.WithFields(log.Fields{"image": imageName, "size": size}).Info("Evicted image")
+	}
+
+	return freed(ctx)
+}
+
+// getEvictionCandidates returns the cached images that are not referenced, least recently used first
+func (mgr *ImageManager) getEvictionCandidates() []string {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	var candidates []string
+	for imageName := range mgr.cachedImages {
+		if mgr.imageStates[imageName].refs == 0 {
+			candidates = append(candidates, imageName)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return mgr.imageStates[candidates[i]].lastUsed.Before(mgr.imageStates[candidates[j]].lastUsed)
+	})
+
+	return candidates
+}
+
+// evictImage removes an image from the cache and from containerd, unless it got referenced in the meantime
+func (mgr *ImageManager) evictImage(ctx context.Context, imageName string) (int64, bool, error) {
+	mgr.Lock()
+	imgState := mgr.getImageState(imageName)
+	mgr.Unlock()
+
+	// Holding the image lock prevents concurrent pulls of the image
+	imgState.Lock()
+	defer imgState.Unlock()
+
+	mgr.Lock()
+	image, isCached := mgr.cachedImages[imageName]
+	if !isCached || imgState.refs > 0 {
+		mgr.Unlock()
+		return 0, false, nil
+	}
+	delete(mgr.cachedImages, imageName)
+	imgState.isCached = false
+	mgr.Unlock()
+
+	size, err := image.Size(ctx)
+	if err != nil {
+		size = 0
+	}
+
+	// Content and snapshots that are no longer referenced are removed by the garbage collector of containerd
+	if err := mgr.client.ImageService().Delete(ctx, image.Name(), images.SynchronousDelete()); err != nil {
+		return 0, false, errors.Wrapf(err, "deleting image %s", image.Name())
+	}
+
+	return size, true, nil
+}
+
+// getUsage returns the highest usage among the watched resources
+func (mgr *ImageManager) getUsage(ctx context.Context, policy *GCPolicy) (float64, error) {
+	var usage float64
+
+	if policy.ContentQuota > 0 {
+		var total int64
+		if err := mgr.client.ContentStore().Walk(ctx, func(info content.Info) error {
+			total += info.Size
+			return nil
+		}); err != nil {
+			return 0, errors.Wrapf(err, "walking content store")
+		}
+		usage = float64(total) / float64(policy.ContentQuota)
+	}
+
+	if policy.ThinPool != "" {
+		poolUsage, err := devmapper.ReadThinPoolUsage(policy.ThinPool)
+		if err != nil {
+			return 0, err
+		}
+		usage = math.Max(usage, poolUsage.MaxUsage())
+	}
+
+	return usage, nil
+}
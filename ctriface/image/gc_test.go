@@ -0,0 +1,63 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCEvictionCandidates(t *testing.T) {
+	mgr := NewImageManager(nil, "devmapper")
+	now := time.Now()
+
+	for imageName, idle := range map[string]time.Duration{"old": time.Minute, "used": time.Hour, "recent": 0, "older": time.Hour} {
+		mgr.cachedImages[imageName] = nil
+		mgr.getImageState(imageName).lastUsed = now.Add(-idle)
+	}
+	mgr.RetainImage("used")
+
+	require.Equal(t, []string{"older", "old", "recent"}, mgr.getEvictionCandidates(),
+		"Unreferenced images should be evicted least recently used first")
+
+	mgr.ReleaseImage("used")
+	require.Contains(t, mgr.getEvictionCandidates(), "used", "Released images should be evictable")
+
+	// Images that are not cached cannot be evicted
+	mgr.RetainImage("pulling")
+	mgr.ReleaseImage("pulling")
+	require.NotContains(t, mgr.getEvictionCandidates(), "pulling")
+}
+
+func TestGCPolicyValidate(t *testing.T) {
+	policy := GCPolicy{Interval: time.Minute, HighWatermark: 0.9, LowWatermark: 0.7, ThinPool: "pool"}
+	require.NoError(t, policy.validate())
+
+	policy.LowWatermark = 0.95
+	require.Error(t, policy.validate(), "Low watermark above the high watermark should be rejected")
+
+	policy = GCPolicy{Interval: time.Minute, HighWatermark: 0.9, LowWatermark: 0.7}
+	require.Error(t, policy.validate(), "GC without any resource to watch should be rejected")
+}
@@ -0,0 +1,645 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxManifestSize bounds the size of the manifests and configs fetched from registries
+const maxManifestSize = 4 << 20
+
+// DefaultLazyFetchTimeout bounds the time a read of the root file system of a lazily loaded image waits for the
+// chunks it fetches from the registry
+const DefaultLazyFetchTimeout = 30 * time.Second
+
+// ErrNotLazy is returned for images that cannot be loaded lazily, which are pulled instead
+var ErrNotLazy = errors.New("image is not in the eStargz format")
+
+// LazyImage is an image in the eStargz format whose root file system is served as a read-only block device. Only
+// the manifest, the config and the tables of contents of the layers are fetched up front, while the contents of the
+// files are fetched chunk by chunk on first access, and cached
+type LazyImage struct {
+	sync.Mutex
+	mgr      *ImageManager
+	name     string
+	digest   digest.Digest
+	config   ocispec.Image
+	fs       *fsImage
+	cache    *blockCache
+	device   *nbdDevice
+	refs     int
+	lastUsed time.Time
+	notLazy  bool
+	fetched  int64 // bytes fetched from the registry
+
+	fetchMu sync.Mutex
+	fetches map[*tocEntry]*chunkFetch
+}
+
+// chunkFetch is a fetch of a chunk in progress, which concurrent reads of the chunk wait for
+type chunkFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// WithLazyPull Loads the images in the eStargz format lazily, caching the fetched chunks in cacheDir
+func WithLazyPull(cacheDir string) ImageManagerOption {
+	return func(mgr *ImageManager) {
+		mgr.lazyDir = cacheDir
+	}
+}
+
+// WithLazyFetchTimeout Fails the reads of lazily loaded images whose chunks are not fetched within the timeout
+func WithLazyFetchTimeout(timeout time.Duration) ImageManagerOption {
+	return func(mgr *ImageManager) {
+		mgr.lazyFetchTimeout = timeout
+	}
+}
+
+// WithLazyCacheBudget Drops the cached chunks of lazily loaded images, least recently used first, once they exceed
+// the budget in bytes (0 for no limit)
+func WithLazyCacheBudget(budget int64) ImageManagerOption {
+	return func(mgr *ImageManager) {
+		mgr.lazyCacheBudget = budget
+	}
+}
+
+func newLazyImage(mgr *ImageManager, name string) *LazyImage {
+	return &LazyImage{mgr: mgr, name: name, fetches: make(map[*tocEntry]*chunkFetch)}
+}
+
+// Name returns the name of the image
+func (img *LazyImage) Name() string {
+	return img.name
+}
+
+// Digest returns the digest of the manifest of the image
+func (img *LazyImage) Digest() digest.Digest {
+	return img.digest
+}
+
+// Config returns the configuration of the image, e.g., its entrypoint and environment
+func (img *LazyImage) Config() ocispec.ImageConfig {
+	return img.config.Config
+}
+
+// DevicePath returns the block device holding the root file system of the image
+func (img *LazyImage) DevicePath() string {
+	img.Lock()
+	defer img.Unlock()
+
+	if img.device == nil {
+		return ""
+	}
+	return img.device.path
+}
+
+// FetchedBytes returns the number of bytes fetched from the registry so far
+func (img *LazyImage) FetchedBytes() int64 {
+	return atomic.LoadInt64(&img.fetched)
+}
+
+// AcquireLazyImage fetches the metadata of an eStargz image and attaches its root file system as a block device,
+// which is detached once every VM using it called ReleaseLazyImage. ErrNotLazy is returned if lazy pulls are
+// disabled or the image is not in the eStargz format
+func (mgr *ImageManager) AcquireLazyImage(ctx context.Context, imageName string) (*LazyImage, error) {
+	if mgr.lazyDir == "" {
+		return nil, ErrNotLazy
+	}
+	if err := mgr.checkPolicy(imageName); err != nil {
+		return nil, err
+	}
+
+	mgr.Lock()
+	img, found := mgr.lazyImages[imageName]
+	if !found {
+		img = newLazyImage(mgr, imageName)
+		mgr.lazyImages[imageName] = img
+	}
+	mgr.Unlock()
+
+	img.Lock()
+	defer img.Unlock()
+
+	if img.notLazy {
+		return nil, ErrNotLazy
+	}
+	if img.fs == nil {
+		if err := mgr.loadLazyImage(ctx, img); err != nil {
+			img.notLazy = errors.Is(err, ErrNotLazy)
+			return nil, err
+		}
+	}
+
+	if img.device == nil {
+		device, err := attachNBD(img, img.fs.size)
+		if err != nil {
+			return nil, errors.Wrapf(err, "attaching root file system of %s", imageName)
+		}
+		img.device = device
+	}
+	img.refs++
+	img.lastUsed = time.Now()
+
+	return img, nil
+}
+
+// ReleaseLazyImage drops a reference taken by AcquireLazyImage. The chunks fetched so far stay cached
+func (mgr *ImageManager) ReleaseLazyImage(imageName string) {
+	mgr.Lock()
+	img, found := mgr.lazyImages[imageName]
+	mgr.Unlock()
+
+	logger := log.WithField("image", imageName)
+	if !found {
+		logger.Warn("Releasing a lazy image that is not loaded")
+		return
+	}
+
+	img.Lock()
+	defer img.Unlock()
+
+	if img.refs == 0 {
+		logger.Warn("Releasing a lazy image that is not referenced")
+		return
+	}
+	img.refs--
+	img.lastUsed = time.Now()
+
+	if img.refs == 0 && img.device != nil {
+		if err := img.device.Close(); err != nil {
+			logger.WithError(err).Warn("Failed to detach root file system")
+		}
+		img.device = nil
+	}
+}
+
+// loadLazyImage fetches the manifest, the config and the tables of contents of the layers of an image, and lays
+// out its root file system
+func (mgr *ImageManager) loadLazyImage(ctx context.Context, img *LazyImage) error {
+	var (
+		manifest ocispec.Manifest
+		blobs    []*remoteBlob
+	)
+
+	err := mgr.retryPolicy.withRetries(ctx, img.name, func() error {
+		var err error
+		manifest, blobs, err = mgr.resolveLazy(ctx, img)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	layers := make([]*estargzLayer, len(blobs))
+	errs := make([]error, len(blobs))
+	var wg sync.WaitGroup
+	for i := range blobs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tocDigest := digest.Digest(manifest.Layers[i].Annotations[TOCDigestAnnotation])
+			layers[i], errs[i] = openEStargz(ctx, blobs[i], tocDigest)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "opening layer %s", manifest.Layers[i].Digest)
+		}
+	}
+
+	var uuid [16]byte
+	_, _ = hex.Decode(uuid[:], []byte(img.digest.Encoded()[:32]))
+	fs, err := buildFSImage(mergeLayers(layers), uuid)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(mgr.lazyDir, 0755); err != nil {
+		return err
+	}
+	cache, err := newBlockCache(filepath.Join(mgr.lazyDir, img.digest.Encoded()+".img"), fs.size)
+	if err != nil {
+		return err
+	}
+
+	img.fs = fs
+	img.cache = cache
+	log.WithFields(log.Fields{"image": img.name, "size": fs.size}).Debug("Laid out root file system of lazy image")
+
+	return nil
+}
+
+// resolveLazy resolves the manifest and fetches the config of an image, and locates its layers in the registry
+func (mgr *ImageManager) resolveLazy(ctx context.Context, img *LazyImage) (ocispec.Manifest, []*remoteBlob, error) {
+	var manifest ocispec.Manifest
+
+	resolver := mgr.registries.Resolver()
+	name, desc, err := resolver.Resolve(ctx, getImageURL(img.name))
+	if err != nil {
+		return manifest, nil, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var index ocispec.Index
+		if err := fetchJSON(ctx, fetcher, desc, &index); err != nil {
+			return manifest, nil, err
+		}
+		if desc, err = selectManifest(index); err != nil {
+			return manifest, nil, err
+		}
+	}
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+	default:
+		return manifest, nil, errors.Errorf("unsupported manifest type %s", desc.MediaType)
+	}
+
+	if err := fetchJSON(ctx, fetcher, desc, &manifest); err != nil {
+		return manifest, nil, err
+	}
+	for _, layer := range manifest.Layers {
+		if layer.Annotations[TOCDigestAnnotation] == "" {
+			return manifest, nil, ErrNotLazy
+		}
+	}
+	if err := fetchJSON(ctx, fetcher, manifest.Config, &img.config); err != nil {
+		return manifest, nil, err
+	}
+	img.digest = desc.Digest
+
+	named, err := refdocker.ParseDockerRef(name)
+	if err != nil {
+		return manifest, nil, err
+	}
+	host, err := mgr.pullHost(refdocker.Domain(named))
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	var blobs []*remoteBlob
+	for _, layer := range manifest.Layers {
+		blobs = append(blobs, &remoteBlob{
+			url:        fmt.Sprintf("%s://%s%s/%s/blobs/%s", host.Scheme, host.Host, host.Path, refdocker.Path(named), layer.Digest),
+			size:       layer.Size,
+			client:     host.Client,
+			authorizer: host.Authorizer,
+			retries:    mgr.retryPolicy,
+			imageName:  img.name,
+			fetched:    &img.fetched,
+		})
+	}
+
+	return manifest, blobs, nil
+}
+
+// pullHost returns the first host images of a registry are pulled from, a mirror if any is configured
+func (mgr *ImageManager) pullHost(registry string) (docker.RegistryHost, error) {
+	hosts, err := mgr.registries.registryHosts(registry)
+	if err != nil {
+		return docker.RegistryHost{}, err
+	}
+	for _, host := range hosts {
+		if host.Capabilities.Has(docker.HostCapabilityPull) {
+			return host, nil
+		}
+	}
+	return docker.RegistryHost{}, errors.Errorf("no host to pull from registry %s", registry)
+}
+
+// selectManifest returns the manifest of an index matching the platform of the host
+func selectManifest(index ocispec.Index) (ocispec.Descriptor, error) {
+	matcher := platforms.Default()
+	for _, m := range index.Manifests {
+		if m.Platform == nil || matcher.Match(*m.Platform) {
+			return m, nil
+		}
+	}
+	return ocispec.Descriptor{}, errors.Errorf("no manifest for platform %s", platforms.DefaultString())
+}
+
+// fetchJSON fetches a manifest or a config, checking its digest
+func fetchJSON(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, v interface{}) error {
+	if desc.Size > maxManifestSize {
+		return errors.Errorf("%s of %d bytes is too large", desc.MediaType, desc.Size)
+	}
+
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	if err != nil {
+		return err
+	}
+	if digest.FromBytes(data) != desc.Digest {
+		return errors.Errorf("digest of %s does not match %s", desc.MediaType, desc.Digest)
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// ReadAt reads the root file system of the image, fetching the chunks of the files it reads that are not cached
+func (img *LazyImage) ReadAt(p []byte, off int64) (int, error) {
+	// The guest waits for the reads of its root file system, which fail rather than hang if the registry stalls
+	ctx, cancel := context.WithTimeout(context.Background(), img.mgr.lazyFetchTimeout)
+	defer cancel()
+
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		if pos >= img.fs.size {
+			return n, io.EOF
+		}
+
+		blk := uint32(pos / fsBlockSize)
+		inBlock := pos % fsBlockSize
+		length := fsBlockSize - int(inBlock)
+		if length > len(p)-n {
+			length = len(p) - n
+		}
+		dst := p[n : n+length]
+
+		meta, ext := img.fs.locate(blk)
+		switch {
+		case meta != nil:
+			copy(dst, meta[inBlock:])
+		case ext != nil:
+			if err := img.readData(ctx, ext, blk, inBlock, dst); err != nil {
+				return n, err
+			}
+		default:
+			for i := range dst {
+				dst[i] = 0
+			}
+		}
+		n += length
+	}
+
+	return len(p), nil
+}
+
+// readData reads a data block of a file, fetching the chunks holding it if it is not cached
+func (img *LazyImage) readData(ctx context.Context, ext *fsExtent, blk uint32, inBlock int64, dst []byte) error {
+	// The cache is not dropped between fetching a block and reading it
+	img.cache.dropLock.RLock()
+	defer img.cache.dropLock.RUnlock()
+
+	if !img.cache.has(blk) {
+		node := ext.node
+		start := (ext.fileBlock + int64(blk-ext.devBlock)) * fsBlockSize
+		end := start + fsBlockSize
+		if end > node.size {
+			end = node.size
+		}
+
+		// A block may span chunks that are not aligned to blocks
+		i := sort.Search(len(node.chunks), func(i int) bool {
+			return node.chunks[i].offset+node.chunks[i].size > start
+		})
+		for ; i < len(node.chunks) && node.chunks[i].offset < end; i++ {
+			if err := img.fetchChunk(ctx, node, node.chunks[i]); err != nil {
+				return err
+			}
+		}
+		img.cache.set(blk)
+	}
+
+	_, err := img.cache.file.ReadAt(dst, int64(blk)*fsBlockSize+inBlock)
+	return err
+}
+
+// fetchChunk fetches a chunk of a file into the cache, once for concurrent readers
+func (img *LazyImage) fetchChunk(ctx context.Context, node *fsNode, chunk fsChunk) error {
+	img.fetchMu.Lock()
+	if fetch, ok := img.fetches[chunk.entry]; ok {
+		img.fetchMu.Unlock()
+		select {
+		case <-fetch.done:
+			return fetch.err
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "fetching chunk of image %s", img.name)
+		}
+	}
+	fetch := &chunkFetch{done: make(chan struct{})}
+	img.fetches[chunk.entry] = fetch
+	img.fetchMu.Unlock()
+
+	fetch.err = img.storeChunk(ctx, node, chunk)
+	close(fetch.done)
+
+	img.fetchMu.Lock()
+	delete(img.fetches, chunk.entry)
+	img.fetchMu.Unlock()
+
+	return fetch.err
+}
+
+// storeChunk writes a chunk to the blocks of its file in the cache, marking the blocks it fully covers as cached
+func (img *LazyImage) storeChunk(ctx context.Context, node *fsNode, chunk fsChunk) error {
+	data, err := node.layer.readChunk(ctx, chunk.entry, chunk.size)
+	if err != nil {
+		return errors.Wrapf(err, "fetching chunk of image %s", img.name)
+	}
+
+	chunkEnd := chunk.offset + chunk.size
+	for fileBlock := chunk.offset / fsBlockSize; fileBlock*fsBlockSize < chunkEnd; fileBlock++ {
+		blockStart := fileBlock * fsBlockSize
+		from, to := blockStart, blockStart+fsBlockSize
+		if from < chunk.offset {
+			from = chunk.offset
+		}
+		if to > chunkEnd {
+			to = chunkEnd
+		}
+
+		blk, ok := node.devBlock(fileBlock)
+		if !ok {
+			return errors.Errorf("chunk of image %s out of its file", img.name)
+		}
+		if _, err := img.cache.file.WriteAt(data[from-chunk.offset:to-chunk.offset], int64(blk)*fsBlockSize+from-blockStart); err != nil {
+			return err
+		}
+		img.mgr.addLazyCached(img.cache, to-from)
+		if from == blockStart && (to == blockStart+fsBlockSize || to == node.size) {
+			img.cache.set(blk)
+		}
+	}
+
+	return nil
+}
+
+// blockCache is a sparse file holding the blocks of a root file system fetched so far
+type blockCache struct {
+	sync.Mutex
+	file    *os.File
+	size    int64
+	present []uint64
+	written int64 // bytes written since the cache was last dropped
+
+	// dropLock is held for reading by the reads of the cache, and for writing while dropping it
+	dropLock sync.RWMutex
+}
+
+func newBlockCache(path string, size int64) (*blockCache, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cache of lazy image")
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "creating cache of lazy image")
+	}
+
+	blocks := size / fsBlockSize
+	return &blockCache{
+		file:    file,
+		size:    size,
+		present: make([]uint64, (blocks+63)/64),
+	}, nil
+}
+
+// drop deallocates the cached blocks, which are fetched again on their next read, and returns the bytes freed
+func (c *blockCache) drop() (int64, error) {
+	c.dropLock.Lock()
+	defer c.dropLock.Unlock()
+
+	if err := c.file.Truncate(0); err != nil {
+		return 0, err
+	}
+	if err := c.file.Truncate(c.size); err != nil {
+		return 0, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.present {
+		c.present[i] = 0
+	}
+	return atomic.SwapInt64(&c.written, 0), nil
+}
+
+func (c *blockCache) has(blk uint32) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.present[blk/64]&(1<<(blk%64)) != 0
+}
+
+func (c *blockCache) set(blk uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.present[blk/64] |= 1 << (blk % 64)
+}
+
+// addLazyCached accounts bytes written to the cache of a lazily loaded image, and evicts cached chunks in the
+// background once the caches exceed the budget
+func (mgr *ImageManager) addLazyCached(cache *blockCache, n int64) {
+	atomic.AddInt64(&cache.written, n)
+	cached := atomic.AddInt64(&mgr.lazyCached, n)
+	if mgr.lazyCacheBudget <= 0 || cached <= mgr.lazyCacheBudget {
+		return
+	}
+
+	// Readers of the image being evicted hold its cache, hence the eviction does not run on their path
+	if atomic.CompareAndSwapInt32(&mgr.lazyEvicting, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&mgr.lazyEvicting, 0)
+			mgr.evictLazyCaches()
+		}()
+	}
+}
+
+// evictLazyCaches drops the caches of lazily loaded images until they fit in the budget, those of images no VM
+// uses first, least recently used first
+func (mgr *ImageManager) evictLazyCaches() {
+	type candidate struct {
+		img      *LazyImage
+		inUse    bool
+		lastUsed time.Time
+	}
+
+	mgr.Lock()
+	var candidates []candidate
+	for _, img := range mgr.lazyImages {
+		// Images being loaded have no cache yet
+		if !img.TryLock() {
+			continue
+		}
+		if img.cache != nil {
+			candidates = append(candidates, candidate{img: img, inUse: img.refs > 0, lastUsed: img.lastUsed})
+		}
+		img.Unlock()
+	}
+	mgr.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].inUse != candidates[j].inUse {
+			return !candidates[i].inUse
+		}
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+
+	for _, c := range candidates {
+		if atomic.LoadInt64(&mgr.lazyCached) <= mgr.lazyCacheBudget {
+			return
+		}
+
+		freed, err := c.img.cache.drop()
+		if err != nil {
+			log.WithError(err).WithField("image", c.img.name).Warn("Failed to drop cache of lazy image")
+			continue
+		}
+		atomic.AddInt64(&mgr.lazyCached, -freed)
+		log.WithFields(log.Fields{"image": c.img.name, "freed": freed}).Debug("Dropped cache of lazy image")
+	}
+}
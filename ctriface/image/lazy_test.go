@@ -0,0 +1,401 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type testFile struct {
+	name string
+	typ  byte
+	data []byte
+	link string
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// buildEStargz writes a layer in the eStargz format: every chunk of a regular file starts a new gzip stream, the
+// table of contents follows the files and the footer points to it
+func buildEStargz(t *testing.T, files []testFile, chunkSize int) ([]byte, digest.Digest) {
+	var (
+		blob    bytes.Buffer
+		entries []*tocEntry
+		gz      *gzip.Writer
+	)
+
+	closeGz := func() {
+		if gz != nil {
+			require.NoError(t, gz.Close())
+			gz = nil
+		}
+	}
+	tw := tar.NewWriter(writerFunc(func(p []byte) (int, error) {
+		if gz == nil {
+			gz = gzip.NewWriter(&blob)
+		}
+		return gz.Write(p)
+	}))
+
+	modTime := time.Unix(1700000000, 0)
+	for _, f := range files {
+		mode := int64(0644)
+		if f.typ == tar.TypeDir {
+			mode = 0755
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     f.name,
+			Typeflag: f.typ,
+			Mode:     mode,
+			Size:     int64(len(f.data)),
+			Linkname: f.link,
+			ModTime:  modTime,
+		}))
+
+		e := &tocEntry{Name: f.name, Mode: mode, ModTime3339: modTime.UTC().Format(time.RFC3339), LinkName: f.link}
+		e.Type = map[byte]string{tar.TypeDir: "dir", tar.TypeReg: "reg", tar.TypeSymlink: "symlink", tar.TypeLink: "hardlink"}[f.typ]
+		entries = append(entries, e)
+
+		if f.typ != tar.TypeReg || len(f.data) == 0 {
+			continue
+		}
+		e.Size = int64(len(f.data))
+		for off := 0; off < len(f.data); off += chunkSize {
+			end := off + chunkSize
+			if end > len(f.data) {
+				end = len(f.data)
+			}
+
+			chunk := e
+			if off > 0 {
+				chunk = &tocEntry{Name: f.name, Type: "chunk"}
+				entries = append(entries, chunk)
+			}
+			closeGz()
+			chunk.Offset = int64(blob.Len())
+			chunk.ChunkOffset = int64(off)
+			if len(f.data) > chunkSize {
+				chunk.ChunkSize = int64(end - off)
+			}
+			chunk.ChunkDigest = digest.FromBytes(f.data[off:end]).String()
+
+			_, err := tw.Write(f.data[off:end])
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Flush())
+	closeGz()
+
+	tocOffset := blob.Len()
+	tocJSON, err := json.Marshal(toc{Version: 1, Entries: entries})
+	require.NoError(t, err)
+	gz = gzip.NewWriter(&blob)
+	tocTar := tar.NewWriter(gz)
+	require.NoError(t, tocTar.WriteHeader(&tar.Header{Name: tocTarName, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(tocJSON))}))
+	_, err = tocTar.Write(tocJSON)
+	require.NoError(t, err)
+	require.NoError(t, tocTar.Close())
+	closeGz()
+
+	footer, err := gzip.NewWriterLevel(&blob, gzip.NoCompression)
+	require.NoError(t, err)
+	footer.Header.Extra = append([]byte{'S', 'G', 22, 0}, fmt.Sprintf("%016xSTARGZ", tocOffset)...)
+	require.NoError(t, footer.Close())
+
+	return blob.Bytes(), digest.FromBytes(tocJSON)
+}
+
+// testRegistry is a registry serving a single image, which counts the bytes of blobs it serves
+type testRegistry struct {
+	*httptest.Server
+	manifest      []byte
+	manifestDesc  ocispec.Descriptor
+	blobs         map[digest.Digest][]byte
+	servedBytes   int64
+	rangeRequests int64
+	stalled       int32 // range requests hang until they are canceled
+}
+
+func newTestRegistry(t *testing.T, layers [][]byte, tocDigests []digest.Digest) *testRegistry {
+	r := &testRegistry{blobs: make(map[digest.Digest][]byte)}
+
+	config, err := json.Marshal(ocispec.Image{
+		Config: ocispec.ImageConfig{Entrypoint: []string{"/bin/app"}, Env: []string{"PATH=/bin"}},
+	})
+	require.NoError(t, err)
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+	}
+	manifest.SchemaVersion = 2
+	r.blobs[digest.FromBytes(config)] = config
+
+	for i, layer := range layers {
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+		if tocDigests[i] != "" {
+			desc.Annotations = map[string]string{TOCDigestAnnotation: tocDigests[i].String()}
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		r.blobs[desc.Digest] = layer
+	}
+	r.manifest, err = json.Marshal(manifest)
+	require.NoError(t, err)
+	r.manifestDesc = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(r.manifest), Size: int64(len(r.manifest))}
+
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.HasPrefix(req.URL.Path, "/v2/lazy/app/manifests/"):
+		w.Header().Set("Content-Type", r.manifestDesc.MediaType)
+		w.Header().Set("Docker-Content-Digest", r.manifestDesc.Digest.String())
+		w.Header().Set("Content-Length", fmt.Sprint(len(r.manifest)))
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(r.manifest)
+		}
+	case strings.HasPrefix(req.URL.Path, "/v2/lazy/app/blobs/"):
+		blob, ok := r.blobs[digest.Digest(strings.TrimPrefix(req.URL.Path, "/v2/lazy/app/blobs/"))]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Header.Get("Range") != "" {
+			atomic.AddInt64(&r.rangeRequests, 1)
+			if atomic.LoadInt32(&r.stalled) != 0 {
+				<-req.Context().Done()
+				return
+			}
+		}
+		http.ServeContent(writerCounter{w, &r.servedBytes}, req, "", time.Time{}, bytes.NewReader(blob))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+type writerCounter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w writerCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(w.n, int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+func (r *testRegistry) imageManager(t *testing.T) *ImageManager {
+	host := strings.TrimPrefix(r.URL, "http://")
+	registries, err := NewRegistries(RegistriesConfig{Hosts: map[string]RegistryHost{host: {PlainHTTP: true}}})
+	require.NoError(t, err)
+
+	return NewImageManager(nil, "devmapper", WithRegistries(registries), WithLazyPull(t.TempDir()),
+		WithRetryPolicy(RetryPolicy{Attempts: 1}))
+}
+
+func (r *testRegistry) imageName() string {
+	return strings.TrimPrefix(r.URL, "http://") + "/lazy/app:latest"
+}
+
+// testData returns incompressible data, so that the layers are dominated by the contents of files
+func testData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestLazyImage(t *testing.T) {
+	app := testData(50000, 1)
+	large := testData(5<<20, 2)
+
+	lower, lowerTOC := buildEStargz(t, []testFile{
+		{name: "bin/", typ: tar.TypeDir},
+		{name: "bin/app", typ: tar.TypeReg, data: app},
+		{name: "bin/app-link", typ: tar.TypeLink, link: "bin/app"},
+		{name: "etc/", typ: tar.TypeDir},
+		{name: "etc/old", typ: tar.TypeReg, data: []byte("removed by the upper layer")},
+		{name: "opt/", typ: tar.TypeDir},
+		{name: "opt/a", typ: tar.TypeReg, data: []byte("hidden by an opaque directory")},
+		{name: "lib/", typ: tar.TypeDir},
+		{name: "lib/large", typ: tar.TypeReg, data: large},
+	}, 10000)
+	upper, upperTOC := buildEStargz(t, []testFile{
+		{name: "etc/", typ: tar.TypeDir},
+		{name: "etc/.wh.old", typ: tar.TypeReg},
+		{name: "etc/new", typ: tar.TypeReg, data: []byte("hello")},
+		{name: "opt/", typ: tar.TypeDir},
+		{name: "opt/.wh..wh..opq", typ: tar.TypeReg},
+		{name: "opt/b", typ: tar.TypeReg, data: []byte("visible")},
+		{name: "sh", typ: tar.TypeSymlink, link: "/bin/app"},
+		{name: "long", typ: tar.TypeSymlink, link: "/" + strings.Repeat("long/", 20) + "target"},
+	}, 1<<20)
+
+	reg := newTestRegistry(t, [][]byte{lower, upper}, []digest.Digest{lowerTOC, upperTOC})
+	mgr := reg.imageManager(t)
+
+	img := newLazyImage(mgr, reg.imageName())
+	require.NoError(t, mgr.loadLazyImage(context.Background(), img), "Failed to load lazy image")
+	require.Equal(t, []string{"/bin/app"}, img.Config().Entrypoint)
+	require.Less(t, img.FetchedBytes(), int64(len(lower)+len(upper))/10, "Only the metadata should be fetched up front")
+
+	// Reading a block of a file only fetches the chunks holding it
+	node := lookupFile(t, img, "bin/app")
+	blk, ok := node.devBlock(2)
+	require.True(t, ok)
+	fetched := img.FetchedBytes()
+	block := make([]byte, fsBlockSize)
+	_, err := img.ReadAt(block, int64(blk)*fsBlockSize)
+	require.NoError(t, err)
+	require.Equal(t, app[2*fsBlockSize:3*fsBlockSize], block, "Block spanning two chunks should be read")
+	require.Less(t, img.FetchedBytes()-fetched, int64(3*10000), "Only the chunks holding the block should be fetched")
+	require.True(t, img.cache.has(blk))
+
+	// The whole file system is checked by fsck and read back through debugfs
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("e2fsprogs not installed")
+	}
+	path := filepath.Join(t.TempDir(), "rootfs.img")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = io.Copy(f, io.NewSectionReader(img, 0, img.fs.size))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	out, err := exec.Command("e2fsck", "-fn", path).CombinedOutput()
+	require.NoError(t, err, "fsck failed: %s", out)
+
+	debugfs := func(cmd string) string {
+		out, err := exec.Command("debugfs", "-R", cmd, path).Output()
+		require.NoError(t, err)
+		return string(out)
+	}
+	require.Equal(t, string(app), debugfs("cat /bin/app"))
+	require.Equal(t, string(app), debugfs("cat /bin/app-link"))
+	require.Equal(t, string(large), debugfs("cat /lib/large"))
+	require.Equal(t, "hello", debugfs("cat /etc/new"))
+	require.Equal(t, "visible", debugfs("cat /opt/b"))
+	require.NotContains(t, debugfs("ls /etc"), "old", "Whiteout should remove the file of the lower layer")
+	require.NotContains(t, debugfs("ls /opt"), "a ", "Opaque directory should hide the files of the lower layer")
+	require.Contains(t, debugfs("stat /sh"), `Fast link dest: "/bin/app"`)
+	require.Contains(t, debugfs("ls -l /"), "long")
+}
+
+func lookupFile(t *testing.T, img *LazyImage, name string) *fsNode {
+	for _, ext := range img.fs.extents {
+		if ext.node.chunks[0].entry.Name == name {
+			return ext.node
+		}
+	}
+	t.Fatalf("file %s not found", name)
+	return nil
+}
+
+func TestLazyImageNotEStargz(t *testing.T) {
+	reg := newTestRegistry(t, [][]byte{[]byte("plain gzip layer")}, []digest.Digest{""})
+	mgr := reg.imageManager(t)
+
+	img := newLazyImage(mgr, reg.imageName())
+	err := mgr.loadLazyImage(context.Background(), img)
+	require.ErrorIs(t, err, ErrNotLazy, "Images without tables of contents should be pulled")
+	require.Zero(t, atomic.LoadInt64(&reg.servedBytes), "No layer should be fetched")
+}
+
+// testLazyImage returns a lazy image of a single file holding data
+func testLazyImage(t *testing.T, data []byte) (*testRegistry, *LazyImage) {
+	layer, tocDigest := buildEStargz(t, []testFile{
+		{name: "data", typ: tar.TypeReg, data: data},
+	}, 10000)
+	reg := newTestRegistry(t, [][]byte{layer}, []digest.Digest{tocDigest})
+	mgr := reg.imageManager(t)
+
+	img := newLazyImage(mgr, reg.imageName())
+	require.NoError(t, mgr.loadLazyImage(context.Background(), img), "Failed to load lazy image")
+	mgr.lazyImages[img.name] = img
+
+	return reg, img
+}
+
+func TestLazyCacheEviction(t *testing.T) {
+	data := testData(100000, 3)
+	_, img := testLazyImage(t, data)
+	mgr := img.mgr
+
+	node := lookupFile(t, img, "data")
+	blk, ok := node.devBlock(5)
+	require.True(t, ok)
+	block := make([]byte, fsBlockSize)
+	_, err := img.ReadAt(block, int64(blk)*fsBlockSize)
+	require.NoError(t, err)
+	require.Positive(t, atomic.LoadInt64(&mgr.lazyCached), "Fetched chunks should be accounted")
+
+	mgr.lazyCacheBudget = 1
+	mgr.evictLazyCaches()
+	require.Zero(t, atomic.LoadInt64(&mgr.lazyCached), "Cache over the budget should be dropped")
+	require.False(t, img.cache.has(blk), "Dropped blocks should be fetched again")
+
+	fetched := img.FetchedBytes()
+	_, err = img.ReadAt(block, int64(blk)*fsBlockSize)
+	require.NoError(t, err)
+	require.Equal(t, data[5*fsBlockSize:6*fsBlockSize], block, "Dropped block should be read back")
+	require.Greater(t, img.FetchedBytes(), fetched, "Dropped block should be fetched again")
+}
+
+func TestLazyFetchTimeout(t *testing.T) {
+	reg, img := testLazyImage(t, testData(100000, 4))
+	img.mgr.lazyFetchTimeout = 100 * time.Millisecond
+	atomic.StoreInt32(&reg.stalled, 1)
+
+	node := lookupFile(t, img, "data")
+	blk, ok := node.devBlock(0)
+	require.True(t, ok)
+	_, err := img.ReadAt(make([]byte, fsBlockSize), int64(blk)*fsBlockSize)
+	require.ErrorIs(t, err, context.DeadlineExceeded, "Reads should not wait for a stalled registry")
+}
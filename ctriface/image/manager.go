@@ -26,13 +26,13 @@ package image
 import (
 	"context"
 	"net"
-	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/remotes/docker"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,6 +40,10 @@ import (
 type ImageState struct {
 	sync.Mutex
 	isCached bool
+	refs     int       // VMs and snapshots using the image, guarded by the ImageManager lock
+	lastUsed time.Time // guarded by the ImageManager lock
+	pulls    uint64    // pull attempts so far, guarded by the ImageManager lock
+	pullErr  error     // failure of the last pull
 }
 
 // NewImageState creates a new ImageState object that can be used to synchronize pulling a single image
@@ -56,16 +60,59 @@ type ImageManager struct {
 	cachedImages map[string]containerd.Image // Cached container images
 	imageStates  map[string]*ImageState
 	client       *containerd.Client
+	gcPolicy     *GCPolicy
+	gcStats      GCStats
+	gcStop       chan struct{}
+	warmSet      *warmSet
+	registries   *Registries
+	pullPolicy   PullPolicy
+	retryPolicy  RetryPolicy
+	lazyDir      string // cache of lazily loaded images, lazy pulls are disabled if empty
+	lazyImages   map[string]*LazyImage
+
+	lazyFetchTimeout time.Duration
+	lazyCacheBudget  int64
+	lazyCached       int64 // bytes written to the caches of lazily loaded images, accessed atomically
+	lazyEvicting     int32
+}
+
+// ImageManagerOption Options to pass to ImageManager
+type ImageManagerOption func(*ImageManager)
+
+// WithRegistries Sets the credentials and TLS options of the registries images are pulled from
+func WithRegistries(registries *Registries) ImageManagerOption {
+	return func(mgr *ImageManager) {
+		mgr.registries = registries
+	}
 }
 
 // NewImageManager creates a new image manager that can be used to fetch container images.
-func NewImageManager(client *containerd.Client, snapshotter string) *ImageManager {
+func NewImageManager(client *containerd.Client, snapshotter string, opts ...ImageManagerOption) *ImageManager {
 	log.Info("Creating image manager")
 	manager := new(ImageManager)
 	manager.snapshotter = snapshotter
 	manager.cachedImages = make(map[string]containerd.Image)
 	manager.imageStates = make(map[string]*ImageState)
+	manager.lazyImages = make(map[string]*LazyImage)
 	manager.client = client
+	manager.warmSet = newWarmSet()
+	// Anonymous pulls by default
+	manager.registries, _ = NewRegistries(RegistriesConfig{})
+	manager.pullPolicy = PullIfNotPresent
+	manager.retryPolicy = DefaultRetryPolicy()
+	manager.lazyFetchTimeout = DefaultLazyFetchTimeout
+
+	for _, opt := range opts {
+		opt(manager)
+	}
+
+	if manager.lazyDir != "" {
+		// The caches and overlays of a previous run are not tracked anymore
+		if err := os.RemoveAll(manager.lazyDir); err != nil {
+			log.WithError(err).Warn("Failed to remove stale caches of lazy images")
+		}
+	}
+
 	return manager
 }
 
@@ -75,27 +122,15 @@ func (mgr *ImageManager) pullImage(ctx context.Context, imageName string) error
 	var image containerd.Image
 
 	imageURL := getImageURL(imageName)
-	local, _ := isLocalDomain(imageURL)
-	if local {
-		// Pull local image using HTTP
-		resolver := docker.NewResolver(docker.ResolverOptions{
-			Client: http.DefaultClient,
-			Hosts: docker.ConfigureDefaultRegistries(
-				docker.WithPlainHTTP(docker.MatchAllHosts),
-			),
-		})
-		image, err = mgr.client.Pull(ctx, imageURL,
+	err = mgr.retryPolicy.withRetries(ctx, imageName, func() error {
+		var pullErr error
+		image, pullErr = mgr.client.Pull(ctx, imageURL,
 			containerd.WithPullUnpack,
 			containerd.WithPullSnapshotter(mgr.snapshotter),
-			containerd.WithResolver(resolver),
+			containerd.WithResolver(mgr.registries.Resolver()),
 		)
-	} else {
-		// Pull remote image
-		image, err = mgr.client.Pull(ctx, imageURL,
-			containerd.WithPullUnpack,
-			containerd.WithPullSnapshotter(mgr.snapshotter),
-		)
-	}
+		return pullErr
+	})
 	if err != nil {
 		return err
 	}
@@ -105,22 +140,54 @@ func (mgr *ImageManager) pullImage(ctx context.Context, imageName string) error
 	return nil
 }
 
-// GetImage fetches an image that can be used to create a container using containerd. Synchronization is implemented
-// on a per image level to keep waiting to a minimum.
-func (mgr *ImageManager) GetImage(ctx context.Context, imageName string) (*containerd.Image, error) {
-	// Get reference to synchronization object for image
-	mgr.Lock()
+// getImageState returns the synchronization object of an image, creating it if necessary. The caller must hold
+// the ImageManager lock
+func (mgr *ImageManager) getImageState(imageName string) *ImageState {
 	imgState, found := mgr.imageStates[imageName]
 	if !found {
 		imgState = NewImageState()
 		mgr.imageStates[imageName] = imgState
 	}
+	return imgState
+}
+
+// GetImage fetches an image that can be used to create a container using containerd. Synchronization is implemented
+// on a per image level to keep waiting to a minimum.
+func (mgr *ImageManager) GetImage(ctx context.Context, imageName string) (*containerd.Image, error) {
+	if err := mgr.checkPolicy(imageName); err != nil {
+		return nil, err
+	}
+
+	// Get reference to synchronization object for image
+	mgr.Lock()
+	imgState := mgr.getImageState(imageName)
+	imgState.lastUsed = time.Now()
+	pulls := imgState.pulls
 	mgr.Unlock()
 
 	// Pull image if necessary. The image will only be pulled by the first thread to take the lock.
 	imgState.Lock()
+	if !imgState.isCached && imgState.pulls != pulls {
+		// The pull that completed while waiting failed, which is reported rather than pulling again
+		err := imgState.pullErr
+		imgState.Unlock()
+		return nil, err
+	}
+	if imgState.isCached {
+		mgr.Lock()
+		cached := mgr.cachedImages[imageName]
+		mgr.Unlock()
+		imgState.isCached = !mgr.isStale(ctx, imageName, cached)
+	}
 	if !imgState.isCached {
-		if err := mgr.pullImage(ctx, imageName); err != nil {
+		err := mgr.pullImage(ctx, imageName)
+
+		mgr.Lock()
+		imgState.pulls++
+		imgState.pullErr = err
+		mgr.Unlock()
+
+		if err != nil {
 			imgState.Unlock()
 			return nil, err
 		}
@@ -135,6 +202,48 @@ func (mgr *ImageManager) GetImage(ctx context.Context, imageName string) (*conta
 	return &image, nil
 }
 
+// SetPullCredentials sets the credentials of the registry of an image, e.g., as passed by the kubelet
+func (mgr *ImageManager) SetPullCredentials(imageName string, creds Credentials) {
+	mgr.registries.SetPullCredentials(imageName, creds)
+}
+
+// AcquireImage fetches an image like GetImage and protects it from garbage collection until ReleaseImage is called
+func (mgr *ImageManager) AcquireImage(ctx context.Context, imageName string) (*containerd.Image, error) {
+	// The reference is taken first, so that the image cannot be evicted once fetched
+	mgr.RetainImage(imageName)
+
+	image, err := mgr.GetImage(ctx, imageName)
+	if err != nil {
+		mgr.ReleaseImage(imageName)
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// RetainImage protects an image from garbage collection, e.g., for as long as a snapshot of a VM running the
+// image exists
+func (mgr *ImageManager) RetainImage(imageName string) {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	mgr.getImageState(imageName).refs++
+}
+
+// ReleaseImage drops a reference taken by AcquireImage or RetainImage
+func (mgr *ImageManager) ReleaseImage(imageName string) {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	imgState := mgr.getImageState(imageName)
+	if imgState.refs == 0 {
+		log.WithField("image", imageName).Warn("Releasing an image that is not referenced")
+		return
+	}
+	imgState.refs--
+	imgState.lastUsed = time.Now()
+}
+
 // Converts an image name to a url if it is not a URL
 func getImageURL(image string) string {
 	// Pull from dockerhub by default if not specified (default k8s behavior)
@@ -0,0 +1,241 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ioctls and protocol of the Linux network block device driver, see linux/nbd.h
+const (
+	nbdSetSock       = 0xab00
+	nbdSetBlkSize    = 0xab01
+	nbdDoIt          = 0xab03
+	nbdClearSock     = 0xab04
+	nbdClearQue      = 0xab05
+	nbdSetSizeBlocks = 0xab07
+	nbdDisconnect    = 0xab08
+	nbdSetFlags      = 0xab0a
+
+	nbdFlagHasFlags = 1 << 0
+	nbdFlagReadOnly = 1 << 1
+
+	nbdCmdRead  = 0
+	nbdCmdDisc  = 2
+	nbdCmdFlush = 3
+
+	nbdRequestMagic = 0x25609513
+	nbdReplyMagic   = 0x67446698
+	nbdRequestSize  = 28
+)
+
+// nbdLock serializes the search for a free device
+var nbdLock sync.Mutex
+
+// nbdDevice serves a read-only block device from an io.ReaderAt, e.g., the root file system of a lazily loaded
+// image, through the network block device driver (modprobe nbd)
+type nbdDevice struct {
+	path   string
+	dev    *os.File
+	conn   net.Conn
+	source io.ReaderAt
+	done   chan struct{}
+	sendMu sync.Mutex
+}
+
+// attachNBD serves source as a block device of the given size on the first free /dev/nbdX
+func attachNBD(source io.ReaderAt, size int64) (*nbdDevice, error) {
+	nbdLock.Lock()
+	defer nbdLock.Unlock()
+
+	sysDevs, err := filepath.Glob("/sys/block/nbd*")
+	if err != nil || len(sysDevs) == 0 {
+		return nil, errors.New("no network block device found, is the nbd module loaded?")
+	}
+
+	for _, sysDev := range sysDevs {
+		// Devices in use have a server process
+		if _, err := os.Stat(filepath.Join(sysDev, "pid")); err == nil {
+			continue
+		}
+
+		d, err := connectNBD(filepath.Join("/dev", filepath.Base(sysDev)), source, size)
+		if errors.Is(err, syscall.EBUSY) {
+			continue
+		}
+		return d, err
+	}
+
+	return nil, errors.New("all network block devices are in use")
+}
+
+func connectNBD(path string, source io.ReaderAt, size int64) (_ *nbdDevice, retErr error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating socket of network block device")
+	}
+	kernelSock := os.NewFile(uintptr(fds[0]), "nbd-kernel")
+	serverSock := os.NewFile(uintptr(fds[1]), "nbd-server")
+	defer kernelSock.Close()
+	defer serverSock.Close()
+
+	dev, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = ioctl(dev, nbdClearSock, 0)
+			dev.Close()
+		}
+	}()
+
+	if err := ioctl(dev, nbdSetSock, kernelSock.Fd()); err != nil {
+		return nil, errors.Wrapf(err, "setting socket of %s", path)
+	}
+	for _, setting := range []struct{ req, val uintptr }{
+		{nbdSetBlkSize, fsBlockSize},
+		{nbdSetSizeBlocks, uintptr(size / fsBlockSize)},
+		{nbdSetFlags, nbdFlagHasFlags | nbdFlagReadOnly},
+	} {
+		if err := ioctl(dev, setting.req, setting.val); err != nil {
+			return nil, errors.Wrapf(err, "configuring %s", path)
+		}
+	}
+
+	conn, err := net.FileConn(serverSock)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &nbdDevice{
+		path:   path,
+		dev:    dev,
+		conn:   conn,
+		source: source,
+		done:   make(chan struct{}),
+	}
+
+	go d.serve()
+	go func() {
+		// The driver serves the device until it is disconnected
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if err := ioctl(dev, nbdDoIt, 0); err != nil {
+			log.WithError(err).WithField("device", path).Debug("Network block device stopped")
+		}
+		_ = ioctl(dev, nbdClearQue, 0)
+		_ = ioctl(dev, nbdClearSock, 0)
+		close(d.done)
+	}()
+
+	log.WithField("device", path).Debug("Attached network block device")
+
+	return d, nil
+}
+
+// serve answers the requests of the driver. Reads are served concurrently since they may fetch data remotely
+func (d *nbdDevice) serve() {
+	header := make([]byte, nbdRequestSize)
+	for {
+		if _, err := io.ReadFull(d.conn, header); err != nil {
+			return
+		}
+
+		be := binary.BigEndian
+		if be.Uint32(header[0:]) != nbdRequestMagic {
+			log.WithField("device", d.path).Error("Invalid request to network block device")
+			return
+		}
+		cmd := be.Uint32(header[4:]) & 0xffff
+		handle := be.Uint64(header[8:])
+		offset := int64(be.Uint64(header[16:]))
+		length := be.Uint32(header[24:])
+
+		switch cmd {
+		case nbdCmdRead:
+			go d.read(handle, offset, length)
+		case nbdCmdDisc:
+			return
+		case nbdCmdFlush:
+			d.reply(handle, 0, nil)
+		default:
+			// Writes are refused by the driver already, since the device is read-only
+			d.reply(handle, uint32(syscall.EPERM), nil)
+		}
+	}
+}
+
+func (d *nbdDevice) read(handle uint64, offset int64, length uint32) {
+	data := make([]byte, length)
+	if _, err := d.source.ReadAt(data, offset); err != nil && err != io.EOF {
+		log.WithError(err).WithFields(log.Fields{"device": d.path, "offset": offset}).Error("Failed to read block")
+		d.reply(handle, uint32(syscall.EIO), nil)
+		return
+	}
+	d.reply(handle, 0, data)
+}
+
+func (d *nbdDevice) reply(handle uint64, errno uint32, data []byte) {
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint32(header[0:], nbdReplyMagic)
+	binary.BigEndian.PutUint32(header[4:], errno)
+	binary.BigEndian.PutUint64(header[8:], handle)
+
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	if _, err := d.conn.Write(append(header, data...)); err != nil {
+		log.WithError(err).WithField("device", d.path).Debug("Failed to reply to network block device")
+	}
+}
+
+// Close disconnects the device and stops serving it
+func (d *nbdDevice) Close() error {
+	err := ioctl(d.dev, nbdDisconnect, 0)
+	<-d.done
+	d.conn.Close()
+	if closeErr := d.dev.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func ioctl(f *os.File, req, arg uintptr) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, arg); errno != 0 {
+		return fmt.Errorf("ioctl %#x: %w", req, errno)
+	}
+	return nil
+}
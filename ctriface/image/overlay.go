@@ -0,0 +1,260 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/vhive-serverless/vhive/devmapper"
+)
+
+// ErrCorruptOverlay is returned when the saved state of an overlay does not match its checksum
+var ErrCorruptOverlay = errors.New("saved overlay does not match its digest")
+
+// LazyOverlay is the writable root file system of a VM of a lazily loaded image: a device mapper snapshot of the
+// read-only device serving the image, whose copy-on-write store is a sparse file private to the VM
+type LazyOverlay struct {
+	name    string
+	image   *LazyImage
+	cowPath string
+	loopDev string
+}
+
+// NewOverlay creates a writable overlay of the root file system of the image for the VM with the given ID. The
+// overlay starts from the state saved by LazyOverlay.Save at statePath, unless it is empty, whose digest is verified
+func (img *LazyImage) NewOverlay(id, statePath, stateDigest string) (_ *LazyOverlay, retErr error) {
+	origin := img.DevicePath()
+	if origin == "" {
+		return nil, errors.Errorf("root file system of image %s is not attached", img.name)
+	}
+
+	dir := filepath.Join(img.mgr.lazyDir, "overlays")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ov := &LazyOverlay{
+		name:    "vhive-lazy-" + id,
+		image:   img,
+		cowPath: filepath.Join(dir, id+".cow"),
+	}
+
+	var err error
+	if statePath != "" {
+		err = restoreCOW(statePath, stateDigest, ov.cowPath)
+	} else {
+		err = createCOW(ov.cowPath, cowSize(img.fs.size))
+	}
+	if err != nil {
+		_ = os.Remove(ov.cowPath)
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = os.Remove(ov.cowPath)
+		}
+	}()
+
+	out, err := exec.Command("losetup", "--find", "--show", ov.cowPath).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "attaching copy-on-write store of %s", ov.name)
+	}
+	ov.loopDev = strings.TrimSpace(string(out))
+	defer func() {
+		if retErr != nil {
+			_ = exec.Command("losetup", "--detach", ov.loopDev).Run()
+		}
+	}()
+
+	// The persistent store keeps the exceptions in the file, which is what LazyOverlay.Save captures
+	table := fmt.Sprintf("0 %d snapshot %s %s P %d", img.fs.size/512, origin, ov.loopDev, fsBlockSize/512)
+	if out, err := exec.Command("dmsetup", "create", ov.name, "--table", table).CombinedOutput(); err != nil {
+		return nil, errors.Wrapf(err, "creating overlay %s: %s", ov.name, strings.TrimSpace(string(out)))
+	}
+
+	log.WithFields(log.Fields{"image": img.name, "overlay": ov.name}).Debug("Created overlay of lazy image")
+
+	return ov, nil
+}
+
+// Path returns the block device of the overlay
+func (ov *LazyOverlay) Path() string {
+	return filepath.Join("/dev/mapper", ov.name)
+}
+
+// ImageDigest returns the digest of the image the overlay is on top of
+func (ov *LazyOverlay) ImageDigest() string {
+	return ov.image.Digest().String()
+}
+
+// Save writes the blocks the VM changed to path and returns their digest. The VM must be paused
+func (ov *LazyOverlay) Save(path string) (string, error) {
+	// Suspending the overlay flushes its exceptions to the copy-on-write store
+	if out, err := exec.Command("dmsetup", "suspend", ov.name).CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "suspending overlay %s: %s", ov.name, strings.TrimSpace(string(out)))
+	}
+	defer func() {
+		if out, err := exec.Command("dmsetup", "resume", ov.name).CombinedOutput(); err != nil {
+			log.WithError(err).WithField("overlay", ov.name).Errorf("Failed to resume overlay: %s", out)
+		}
+	}()
+
+	return saveCOW(ov.cowPath, path)
+}
+
+// Remove removes the overlay and the changes of the VM
+func (ov *LazyOverlay) Remove() error {
+	if out, err := exec.Command("dmsetup", "remove", "--retry", ov.name).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "removing overlay %s: %s", ov.name, strings.TrimSpace(string(out)))
+	}
+	if err := exec.Command("losetup", "--detach", ov.loopDev).Run(); err != nil {
+		return errors.Wrapf(err, "detaching copy-on-write store of %s", ov.name)
+	}
+	return os.Remove(ov.cowPath)
+}
+
+// cowSize returns the size of the copy-on-write store of an overlay, which fits every block of the root file system
+// along with the metadata of the exceptions
+func cowSize(fsSize int64) int64 {
+	size := fsSize + fsSize/32 + 1<<20
+	return size - size%fsBlockSize
+}
+
+func createCOW(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "creating copy-on-write store")
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return errors.Wrap(err, "creating copy-on-write store")
+	}
+	return f.Close()
+}
+
+// saveCOW writes the blocks of a sparse copy-on-write store that are not zero to a patch file at path, as the size
+// of the store followed by the offset and contents of each block, and returns the checksum of the patch file
+func saveCOW(cowPath, path string) (string, error) {
+	in, err := os.Open(cowPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	return devmapper.WritePatchFile(path, func(pw io.Writer) error {
+		w := bufio.NewWriterSize(pw, 1<<20)
+		if err := binary.Write(w, binary.BigEndian, info.Size()); err != nil {
+			return err
+		}
+
+		block := make([]byte, fsBlockSize)
+		zero := make([]byte, fsBlockSize)
+		for off := int64(0); off < info.Size(); off += fsBlockSize {
+			// Holes are skipped without being read
+			data, err := unix.Seek(int(in.Fd()), off, unix.SEEK_DATA)
+			if err == unix.ENXIO {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "seeking data of copy-on-write store")
+			}
+			off = data - data%fsBlockSize
+
+			n, err := in.ReadAt(block, off)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			copy(block[n:], zero)
+			if bytes.Equal(block, zero) {
+				continue
+			}
+			if err := binary.Write(w, binary.BigEndian, off); err != nil {
+				return err
+			}
+			if _, err := w.Write(block); err != nil {
+				return err
+			}
+		}
+
+		return w.Flush()
+	})
+}
+
+// restoreCOW writes the blocks saved by saveCOW to a new sparse copy-on-write store at cowPath, once the patch file
+// is checked against its checksum
+func restoreCOW(path, expected, cowPath string) error {
+	err := devmapper.ReadPatchFile(path, expected, func(r io.Reader) error {
+		var size int64
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return errors.Wrapf(ErrCorruptOverlay, "reading size: %v", err)
+		}
+		if err := createCOW(cowPath, size); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(cowPath, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		block := make([]byte, fsBlockSize)
+		for {
+			var off int64
+			if err := binary.Read(r, binary.BigEndian, &off); err == io.EOF {
+				break
+			} else if err != nil {
+				return errors.Wrapf(ErrCorruptOverlay, "reading block offset: %v", err)
+			}
+			if _, err := io.ReadFull(r, block); err != nil {
+				return errors.Wrapf(ErrCorruptOverlay, "reading block at %d: %v", off, err)
+			}
+			if off < 0 || off+fsBlockSize > size {
+				return errors.Wrapf(ErrCorruptOverlay, "block at %d out of the store", off)
+			}
+			if _, err := out.WriteAt(block, off); err != nil {
+				return err
+			}
+		}
+
+		return out.Close()
+	})
+	if errors.Is(err, devmapper.ErrCorruptPatch) {
+		return errors.Wrapf(ErrCorruptOverlay, "%v", err)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayState(t *testing.T) {
+	dir := t.TempDir()
+	cowPath := filepath.Join(dir, "vm1.cow")
+	size := cowSize(64 * fsBlockSize)
+	require.NoError(t, createCOW(cowPath, size))
+
+	f, err := os.OpenFile(cowPath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("header"), 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(testData(fsBlockSize, 5), 40*fsBlockSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	statePath := filepath.Join(dir, "patch_file")
+	stateDigest, err := saveCOW(cowPath, statePath)
+	require.NoError(t, err)
+	info, err := os.Stat(statePath)
+	require.NoError(t, err)
+	require.Less(t, info.Size(), int64(3*fsBlockSize), "Only the blocks written should be saved")
+
+	restoredPath := filepath.Join(dir, "vm2.cow")
+	require.NoError(t, restoreCOW(statePath, stateDigest, restoredPath))
+	saved, err := os.ReadFile(cowPath)
+	require.NoError(t, err)
+	restored, err := os.ReadFile(restoredPath)
+	require.NoError(t, err)
+	require.Equal(t, saved, restored, "Restored store differs")
+
+	state, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	state[len(state)-1] ^= 1
+	require.NoError(t, os.WriteFile(statePath, state, 0644))
+	require.ErrorIs(t, restoreCOW(statePath, stateDigest, restoredPath), ErrCorruptOverlay)
+}
@@ -0,0 +1,115 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containerd/containerd"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PullPolicy Decides when the registry is queried for the image an image name refers to
+type PullPolicy string
+
+const (
+	// PullIfNotPresent pulls an image at first use and pins its name to the digest resolved then
+	PullIfNotPresent PullPolicy = "IfNotPresent"
+	// PullAlways resolves the tag at every use and pulls the image again if the tag moved to another digest
+	PullAlways PullPolicy = "Always"
+	// PullDigestOnly only accepts images referenced by digest, e.g., ghcr.io/ease-lab/helloworld@sha256:...
+	PullDigestOnly PullPolicy = "DigestOnly"
+)
+
+// ParsePullPolicy Parses the name of a pull policy
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	for _, p := range []PullPolicy{PullIfNotPresent, PullAlways, PullDigestOnly} {
+		if strings.EqualFold(s, string(p)) {
+			return p, nil
+		}
+	}
+	return "", errors.Errorf("unknown pull policy %q", s)
+}
+
+// WithPullPolicy Sets the pull policy of the images
+func WithPullPolicy(policy PullPolicy) ImageManagerOption {
+	return func(mgr *ImageManager) {
+		mgr.pullPolicy = policy
+	}
+}
+
+// GetImageDigest returns the digest of the cached image of the given name
+func (mgr *ImageManager) GetImageDigest(imageName string) (string, bool) {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	image, found := mgr.cachedImages[imageName]
+	if !found {
+		return "", false
+	}
+	return image.Target().Digest.String(), true
+}
+
+// checkPolicy returns an error if the pull policy does not accept the image name
+func (mgr *ImageManager) checkPolicy(imageName string) error {
+	if mgr.pullPolicy != PullDigestOnly {
+		return nil
+	}
+
+	named, err := refdocker.ParseDockerRef(getImageURL(imageName))
+	if err != nil {
+		return errors.Wrapf(err, "parsing image name %s", imageName)
+	}
+	if _, ok := named.(refdocker.Digested); !ok {
+		return errors.Errorf("pull policy %s requires image %s to be referenced by digest", PullDigestOnly, imageName)
+	}
+
+	return nil
+}
+
+// isStale returns true if the tag of a cached image moved to another digest since it was pulled. The caller must
+// hold the lock of the image
+func (mgr *ImageManager) isStale(ctx context.Context, imageName string, image containerd.Image) bool {
+	if mgr.pullPolicy != PullAlways {
+		return false
+	}
+
+	logger := log.WithFields(log.Fields{"image": imageName})
+
+	_, desc, err := mgr.registries.Resolver().Resolve(ctx, getImageURL(imageName))
+	if err != nil {
+		// Keep serving the cached image if the registry is unreachable
+		logger.WithError(err).Warn("Failed to resolve image, using the cached one")
+		return false
+	}
+
+	if desc.Digest != image.Target().Digest {
+		logger.WithFields(log.Fields{"old": image.Target().Digest, "new": desc.Digest}).Info("Image tag moved, pulling it again")
+		return true
+	}
+
+	return false
+}
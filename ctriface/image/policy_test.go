@@ -0,0 +1,50 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePullPolicy(t *testing.T) {
+	p, err := ParsePullPolicy("always")
+	require.NoError(t, err)
+	require.Equal(t, PullAlways, p)
+
+	_, err = ParsePullPolicy("Never")
+	require.Error(t, err, "Unknown policies should be rejected")
+}
+
+func TestPullPolicyDigestOnly(t *testing.T) {
+	mgr := NewImageManager(nil, "devmapper", WithPullPolicy(PullDigestOnly))
+
+	require.NoError(t, mgr.checkPolicy("ghcr.io/ease-lab/helloworld@sha256:"+
+		"0c35e6a7e2e1b8d4f4b2e1a0a5e2e3c47e8cd3b37c4d5a6b4f0cd3bd0e7f6e41"))
+	require.Error(t, mgr.checkPolicy("ghcr.io/ease-lab/helloworld:var_workload"), "Tags should be rejected")
+	require.Error(t, mgr.checkPolicy("vhiveease/helloworld"), "Implicit tags should be rejected")
+
+	mgr = NewImageManager(nil, "devmapper")
+	require.NoError(t, mgr.checkPolicy("ghcr.io/ease-lab/helloworld:var_workload"), "Tags are accepted by default")
+}
@@ -0,0 +1,196 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PrePullStatus Progress of the pre-pull of the warm set
+type PrePullStatus struct {
+	Total  int
+	Pulled int
+	Failed int
+	// Errors maps the images that could not be pulled to the reason
+	Errors map[string]string
+}
+
+// Ready returns true if all the images of the warm set are local
+func (s PrePullStatus) Ready() bool {
+	return s.Pulled == s.Total
+}
+
+// errPulling marks the images of the warm set that are being pulled
+var errPulling = errors.New("pull in progress")
+
+// warmSet tracks the images pre-pulled in the background
+type warmSet struct {
+	sync.Mutex
+	images  map[string]error // nil once the image is pulled
+	pending int
+	idle    chan struct{} // closed when there are no pending pulls
+}
+
+func newWarmSet() *warmSet {
+	ws := &warmSet{
+		images: make(map[string]error),
+		idle:   make(chan struct{}),
+	}
+	close(ws.idle)
+	return ws
+}
+
+// LoadWarmSet reads the names of the images to pre-pull from a file, one per line. Empty lines and lines
+// starting with # are ignored
+func LoadWarmSet(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening warm set %s", path)
+	}
+	defer f.Close()
+
+	var imageNames []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		imageNames = append(imageNames, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "reading warm set %s", path)
+	}
+
+	return imageNames, nil
+}
+
+// PrePull adds images to the warm set and pulls them in the background, at most parallelism at a time. The
+// images are unpacked into the snapshotter and protected from garbage collection. ctx must outlive the pulls,
+// images that failed to be pulled are retried by the next call
+func (mgr *ImageManager) PrePull(ctx context.Context, imageNames []string, parallelism int) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	ws := mgr.warmSet
+	ws.Lock()
+	var toPull []string
+	for _, imageName := range imageNames {
+		if err, found := ws.images[imageName]; found && (err == nil || err == errPulling) {
+			continue
+		}
+		ws.images[imageName] = errPulling
+		toPull = append(toPull, imageName)
+	}
+	if len(toPull) > 0 && ws.pending == 0 {
+		ws.idle = make(chan struct{})
+	}
+	ws.pending += len(toPull)
+	ws.Unlock()
+
+	if len(toPull) == 0 {
+		return
+	}
+	log.Infof("Pre-pulling %d images", len(toPull))
+
+	sem := make(chan struct{}, parallelism)
+	for _, imageName := range toPull {
+		go func(imageName string) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			tStart := time.Now()
+			_, err := mgr.GetImage(ctx, imageName)
+			logger := log.WithFields(log.Fields{"image": imageName})
+			if err != nil {
+				logger.WithError(err).Error("Failed to pre-pull image")
+			} else {
+				// Images of the warm set are never evicted
+				mgr.RetainImage(imageName)
+				logger.Infof("Pre-pulled image in %s", time.Since(tStart))
+			}
+
+			ws.Lock()
+			defer ws.Unlock()
+			ws.images[imageName] = err
+			ws.pending--
+			if ws.pending == 0 {
+				close(ws.idle)
+			}
+		}(imageName)
+	}
+}
+
+// GetPrePullStatus returns the progress of the pre-pull of the warm set
+func (mgr *ImageManager) GetPrePullStatus() PrePullStatus {
+	ws := mgr.warmSet
+	ws.Lock()
+	defer ws.Unlock()
+
+	status := PrePullStatus{
+		Total:  len(ws.images),
+		Errors: make(map[string]string),
+	}
+	for imageName, err := range ws.images {
+		switch err {
+		case nil:
+			status.Pulled++
+		case errPulling:
+		default:
+			status.Failed++
+			status.Errors[imageName] = err.Error()
+		}
+	}
+
+	return status
+}
+
+// WaitPrePull waits for the pending pulls of the warm set to finish and returns an error if any image could
+// not be pulled
+func (mgr *ImageManager) WaitPrePull(ctx context.Context) error {
+	ws := mgr.warmSet
+	ws.Lock()
+	idle := ws.idle
+	ws.Unlock()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if status := mgr.GetPrePullStatus(); status.Failed > 0 {
+		return errors.Errorf("failed to pre-pull %d out of %d images", status.Failed, status.Total)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadWarmSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warmset")
+	content := "# functions of the node\nghcr.io/ease-lab/helloworld:var_workload\n\n  ghcr.io/ease-lab/pyaes:var_workload  \n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	imageNames, err := LoadWarmSet(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ghcr.io/ease-lab/helloworld:var_workload", "ghcr.io/ease-lab/pyaes:var_workload"}, imageNames)
+
+	_, err = LoadWarmSet(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err, "Missing warm set should be reported")
+}
+
+func TestPrePullStatus(t *testing.T) {
+	mgr := NewImageManager(nil, "devmapper")
+	require.True(t, mgr.GetPrePullStatus().Ready(), "Empty warm set should be ready")
+	require.NoError(t, mgr.WaitPrePull(context.Background()))
+
+	// Simulate pulls in progress
+	ws := mgr.warmSet
+	ws.Lock()
+	ws.images["pulled"] = nil
+	ws.images["pulling"] = errPulling
+	ws.images["failed"] = errors.New("not found")
+	ws.pending = 1
+	ws.idle = make(chan struct{})
+	ws.Unlock()
+
+	status := mgr.GetPrePullStatus()
+	require.False(t, status.Ready(), "Warm set should not be ready while pulling")
+	require.Equal(t, PrePullStatus{Total: 3, Pulled: 1, Failed: 1, Errors: map[string]string{"failed": "not found"}}, status)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, mgr.WaitPrePull(ctx), context.DeadlineExceeded, "Wait should block on pending pulls")
+
+	ws.Lock()
+	ws.images["pulling"] = nil
+	ws.pending = 0
+	close(ws.idle)
+	ws.Unlock()
+
+	require.Error(t, mgr.WaitPrePull(context.Background()), "Failed pulls should be reported")
+}
@@ -0,0 +1,332 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	refdocker "github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const dockerHubHost = "docker.io"
+
+// Credentials Credentials of a registry. Either a username and a password or an identity token must be set
+type Credentials struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identityToken,omitempty"`
+}
+
+// RegistryHost Credentials and TLS options of a registry host
+type RegistryHost struct {
+	Credentials
+	// CAFile is a PEM bundle trusted in addition to the system CAs
+	CAFile string `json:"caFile,omitempty"`
+	// Insecure skips the verification of the certificate of the registry
+	Insecure bool `json:"insecure,omitempty"`
+	// PlainHTTP pulls over HTTP, the default for .local hosts
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+	// Mirrors are tried in order before the registry, e.g., mirror.gcr.io or http://10.0.0.5:5000
+	Mirrors []string `json:"mirrors,omitempty"`
+}
+
+// RegistriesConfig Configuration of the registries images are pulled from
+type RegistriesConfig struct {
+	// DockerConfig is the path of a docker config.json holding credentials
+	DockerConfig string `json:"dockerConfig,omitempty"`
+	// Hosts maps a registry host, e.g., ghcr.io or registry.local:5000, to its configuration
+	Hosts map[string]RegistryHost `json:"hosts,omitempty"`
+}
+
+// Registries Resolves images using the credentials of the daemon config, of docker config.json and those
+// the kubelet passes along with image pulls, in decreasing order of precedence: kubelet, daemon, docker
+type Registries struct {
+	sync.Mutex
+	hosts       map[string]RegistryHost
+	caPools     map[string]*x509.CertPool
+	dockerCreds map[string]Credentials
+	pullCreds   map[string]Credentials // set by the kubelet
+}
+
+// LoadRegistriesConfig reads the configuration of the registries from a JSON file
+func LoadRegistriesConfig(path string) (RegistriesConfig, error) {
+	var cfg RegistriesConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Wrapf(err, "reading registries config %s", path)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.Wrapf(err, "parsing registries config %s", path)
+	}
+
+	return cfg, nil
+}
+
+// NewRegistries creates the registries of a config, loading the CA bundles and the docker credentials
+func NewRegistries(cfg RegistriesConfig) (*Registries, error) {
+	r := &Registries{
+		hosts:       make(map[string]RegistryHost),
+		caPools:     make(map[string]*x509.CertPool),
+		dockerCreds: make(map[string]Credentials),
+		pullCreds:   make(map[string]Credentials),
+	}
+
+	for host, hostCfg := range cfg.Hosts {
+		host = normalizeHost(host)
+		r.hosts[host] = hostCfg
+
+		if hostCfg.CAFile == "" {
+			continue
+		}
+		pem, err := os.ReadFile(hostCfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading CA of registry %s", host)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in CA %s of registry %s", hostCfg.CAFile, host)
+		}
+		r.caPools[host] = pool
+	}
+
+	if cfg.DockerConfig != "" {
+		dockerCreds, err := loadDockerConfig(cfg.DockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		r.dockerCreds = dockerCreds
+	}
+
+	return r, nil
+}
+
+// SetPullCredentials sets the credentials of the registry of an image, as passed by the kubelet
+func (r *Registries) SetPullCredentials(imageName string, creds Credentials) {
+	host := getImageHost(imageName)
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.pullCreds[host] = creds
+}
+
+// Resolver returns a resolver of image references that authenticates to the registries
+func (r *Registries) Resolver() remotes.Resolver {
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: r.registryHosts,
+	})
+}
+
+func (r *Registries) registryHosts(host string) ([]docker.RegistryHost, error) {
+	r.Lock()
+	mirrors := r.hosts[normalizeHost(host)].Mirrors
+	r.Unlock()
+
+	// Mirrors are tried first, in order, before falling back to the registry itself
+	var hosts []docker.RegistryHost
+	for _, mirror := range mirrors {
+		scheme, mirrorHost := "", mirror
+		if i := strings.Index(mirror, "://"); i >= 0 {
+			scheme, mirrorHost = mirror[:i], mirror[i+3:]
+		}
+		mirrorHost = strings.TrimSuffix(mirrorHost, "/")
+
+		client, authorizer, plainHTTP := r.getClient(mirrorHost)
+		if scheme == "" {
+			scheme = "https"
+			if plainHTTP {
+				scheme = "http"
+			}
+		}
+		hosts = append(hosts, docker.RegistryHost{
+			Client:       client,
+			Authorizer:   authorizer,
+			Host:         mirrorHost,
+			Scheme:       scheme,
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+		})
+	}
+
+	client, authorizer, plainHTTP := r.getClient(host)
+	registryHosts, err := docker.ConfigureDefaultRegistries(
+		docker.WithClient(client),
+		docker.WithAuthorizer(authorizer),
+		docker.WithPlainHTTP(func(string) (bool, error) { return plainHTTP, nil }),
+	)(host)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(hosts, registryHosts...), nil
+}
+
+// getClient returns the HTTP client and the authorizer of a registry host, and whether it is reached over HTTP
+func (r *Registries) getClient(host string) (*http.Client, docker.Authorizer, bool) {
+	r.Lock()
+	hostCfg := r.hosts[normalizeHost(host)]
+	caPool := r.caPools[normalizeHost(host)]
+	r.Unlock()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig: &tls.Config{
+				RootCAs:            caPool,
+				InsecureSkipVerify: hostCfg.Insecure,
+			},
+		},
+	}
+	authorizer := docker.NewDockerAuthorizer(
+		docker.WithAuthClient(client),
+		docker.WithAuthCreds(r.getCredentials),
+	)
+
+	plainHTTP := hostCfg.PlainHTTP
+	if local, _ := isLocalDomain(host); local {
+		plainHTTP = true
+	}
+
+	return client, authorizer, plainHTTP
+}
+
+// getCredentials returns the username and the secret of a registry host. An empty username makes the secret
+// an identity token
+func (r *Registries) getCredentials(host string) (string, string, error) {
+	host = normalizeHost(host)
+
+	r.Lock()
+	defer r.Unlock()
+
+	creds, found := r.pullCreds[host]
+	if !found {
+		var hostCfg RegistryHost
+		if hostCfg, found = r.hosts[host]; found {
+			creds = hostCfg.Credentials
+		}
+	}
+	if !found || creds == (Credentials{}) {
+		creds = r.dockerCreds[host]
+	}
+
+	if creds.IdentityToken != "" {
+		return "", creds.IdentityToken, nil
+	}
+	return creds.Username, creds.Password, nil
+}
+
+// dockerConfig is the subset of docker config.json holding credentials
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+}
+
+// loadDockerConfig reads the credentials of a docker config.json, indexed by registry host
+func loadDockerConfig(path string) (map[string]Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading docker config %s", path)
+	}
+
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "parsing docker config %s", path)
+	}
+
+	creds := make(map[string]Credentials)
+	for server, entry := range cfg.Auths {
+		c := Credentials{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+		}
+		if entry.Auth != "" {
+			if c.Username, c.Password, err = decodeAuth(entry.Auth); err != nil {
+				log.WithError(err).Warnf("Ignoring invalid credentials of %s in docker config", server)
+				continue
+			}
+		}
+		creds[normalizeHost(server)] = c
+	}
+
+	return creds, nil
+}
+
+// decodeAuth decodes base64 encoded "username:password" credentials
+func decodeAuth(auth string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", "", err
+	}
+
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return "", "", errors.New("credentials must be formatted as username:password")
+	}
+
+	return username, password, nil
+}
+
+// normalizeHost strips the scheme and the path of a registry address and maps the aliases of Docker Hub
+func normalizeHost(server string) string {
+	if i := strings.Index(server, "://"); i >= 0 {
+		server = server[i+3:]
+	}
+	server, _, _ = strings.Cut(server, "/")
+
+	switch server {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHubHost
+	}
+	return server
+}
+
+// getImageHost returns the registry host of an image
+func getImageHost(imageName string) string {
+	named, err := refdocker.ParseDockerRef(imageName)
+	if err != nil {
+		return normalizeHost(getImageURL(imageName))
+	}
+	return normalizeHost(refdocker.Domain(named))
+}
@@ -0,0 +1,86 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	require.Equal(t, "docker.io", normalizeHost("https://index.docker.io/v1/"))
+	require.Equal(t, "docker.io", normalizeHost("registry-1.docker.io"))
+	require.Equal(t, "registry.local:5000", normalizeHost("http://registry.local:5000"))
+
+	require.Equal(t, "docker.io", getImageHost("vhiveease/helloworld:var_workload"))
+	require.Equal(t, "ghcr.io", getImageHost("ghcr.io/ease-lab/helloworld:var_workload"))
+}
+
+func TestRegistriesCredentials(t *testing.T) {
+	dockerConfig := filepath.Join(t.TempDir(), "config.json")
+	// "docker:secret" and "ghcr:docker" in base64
+	content := `{"auths": {"https://index.docker.io/v1/": {"auth": "ZG9ja2VyOnNlY3JldA=="}, "ghcr.io": {"auth": "Z2hjcjpkb2NrZXI="}}}`
+	require.NoError(t, os.WriteFile(dockerConfig, []byte(content), 0600))
+
+	r, err := NewRegistries(RegistriesConfig{
+		DockerConfig: dockerConfig,
+		Hosts: map[string]RegistryHost{
+			"ghcr.io":        {Credentials: Credentials{Username: "ghcr", Password: "daemon"}},
+			"quay.io":        {Credentials: Credentials{IdentityToken: "token"}},
+			"registry.local": {Insecure: true},
+		},
+	})
+	require.NoError(t, err)
+
+	username, secret, err := r.getCredentials("registry-1.docker.io")
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker", "secret"}, []string{username, secret}, "Docker config should be used by default")
+
+	username, secret, _ = r.getCredentials("ghcr.io")
+	require.Equal(t, []string{"ghcr", "daemon"}, []string{username, secret}, "Daemon config should take precedence")
+
+	r.SetPullCredentials("ghcr.io/ease-lab/helloworld:var_workload", Credentials{Username: "ghcr", Password: "kubelet"})
+	username, secret, _ = r.getCredentials("ghcr.io")
+	require.Equal(t, []string{"ghcr", "kubelet"}, []string{username, secret}, "Kubelet credentials should take precedence")
+
+	username, secret, _ = r.getCredentials("quay.io")
+	require.Equal(t, []string{"", "token"}, []string{username, secret}, "Identity tokens have no username")
+
+	username, secret, _ = r.getCredentials("registry.local")
+	require.Empty(t, username+secret, "Hosts without credentials should be pulled anonymously")
+
+	hosts, err := r.registryHosts("registry.local")
+	require.NoError(t, err)
+	require.Equal(t, "http", hosts[0].Scheme, ".local hosts should be pulled over HTTP")
+}
+
+func TestRegistriesInvalidCA(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+
+	_, err := NewRegistries(RegistriesConfig{Hosts: map[string]RegistryHost{"registry.example.com": {CAFile: caFile}}})
+	require.Error(t, err, "CA bundles without certificates should be rejected")
+}
@@ -0,0 +1,180 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+// PullErrKind Class of the failure of an image pull
+type PullErrKind string
+
+const (
+	// PullErrAuth is returned when the registry rejects the credentials or the lack thereof
+	PullErrAuth PullErrKind = "unauthorized"
+	// PullErrNotFound is returned when the image does not exist
+	PullErrNotFound PullErrKind = "not found"
+	// PullErrTransient is returned when the registry could not be reached, after retries
+	PullErrTransient PullErrKind = "transient"
+	// PullErrUnknown is returned for the failures that are not classified
+	PullErrUnknown PullErrKind = "unknown"
+)
+
+// PullErr Failure of the pull of an image
+type PullErr struct {
+	Image    string
+	Kind     PullErrKind
+	Attempts int
+	Err      error
+}
+
+func (e *PullErr) Error() string {
+	return fmt.Sprintf("pull of image %s failed (%s) after %d attempt(s): %v", e.Image, e.Kind, e.Attempts, e.Err)
+}
+
+func (e *PullErr) Unwrap() error {
+	return e.Err
+}
+
+// Code returns the gRPC code reported to the callers of the CRI
+func (e *PullErr) Code() codes.Code {
+	switch e.Kind {
+	case PullErrAuth:
+		return codes.PermissionDenied
+	case PullErrNotFound:
+		return codes.NotFound
+	case PullErrTransient:
+		return codes.Unavailable
+	default:
+		return codes.Unknown
+	}
+}
+
+// RetryPolicy Retries of the pulls that fail for transient reasons, with exponential backoff
+type RetryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy Returns the retry policy used unless configured otherwise
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:       4,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// WithRetryPolicy Sets the retries of the pulls that fail for transient reasons
+func WithRetryPolicy(policy RetryPolicy) ImageManagerOption {
+	return func(mgr *ImageManager) {
+		mgr.retryPolicy = policy
+	}
+}
+
+// backoff returns the delay before the given retry, starting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// withRetries runs pull until it succeeds, fails for a reason that is not transient or runs out of attempts
+func (p RetryPolicy) withRetries(ctx context.Context, imageName string, pull func() error) error {
+	logger := log.WithFields(log.Fields{"image": imageName})
+
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := pull()
+		if err == nil {
+			return nil
+		}
+
+		kind := classifyPullErr(err)
+		if kind != PullErrTransient || attempt == attempts || ctx.Err() != nil {
+			return &PullErr{Image: imageName, Kind: kind, Attempts: attempt, Err: err}
+		}
+
+		backoff := p.backoff(attempt)
+		logger.WithError(err).Warnf("Pull failed, retrying in %s", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return &PullErr{Image: imageName, Kind: kind, Attempts: attempt, Err: err}
+		}
+	}
+}
+
+// classifyPullErr tells authorization failures, missing images and transient failures apart
+func classifyPullErr(err error) PullErrKind {
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden:
+			return PullErrAuth
+		case statusErr.StatusCode == http.StatusNotFound:
+			return PullErrNotFound
+		case statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500:
+			return PullErrTransient
+		default:
+			return PullErrUnknown
+		}
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, docker.ErrInvalidAuthorization):
+		return PullErrAuth
+	case errdefs.IsNotFound(err):
+		return PullErrNotFound
+	case errdefs.IsUnavailable(err), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED), errors.As(err, &netErr):
+		return PullErrTransient
+	default:
+		return PullErrUnknown
+	}
+}
@@ -0,0 +1,102 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestClassifyPullErr(t *testing.T) {
+	require.Equal(t, PullErrAuth, classifyPullErr(fmt.Errorf("pull access denied: %w", docker.ErrInvalidAuthorization)))
+	require.Equal(t, PullErrAuth, classifyPullErr(remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusForbidden}))
+	require.Equal(t, PullErrNotFound, classifyPullErr(fmt.Errorf("ghcr.io/ease-lab/missing:latest: %w", errdefs.ErrNotFound)))
+	require.Equal(t, PullErrTransient, classifyPullErr(remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusTooManyRequests}))
+	require.Equal(t, PullErrTransient, classifyPullErr(remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusBadGateway}))
+	require.Equal(t, PullErrTransient, classifyPullErr(errdefs.ErrUnavailable))
+	require.Equal(t, PullErrUnknown, classifyPullErr(errors.New("unexpected media type")))
+}
+
+func TestPullRetries(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	require.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 2 * time.Millisecond},
+		[]time.Duration{policy.backoff(1), policy.backoff(2), policy.backoff(3)}, "Backoff should double up to the max")
+
+	attempts := 0
+	err := policy.withRetries(context.Background(), "img", func() error {
+		attempts++
+		if attempts < 3 {
+			return errdefs.ErrUnavailable
+		}
+		return nil
+	})
+	require.NoError(t, err, "Transient failures should be retried")
+	require.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = policy.withRetries(context.Background(), "img", func() error {
+		attempts++
+		return errdefs.ErrUnavailable
+	})
+	var pullErr *PullErr
+	require.ErrorAs(t, err, &pullErr)
+	require.Equal(t, PullErr{Image: "img", Kind: PullErrTransient, Attempts: 3, Err: errdefs.ErrUnavailable}, *pullErr)
+	require.Equal(t, codes.Unavailable, pullErr.Code())
+
+	attempts = 0
+	err = policy.withRetries(context.Background(), "img", func() error {
+		attempts++
+		return docker.ErrInvalidAuthorization
+	})
+	require.ErrorAs(t, err, &pullErr)
+	require.Equal(t, PullErrAuth, pullErr.Kind)
+	require.Equal(t, 1, attempts, "Authorization failures should not be retried")
+}
+
+func TestRegistryMirrors(t *testing.T) {
+	r, err := NewRegistries(RegistriesConfig{
+		Hosts: map[string]RegistryHost{
+			"docker.io":     {Mirrors: []string{"mirror.gcr.io", "http://10.0.0.5:5000/"}},
+			"mirror.gcr.io": {Credentials: Credentials{Username: "mirror", Password: "secret"}},
+		},
+	})
+	require.NoError(t, err)
+
+	hosts, err := r.registryHosts("docker.io")
+	require.NoError(t, err)
+	require.Len(t, hosts, 3, "Mirrors should precede the registry")
+	require.Equal(t, []string{"mirror.gcr.io", "10.0.0.5:5000", "registry-1.docker.io"},
+		[]string{hosts[0].Host, hosts[1].Host, hosts[2].Host})
+	require.Equal(t, []string{"https", "http", "https"}, []string{hosts[0].Scheme, hosts[1].Scheme, hosts[2].Scheme})
+	require.False(t, hosts[0].Capabilities.Has(docker.HostCapabilityPush), "Mirrors should only be pulled from")
+}
@@ -0,0 +1,314 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/vhive-serverless/vhive/misc"
+)
+
+const (
+	// shimBaseDir is where firecracker-containerd creates the directory of each VM, whose rootfs folder is
+	// the chroot of the jailed Firecracker process
+	shimBaseDir = "/var/lib/firecracker-containerd/shim-base"
+
+	// SeccompNone disables the seccomp filters of Firecracker
+	SeccompNone = 0
+	// SeccompBasic only filters syscalls
+	SeccompBasic = 1
+	// SeccompAdvanced filters syscalls and their arguments
+	SeccompAdvanced = 2
+)
+
+// JailerConfig Configures how the Firecracker process of each VM is jailed. Every VM gets its own chroot under
+// the shim directory of firecracker-containerd, which is populated by firecracker-containerd, and its own user. The
+// files of the VM created or loaded by vHive (snapshot and memory files, drives and the container device) are staged
+// into its chroot at their usual paths while Firecracker opens them, so that a VM can reach no other VM's files.
+type JailerConfig struct {
+	// UID of the first jailed VM, which cannot be 0. Each VM runs as its own user, allocated among the IDs
+	// consecutive ones
+	UID uint32
+	IDs uint32
+	// GID is the group shared by the jailed VMs, which cannot be 0. The files of snapshots belong to the group, so
+	// that VMs loaded from a snapshot can read the files staged into their jail, while other users cannot
+	GID uint32
+	// CgroupPath is the parent of the cgroups of the jailed VMs
+	CgroupPath string
+	// CPUs and Mems restrict the cpuset of the jailed VMs (cpuset list format)
+	CPUs string
+	Mems string
+	// SeccompLevel of Firecracker. firecracker-containerd builds the command line of the jailed Firecracker,
+	// which always runs with its built-in advanced filters, hence other levels cannot be honoured
+	SeccompLevel int
+}
+
+func (c *JailerConfig) validate() error {
+	if c.UID == 0 || c.GID == 0 {
+		return errors.Errorf("jailed VMs cannot run as %d:%d", c.UID, c.GID)
+	}
+	if c.IDs == 0 || c.UID+c.IDs < c.UID {
+		return errors.Errorf("jailed VMs need a range of UIDs from %d, not %d", c.UID, c.IDs)
+	}
+
+	if c.SeccompLevel != SeccompAdvanced {
+		return errors.Errorf("seccomp level %d is not supported for jailed VMs, only %d is", c.SeccompLevel, SeccompAdvanced)
+	}
+
+	return nil
+}
+
+// GetJailerEnabled Returns whether VMs are run under the jailer
+func (o *Orchestrator) GetJailerEnabled() bool {
+	return o.jailerConfig != nil
+}
+
+// GetJailRoot Returns the chroot of the Firecracker process of a jailed VM
+func GetJailRoot(vmID string) string {
+	return filepath.Join(shimBaseDir, namespaceName+"#"+vmID, "rootfs")
+}
+
+// jailUsers allocates the users of the jailed VMs, as offsets from the base UID
+type jailUsers struct {
+	sync.Mutex
+	size  uint32
+	next  uint32
+	free  []uint32
+	users map[string]uint32 // vmID -> offset
+}
+
+func newJailUsers(size uint32) *jailUsers {
+	return &jailUsers{size: size, users: make(map[string]uint32)}
+}
+
+// allocate returns the offset of the user of a VM, allocating one if the VM has none yet
+func (u *jailUsers) allocate(vmID string) (uint32, error) {
+	u.Lock()
+	defer u.Unlock()
+
+	if offset, ok := u.users[vmID]; ok {
+		return offset, nil
+	}
+
+	var offset uint32
+	switch {
+	case len(u.free) > 0:
+		offset = u.free[len(u.free)-1]
+		u.free = u.free[:len(u.free)-1]
+	case u.next < u.size:
+		offset = u.next
+		u.next++
+	default:
+		return 0, errors.Errorf("all %d users of jailed VMs are in use", u.size)
+	}
+	u.users[vmID] = offset
+
+	return offset, nil
+}
+
+// release frees the user of a stopped VM
+func (u *jailUsers) release(vmID string) {
+	u.Lock()
+	defer u.Unlock()
+
+	if offset, ok := u.users[vmID]; ok {
+		delete(u.users, vmID)
+		u.free = append(u.free, offset)
+	}
+}
+
+// getJailUser Returns the UID and GID of a jailed VM, allocating its user on first use
+func (o *Orchestrator) getJailUser(vmID string) (int, int, error) {
+	offset, err := o.jailUsers.allocate(vmID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(o.jailerConfig.UID + offset), int(o.jailerConfig.GID), nil
+}
+
+// releaseJailUser Frees the user of a stopped VM
+func (o *Orchestrator) releaseJailUser(vmID string) {
+	if o.jailerConfig != nil {
+		o.jailUsers.release(vmID)
+	}
+}
+
+func (o *Orchestrator) getJailerConfig(vm *misc.VM) (*proto.JailerConfig, error) {
+	uid, gid, err := o.getJailUser(vm.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &proto.JailerConfig{
+		NetNS:             vm.GetNetworkNamespace(),
+		UID:               uint32(uid),
+		GID:               uint32(gid),
+		CgroupPath:        o.jailerConfig.CgroupPath,
+		CPUs:              o.jailerConfig.CPUs,
+		Mems:              o.jailerConfig.Mems,
+		DriveExposePolicy: proto.DriveExposePolicy_BIND,
+	}
+
+	// runc creates the cgroup of the VM, which is then accounted as the other VMs
+	if o.isCgroupsEnabled {
+		cfg.CgroupPath = "/" + vhiveCgroup
+	}
+
+	return cfg, nil
+}
+
+// jailStage holds the host files staged into the chroot of a jailed VM. Block devices are created with mknod, and
+// other files and directories are bind-mounted, read-only unless they are written by Firecracker. They are removed by
+// unstage once Firecracker opened them, before firecracker-containerd removes the chroot with the VM
+type jailStage struct {
+	root     string
+	uid, gid int
+	mounts   []string
+	nodes    []string
+}
+
+// newJailStage Returns the stage of the files of a VM, which is nil if VMs are not jailed
+func (o *Orchestrator) newJailStage(vmID string) (*jailStage, error) {
+	if o.jailerConfig == nil {
+		return nil, nil
+	}
+
+	uid, gid, err := o.getJailUser(vmID)
+	if err != nil {
+		return nil, err
+	}
+	return &jailStage{root: GetJailRoot(vmID), uid: uid, gid: gid}, nil
+}
+
+// add Stages host paths at the same paths in the chroot. The owner of writable paths becomes the user of the VM
+func (s *jailStage) add(writable bool, paths ...string) error {
+	if s == nil {
+		return nil
+	}
+
+	for _, path := range paths {
+		var stat unix.Stat_t
+		if err := unix.Stat(path, &stat); err != nil {
+			return errors.Wrapf(err, "staging %s into the jail", path)
+		}
+
+		dst := filepath.Join(s.root, path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return errors.Wrapf(err, "staging %s into the jail", path)
+		}
+
+		var err error
+		switch stat.Mode & unix.S_IFMT {
+		case unix.S_IFBLK:
+			err = s.addDevice(dst, stat)
+		case unix.S_IFDIR:
+			err = s.addMount(path, dst, writable, true)
+		default:
+			err = s.addMount(path, dst, writable, false)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "staging %s into the jail", path)
+		}
+	}
+
+	return nil
+}
+
+// addDevice creates the node of a block device, only accessible to the user of the VM, not to its group
+func (s *jailStage) addDevice(dst string, stat unix.Stat_t) error {
+	_ = os.Remove(dst)
+	if err := unix.Mknod(dst, unix.S_IFBLK|0600, int(stat.Rdev)); err != nil {
+		return err
+	}
+	s.nodes = append(s.nodes, dst)
+
+	return os.Chown(dst, s.uid, s.gid)
+}
+
+// addMount bind-mounts a file or directory
+func (s *jailStage) addMount(src, dst string, writable, isDir bool) error {
+	if isDir {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+	} else if f, err := os.OpenFile(dst, os.O_CREATE|os.O_RDONLY, 0644); err != nil {
+		return err
+	} else {
+		f.Close()
+	}
+
+	if err := unix.Mount(src, dst, "", unix.MS_BIND, ""); err != nil {
+		return err
+	}
+	s.mounts = append(s.mounts, dst)
+
+	if writable {
+		return os.Chown(src, s.uid, s.gid)
+	}
+	return unix.Mount("", dst, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, "")
+}
+
+// unstage Removes the staged files from the chroot. The mount points are only removed once unmounted, since
+// removing a directory recursively through its mount would remove the files of the host
+func (s *jailStage) unstage() {
+	if s == nil {
+		return
+	}
+
+	for i := len(s.mounts) - 1; i >= 0; i-- {
+		if err := unix.Unmount(s.mounts[i], unix.MNT_DETACH); err != nil {
+			log.WithError(err).WithField("path", s.mounts[i]).Warn("failed to unmount file staged into the jail")
+			continue
+		}
+		_ = os.Remove(s.mounts[i])
+	}
+	for _, node := range s.nodes {
+		_ = os.Remove(node)
+	}
+	s.mounts, s.nodes = nil, nil
+}
+
+// reclaimFromJail Gives the files written by a jailed Firecracker process back to root, only readable by the group
+// of the jailed VMs they are staged into later on, e.g., the files of a snapshot loaded by other VMs
+func reclaimFromJail(dir string, gid int) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, 0, gid); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return os.Chmod(path, 0750)
+		}
+		return os.Chmod(path, 0640)
+	})
+}
@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJailerConfigValidate(t *testing.T) {
+	cfg := JailerConfig{UID: 10000, GID: 10000, IDs: 1024, SeccompLevel: SeccompAdvanced}
+	require.NoError(t, cfg.validate(), "Valid jailer config rejected")
+
+	cfg.UID = 0
+	require.Error(t, cfg.validate(), "Jailed VMs must not run as root")
+
+	cfg.UID = 10000
+	cfg.IDs = 0
+	require.Error(t, cfg.validate(), "Jailed VMs need their own users")
+
+	cfg.IDs = 1024
+	cfg.GID = 0
+	require.Error(t, cfg.validate(), "Jailed VMs must not share the root group")
+
+	cfg.GID = 10000
+	cfg.SeccompLevel = SeccompBasic
+	require.Error(t, cfg.validate(), "Seccomp level that cannot be honoured should be rejected")
+
+	require.Equal(t, "/var/lib/firecracker-containerd/shim-base/firecracker-containerd#1/rootfs", GetJailRoot("1"))
+}
+
+func TestJailUsers(t *testing.T) {
+	users := newJailUsers(2)
+
+	first, err := users.allocate("1")
+	require.NoError(t, err)
+	second, err := users.allocate("2")
+	require.NoError(t, err)
+	require.NotEqual(t, first, second, "VMs should run as distinct users")
+
+	again, err := users.allocate("1")
+	require.NoError(t, err)
+	require.Equal(t, first, again, "A VM should keep its user")
+
+	_, err = users.allocate("3")
+	require.Error(t, err, "Users should not be shared once all are in use")
+
+	users.release("1")
+	third, err := users.allocate("3")
+	require.NoError(t, err)
+	require.Equal(t, first, third, "Users of stopped VMs should be reused")
+}
+
+func TestJailStageNoJailer(t *testing.T) {
+	stage, err := (&Orchestrator{}).newJailStage("1")
+	require.NoError(t, err)
+	require.NoError(t, stage.add(true, "/missing"), "Nothing is staged for VMs that are not jailed")
+	stage.unstage()
+}
+
+func TestJailStage(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Staging files into a jail requires root")
+	}
+
+	snapDir := filepath.Join(t.TempDir(), "snapshot")
+	memFile := filepath.Join(snapDir, "mem_file")
+	require.NoError(t, os.MkdirAll(snapDir, 0755))
+	require.NoError(t, os.WriteFile(memFile, []byte("mem"), 0644))
+
+	stage := &jailStage{root: t.TempDir(), uid: 10001, gid: 10001}
+	require.NoError(t, stage.add(false, memFile))
+	jailedMemFile := filepath.Join(stage.root, memFile)
+	data, err := os.ReadFile(jailedMemFile)
+	require.NoError(t, err)
+	require.Equal(t, "mem", string(data), "Staged file should be reachable in the jail")
+	require.Error(t, os.WriteFile(jailedMemFile, []byte("x"), 0644), "Read-only files should not be writable in the jail")
+
+	stage.unstage()
+	_, err = os.Stat(jailedMemFile)
+	require.True(t, os.IsNotExist(err), "Unstaged file should be removed from the jail")
+	data, err = os.ReadFile(memFile)
+	require.NoError(t, err)
+	require.Equal(t, "mem", string(data), "Unstaging should leave the file of the host alone")
+}
+
+func TestReclaimFromJail(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Reclaiming files from a jail requires root")
+	}
+
+	snapDir := filepath.Join(t.TempDir(), "snapshot")
+	memFile := filepath.Join(snapDir, "mem_file")
+	require.NoError(t, os.MkdirAll(snapDir, 0700))
+	require.NoError(t, os.WriteFile(memFile, []byte("mem"), 0600))
+	require.NoError(t, os.Chown(snapDir, 10001, 10001))
+	require.NoError(t, os.Chown(memFile, 10001, 10001))
+
+	require.NoError(t, reclaimFromJail(snapDir, 10000), "Failed to reclaim snapshot")
+
+	for path, mode := range map[string]os.FileMode{snapDir: 0750, memFile: 0640} {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, mode, info.Mode().Perm(), "%s should only be readable by the group of the jailed VMs", path)
+		st := info.Sys().(*syscall.Stat_t)
+		require.Equal(t, uint32(0), st.Uid, "%s should belong to root", path)
+		require.Equal(t, uint32(10000), st.Gid, "%s should belong to the group of the jailed VMs", path)
+	}
+}
@@ -23,6 +23,7 @@
 package ctriface
 
 import (
+	"context"
 	"github.com/vhive-serverless/vhive/devmapper"
 	"os"
 	"os/signal"
@@ -35,6 +36,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
 
 	fcclient "github.com/firecracker-microvm/firecracker-containerd/firecracker-control/client"
 	// note: from the original repo
@@ -46,6 +48,8 @@ import (
 	"github.com/vhive-serverless/vhive/memory/manager"
 	"github.com/vhive-serverless/vhive/metrics"
 	"github.com/vhive-serverless/vhive/misc"
+	"github.com/vhive-serverless/vhive/profile"
+	"github.com/vhive-serverless/vhive/snapshotting"
 
 	_ "github.com/davecgh/go-spew/spew" //tmp
 )
@@ -75,21 +79,53 @@ func (wio WorkloadIoWriter) Write(p []byte) (n int, err error) {
 
 // Orchestrator Drives all VMs
 type Orchestrator struct {
-	vmPool       *misc.VMPool
-	cachedImages map[string]containerd.Image
-	workloadIo   sync.Map // vmID string -> WorkloadIoWriter
-	snapshotter  string
-	client       *containerd.Client
-	fcClient     *fcclient.Client
-	devMapper    *devmapper.DeviceMapper
-	imageManager *image.ImageManager
+	vmPool         *misc.VMPool
+	cachedImages   map[string]containerd.Image
+	workloadIo     sync.Map // vmID string -> WorkloadIoWriter
+	snapshotter    string
+	client         *containerd.Client
+	fcClient       *fcclient.Client
+	devMapper      *devmapper.DeviceMapper
+	patchMode      devmapper.PatchMode
+	devicePool     devmapper.DevicePoolPolicy
+	thinPoolPolicy *devmapper.ThinPoolPolicy
+	imageManager   *image.ImageManager
 	// store *skv.KVStore
 	snapshotsEnabled bool
 	isUPFEnabled     bool
 	isLazyMode       bool
 	snapshotsDir     string
+	keepSnapshots    bool
+	snapshotBudget   int64
+	evictionPolicy   snapshotting.EvictionPolicy
+	snapshotStore    snapshotting.SnapshotStore
+	snapshotVersions int
+	resnapshotLoads  int
 	isMetricsMode    bool
 	netPoolSize      int
+	readinessProbe   *ReadinessProbe
+	cpuPolicy        CPUPolicy
+	cpuAllocator     *cpuAllocator
+	isBalloonEnabled bool
+	isCgroupsEnabled bool
+	jailerConfig     *JailerConfig
+	jailUsers        *jailUsers
+	timeouts         TimeoutProfile
+	imageGCPolicy    *image.GCPolicy
+	warmSet          []string
+	registries       *image.Registries
+	pullPolicy       image.PullPolicy
+	pullRetries      *image.RetryPolicy
+	prePullWorkers   int
+	isLazyPull       bool
+	lazyDir          string
+	lazyFetchTimeout time.Duration
+	lazyCacheBudget  int64
+	lazyOverlays     sync.Map // vmID string -> *image.LazyOverlay
+	drivesDir        string
+	driveImageRoot   string
+	vmDrives         sync.Map // vmID string -> []*vmDrive
+	drivePathLocks   sync.Map // host path string -> *sync.Mutex, serializes the loads sharing the paths of drives
 
 	memoryManager *manager.MemoryManager
 }
@@ -102,7 +138,13 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 	o.cachedImages = make(map[string]containerd.Image)
 	o.snapshotter = snapshotter
 	o.snapshotsDir = "/fccd/snapshots"
+	o.drivesDir = "/fccd/drives"
+	o.lazyDir = "/fccd/lazy"
+	o.timeouts = DefaultTimeoutProfile()
 	o.netPoolSize = 10
+	o.prePullWorkers = 4
+	o.patchMode = devmapper.PatchModeFile
+	o.snapshotVersions = snapshotting.DefaultRetainedVersions
 
 	for _, opt := range opts {
 		opt(o)
@@ -120,6 +162,44 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 		log.Panicf("Failed to create snapshots dir %s", o.snapshotsDir)
 	}
 
+	if err := os.MkdirAll(o.drivesDir, 0777); err != nil {
+		log.Panicf("Failed to create drives dir %s", o.drivesDir)
+	}
+
+	if o.cpuPolicy != CPUPolicyNone {
+		// Only the cpuset of the cgroup of a VM holds the threads Firecracker creates after the VM is placed
+		if !o.isCgroupsEnabled {
+			log.Panic("Placing VMs on CPUs requires cgroups")
+		}
+		cpuInfo, err := profile.GetCPUInfo()
+		if err != nil {
+			log.Panicf("Failed to read CPU topology: %v", err)
+		}
+		sockets, err := cpuTopology(cpuInfo)
+		if err != nil {
+			log.Panicf("Failed to read CPU topology: %v", err)
+		}
+		o.cpuAllocator = newCPUAllocator(o.cpuPolicy, sockets)
+	}
+
+	if o.jailerConfig != nil {
+		if err := o.jailerConfig.validate(); err != nil {
+			log.Panicf("Invalid jailer config: %v", err)
+		}
+		o.jailUsers = newJailUsers(o.jailerConfig.IDs)
+	}
+
+	if o.isCgroupsEnabled {
+		// Firecracker is spawned in the cgroup of its VM by the jailer. Moving it there later would leave the memory
+		// charged before the move, e.g., the guest memory of loaded snapshots, to the cgroup of the shim
+		if o.jailerConfig == nil {
+			log.Panic("Accounting VMs in cgroups requires the jailer")
+		}
+		if err := setupCgroups(); err != nil {
+			log.Panicf("Failed to set up cgroups: %v", err)
+		}
+	}
+
 	if o.GetUPFEnabled() {
 		managerCfg := manager.MemoryManagerCfg{
 			MetricsModeOn: o.isMetricsMode,
@@ -141,8 +221,64 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 	}
 	log.Info("Created firecracker client")
 
-	o.devMapper = devmapper.NewDeviceMapper(o.client)
-	o.imageManager = image.NewImageManager(o.client, o.snapshotter)
+	o.devMapper = devmapper.NewDeviceMapper(o.client,
+		devmapper.WithPatchMode(o.patchMode),
+		devmapper.WithDevicePool(o.devicePool),
+	)
+	var imageOpts []image.ImageManagerOption
+	if o.registries != nil {
+		imageOpts = append(imageOpts, image.WithRegistries(o.registries))
+	}
+	if o.pullPolicy != "" {
+		imageOpts = append(imageOpts, image.WithPullPolicy(o.pullPolicy))
+	}
+	if o.pullRetries != nil {
+		imageOpts = append(imageOpts, image.WithRetryPolicy(*o.pullRetries))
+	}
+	if o.isLazyPull {
+		imageOpts = append(imageOpts, image.WithLazyPull(o.lazyDir), image.WithLazyCacheBudget(o.lazyCacheBudget))
+		if o.lazyFetchTimeout > 0 {
+			imageOpts = append(imageOpts, image.WithLazyFetchTimeout(o.lazyFetchTimeout))
+		}
+	}
+	o.imageManager = image.NewImageManager(o.client, o.snapshotter, imageOpts...)
+
+	// Device snapshots left behind by a previous crash fill the thin pool
+	if _, err := o.ReconcileDevices(context.Background()); err != nil {
+		log.WithError(err).Warn("Failed to reconcile devmapper snapshots")
+	}
+	o.setupReconcileHandler()
+
+	if o.imageGCPolicy != nil {
+		o.imageGCPolicy.Namespace = namespaceName
+		if err := o.imageManager.StartGC(*o.imageGCPolicy); err != nil {
+			log.Panicf("Failed to start image GC: %v", err)
+		}
+	}
+
+	if o.thinPoolPolicy != nil {
+		// Unused images are evicted until the thin pool is below its GC watermark, whatever the image GC watermarks
+		policy := *o.thinPoolPolicy
+		o.devMapper.AddThinPoolHook(func(ctx context.Context, _ devmapper.ThinPoolUsage) {
+			ctx = namespaces.WithNamespace(ctx, namespaceName)
+			freed, err := o.imageManager.EvictImages(ctx, func(context.Context) (bool, error) {
+				usage, err := devmapper.ReadThinPoolUsage(policy.Pool)
+				return usage.MaxUsage() <= policy.GCWatermark, err
+			})
+			if err != nil {
+				log.WithError(err).Warn("Failed to evict images to free space in the thin pool")
+			} else if !freed {
+				log.Warn("Thin pool usage still above the GC watermark, all unused images have been evicted")
+			}
+		})
+		if err := o.devMapper.StartThinPoolMonitor(*o.thinPoolPolicy); err != nil {
+			log.Panicf("Failed to start thin pool monitor: %v", err)
+		}
+	}
+
+	if len(o.warmSet) > 0 {
+		o.PrePullImages(o.warmSet)
+	}
 
 	return o
 }
@@ -159,12 +295,33 @@ func (o *Orchestrator) setupCloseHandler() {
 	}()
 }
 
+// setupReconcileHandler Reconciles the devmapper snapshots on demand, upon SIGUSR1
+func (o *Orchestrator) setupReconcileHandler() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			if _, err := o.ReconcileDevices(context.Background()); err != nil {
+				log.WithError(err).Warn("Failed to reconcile devmapper snapshots")
+			}
+		}
+	}()
+}
+
 // Cleanup Removes the bridges created by the VM pool's tap manager
-// Cleans up snapshots directory
+// Cleans up snapshots and drives directories
 func (o *Orchestrator) Cleanup() {
 	o.vmPool.CleanupNetwork()
-	if err := os.RemoveAll(o.snapshotsDir); err != nil {
-		log.Panic("failed to delete snapshots dir", err)
+	if !o.keepSnapshots {
+		if err := os.RemoveAll(o.snapshotsDir); err != nil {
+			log.Panic("failed to delete snapshots dir", err)
+		}
+	}
+	if err := os.RemoveAll(o.drivesDir); err != nil {
+		log.Panic("failed to delete drives dir", err)
+	}
+	if err := os.RemoveAll(o.lazyDir); err != nil {
+		log.Panic("failed to delete lazy images dir", err)
 	}
 }
 
@@ -173,6 +330,33 @@ func (o *Orchestrator) GetSnapshotsEnabled() bool {
 	return o.snapshotsEnabled
 }
 
+// GetSnapshotManagerOptions Returns the options of the snapshot managers storing the snapshots of the orchestrator
+func (o *Orchestrator) GetSnapshotManagerOptions() []snapshotting.SnapshotManagerOption {
+	opts := []snapshotting.SnapshotManagerOption{
+		snapshotting.WithKeepOnStart(o.keepSnapshots),
+		snapshotting.WithDiskBudget(o.snapshotBudget, o.evictionPolicy),
+		snapshotting.WithRetainedVersions(o.snapshotVersions),
+		// Snapshots are loaded on top of their image, which must outlive them
+		snapshotting.WithImageReferences(o.imageManager.RetainImage, o.imageManager.ReleaseImage),
+	}
+	if o.snapshotStore != nil {
+		opts = append(opts, snapshotting.WithStore(o.snapshotStore))
+	}
+	return opts
+}
+
+// GetDriveImageRoot Returns the directory holding the image files that image drives may use, empty if image drives
+// are disabled
+func (o *Orchestrator) GetDriveImageRoot() string {
+	return o.driveImageRoot
+}
+
+// GetResnapshotLoads Returns the number of loads of a snapshot after which it is refreshed with a diff snapshot,
+// 0 if snapshots are never refreshed
+func (o *Orchestrator) GetResnapshotLoads() int {
+	return o.resnapshotLoads
+}
+
 // GetUPFEnabled Returns the UPF mode of the orchestrator
 func (o *Orchestrator) GetUPFEnabled() bool {
 	return o.isUPFEnabled
@@ -203,6 +387,88 @@ func (o *Orchestrator) GetUPFLatencyStats(vmID string) ([]*metrics.Metric, error
 	return o.memoryManager.GetUPFLatencyStats(vmID)
 }
 
+// GetImageGCStats Returns the statistics of the image garbage collection
+func (o *Orchestrator) GetImageGCStats() image.GCStats {
+	return o.imageManager.GetGCStats()
+}
+
+// GetDevicePoolStats Returns the statistics of the pool of patched container devices
+func (o *Orchestrator) GetDevicePoolStats() devmapper.DevicePoolStats {
+	return o.devMapper.GetDevicePoolStats()
+}
+
+// GetThinPoolUsage Returns the usage of the devmapper thin pool last read by the monitor
+func (o *Orchestrator) GetThinPoolUsage() (devmapper.ThinPoolUsage, error) {
+	return o.devMapper.GetThinPoolUsage()
+}
+
+// GetNodeMetrics Returns the metrics of the node shared by all VMs, i.e., the statistics of the device pool and of the
+// image GC, and the usage of the devmapper thin pool if it is monitored
+func (o *Orchestrator) GetNodeMetrics() map[string]float64 {
+	nodeMetrics := o.GetDevicePoolStats().ToMap()
+	for k, v := range o.GetImageGCStats().ToMap() {
+		nodeMetrics[k] = v
+	}
+	if usage, err := o.GetThinPoolUsage(); err == nil {
+		for k, v := range usage.ToMap() {
+			nodeMetrics[k] = v
+		}
+	}
+	return nodeMetrics
+}
+
+// AddThinPoolHook Adds a hook that frees space, e.g., by removing snapshots, when the usage of the thin pool exceeds
+// the GC watermark
+func (o *Orchestrator) AddThinPoolHook(hook devmapper.ThinPoolHook) {
+	o.devMapper.AddThinPoolHook(hook)
+}
+
+// ReconcileDevices Removes the orphaned devmapper snapshots and leases, i.e., the ones created by vHive that are
+// used by no VM
+func (o *Orchestrator) ReconcileDevices(ctx context.Context) (devmapper.ReconcileStats, error) {
+	ctx = namespaces.WithNamespace(ctx, namespaceName)
+
+	var live []string
+	for _, vm := range o.vmPool.GetVMMap() {
+		live = append(live, vm.ContainerSnapKey)
+	}
+	o.vmDrives.Range(func(_, value interface{}) bool {
+		for _, drive := range value.([]*vmDrive) {
+			if drive.snapKey != "" {
+				live = append(live, drive.snapKey)
+			}
+		}
+		return true
+	})
+
+	stats, err := o.devMapper.Reconcile(ctx, live)
+	if stats.Snapshots > 0 || stats.Leases > 0 {
+		log.Infof("Removed %d orphaned devmapper snapshots and %d orphaned leases", stats.Snapshots, stats.Leases)
+	}
+	return stats, err
+}
+
+// PrePullImages Pulls images in the background and adds them to the warm set
+func (o *Orchestrator) PrePullImages(imageNames []string) {
+	ctx := namespaces.WithNamespace(context.Background(), namespaceName)
+	o.imageManager.PrePull(ctx, imageNames, o.prePullWorkers)
+}
+
+// SetPullCredentials Sets the credentials of the registry of an image
+func (o *Orchestrator) SetPullCredentials(imageName string, creds image.Credentials) {
+	o.imageManager.SetPullCredentials(imageName, creds)
+}
+
+// GetPrePullStatus Returns the progress of the pre-pull of the warm set
+func (o *Orchestrator) GetPrePullStatus() image.PrePullStatus {
+	return o.imageManager.GetPrePullStatus()
+}
+
+// WaitPrePull Waits for the pending pulls of the warm set to finish
+func (o *Orchestrator) WaitPrePull(ctx context.Context) error {
+	return o.imageManager.WaitPrePull(ctx)
+}
+
 // GetSnapshotsDir Returns the orchestrator's snapshot directory
 func (o *Orchestrator) GetSnapshotsDir() string {
 	return o.snapshotsDir
@@ -22,6 +22,14 @@
 
 package ctriface
 
+import (
+	"time"
+
+	"github.com/vhive-serverless/vhive/ctriface/image"
+	"github.com/vhive-serverless/vhive/devmapper"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
 // OrchestratorOption Options to pass to Orchestrator
 type OrchestratorOption func(*Orchestrator)
 
@@ -78,3 +86,175 @@ func WithNetPoolSize(netPoolSize int) OrchestratorOption {
 		o.netPoolSize = netPoolSize
 	}
 }
+
+// WithReadinessProbe Sets the probe that StartVM runs against the guest
+// before returning. VMs that do not pass the probe are torn down
+func WithReadinessProbe(probe ReadinessProbe) OrchestratorOption {
+	return func(o *Orchestrator) {
+		if probe.Type == ProbeNone {
+			o.readinessProbe = nil
+			return
+		}
+		o.readinessProbe = &probe
+	}
+}
+
+// WithCPUPlacement Sets the policy used to pin the vCPU threads of VMs to host CPUs, which requires WithCgroups
+func WithCPUPlacement(policy CPUPolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.cpuPolicy = policy
+	}
+}
+
+// WithBalloon Sets whether VMs are booted with a virtio-balloon device,
+// which allows reclaiming the memory of idle VMs
+func WithBalloon(isBalloonEnabled bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.isBalloonEnabled = isBalloonEnabled
+	}
+}
+
+// WithCgroups Places each VM in a dedicated cgroup to account the resources it uses, which requires WithJailer
+func WithCgroups(isCgroupsEnabled bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.isCgroupsEnabled = isCgroupsEnabled
+	}
+}
+
+// WithJailer Runs the Firecracker process of each VM under the jailer,
+// in its own chroot and as an unprivileged user
+func WithJailer(cfg JailerConfig) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.jailerConfig = &cfg
+	}
+}
+
+// WithTimeoutProfile Sets the timeouts of the stages of the VM lifecycle
+func WithTimeoutProfile(profile TimeoutProfile) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.timeouts = profile
+	}
+}
+
+// WithImageGC Evicts the images not used by any VM or snapshot, least recently used first,
+// when the disk usage exceeds the high watermark of the policy
+func WithImageGC(policy image.GCPolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.imageGCPolicy = &policy
+	}
+}
+
+// WithWarmSet Pulls the images of the warm set in the background at startup,
+// at most parallelism at a time
+func WithWarmSet(imageNames []string, parallelism int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.warmSet = imageNames
+		o.prePullWorkers = parallelism
+	}
+}
+
+// WithRegistries Sets the credentials and TLS options of the registries images are pulled from
+func WithRegistries(registries *image.Registries) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.registries = registries
+	}
+}
+
+// WithPullPolicy Sets when the registry is queried for the image a name refers to
+func WithPullPolicy(policy image.PullPolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.pullPolicy = policy
+	}
+}
+
+// WithPullRetries Sets the retries of the image pulls that fail for transient reasons
+func WithPullRetries(policy image.RetryPolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.pullRetries = &policy
+	}
+}
+
+// WithLazyPull Boots the VMs of images in the eStargz format from a root file system whose files are fetched from
+// the registry on first access, instead of pulling and unpacking the image first
+func WithLazyPull(isLazyPull bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.isLazyPull = isLazyPull
+	}
+}
+
+// WithLazyPullLimits Bounds the time the reads of lazily loaded images wait for the registry, and the bytes of
+// their files cached on the node (0 for no limit)
+func WithLazyPullLimits(fetchTimeout time.Duration, cacheBudget int64) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.lazyFetchTimeout = fetchTimeout
+		o.lazyCacheBudget = cacheBudget
+	}
+}
+
+// WithPatchMode Sets how the changes of a VM to its root file system are stored in its snapshots
+func WithPatchMode(mode devmapper.PatchMode) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.patchMode = mode
+	}
+}
+
+// WithDevicePool Keeps the container devices of snapshots with their patch applied, of which the devices of the loaded
+// VMs are thin snapshots
+func WithDevicePool(policy devmapper.DevicePoolPolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.devicePool = policy
+	}
+}
+
+// WithThinPoolMonitor Watches the usage of the devmapper thin pool, refusing to create VMs above the high watermark
+// of the policy
+func WithThinPoolMonitor(policy devmapper.ThinPoolPolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.thinPoolPolicy = &policy
+	}
+}
+
+// WithKeepSnapshots Keeps the snapshots of a previous run at start, as well as the snapshots directory on cleanup
+func WithKeepSnapshots(keepSnapshots bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.keepSnapshots = keepSnapshots
+	}
+}
+
+// WithSnapshotBudget Evicts snapshots according to the policy once their size exceeds the budget in bytes
+func WithSnapshotBudget(budget int64, policy snapshotting.EvictionPolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.snapshotBudget = budget
+		o.evictionPolicy = policy
+	}
+}
+
+// WithSnapshotVersions Keeps the given number of previous versions of the snapshot of each revision, to which the
+// revision can be rolled back
+func WithSnapshotVersions(versions int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.snapshotVersions = versions
+	}
+}
+
+// WithDiffSnapshots Refreshes the snapshot of a revision once its current version served the given number of loads,
+// with a diff snapshot of the next VM loaded from it, taken when the VM stops (0 disables)
+func WithDiffSnapshots(loads int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.resnapshotLoads = loads
+	}
+}
+
+// WithSnapshotStore Shares the snapshots with the other nodes through the store
+func WithSnapshotStore(store snapshotting.SnapshotStore) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.snapshotStore = store
+	}
+}
+
+// WithDriveImageRoot Allows image drives whose image files are under root, image drives being refused otherwise
+func WithDriveImageRoot(root string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.driveImageRoot = root
+	}
+}
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// ProbeType Selects how the orchestrator checks that a guest is ready
+type ProbeType string
+
+const (
+	// ProbeNone Disables readiness probing, StartVM returns as soon as the task is started
+	ProbeNone ProbeType = ""
+	// ProbeTCP Waits until a TCP connection to the guest port is accepted
+	ProbeTCP ProbeType = "tcp"
+	// ProbeGRPC Waits until the standard gRPC health service reports SERVING
+	ProbeGRPC ProbeType = "grpc"
+	// ProbeHTTP Waits until an HTTP GET on the guest port returns a 2xx or 3xx status
+	ProbeHTTP ProbeType = "http"
+)
+
+const defaultProbePeriod = 10 * time.Millisecond
+
+// ReadinessProbe Describes the readiness check performed on a freshly booted VM, the time spent probing is bounded
+// by the Probe timeout of the timeout profile
+type ReadinessProbe struct {
+	Type ProbeType
+	// Port is the guest port to probe
+	Port int
+	// Path is the URL path used by HTTP probes
+	Path string
+	// Service is the service name sent in gRPC health checks ("" checks the whole server)
+	Service string
+	// Period is the delay between two failed attempts
+	Period time.Duration
+}
+
+// BootFailureErr is returned when a VM was created but did not become ready
+type BootFailureErr struct {
+	VMID string
+	Err  error
+}
+
+func (e *BootFailureErr) Error() string {
+	return fmt.Sprintf("VM %s failed to boot: %v", e.VMID, e.Err)
+}
+
+func (e *BootFailureErr) Unwrap() error {
+	return e.Err
+}
+
+// ParseProbeType Converts a command line value to a probe type
+func ParseProbeType(s string) (ProbeType, error) {
+	switch t := ProbeType(s); t {
+	case ProbeNone, ProbeTCP, ProbeGRPC, ProbeHTTP:
+		return t, nil
+	case "none":
+		return ProbeNone, nil
+	default:
+		return ProbeNone, errors.Errorf("unknown readiness probe type %q", s)
+	}
+}
+
+// waitReady Probes the guest at guestIP until it is ready or ctx is done
+func (p *ReadinessProbe) waitReady(ctx context.Context, guestIP string) error {
+	if p == nil || p.Type == ProbeNone {
+		return nil
+	}
+
+	period := p.Period
+	if period <= 0 {
+		period = defaultProbePeriod
+	}
+
+	address := net.JoinHostPort(guestIP, strconv.Itoa(p.Port))
+	logger := log.WithFields(log.Fields{"address": address, "probe": p.Type})
+
+	var lastErr error
+	for {
+		if lastErr = p.probeOnce(ctx, address); lastErr == nil {
+			logger.Debug("Guest is ready")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(lastErr, "%s readiness probe on %s did not succeed", p.Type, address)
+		case <-time.After(period):
+		}
+	}
+}
+
+func (p *ReadinessProbe) probeOnce(ctx context.Context, address string) error {
+	switch p.Type {
+	case ProbeTCP:
+		return probeTCP(ctx, address)
+	case ProbeGRPC:
+		return probeGRPC(ctx, address, p.Service)
+	case ProbeHTTP:
+		return probeHTTP(ctx, address, p.Path)
+	default:
+		return errors.Errorf("unknown readiness probe type %q", p.Type)
+	}
+}
+
+func probeTCP(ctx context.Context, address string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeGRPC(ctx context.Context, address, service string) error {
+	conn, err := grpc.DialContext(ctx, address, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return errors.Errorf("health service reports %s", resp.GetStatus())
+	}
+	return nil
+}
+
+func probeHTTP(ctx context.Context, address, path string) error {
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("GET %s returned %s", path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func splitHostPort(t *testing.T, address string) (string, int) {
+	host, portStr, err := net.SplitHostPort(address)
+	require.NoError(t, err, "Failed to split address")
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err, "Failed to parse port")
+	return host, port
+}
+
+func waitReady(probe *ReadinessProbe, host string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return probe.waitReady(ctx, host)
+}
+
+func TestReadinessProbeTCP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+	defer lis.Close()
+
+	host, port := splitHostPort(t, lis.Addr().String())
+	probe := &ReadinessProbe{Type: ProbeTCP, Port: port}
+	require.NoError(t, waitReady(probe, host, time.Second), "TCP probe should succeed")
+
+	lis.Close()
+	require.Error(t, waitReady(probe, host, 100*time.Millisecond), "TCP probe should fail on a closed port")
+}
+
+func TestReadinessProbeHTTP(t *testing.T) {
+	ready := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-ready:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	host, port := splitHostPort(t, srv.Listener.Addr().String())
+	probe := &ReadinessProbe{Type: ProbeHTTP, Port: port, Path: "/healthz"}
+	require.Error(t, waitReady(probe, host, 100*time.Millisecond), "HTTP probe should fail while the server is unavailable")
+
+	close(ready)
+	require.NoError(t, waitReady(probe, host, time.Second), "HTTP probe should succeed")
+}
+
+func TestReadinessProbeGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Failed to listen")
+
+	s := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	go func() { _ = s.Serve(lis) }()
+	defer s.Stop()
+
+	host, port := splitHostPort(t, lis.Addr().String())
+	probe := &ReadinessProbe{Type: ProbeGRPC, Port: port}
+	require.NoError(t, waitReady(probe, host, time.Second), "gRPC probe should succeed")
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	require.Error(t, waitReady(probe, host, 200*time.Millisecond), "gRPC probe should fail when not serving")
+}
+
+func TestBootFailureErr(t *testing.T) {
+	cause := errors.New("connection refused")
+	var err error = &BootFailureErr{VMID: "1", Err: cause}
+
+	var bootErr *BootFailureErr
+	require.True(t, errors.As(err, &bootErr), "Error should be a boot failure")
+	require.True(t, errors.Is(err, cause), "Boot failure should wrap its cause")
+
+	_, err = ParseProbeType("udp")
+	require.Error(t, err, "Unknown probe types should be rejected")
+}
@@ -0,0 +1,75 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/misc"
+)
+
+// VMStatus is the status of a VM managed by the orchestrator
+type VMStatus struct {
+	VMID       string
+	GuestIP    string
+	SnapBooted bool
+	// CPUPlacement is nil when the VM is not pinned
+	CPUPlacement *CPUPlacement
+	// BalloonMib is the target size of the balloon
+	BalloonMib int64
+	// Resources is nil when VMs are not accounted in cgroups
+	Resources *VMResources
+}
+
+// GetVMStatus Returns the status of an active VM
+func (o *Orchestrator) GetVMStatus(vmID string) (*VMStatus, error) {
+	vm, err := o.vmPool.GetVM(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.getVMStatus(vm), nil
+}
+
+func (o *Orchestrator) getVMStatus(vm *misc.VM) *VMStatus {
+	status := &VMStatus{
+		VMID:       vm.ID,
+		GuestIP:    vm.GetIP(),
+		SnapBooted: vm.SnapBooted,
+		BalloonMib: vm.BalloonMib,
+	}
+
+	if o.cpuAllocator != nil {
+		status.CPUPlacement = o.cpuAllocator.getPlacement(vm.ID)
+	}
+
+	if o.isCgroupsEnabled {
+		res, err := o.GetVMResources(vm.ID)
+		if err != nil {
+			log.WithError(err).WithField("vmID", vm.ID).Warn("failed to read VM resources")
+		}
+		status.Resources = res
+	}
+
+	return status
+}
@@ -0,0 +1,229 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stage is a stage of the VM lifecycle bounded by the timeout profile
+type Stage string
+
+const (
+	StageImagePull Stage = "image pull"
+	StageCreateVM  Stage = "VM creation"
+	StageTaskStart Stage = "task start"
+	StagePause     Stage = "pause"
+	StageSnapshot  Stage = "snapshot creation"
+	StageLoad      Stage = "snapshot load"
+	StageResume    Stage = "resume"
+	StageStop      Stage = "stop"
+	StageProbe     Stage = "readiness probe"
+)
+
+// Default budgets of the operations spanning several stages, unless the profile sets its own
+const (
+	DefaultStartBudget    = 40 * time.Second
+	DefaultLoadBudget     = 30 * time.Second
+	DefaultSnapshotBudget = 60 * time.Second
+)
+
+// TimeoutProfile Bounds the duration of each stage of the VM lifecycle
+type TimeoutProfile struct {
+	ImagePull time.Duration
+	// CreateVM is also the time firecracker-containerd waits for the VM agent
+	CreateVM  time.Duration
+	TaskStart time.Duration
+	Pause     time.Duration
+	Snapshot  time.Duration
+	Load      time.Duration
+	Resume    time.Duration
+	Stop      time.Duration
+	// Probe bounds the readiness probe run once the task is started
+	Probe time.Duration
+
+	// Budgets bound whole operations, whichever of their stages takes the time. Zero keeps the default
+	// budget of the caller
+	StartBudget    time.Duration
+	LoadBudget     time.Duration
+	SnapshotBudget time.Duration
+}
+
+// DefaultTimeoutProfile Returns the timeouts used unless configured otherwise
+func DefaultTimeoutProfile() TimeoutProfile {
+	return TimeoutProfile{
+		ImagePull: 5 * time.Minute,
+		CreateVM:  100 * time.Second,
+		TaskStart: 60 * time.Second,
+		Pause:     5 * time.Second,
+		Snapshot:  60 * time.Second,
+		Load:      60 * time.Second,
+		Resume:    10 * time.Second,
+		Stop:      30 * time.Second,
+		Probe:     60 * time.Second,
+	}
+}
+
+// LoadTimeoutProfile Reads a timeout profile from a JSON file mapping stages and budgets to durations, e.g.,
+// {"Snapshot": "2m", "Load": "90s", "LoadBudget": "2m"}. Entries missing from the file keep their default
+func LoadTimeoutProfile(path string) (TimeoutProfile, error) {
+	profile := DefaultTimeoutProfile()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return profile, errors.Wrapf(err, "reading timeout profile")
+	}
+
+	var durations map[string]string
+	if err := json.Unmarshal(data, &durations); err != nil {
+		return profile, errors.Wrapf(err, "parsing timeout profile")
+	}
+
+	fields := map[string]*time.Duration{
+		"ImagePull": &profile.ImagePull,
+		"CreateVM":  &profile.CreateVM,
+		"TaskStart": &profile.TaskStart,
+		"Pause":     &profile.Pause,
+		"Snapshot":  &profile.Snapshot,
+		"Load":      &profile.Load,
+		"Resume":    &profile.Resume,
+		"Stop":      &profile.Stop,
+		"Probe":     &profile.Probe,
+
+		"StartBudget":    &profile.StartBudget,
+		"LoadBudget":     &profile.LoadBudget,
+		"SnapshotBudget": &profile.SnapshotBudget,
+	}
+
+	for key, val := range durations {
+		field, ok := fields[key]
+		if !ok {
+			return profile, errors.Errorf("unknown stage %q in timeout profile", key)
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return profile, errors.Errorf("invalid timeout %q for stage %s", val, key)
+		}
+		*field = d
+	}
+
+	return profile, nil
+}
+
+// StartVM Returns the time a VM may take to boot, from pulling its image until it passes the readiness probe,
+// or def if the profile sets no start budget
+func (p TimeoutProfile) StartVM(def time.Duration) time.Duration {
+	return budget(p.StartBudget, def)
+}
+
+// SnapshotVM Returns the time a running VM may take to be snapshotted, including pausing and resuming it, or def
+// if the profile sets no snapshot budget
+func (p TimeoutProfile) SnapshotVM(def time.Duration) time.Duration {
+	return budget(p.SnapshotBudget, def)
+}
+
+// LoadVM Returns the time a VM may take to be loaded from a snapshot and resumed, or def if the profile sets no
+// load budget
+func (p TimeoutProfile) LoadVM(def time.Duration) time.Duration {
+	return budget(p.LoadBudget, def)
+}
+
+func budget(configured, def time.Duration) time.Duration {
+	if configured > 0 {
+		return configured
+	}
+	return def
+}
+
+func (p TimeoutProfile) get(stage Stage) time.Duration {
+	switch stage {
+	case StageImagePull:
+		return p.ImagePull
+	case StageCreateVM:
+		return p.CreateVM
+	case StageTaskStart:
+		return p.TaskStart
+	case StagePause:
+		return p.Pause
+	case StageSnapshot:
+		return p.Snapshot
+	case StageLoad:
+		return p.Load
+	case StageResume:
+		return p.Resume
+	case StageStop:
+		return p.Stop
+	case StageProbe:
+		return p.Probe
+	}
+	return 0
+}
+
+// TimeoutErr is returned when a stage of the VM lifecycle does not complete in time
+type TimeoutErr struct {
+	Stage   Stage
+	VMID    string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *TimeoutErr) Error() string {
+	return fmt.Sprintf("%s of VM %s timed out after %s: %v", e.Stage, e.VMID, e.Timeout, e.Err)
+}
+
+func (e *TimeoutErr) Unwrap() error {
+	return e.Err
+}
+
+// GetTimeoutProfile Returns the timeouts of the VM lifecycle stages
+func (o *Orchestrator) GetTimeoutProfile() TimeoutProfile {
+	return o.timeouts
+}
+
+// stageDeadlineKey Keys the deadline set by the timeout of a stage in its context
+type stageDeadlineKey struct{}
+
+// stageContext Bounds ctx by the timeout of the stage
+func (o *Orchestrator) stageContext(ctx context.Context, stage Stage) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(o.timeouts.get(stage))
+	return context.WithDeadline(context.WithValue(ctx, stageDeadlineKey{}, deadline), deadline)
+}
+
+// stageErr Turns the error of a stage into a TimeoutErr if the stage ran out of its own time. The errors of stages
+// cut short by the deadline of the whole operation, which is earlier than theirs, are kept
+func (o *Orchestrator) stageErr(stageCtx context.Context, stage Stage, vmID string, err error) error {
+	if err == nil || !errors.Is(stageCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	deadline, _ := stageCtx.Deadline()
+	if own, ok := stageCtx.Value(stageDeadlineKey{}).(time.Time); !ok || !deadline.Equal(own) {
+		return err
+	}
+	return &TimeoutErr{Stage: stage, VMID: vmID, Timeout: o.timeouts.get(stage), Err: err}
+}
@@ -0,0 +1,87 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTimeoutProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timeouts.json")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"Snapshot": "2m", "Load": "90s", "LoadBudget": "2m"}`), 0644))
+	profile, err := LoadTimeoutProfile(path)
+	require.NoError(t, err, "Failed to load timeout profile")
+
+	expected := DefaultTimeoutProfile()
+	expected.Snapshot = 2 * time.Minute
+	expected.Load = 90 * time.Second
+	expected.LoadBudget = 2 * time.Minute
+	require.Equal(t, expected, profile, "Timeout profile is wrong")
+	require.Equal(t, 2*time.Minute, profile.LoadVM(DefaultLoadBudget), "Configured budget should be used")
+	require.Equal(t, DefaultStartBudget, profile.StartVM(DefaultStartBudget), "Unset budget should keep the default")
+
+	for _, content := range []string{`{"Boot": "1s"}`, `{"Load": "soon"}`, `{"Load": "-1s"}`, `[]`} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		_, err := LoadTimeoutProfile(path)
+		require.Error(t, err, "Loading %s should fail", content)
+	}
+}
+
+func TestStageTimeout(t *testing.T) {
+	profile := DefaultTimeoutProfile()
+	profile.Pause = time.Millisecond
+	o := &Orchestrator{timeouts: profile}
+
+	ctx, cancel := o.stageContext(context.Background(), StagePause)
+	defer cancel()
+	<-ctx.Done()
+
+	err := o.stageErr(ctx, StagePause, "1", ctx.Err())
+	var timeoutErr *TimeoutErr
+	require.True(t, errors.As(err, &timeoutErr), "Expired stage should return a TimeoutErr")
+	require.Equal(t, StagePause, timeoutErr.Stage, "Timeout error reports the wrong stage")
+	require.Contains(t, err.Error(), "pause of VM 1 timed out")
+
+	ctx, cancel = o.stageContext(context.Background(), StageResume)
+	defer cancel()
+	err = o.stageErr(ctx, StageResume, "1", errors.New("failed"))
+	require.False(t, errors.As(err, &timeoutErr), "Errors of stages that did not expire should be kept")
+
+	// The budget of the operation runs out before the stage does
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelParent()
+	ctx, cancel = o.stageContext(parent, StageResume)
+	defer cancel()
+	<-ctx.Done()
+	err = o.stageErr(ctx, StageResume, "1", ctx.Err())
+	require.False(t, errors.As(err, &timeoutErr), "Stages cut short by the budget should not report their timeout")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,383 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// PatchMode Selects how the changes of a container to its root file system are captured in snapshots
+type PatchMode string
+
+const (
+	// PatchModeFile captures the changed files, which requires mounting the container and image snapshots
+	PatchModeFile PatchMode = "file"
+	// PatchModeBlock captures the changed blocks of the container snapshot from the thin pool metadata, without
+	// mounting the snapshots
+	PatchModeBlock PatchMode = "block"
+)
+
+// ParsePatchMode Parses the name of a patch mode
+func ParsePatchMode(s string) (PatchMode, error) {
+	for _, m := range []PatchMode{PatchModeFile, PatchModeBlock} {
+		if strings.EqualFold(s, string(m)) {
+			return m, nil
+		}
+	}
+	return "", errors.Errorf("unknown patch mode %q", s)
+}
+
+const (
+	sectorSize = 512
+
+	// blockPatchMagic starts block patches, which tells them apart from file patches when restoring
+	blockPatchMagic = "VHBLKPT1"
+
+	extentData    uint32 = 1 // the extent is followed by the data of the blocks
+	extentDiscard uint32 = 2 // the blocks are unmapped in the container snapshot
+	extentEnd     uint32 = 3
+)
+
+// blockExtent is a byte range of a thin device
+type blockExtent struct {
+	Kind   uint32
+	Offset uint64
+	Length uint64
+}
+
+// thinDevice identifies a thin device within its pool
+type thinDevice struct {
+	id   uint64
+	pool string // major:minor of the pool device
+}
+
+// thinPool is the part of the table of a thin pool needed to read its metadata
+type thinPool struct {
+	name     string
+	metadata string // path of the metadata device
+}
+
+// getThinDevice reads the table of a thin device, e.g., "0 20971520 thin 253:2 7"
+func getThinDevice(devicePath string) (thinDevice, error) {
+	out, err := exec.Command("dmsetup", "table", filepath.Base(devicePath)).Output()
+	if err != nil {
+		return thinDevice{}, errors.Wrapf(err, "getting table of %s", devicePath)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) < 5 || fields[2] != "thin" {
+		return thinDevice{}, errors.Errorf("%s is not a thin device: %q", devicePath, strings.TrimSpace(string(out)))
+	}
+	id, err := strconv.ParseUint(fields[4], 10, 64)
+	if err != nil {
+		return thinDevice{}, errors.Wrapf(err, "parsing id of thin device %s", devicePath)
+	}
+
+	return thinDevice{id: id, pool: fields[3]}, nil
+}
+
+// getThinPool reads the name and the table of a thin pool, e.g.,
+// "0 209715200 thin-pool 253:0 253:1 128 32768 1 skip_block_zeroing"
+func getThinPool(majorMinor string) (thinPool, error) {
+	major, minor, found := strings.Cut(majorMinor, ":")
+	if !found {
+		return thinPool{}, errors.Errorf("invalid device number %q", majorMinor)
+	}
+
+	name, err := exec.Command("dmsetup", "info", "-c", "--noheadings", "-o", "name", "-j", major, "-m", minor).Output()
+	if err != nil {
+		return thinPool{}, errors.Wrapf(err, "getting name of thin pool %s", majorMinor)
+	}
+	out, err := exec.Command("dmsetup", "table", "-j", major, "-m", minor).Output()
+	if err != nil {
+		return thinPool{}, errors.Wrapf(err, "getting table of thin pool %s", majorMinor)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) < 5 || fields[2] != "thin-pool" {
+		return thinPool{}, errors.Errorf("unexpected thin pool table %q", strings.TrimSpace(string(out)))
+	}
+
+	return thinPool{name: strings.TrimSpace(string(name)), metadata: "/dev/block/" + fields[3]}, nil
+}
+
+// thinDelta is the output of thin_delta, e.g.,
+//
+//	<superblock uuid="" time="1" transaction="2" data_block_size="128" nr_data_blocks="0">
+//	  <diff left="3" right="7">
+//	    <same begin="0" length="10"/>
+//	    <different begin="10" length="5"/>
+//	    <right_only begin="15" length="1"/>
+//	  </diff>
+//	</superblock>
+type thinDelta struct {
+	DataBlockSize uint64 `xml:"data_block_size,attr"`
+	Diff          struct {
+		Ranges []struct {
+			XMLName xml.Name
+			Begin   uint64 `xml:"begin,attr"`
+			Length  uint64 `xml:"length,attr"`
+		} `xml:",any"`
+	} `xml:"diff"`
+}
+
+// parseThinDelta converts the ranges of blocks that differ between two thin devices to the byte extents of the
+// second device. Adjacent extents of the same kind are merged
+func parseThinDelta(out []byte) ([]blockExtent, error) {
+	var delta thinDelta
+	if err := xml.Unmarshal(out, &delta); err != nil {
+		return nil, errors.Wrap(err, "parsing thin_delta output")
+	}
+	if delta.DataBlockSize == 0 {
+		return nil, errors.New("thin_delta output has no data block size")
+	}
+	blockBytes := delta.DataBlockSize * sectorSize
+
+	var extents []blockExtent
+	for _, r := range delta.Diff.Ranges {
+		var kind uint32
+		switch r.XMLName.Local {
+		case "same":
+			continue
+		case "different", "right_only":
+			kind = extentData
+		case "left_only":
+			kind = extentDiscard
+		default:
+			return nil, errors.Errorf("unexpected thin_delta range %q", r.XMLName.Local)
+		}
+
+		ext := blockExtent{Kind: kind, Offset: r.Begin * blockBytes, Length: r.Length * blockBytes}
+		if n := len(extents); n > 0 && extents[n-1].Kind == kind && extents[n-1].Offset+extents[n-1].Length == ext.Offset {
+			extents[n-1].Length += ext.Length
+			continue
+		}
+		extents = append(extents, ext)
+	}
+
+	return extents, nil
+}
+
+// metadataSnapLocks serialize the uses of the metadata snapshots of the thin pools, by pool name
+var metadataSnapLocks sync.Map
+
+func metadataSnapLock(pool string) *sync.Mutex {
+	lock, _ := metadataSnapLocks.LoadOrStore(pool, new(sync.Mutex))
+	return lock.(*sync.Mutex)
+}
+
+// getChangedExtents returns the extents of the container device that differ from the origin device. Both must be
+// thin devices of the same pool
+func getChangedExtents(originPath, containerPath string) ([]blockExtent, error) {
+	origin, err := getThinDevice(originPath)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getThinDevice(containerPath)
+	if err != nil {
+		return nil, err
+	}
+	if origin.pool != container.pool {
+		return nil, errors.Errorf("%s and %s are not in the same thin pool", originPath, containerPath)
+	}
+	pool, err := getThinPool(container.pool)
+	if err != nil {
+		return nil, err
+	}
+
+	// The metadata is read from a snapshot, since the pool keeps changing the live metadata. Reserving the snapshot
+	// commits the mappings of the blocks written so far. A pool has a single metadata snapshot, so the deltas of a
+	// pool are computed one at a time
+	lock := metadataSnapLock(pool.name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// A reservation left behind, e.g., by a crash while computing a delta, would make reserving fail
+	if usage, err := ReadThinPoolUsage(pool.name); err == nil && usage.MetadataSnapHeld {
+		log.WithField("pool", pool.name).Warn("Releasing stale metadata snapshot of thin pool")
+		if err := exec.Command("dmsetup", "message", pool.name, "0", "release_metadata_snap").Run(); err != nil {
+			return nil, errors.Wrapf(err, "releasing stale metadata snapshot of %s", pool.name)
+		}
+	}
+	if err := exec.Command("dmsetup", "message", pool.name, "0", "reserve_metadata_snap").Run(); err != nil {
+		return nil, errors.Wrapf(err, "reserving metadata snapshot of %s", pool.name)
+	}
+	defer func() { _ = exec.Command("dmsetup", "message", pool.name, "0", "release_metadata_snap").Run() }()
+
+	var errb bytes.Buffer
+	cmd := exec.Command("thin_delta", "-m",
+		"--snap1", strconv.FormatUint(origin.id, 10),
+		"--snap2", strconv.FormatUint(container.id, 10),
+		pool.metadata)
+	cmd.Stderr = &errb
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "computing delta of %s and %s: %s", originPath, containerPath, errb.String())
+	}
+
+	return parseThinDelta(out)
+}
+
+// extractBlockPatch writes the blocks of the container device that differ from the origin device to patchPath and
+// returns the checksum of the patch file
+func extractBlockPatch(originPath, containerPath, patchPath string) (string, error) {
+	// Flush the writes of the container, so that their blocks are mapped in the pool
+	dev, err := os.Open(containerPath)
+	if err != nil {
+		return "", err
+	}
+	defer dev.Close()
+	if err := dev.Sync(); err != nil {
+		return "", errors.Wrapf(err, "flushing %s", containerPath)
+	}
+
+	extents, err := getChangedExtents(originPath, containerPath)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := createPatchFile(patchPath)
+	if err != nil {
+		return "", err
+	}
+	if err := writeBlockPatch(w, dev, extents); err != nil {
+		w.Abort()
+		return "", errors.Wrapf(err, "writing block patch %s", patchPath)
+	}
+	return w.Commit()
+}
+
+// writeBlockPatch writes a patch made of the given extents, followed by their data read from dev
+func writeBlockPatch(w io.Writer, dev io.ReaderAt, extents []blockExtent) error {
+	bw := bufio.NewWriterSize(w, 1<<20)
+
+	if _, err := bw.WriteString(blockPatchMagic); err != nil {
+		return err
+	}
+	for _, ext := range extents {
+		if err := binary.Write(bw, binary.LittleEndian, ext); err != nil {
+			return err
+		}
+		if ext.Kind != extentData {
+			continue
+		}
+		n, err := io.Copy(bw, io.NewSectionReader(dev, int64(ext.Offset), int64(ext.Length)))
+		if err != nil {
+			return err
+		}
+		if uint64(n) != ext.Length {
+			return errors.Errorf("extent at %d is beyond the end of the device", ext.Offset)
+		}
+	}
+	if err := binary.Write(bw, binary.LittleEndian, blockExtent{Kind: extentEnd}); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// applyBlockPatch writes the blocks of a patch to the device at containerPath
+func applyBlockPatch(containerPath string, patch io.Reader) error {
+	dev, err := os.OpenFile(containerPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	if err := readBlockPatch(patch, dev, discardBlocks); err != nil {
+		return errors.Wrapf(err, "applying patch at %s", containerPath)
+	}
+	return dev.Sync()
+}
+
+// readBlockPatch writes the data extents of a patch to dev and passes the discarded extents to discard
+func readBlockPatch(r io.Reader, dev io.WriterAt, discard func(dev io.WriterAt, ext blockExtent) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+
+	magic := make([]byte, len(blockPatchMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != blockPatchMagic {
+		return errors.New("not a block patch")
+	}
+
+	for {
+		var ext blockExtent
+		if err := binary.Read(br, binary.LittleEndian, &ext); err != nil {
+			return errors.Wrap(err, "reading extent")
+		}
+
+		switch ext.Kind {
+		case extentEnd:
+			return nil
+		case extentData:
+			w := io.NewOffsetWriter(dev, int64(ext.Offset))
+			if _, err := io.CopyN(w, br, int64(ext.Length)); err != nil {
+				return errors.Wrapf(err, "writing extent at %d", ext.Offset)
+			}
+		case extentDiscard:
+			if err := discard(dev, ext); err != nil {
+				return errors.Wrapf(err, "discarding extent at %d", ext.Offset)
+			}
+		default:
+			return errors.Errorf("unknown extent kind %d", ext.Kind)
+		}
+	}
+}
+
+// discardBlocks unmaps an extent of a thin device, so that it reads as zeros again. Devices that do not support
+// discards are zeroed instead
+func discardBlocks(dev io.WriterAt, ext blockExtent) error {
+	if f, ok := dev.(*os.File); ok {
+		r := [2]uint64{ext.Offset, ext.Length}
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKDISCARD, uintptr(unsafe.Pointer(&r[0])))
+		if errno == 0 {
+			return nil
+		}
+	}
+
+	zeros := make([]byte, 1<<20)
+	for off := uint64(0); off < ext.Length; off += uint64(len(zeros)) {
+		n := ext.Length - off
+		if n > uint64(len(zeros)) {
+			n = uint64(len(zeros))
+		}
+		if _, err := dev.WriteAt(zeros[:n], int64(ext.Offset+off)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
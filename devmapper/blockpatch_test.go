@@ -0,0 +1,123 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseThinDelta(t *testing.T) {
+	out := []byte(`<superblock uuid="" time="1" transaction="2" data_block_size="128" nr_data_blocks="0">
+  <diff left="3" right="7">
+    <same begin="0" length="10"/>
+    <different begin="10" length="5"/>
+    <right_only begin="15" length="1"/>
+    <same begin="16" length="4"/>
+    <left_only begin="20" length="2"/>
+    <different begin="22" length="1"/>
+  </diff>
+</superblock>`)
+
+	extents, err := parseThinDelta(out)
+	require.NoError(t, err, "Failed to parse thin_delta output")
+
+	block := uint64(128 * sectorSize)
+	require.Equal(t, []blockExtent{
+		{Kind: extentData, Offset: 10 * block, Length: 6 * block},
+		{Kind: extentDiscard, Offset: 20 * block, Length: 2 * block},
+		{Kind: extentData, Offset: 22 * block, Length: block},
+	}, extents)
+
+	_, err = parseThinDelta([]byte(`<superblock><diff left="3" right="7"></diff></superblock>`))
+	require.Error(t, err, "Output without block size must be rejected")
+}
+
+func TestBlockPatch(t *testing.T) {
+	const size = 1 << 20
+	dir := t.TempDir()
+
+	container := make([]byte, size)
+	rand.New(rand.NewSource(0)).Read(container)
+	// The discarded extent reads as zeros in the container device
+	copy(container[0x40000:0x50000], make([]byte, 0x10000))
+
+	// The device the patch is restored to holds the origin, which differs in all patched extents
+	origin := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(origin)
+	copy(origin[:0x10000], container[:0x10000])
+	copy(origin[0x30000:0x40000], container[0x30000:0x40000])
+	copy(origin[0x50000:], container[0x50000:])
+
+	extents := []blockExtent{
+		{Kind: extentData, Offset: 0x10000, Length: 0x20000},
+		{Kind: extentDiscard, Offset: 0x40000, Length: 0x10000},
+	}
+
+	var patch bytes.Buffer
+	require.NoError(t, writeBlockPatch(&patch, bytes.NewReader(container), extents), "Failed to write patch")
+	require.Less(t, patch.Len(), 0x20000+1024, "Patch must only hold the data extents")
+
+	patchPath := filepath.Join(dir, "patch")
+	w, err := createPatchFile(patchPath)
+	require.NoError(t, err)
+	_, err = w.Write(patch.Bytes())
+	require.NoError(t, err)
+	patchDigest, err := w.Commit()
+	require.NoError(t, err)
+
+	r, err := openPatchFile(patchPath, patchDigest)
+	require.NoError(t, err, "Failed to open patch")
+	defer r.Close()
+	require.True(t, r.isBlockPatch(), "Patch not recognized as a block patch")
+
+	devPath := filepath.Join(dir, "dev")
+	require.NoError(t, os.WriteFile(devPath, origin, 0644))
+	require.NoError(t, applyBlockPatch(devPath, r), "Failed to apply patch")
+
+	restored, err := os.ReadFile(devPath)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(container, restored), "Restored device differs from the container device")
+}
+
+func TestBlockPatchTruncated(t *testing.T) {
+	extents := []blockExtent{{Kind: extentData, Offset: 0, Length: 4096}}
+
+	var patch bytes.Buffer
+	require.NoError(t, writeBlockPatch(&patch, bytes.NewReader(make([]byte, 4096)), extents))
+
+	dev, err := os.Create(filepath.Join(t.TempDir(), "dev"))
+	require.NoError(t, err)
+	defer dev.Close()
+
+	truncated := bytes.NewReader(patch.Bytes()[:patch.Len()-100])
+	require.Error(t, readBlockPatch(truncated, dev, discardBlocks), "Truncated patch must be rejected")
+
+	require.Error(t, readBlockPatch(io.LimitReader(&patch, 0), dev, discardBlocks), "Empty patch must be rejected")
+}
@@ -23,17 +23,15 @@
 package devmapper
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/opencontainers/image-spec/identity"
 	"github.com/pkg/errors"
-	"os"
-	"os/exec"
-	"strings"
+	log "github.com/sirupsen/logrus"
 	"sync"
 )
 
@@ -47,14 +45,43 @@ type DeviceMapper struct {
 	// created directly through containerd (eg. container.create)
 	leaseManager leases.Manager
 	leases       map[string]*leases.Lease
+
+	patchMode PatchMode   // how patches of container snapshots are created
+	pool      *devicePool // patched origins of the container snapshots of loaded VMs, if enabled
+	monitor   thinPoolMonitor
+}
+
+// DeviceMapperOption Options to pass to DeviceMapper
+type DeviceMapperOption func(*DeviceMapper)
+
+// WithPatchMode Sets how the changes of containers to their snapshots are captured by CreatePatch
+func WithPatchMode(mode PatchMode) DeviceMapperOption {
+	return func(dmpr *DeviceMapper) {
+		dmpr.patchMode = mode
+	}
+}
+
+// WithDevicePool Keeps the patched origins of container snapshots, see CreatePatchedDeviceSnapshot
+func WithDevicePool(policy DevicePoolPolicy) DeviceMapperOption {
+	return func(dmpr *DeviceMapper) {
+		if policy.MaxOrigins > 0 {
+			dmpr.pool = newDevicePool(policy)
+		}
+	}
 }
 
-func NewDeviceMapper(client *containerd.Client) *DeviceMapper {
+func NewDeviceMapper(client *containerd.Client, opts ...DeviceMapperOption) *DeviceMapper {
 	devMapper := new(DeviceMapper)
 	devMapper.snapDevices = make(map[string]*DeviceSnapshot)
 	devMapper.snapshotService = client.SnapshotService("devmapper")
 	devMapper.leaseManager = client.LeasesService()
 	devMapper.leases = make(map[string]*leases.Lease)
+	devMapper.patchMode = PatchModeFile
+
+	for _, opt := range opts {
+		opt(devMapper)
+	}
+
 	return devMapper
 }
 
@@ -77,21 +104,25 @@ func (dmpr *DeviceMapper) CreateDeviceSnapshotFromImage(ctx context.Context, sna
 	return dmpr.CreateDeviceSnapshot(ctx, snapshotKey, parent)
 }
 
-// CreateDeviceSnapshot creates a new device mapper snapshot from the given parent snapshot.
+// CreateDeviceSnapshot creates a new device mapper snapshot from the given parent snapshot. The snapshot and its lease
+// are labeled as owned by vHive, so that Reconcile can find them if they are orphaned.
 func (dmpr *DeviceMapper) CreateDeviceSnapshot(ctx context.Context, snapKey, parentKey string) error {
 	dmpr.Lock()
 	defer dmpr.Unlock()
 
 	// Create lease to avoid garbage collection
-	lease, err := dmpr.leaseManager.Create(ctx, leases.WithID(snapKey))
+	lease, err := dmpr.leaseManager.Create(ctx, leases.WithID(snapKey), leases.WithLabels(ownerLabels()))
 	if err != nil {
 		return err
 	}
 
 	// Create snapshot from parent
 	leasedCtx := leases.WithLease(ctx, lease.ID)
-	mounts, err := dmpr.snapshotService.Prepare(leasedCtx, snapKey, parentKey)
+	mounts, err := dmpr.snapshotService.Prepare(leasedCtx, snapKey, parentKey, snapshots.WithLabels(ownerLabels()))
 	if err != nil {
+		if delErr := dmpr.leaseManager.Delete(ctx, lease); delErr != nil {
+			log.WithError(delErr).WithField("snapKey", snapKey).Warn("Failed to delete lease of device snapshot")
+		}
 		return err
 	}
 
@@ -107,30 +138,44 @@ func (dmpr *DeviceMapper) CreateDeviceSnapshot(ctx context.Context, snapKey, par
 // RemoveDeviceSnapshot removes the device mapper snapshot identified by the given snapKey. This is only necessary for
 // snapshots created through CreateDeviceSnapshot since other snapshots are managed by containerd. The locking here
 // also assumes this function is only used to remove snapshots that are a child and are only used by a single container.
+// Snapshots that fail to be removed are no longer tracked and are left to Reconcile.
 func (dmpr *DeviceMapper) RemoveDeviceSnapshot(ctx context.Context, snapKey string) error {
 	dmpr.Lock()
 
 	lease, present := dmpr.leases[snapKey]
 	if !present {
 		dmpr.Unlock()
-		return errors.New(fmt.Sprintf("Delete device snapshot: lease for key %s does not exist", snapKey))
-	}
 
-	if _, present := dmpr.snapDevices[snapKey]; !present {
-		dmpr.Unlock()
-		return errors.New(fmt.Sprintf("Delete device snapshot: device for key %s does not exist", snapKey))
+		// Snapshots created before a restart are not tracked, but can be told apart from the snapshots managed by
+		// containerd by their labels. Their lease has the same ID
+		if info, err := dmpr.snapshotService.Stat(ctx, snapKey); err != nil || !isOwned(info.Labels) {
+			return errors.New(fmt.Sprintf("Delete device snapshot: lease for key %s does not exist", snapKey))
+		}
+		return dmpr.removeOwned(ctx, snapKey, leases.Lease{ID: snapKey})
 	}
+
 	delete(dmpr.snapDevices, snapKey)
 	delete(dmpr.leases, snapKey)
 	dmpr.Unlock()
 
+	err := dmpr.removeOwned(ctx, snapKey, *lease)
+
+	// Origins are only removed once their container snapshots are gone
+	if dmpr.pool != nil && dmpr.pool.detach(snapKey) {
+		dmpr.evictOrigins(ctx, dmpr.pool.policy.MaxOrigins)
+	}
+
+	return err
+}
+
+// removeOwned removes a snapshot created by CreateDeviceSnapshot and its lease, either of which may be gone already
+func (dmpr *DeviceMapper) removeOwned(ctx context.Context, snapKey string, lease leases.Lease) error {
 	// Not only deactivates but also deletes device
-	err := dmpr.snapshotService.Remove(ctx, snapKey)
-	if err != nil {
+	if err := dmpr.snapshotService.Remove(ctx, snapKey); err != nil && !errdefs.IsNotFound(err) {
 		return err
 	}
 
-	if err := dmpr.leaseManager.Delete(ctx, *lease); err != nil {
+	if err := dmpr.leaseManager.Delete(ctx, lease); err != nil && !errdefs.IsNotFound(err) {
 		return err
 	}
 
@@ -170,83 +215,81 @@ func (dmpr *DeviceMapper) GetDeviceSnapshot(ctx context.Context, snapKey string)
 	return dmpr.snapDevices[snapKey], nil
 }
 
-// addTrailingSlash adds a trailing slash to a path if it is not present yet.
-func addTrailingSlash(path string) string {
-	if strings.HasSuffix(path, "/") {
-		return path
-	} else {
-		return path + "/"
-	}
+// CreatePatch creates a patch file storing the differences between an image and the changes applied by the
+// container. In file mode, the patch holds the changed files of the mounted snapshots. In block mode, it holds the
+// changed blocks that thin_delta extracts directly from the metadata stored by the device mapper, without mounting.
+// Patches are compressed with zstd, and the returned checksum of the patch file must be passed to RestorePatch.
+func (dmpr *DeviceMapper) CreatePatch(ctx context.Context, patchPath, containerSnapKey string, image containerd.Image) (string, error) {
+	return dmpr.createPatch(ctx, patchPath, containerSnapKey, image, dmpr.patchMode)
 }
 
-// CreatePatch creates a patch file storing the file differences between and image and the changes applied
-// by the container using rsync. Note that this is a different approach than using thin_delta which is able to
-// extract blocks directly by leveraging the metadata stored by the device mapper.
-func (dmpr *DeviceMapper) CreatePatch(ctx context.Context, patchPath, containerSnapKey string, image containerd.Image) error {
+// CreateBlockPatch creates a patch file storing the blocks of a thin snapshot that differ from the image it was
+// created from, whatever the patch mode of the device mapper, e.g., for drives whose file system is not known.
+// The patch is restored with RestorePatch.
+func (dmpr *DeviceMapper) CreateBlockPatch(ctx context.Context, patchPath, snapKey string, image containerd.Image) (string, error) {
+	return dmpr.createPatch(ctx, patchPath, snapKey, image, PatchModeBlock)
+}
+
+func (dmpr *DeviceMapper) createPatch(ctx context.Context, patchPath, containerSnapKey string, image containerd.Image, mode PatchMode) (string, error) {
 	containerSnap, err := dmpr.GetDeviceSnapshot(ctx, containerSnapKey)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	imageSnapKey := fmt.Sprintf("%s-base-image", containerSnapKey)
 	if err := dmpr.CreateDeviceSnapshotFromImage(ctx, imageSnapKey, image); err != nil {
-		return err
+		return "", err
 	}
-	defer func() { _ = dmpr.RemoveDeviceSnapshot(ctx, imageSnapKey) }()
+	defer func() {
+		if err := dmpr.RemoveDeviceSnapshot(ctx, imageSnapKey); err != nil {
+			log.WithError(err).WithField("snapKey", imageSnapKey).Warn("Failed to remove image snapshot, leaving it to reconciliation")
+		}
+	}()
 
 	imageSnap, err := dmpr.GetDeviceSnapshot(ctx, imageSnapKey)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if mode == PatchModeBlock {
+		return extractBlockPatch(imageSnap.GetDevicePath(), containerSnap.GetDevicePath(), patchPath)
 	}
 
 	// 1. Mount original and snapshot image
 	imageMountPath, err := imageSnap.Mount(true)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer func() { _ = imageSnap.UnMount() }()
 
 	containerMountPath, err := containerSnap.Mount(true)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer func() { _ = containerSnap.UnMount() }()
 
 	// 2. Save changes to file
-	result := extractPatch(imageMountPath, containerMountPath, patchPath)
-
-	// 3. Change the rights of patch file to enable upload to local storage
-	_ = exec.Command("sudo", "chmod", "777", patchPath)
-
-	return result
+	return extractPatch(imageMountPath, containerMountPath, patchPath)
 }
 
-// extractPatch extracts the file differences between the file systems mounted at the supplied paths using rsync and
-// writes the differences to the supplied patchPath.
-func extractPatch(imageMountPath, containerMountPath, patchPath string) error {
-	patchArg := fmt.Sprintf("--only-write-batch=%s", patchPath)
-
-	var errb bytes.Buffer
-	cmd := exec.Command("sudo", "rsync", "-ar", patchArg, addTrailingSlash(imageMountPath), addTrailingSlash(containerMountPath))
-	cmd.Stderr = &errb
-	err := cmd.Run()
-
+// RestorePatch applies the changes stored in the supplied patch file on top of the given container snapshot. Patches
+// are restored according to the mode they were created in. The patch file is checked against the checksum returned
+// by CreatePatch beforehand, failing with ErrCorruptPatch if it does not match.
+func (dmpr *DeviceMapper) RestorePatch(ctx context.Context, containerSnapKey, patchPath, patchDigest string) error {
+	containerSnap, err := dmpr.GetDeviceSnapshot(ctx, containerSnapKey)
 	if err != nil {
-		return errors.Wrapf(err, "creating patch between %s and %s at %s: %s", imageMountPath, containerMountPath, patchPath, errb.String())
+		return err
 	}
 
-	err = os.Remove(patchPath + ".sh") // Remove unnecessary script output
+	patch, err := openPatchFile(patchPath, patchDigest)
 	if err != nil {
-		return errors.Wrapf(err, "removing %s", patchPath+".sh")
+		return err
 	}
-	return nil
-}
+	defer patch.Close()
 
-// RestorePatch applies the file changes stored in the supplied patch file on top of the given container snapshot.
-func (dmpr *DeviceMapper) RestorePatch(ctx context.Context, containerSnapKey, patchPath string) error {
-	containerSnap, err := dmpr.GetDeviceSnapshot(ctx, containerSnapKey)
-	if err != nil {
-		return err
+	if patch.isBlockPatch() {
+		// Blocks are written back to the device directly
+		return applyBlockPatch(containerSnap.GetDevicePath(), patch)
 	}
 
 	// 1. Mount container snapshot device
@@ -257,16 +300,5 @@ func (dmpr *DeviceMapper) RestorePatch(ctx context.Context, containerSnapKey, pa
 	defer func() { _ = containerSnap.UnMount() }()
 
 	// 2. Apply changes to container mounted file system
-	return applyPatch(containerMountPath, patchPath)
-}
-
-// applyPatch applies the file changes stored in the supplied patch file to the filesystem mounted at the supplied path
-func applyPatch(containerMountPath, patchPath string) error {
-	patchArg := fmt.Sprintf("--read-batch=%s", patchPath)
-	cmd := exec.Command("sudo", "rsync", "-ar", patchArg, addTrailingSlash(containerMountPath))
-	err := cmd.Run()
-	if err != nil {
-		return errors.Wrapf(err, "applying %s at %s", patchPath, containerMountPath)
-	}
-	return nil
+	return applyPatch(containerMountPath, patch)
 }
@@ -32,7 +32,9 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/vhive-serverless/vhive/ctriface/image"
 	"github.com/vhive-serverless/vhive/devmapper"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -134,3 +136,72 @@ func TestDevmapperConcurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// writeContainerChanges simulates the changes of a container to its root file system
+func writeContainerChanges(b *testing.B, dmpr *devmapper.DeviceMapper, ctx context.Context, snapKey string) {
+	snap, err := dmpr.GetDeviceSnapshot(ctx, snapKey)
+	require.NoError(b, err, "Failed to get container snapshot")
+
+	mountPath, err := snap.Mount(false)
+	require.NoError(b, err, "Failed to mount container snapshot")
+	defer func() { _ = snap.UnMount() }()
+
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+	for i := 0; i < 4; i++ {
+		err := os.WriteFile(filepath.Join(mountPath, fmt.Sprintf("changed-%d", i)), data, 0644)
+		require.NoError(b, err, "Failed to write to container snapshot")
+	}
+	require.NoError(b, os.RemoveAll(filepath.Join(mountPath, "etc")), "Failed to remove from container snapshot")
+}
+
+func BenchmarkPatch(b *testing.B) {
+	client, err := containerd.New(containerdAddress)
+	require.NoError(b, err, "Containerd client creation returned error")
+	defer func() { _ = client.Close() }()
+
+	ctx := namespaces.WithNamespace(context.Background(), NamespaceName)
+	mgr := image.NewImageManager(client, "devmapper")
+	img, err := mgr.GetImage(ctx, TestImageName)
+	require.NoError(b, err, fmt.Sprintf("Failed to pull image %s", TestImageName))
+
+	for _, mode := range []devmapper.PatchMode{devmapper.PatchModeFile, devmapper.PatchModeBlock} {
+		dmpr := devmapper.NewDeviceMapper(client, devmapper.WithPatchMode(mode))
+
+		containerSnapKey := fmt.Sprintf("benchsnap-%s", mode)
+		require.NoError(b, dmpr.CreateDeviceSnapshotFromImage(ctx, containerSnapKey, *img))
+		writeContainerChanges(b, dmpr, ctx, containerSnapKey)
+
+		patchPath := filepath.Join(b.TempDir(), "patch")
+		var patchDigest string
+
+		b.Run(fmt.Sprintf("%s/create", mode), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				patchDigest, err = dmpr.CreatePatch(ctx, patchPath, containerSnapKey, *img)
+				require.NoError(b, err, "Failed to create patch")
+			}
+
+			info, err := os.Stat(patchPath)
+			require.NoError(b, err)
+			b.ReportMetric(float64(info.Size()), "patch-bytes")
+		})
+
+		b.Run(fmt.Sprintf("%s/restore", mode), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				restoreSnapKey := fmt.Sprintf("benchsnap-%s-restore-%d", mode, i)
+				require.NoError(b, dmpr.CreateDeviceSnapshotFromImage(ctx, restoreSnapKey, *img))
+				b.StartTimer()
+
+				err := dmpr.RestorePatch(ctx, restoreSnapKey, patchPath, patchDigest)
+
+				b.StopTimer()
+				_ = dmpr.RemoveDeviceSnapshot(ctx, restoreSnapKey)
+				require.NoError(b, err, "Failed to restore patch")
+				b.StartTimer()
+			}
+		})
+
+		require.NoError(b, dmpr.RemoveDeviceSnapshot(ctx, containerSnapKey))
+	}
+}
@@ -0,0 +1,315 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+// DevicePoolPolicy Configures the pool of patched origins, i.e., read-only snapshots of images with the patch of a
+// VM snapshot applied, of which the container snapshots of the loaded VMs are thin snapshots
+type DevicePoolPolicy struct {
+	// MaxOrigins is the number of origins kept, the least recently used unused ones are removed first. Origins in use
+	// by a container snapshot are kept even if there are more. Zero disables the pool.
+	MaxOrigins int
+}
+
+// DevicePoolStats Reports the use of the pool of patched origins
+type DevicePoolStats struct {
+	// Origins is the number of origins in the pool
+	Origins int
+	// Hits is the number of container snapshots created from an existing origin
+	Hits int
+	// Misses is the number of container snapshots for which an origin was created
+	Misses int
+	// TimeSaved is the time the hits took less than creating the origin they used
+	TimeSaved time.Duration
+}
+
+// ToMap Returns the statistics as metrics
+func (s DevicePoolStats) ToMap() map[string]float64 {
+	return map[string]float64{
+		metrics.DevicePoolOrigins:     float64(s.Origins),
+		metrics.DevicePoolHits:        float64(s.Hits),
+		metrics.DevicePoolMisses:      float64(s.Misses),
+		metrics.DevicePoolTimeSavedUs: metrics.ToUS(s.TimeSaved),
+	}
+}
+
+// patchedOrigin is a committed snapshot of an image with a patch applied
+type patchedOrigin struct {
+	name      string
+	ready     chan struct{} // closed once the origin is created, or failed to be created
+	err       error
+	buildTime time.Duration
+	users     int // container snapshots of the origin, including the ones being created
+	lastUsed  time.Time
+}
+
+// devicePool tracks the patched origins and the container snapshots created from them
+type devicePool struct {
+	sync.Mutex
+	policy   DevicePoolPolicy
+	origins  map[string]*patchedOrigin
+	children map[string]*patchedOrigin // maps container snapshot key to its origin
+	stats    DevicePoolStats
+}
+
+func newDevicePool(policy DevicePoolPolicy) *devicePool {
+	return &devicePool{
+		policy:   policy,
+		origins:  make(map[string]*patchedOrigin),
+		children: make(map[string]*patchedOrigin),
+	}
+}
+
+// originName identifies the origin of an image and a patch. The digest of the patch changes with its contents, thus
+// a new snapshot of a revision never reuses the origin of the previous one
+func originName(imageKey, patchDigest string) string {
+	sum := sha256.Sum256([]byte(imageKey + "\n" + patchDigest))
+	return "origin-" + hex.EncodeToString(sum[:16])
+}
+
+// acquire returns the origin of the given name and whether it has to be created by the caller
+func (p *devicePool) acquire(name string) (*patchedOrigin, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	origin, present := p.origins[name]
+	if !present {
+		origin = &patchedOrigin{name: name, ready: make(chan struct{})}
+		p.origins[name] = origin
+	}
+	origin.users++
+	origin.lastUsed = time.Now()
+
+	return origin, !present
+}
+
+// created records the outcome of the creation of an origin. Failed origins are dropped, to be created again by the
+// next load
+func (p *devicePool) created(origin *patchedOrigin, buildTime time.Duration, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	origin.buildTime = buildTime
+	origin.err = err
+	if err != nil {
+		delete(p.origins, origin.name)
+	} else {
+		p.stats.Misses++
+	}
+	close(origin.ready)
+}
+
+// attach records a container snapshot created from an origin, or drops the reference of the caller if creating it
+// failed
+func (p *devicePool) attach(origin *patchedOrigin, snapKey string, elapsed time.Duration, hit bool, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if err != nil {
+		origin.users--
+		return
+	}
+
+	p.children[snapKey] = origin
+	if hit {
+		p.stats.Hits++
+		if saved := origin.buildTime - elapsed; saved > 0 {
+			p.stats.TimeSaved += saved
+		}
+	}
+}
+
+// detach drops the reference of a removed container snapshot to its origin, returning false if it had none
+func (p *devicePool) detach(snapKey string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	origin, present := p.children[snapKey]
+	if !present {
+		return false
+	}
+	delete(p.children, snapKey)
+	origin.users--
+	return true
+}
+
+// evict removes the unused origins over the given limit from the pool, least recently used first, and returns them
+func (p *devicePool) evict(limit int) []string {
+	p.Lock()
+	defer p.Unlock()
+
+	var evicted []string
+	for len(p.origins) > limit {
+		var lru *patchedOrigin
+		for _, origin := range p.origins {
+			if origin.users > 0 {
+				continue
+			}
+			if lru == nil || origin.lastUsed.Before(lru.lastUsed) {
+				lru = origin
+			}
+		}
+		if lru == nil {
+			break
+		}
+		delete(p.origins, lru.name)
+		evicted = append(evicted, lru.name)
+	}
+
+	return evicted
+}
+
+func (p *devicePool) getStats() DevicePoolStats {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := p.stats
+	stats.Origins = len(p.origins)
+	return stats
+}
+
+// CreatePatchedDeviceSnapshot creates a container snapshot of the image with the given patch applied on top, as
+// RestorePatch does. With a device pool, the patch is only applied once to a read-only origin, and the container
+// snapshot is a thin snapshot of that origin, which takes the patch off the critical path of the following loads.
+func (dmpr *DeviceMapper) CreatePatchedDeviceSnapshot(ctx context.Context, snapKey string, image containerd.Image, patchPath, patchDigest string) error {
+	// Origins are told apart by the digest of their patch
+	if dmpr.pool == nil || patchDigest == "" {
+		if err := dmpr.CreateDeviceSnapshotFromImage(ctx, snapKey, image); err != nil {
+			return err
+		}
+		if err := dmpr.RestorePatch(ctx, snapKey, patchPath, patchDigest); err != nil {
+			dmpr.removeFailed(ctx, snapKey)
+			return err
+		}
+		return nil
+	}
+
+	imageKey, err := getImageKey(image, ctx)
+	if err != nil {
+		return err
+	}
+
+	tStart := time.Now()
+	origin, create := dmpr.pool.acquire(originName(imageKey, patchDigest))
+	if create {
+		err := dmpr.createOrigin(ctx, origin.name, imageKey, patchPath, patchDigest)
+		dmpr.pool.created(origin, time.Since(tStart), err)
+	} else {
+		select {
+		case <-origin.ready:
+		case <-ctx.Done():
+			dmpr.pool.attach(origin, snapKey, 0, false, ctx.Err())
+			return ctx.Err()
+		}
+	}
+
+	if origin.err != nil {
+		dmpr.pool.attach(origin, snapKey, 0, false, origin.err)
+		return origin.err
+	}
+
+	err = dmpr.CreateDeviceSnapshot(ctx, snapKey, origin.name)
+	dmpr.pool.attach(origin, snapKey, time.Since(tStart), !create, err)
+	dmpr.evictOrigins(ctx, dmpr.pool.policy.MaxOrigins)
+
+	return err
+}
+
+// createOrigin applies the patch to a new snapshot of the image, committed as the origin of the given name
+func (dmpr *DeviceMapper) createOrigin(ctx context.Context, name, imageKey, patchPath, patchDigest string) error {
+	activeKey := name + "-active"
+	if err := dmpr.CreateDeviceSnapshot(ctx, activeKey, imageKey); err != nil {
+		return err
+	}
+	if err := dmpr.RestorePatch(ctx, activeKey, patchPath, patchDigest); err != nil {
+		dmpr.removeFailed(ctx, activeKey)
+		return err
+	}
+
+	dmpr.Lock()
+	defer dmpr.Unlock()
+
+	activeLease := dmpr.leases[activeKey]
+	delete(dmpr.snapDevices, activeKey)
+	delete(dmpr.leases, activeKey)
+
+	lease, err := dmpr.leaseManager.Create(ctx, leases.WithID(name), leases.WithLabels(ownerLabels()))
+	if err != nil {
+		_ = dmpr.removeOwned(ctx, activeKey, *activeLease)
+		return err
+	}
+
+	// Committed snapshots are read-only, and are the parents of the thin snapshots of the containers
+	if err := dmpr.snapshotService.Commit(leases.WithLease(ctx, lease.ID), name, activeKey, snapshots.WithLabels(ownerLabels())); err != nil {
+		_ = dmpr.removeOwned(ctx, activeKey, *activeLease)
+		_ = dmpr.leaseManager.Delete(ctx, lease)
+		return errors.Wrapf(err, "committing origin %s", name)
+	}
+	dmpr.leases[name] = &lease
+
+	// The active snapshot is gone once committed
+	if err := dmpr.leaseManager.Delete(ctx, *activeLease); err != nil {
+		log.WithError(err).WithField("lease", activeKey).Warn("Failed to delete lease of committed origin")
+	}
+
+	return nil
+}
+
+// evictOrigins removes the unused origins over the given limit
+func (dmpr *DeviceMapper) evictOrigins(ctx context.Context, limit int) {
+	for _, name := range dmpr.pool.evict(limit) {
+		if err := dmpr.RemoveDeviceSnapshot(ctx, name); err != nil {
+			log.WithError(err).WithField("origin", name).Warn("Failed to remove origin, leaving it to reconciliation")
+		}
+	}
+}
+
+// removeFailed removes a snapshot that failed to be set up
+func (dmpr *DeviceMapper) removeFailed(ctx context.Context, snapKey string) {
+	if err := dmpr.RemoveDeviceSnapshot(ctx, snapKey); err != nil {
+		log.WithError(err).WithField("snapKey", snapKey).Warn("Failed to remove device snapshot, leaving it to reconciliation")
+	}
+}
+
+// GetDevicePoolStats Returns the statistics of the pool of patched origins
+func (dmpr *DeviceMapper) GetDevicePoolStats() DevicePoolStats {
+	if dmpr.pool == nil {
+		return DevicePoolStats{}
+	}
+	return dmpr.pool.getStats()
+}
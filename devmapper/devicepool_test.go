@@ -0,0 +1,91 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginName(t *testing.T) {
+	name := originName("sha256:image", "sha256:patch")
+	require.Equal(t, name, originName("sha256:image", "sha256:patch"))
+	require.NotEqual(t, name, originName("sha256:image", "sha256:other"))
+	require.NotEqual(t, name, originName("sha256:other", "sha256:patch"))
+}
+
+func TestDevicePool(t *testing.T) {
+	pool := newDevicePool(DevicePoolPolicy{MaxOrigins: 1})
+
+	first, create := pool.acquire("first")
+	require.True(t, create)
+	pool.created(first, 100*time.Millisecond, nil)
+	pool.attach(first, "vm1", 100*time.Millisecond, false, nil)
+
+	// Loads of the same snapshot reuse the origin
+	origin, create := pool.acquire("first")
+	require.False(t, create)
+	require.Same(t, first, origin)
+	<-origin.ready
+	pool.attach(origin, "vm2", 10*time.Millisecond, true, nil)
+
+	second, create := pool.acquire("second")
+	require.True(t, create)
+	pool.created(second, 100*time.Millisecond, nil)
+	pool.attach(second, "vm3", 100*time.Millisecond, false, nil)
+
+	require.Empty(t, pool.evict(1), "origins in use must be kept")
+	require.Equal(t, DevicePoolStats{Origins: 2, Hits: 1, Misses: 2, TimeSaved: 90 * time.Millisecond}, pool.getStats())
+
+	require.True(t, pool.detach("vm1"))
+	require.Empty(t, pool.evict(1))
+	require.True(t, pool.detach("vm2"))
+	require.False(t, pool.detach("vm2"))
+	require.Equal(t, []string{"first"}, pool.evict(1))
+
+	require.True(t, pool.detach("vm3"))
+	require.Empty(t, pool.evict(1), "the pool holds one origin")
+	require.Equal(t, 1, pool.getStats().Origins)
+}
+
+func TestDevicePoolFailedOrigin(t *testing.T) {
+	pool := newDevicePool(DevicePoolPolicy{MaxOrigins: 1})
+
+	origin, create := pool.acquire("origin")
+	require.True(t, create)
+	waiter, create := pool.acquire("origin")
+	require.False(t, create)
+
+	pool.created(origin, time.Second, ErrCorruptPatch)
+	<-waiter.ready
+	require.ErrorIs(t, waiter.err, ErrCorruptPatch)
+	pool.attach(origin, "vm1", 0, false, origin.err)
+	pool.attach(waiter, "vm2", 0, false, waiter.err)
+
+	// Failed origins are created again by the next load
+	_, create = pool.acquire("origin")
+	require.True(t, create)
+	require.Equal(t, DevicePoolStats{Origins: 1}, pool.getStats())
+}
@@ -0,0 +1,640 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// filePatchMagic starts file patches
+const filePatchMagic = "VHFSPT01"
+
+// patchOp is the operation of a file patch entry
+type patchOp uint8
+
+const (
+	opEnd     patchOp = iota
+	opDelete          // removes the path and everything below it
+	opFile            // creates a regular file, followed by Size bytes of contents
+	opDir             // creates a directory or updates its metadata
+	opSymlink         // creates a symlink to Link
+	opLink            // creates a hardlink to the path Link, relative to the root
+	opSpecial         // creates a device node or a fifo
+	opMeta            // updates the metadata of a path whose contents are unchanged
+)
+
+// patchEntry is a change to a single path of a file system
+type patchEntry struct {
+	Op     patchOp
+	Path   string // relative to the root, slash separated
+	Link   string
+	Xattrs map[string][]byte
+	patchAttrs
+}
+
+// patchAttrs are the fixed size attributes of a patch entry
+type patchAttrs struct {
+	Mode    uint32 // st_mode, including the file type
+	UID     uint32
+	GID     uint32
+	Rdev    uint64
+	ModTime int64 // nanoseconds since the epoch
+	Size    int64
+}
+
+// fileState is the state of a path compared between two file systems
+type fileState struct {
+	patchAttrs
+	ino    uint64
+	nlink  uint64
+	link   string
+	xattrs map[string][]byte
+}
+
+func statFile(path string) (*fileState, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return nil, err
+	}
+
+	state := &fileState{
+		patchAttrs: patchAttrs{
+			Mode:    st.Mode,
+			UID:     st.Uid,
+			GID:     st.Gid,
+			Rdev:    uint64(st.Rdev),
+			ModTime: st.Mtim.Nano(),
+			Size:    st.Size,
+		},
+		ino:   st.Ino,
+		nlink: uint64(st.Nlink),
+	}
+
+	var err error
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		if state.link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	if state.xattrs, err = listXattrs(path); err != nil {
+		return nil, errors.Wrapf(err, "reading extended attributes of %s", path)
+	}
+
+	return state, nil
+}
+
+func (s *fileState) fileType() uint32 {
+	return s.Mode & unix.S_IFMT
+}
+
+// sameContents checks whether two files have the same type and contents. Like rsync, regular files are considered
+// unchanged if their sizes and modification times match
+func (s *fileState) sameContents(o *fileState) bool {
+	if s.fileType() != o.fileType() {
+		return false
+	}
+	switch s.fileType() {
+	case unix.S_IFREG:
+		return s.Size == o.Size && s.ModTime == o.ModTime
+	case unix.S_IFLNK:
+		return s.link == o.link
+	case unix.S_IFCHR, unix.S_IFBLK:
+		return s.Rdev == o.Rdev
+	}
+	return true
+}
+
+// sameMeta checks whether two files have the same permissions, owner, modification time and extended attributes
+func (s *fileState) sameMeta(o *fileState) bool {
+	if s.Mode != o.Mode || s.UID != o.UID || s.GID != o.GID || s.ModTime != o.ModTime {
+		return false
+	}
+	if len(s.xattrs) != len(o.xattrs) {
+		return false
+	}
+	for k, v := range s.xattrs {
+		if ov, ok := o.xattrs[k]; !ok || string(ov) != string(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func listXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		vsize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:vsize]
+	}
+	return xattrs, nil
+}
+
+// extractPatch writes the differences between the file systems mounted at the supplied paths to the supplied
+// patchPath, such that applyPatch turns the image file system into the container file system. It returns the
+// checksum of the patch file.
+func extractPatch(imageMountPath, containerMountPath, patchPath string) (string, error) {
+	w, err := createPatchFile(patchPath)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFilePatch(w, imageMountPath, containerMountPath); err != nil {
+		w.Abort()
+		return "", errors.Wrapf(err, "creating patch between %s and %s at %s", imageMountPath, containerMountPath, patchPath)
+	}
+	return w.Commit()
+}
+
+// writeFilePatch writes the changes from the tree at oldRoot to the tree at newRoot
+func writeFilePatch(w io.Writer, oldRoot, newRoot string) error {
+	pw := &patchWriter{w: bufio.NewWriterSize(w, 1<<20)}
+	if _, err := pw.w.WriteString(filePatchMagic); err != nil {
+		return err
+	}
+
+	// Deletions come first, so that new paths never collide with stale ones
+	err := filepath.WalkDir(oldRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(oldRoot, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(newRoot, rel)); err == nil {
+			return nil
+		} else if !isNotExist(err) {
+			return err
+		}
+
+		if err := pw.writeEntry(&patchEntry{Op: opDelete, Path: filepath.ToSlash(rel)}, nil); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Paths of hardlinked files seen so far, by inode
+	links := make(map[uint64]string)
+	// Hardlinked files that are part of the patch
+	emitted := make(map[string]bool)
+
+	err = filepath.WalkDir(newRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(newRoot, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		cur, err := statFile(path)
+		if err != nil {
+			return err
+		}
+		if cur.fileType() == unix.S_IFSOCK {
+			return nil
+		}
+
+		old, err := statFile(filepath.Join(oldRoot, rel))
+		if err != nil && !isNotExist(err) {
+			return err
+		}
+		changed := old == nil || !old.sameContents(cur)
+
+		entry := &patchEntry{Path: rel, Xattrs: cur.xattrs, patchAttrs: cur.patchAttrs}
+
+		if cur.fileType() == unix.S_IFREG && cur.nlink > 1 {
+			if first, ok := links[cur.ino]; ok {
+				if changed || (old != nil && !old.sameMeta(cur)) || emitted[first] {
+					entry.Op = opLink
+					entry.Link = first
+					return pw.writeEntry(entry, nil)
+				}
+				return nil
+			}
+			links[cur.ino] = rel
+		}
+
+		if !changed && old.sameMeta(cur) {
+			return nil
+		}
+		emitted[rel] = true
+
+		switch {
+		case !changed && cur.fileType() != unix.S_IFDIR:
+			entry.Op = opMeta
+			return pw.writeEntry(entry, nil)
+		case cur.fileType() == unix.S_IFDIR:
+			entry.Op = opDir
+			return pw.writeEntry(entry, nil)
+		case cur.fileType() == unix.S_IFLNK:
+			entry.Op = opSymlink
+			entry.Link = cur.link
+			return pw.writeEntry(entry, nil)
+		case cur.fileType() == unix.S_IFREG:
+			entry.Op = opFile
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return pw.writeEntry(entry, f)
+		default:
+			entry.Op = opSpecial
+			return pw.writeEntry(entry, nil)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := pw.w.WriteByte(byte(opEnd)); err != nil {
+		return err
+	}
+	return pw.w.Flush()
+}
+
+// isNotExist checks whether a path is missing, including because one of its parents is not a directory
+func isNotExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, unix.ENOTDIR)
+}
+
+// patchWriter encodes the entries of a file patch
+type patchWriter struct {
+	w *bufio.Writer
+}
+
+func (pw *patchWriter) writeString(s string) error {
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := pw.w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))]); err != nil {
+		return err
+	}
+	_, err := pw.w.WriteString(s)
+	return err
+}
+
+// writeEntry writes an entry, followed by the contents read from data for regular files
+func (pw *patchWriter) writeEntry(e *patchEntry, data io.Reader) error {
+	if err := pw.w.WriteByte(byte(e.Op)); err != nil {
+		return err
+	}
+	if err := pw.writeString(e.Path); err != nil {
+		return err
+	}
+	if e.Op == opDelete {
+		return nil
+	}
+	if err := binary.Write(pw.w, binary.LittleEndian, e.patchAttrs); err != nil {
+		return err
+	}
+	if err := pw.writeString(e.Link); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(e.Xattrs))
+	for name := range e.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := pw.w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(names)))]); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := pw.writeString(name); err != nil {
+			return err
+		}
+		if err := pw.writeString(string(e.Xattrs[name])); err != nil {
+			return err
+		}
+	}
+
+	if e.Op != opFile {
+		return nil
+	}
+	n, err := io.Copy(pw.w, io.LimitReader(data, e.Size))
+	if err != nil {
+		return err
+	}
+	if n != e.Size {
+		return errors.Errorf("%s changed while creating the patch", e.Path)
+	}
+	return nil
+}
+
+// patchReader decodes the entries of a file patch
+type patchReader struct {
+	r *bufio.Reader
+}
+
+func (pr *patchReader) readString() (string, error) {
+	n, err := binary.ReadUvarint(pr.r)
+	if err != nil {
+		return "", err
+	}
+	if n > 1<<20 {
+		return "", errors.Errorf("invalid string length %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(pr.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readEntry reads the next entry, without the contents of regular files that follow it
+func (pr *patchReader) readEntry() (*patchEntry, error) {
+	op, err := pr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	e := &patchEntry{Op: patchOp(op)}
+	if e.Op == opEnd {
+		return e, nil
+	}
+	if e.Op > opMeta {
+		return nil, errors.Errorf("unknown patch operation %d", op)
+	}
+	if e.Path, err = pr.readString(); err != nil {
+		return nil, err
+	}
+	if e.Op == opDelete {
+		return e, nil
+	}
+	if err := binary.Read(pr.r, binary.LittleEndian, &e.patchAttrs); err != nil {
+		return nil, err
+	}
+	if e.Link, err = pr.readString(); err != nil {
+		return nil, err
+	}
+
+	n, err := binary.ReadUvarint(pr.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		e.Xattrs = make(map[string][]byte)
+	}
+	for i := uint64(0); i < n; i++ {
+		name, err := pr.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := pr.readString()
+		if err != nil {
+			return nil, err
+		}
+		e.Xattrs[name] = []byte(value)
+	}
+	return e, nil
+}
+
+// applyPatch applies the file changes of a patch to the filesystem mounted at the supplied path
+func applyPatch(containerMountPath string, patch io.Reader) error {
+	if err := readFilePatch(patch, containerMountPath); err != nil {
+		return errors.Wrapf(err, "applying patch at %s", containerMountPath)
+	}
+	return nil
+}
+
+// readFilePatch applies the entries of a file patch to the tree at root as they are read
+func readFilePatch(r io.Reader, root string) error {
+	pr := &patchReader{r: bufio.NewReaderSize(r, 1<<20)}
+
+	magic := make([]byte, len(filePatchMagic))
+	if _, err := io.ReadFull(pr.r, magic); err != nil || string(magic) != filePatchMagic {
+		return errors.New("not a file patch")
+	}
+
+	// Changing the entries of a directory changes its modification time, which is thus restored at the end, either
+	// to its time before the patch or to the time of the patch entry of the directory
+	parents := make(map[string]int64)
+	var dirs []*patchEntry
+
+	for {
+		e, err := pr.readEntry()
+		if err != nil {
+			return errors.Wrap(err, "reading patch entry")
+		}
+		if e.Op == opEnd {
+			break
+		}
+
+		path, err := resolvePatchPath(root, e.Path)
+		if err != nil {
+			return err
+		}
+		if parent := filepath.Dir(path); e.Op != opMeta && path != root {
+			if _, ok := parents[parent]; !ok {
+				var st unix.Stat_t
+				if err := unix.Lstat(parent, &st); err != nil {
+					return err
+				}
+				parents[parent] = st.Mtim.Nano()
+			}
+		}
+		if err := applyEntry(root, path, e, pr.r); err != nil {
+			return errors.Wrapf(err, "applying change to %s", e.Path)
+		}
+		if e.Op == opDir {
+			dirs = append(dirs, e)
+		}
+	}
+
+	for parent, modTime := range parents {
+		if err := setModTime(parent, modTime); err != nil && !isNotExist(errors.Cause(err)) {
+			return err
+		}
+	}
+	for _, dir := range dirs {
+		path, _ := resolvePatchPath(root, dir.Path)
+		if err := setModTime(path, dir.ModTime); err != nil {
+			return errors.Wrapf(err, "applying change to %s", dir.Path)
+		}
+	}
+	return nil
+}
+
+// resolvePatchPath returns the path of a patch entry below root. Paths leaving root, including through symlinks in
+// their parent directories, are rejected
+func resolvePatchPath(root, rel string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(rel))
+	if clean == "." {
+		return root, nil
+	}
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("patch path %q is outside of the root", rel)
+	}
+
+	parent := root
+	parts := strings.Split(clean, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		fi, err := os.Lstat(parent)
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", errors.Errorf("parent %s of patch path %q is not a directory", parent, rel)
+		}
+	}
+	return filepath.Join(root, clean), nil
+}
+
+func applyEntry(root, path string, e *patchEntry, data io.Reader) error {
+	existing, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if e.Op == opDelete {
+		return os.RemoveAll(path)
+	}
+	if e.Op == opMeta {
+		return setMeta(path, e)
+	}
+
+	// Directories are updated in place, other paths are replaced, which also unlinks them from any hardlinks
+	if existing != nil && !(e.Op == opDir && existing.IsDir()) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	switch e.Op {
+	case opDir:
+		if existing == nil || !existing.IsDir() {
+			if err := os.Mkdir(path, 0700); err != nil {
+				return err
+			}
+		}
+	case opFile:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(f, data, e.Size)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case opSymlink:
+		if err := os.Symlink(e.Link, path); err != nil {
+			return err
+		}
+	case opLink:
+		target, err := resolvePatchPath(root, e.Link)
+		if err != nil {
+			return err
+		}
+		// The metadata is shared with the target, which is part of the patch or of the image
+		return os.Link(target, path)
+	case opSpecial:
+		if err := unix.Mknod(path, e.Mode, int(e.Rdev)); err != nil {
+			return err
+		}
+	}
+
+	return setMeta(path, e)
+}
+
+// setMeta sets the owner, extended attributes, permissions and modification time of a path. The mode is set after
+// the owner, since changing the owner clears the setuid and setgid bits
+func setMeta(path string, e *patchEntry) error {
+	if err := os.Lchown(path, int(e.UID), int(e.GID)); err != nil {
+		return err
+	}
+
+	old, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+	for name := range old {
+		if _, ok := e.Xattrs[name]; !ok {
+			if err := unix.Lremovexattr(path, name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, value := range e.Xattrs {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil && !errors.Is(err, unix.ENOTSUP) {
+			return errors.Wrapf(err, "setting extended attribute %s", name)
+		}
+	}
+
+	if e.Mode&unix.S_IFMT != unix.S_IFLNK {
+		if err := unix.Chmod(path, e.Mode&^unix.S_IFMT); err != nil {
+			return err
+		}
+	}
+	return setModTime(path, e.ModTime)
+}
+
+func setModTime(path string, modTime int64) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(modTime), unix.NsecToTimespec(modTime)}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return errors.Wrapf(err, "setting modification time of %s", path)
+	}
+	return nil
+}
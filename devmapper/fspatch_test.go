@@ -0,0 +1,249 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+var treeTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// buildImageTree creates the file system of an image at root, with fixed modification times
+func buildImageTree(t *testing.T, root string) {
+	for _, dir := range []string{"etc", "usr/bin", "var/cache/app", "var/log", "home"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	files := map[string]string{
+		"etc/hostname":         "image\n",
+		"etc/passwd":           "root:x:0:0:root:/root:/bin/sh\n",
+		"usr/bin/app":          "#!/bin/sh\necho app\n",
+		"usr/bin/tool":         "tool",
+		"var/cache/app/index":  "index",
+		"var/cache/app/blob":   string(bytes.Repeat([]byte("b"), 1<<16)),
+		"var/log/app.log":      "started\n",
+		"home/replaced-by-dir": "file",
+	}
+	for name, contents := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(contents), 0644))
+	}
+	require.NoError(t, os.Chmod(filepath.Join(root, "usr/bin/app"), 0755))
+	require.NoError(t, os.Link(filepath.Join(root, "usr/bin/tool"), filepath.Join(root, "usr/bin/tool-alias")))
+	require.NoError(t, os.Symlink("app", filepath.Join(root, "usr/bin/current")))
+	require.NoError(t, unix.Setxattr(filepath.Join(root, "etc/passwd"), "user.origin", []byte("image"), 0))
+
+	setTreeTimes(t, root)
+}
+
+// setTreeTimes sets the modification times of all paths below root to treeTime
+func setTreeTimes(t *testing.T, root string) {
+	var paths []string
+	require.NoError(t, filepath.Walk(root, func(path string, _ os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return err
+	}))
+	ts := []unix.Timespec{unix.NsecToTimespec(treeTime.UnixNano()), unix.NsecToTimespec(treeTime.UnixNano())}
+	for i := len(paths) - 1; i >= 0; i-- {
+		require.NoError(t, unix.UtimesNanoAt(unix.AT_FDCWD, paths[i], ts, unix.AT_SYMLINK_NOFOLLOW))
+	}
+}
+
+// changeContainerTree applies the changes of a container to its image file system
+func changeContainerTree(t *testing.T, root string) {
+	path := func(name string) string { return filepath.Join(root, name) }
+
+	// Added files, directories, symlinks, hardlinks and fifos
+	require.NoError(t, os.MkdirAll(path("srv/data"), 0750))
+	require.NoError(t, os.WriteFile(path("srv/data/new"), []byte("new"), 0600))
+	require.NoError(t, os.Link(path("srv/data/new"), path("srv/new-alias")))
+	require.NoError(t, os.Symlink("/srv/data/new", path("srv/abs-link")))
+	require.NoError(t, unix.Mkfifo(path("srv/fifo"), 0640))
+	require.NoError(t, os.Lchown(path("srv/data"), 1000, 1000))
+
+	// Changed contents, permissions, owners, extended attributes and symlink targets
+	require.NoError(t, os.WriteFile(path("etc/hostname"), []byte("container\n"), 0644))
+	f, err := os.OpenFile(path("var/log/app.log"), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("served\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Chmod(path("usr/bin/tool"), 0700))
+	require.NoError(t, os.Lchown(path("etc/hostname"), 1000, 1001))
+	require.NoError(t, unix.Setxattr(path("etc/passwd"), "user.origin", []byte("container"), 0))
+	require.NoError(t, unix.Setxattr(path("etc/hostname"), "user.added", []byte{0, 1, 2}, 0))
+	require.NoError(t, os.Remove(path("usr/bin/current")))
+	require.NoError(t, os.Symlink("tool", path("usr/bin/current")))
+
+	// Deleted files and directories, and a file replaced by a directory
+	require.NoError(t, os.RemoveAll(path("var/cache/app")))
+	require.NoError(t, os.Remove(path("home/replaced-by-dir")))
+	require.NoError(t, os.Mkdir(path("home/replaced-by-dir"), 0755))
+	require.NoError(t, os.WriteFile(path("home/replaced-by-dir/file"), []byte("file"), 0644))
+}
+
+// requireSameTree checks that two trees have the same paths, contents, metadata and hardlinks
+func requireSameTree(t *testing.T, want, got string) {
+	list := func(root string) ([]string, map[string]string) {
+		var paths []string
+		links := make(map[uint64][]string)
+		require.NoError(t, filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			require.NoError(t, err)
+			rel, _ := filepath.Rel(root, path)
+			paths = append(paths, rel)
+			if fi.Mode().IsRegular() {
+				ino := fi.Sys().(*syscall.Stat_t).Ino
+				links[ino] = append(links[ino], rel)
+			}
+			return nil
+		}))
+		// Maps each hardlinked path to the first path of its inode
+		firsts := make(map[string]string)
+		for _, group := range links {
+			sort.Strings(group)
+			for _, p := range group {
+				firsts[p] = group[0]
+			}
+		}
+		return paths, firsts
+	}
+
+	wantPaths, wantLinks := list(want)
+	gotPaths, gotLinks := list(got)
+	require.Equal(t, wantPaths, gotPaths, "Trees have different paths")
+	require.Equal(t, wantLinks, gotLinks, "Trees have different hardlinks")
+
+	for _, rel := range wantPaths {
+		w, err := statFile(filepath.Join(want, rel))
+		require.NoError(t, err)
+		g, err := statFile(filepath.Join(got, rel))
+		require.NoError(t, err)
+
+		require.True(t, w.sameContents(g), "Contents of %s differ", rel)
+		require.True(t, w.sameMeta(g), "Metadata of %s differs: %+v, %+v", rel, w, g)
+		if w.fileType() == unix.S_IFREG {
+			wb, err := os.ReadFile(filepath.Join(want, rel))
+			require.NoError(t, err)
+			gb, err := os.ReadFile(filepath.Join(got, rel))
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(wb, gb), "Contents of %s differ", rel)
+		}
+	}
+}
+
+func TestFilePatch(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image")
+	container := filepath.Join(t.TempDir(), "container")
+	restored := filepath.Join(t.TempDir(), "restored")
+	patchPath := filepath.Join(t.TempDir(), "patch")
+
+	for _, root := range []string{image, container, restored} {
+		require.NoError(t, os.Mkdir(root, 0755))
+		buildImageTree(t, root)
+	}
+	changeContainerTree(t, container)
+
+	patchDigest, err := extractPatch(image, container, patchPath)
+	require.NoError(t, err, "Failed to create patch")
+
+	info, err := os.Stat(patchPath)
+	require.NoError(t, err)
+	require.Less(t, info.Size(), int64(1<<12), "Patch must not hold unchanged files")
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm(), "Patch must be readable by everyone")
+
+	patch, err := openPatchFile(patchPath, patchDigest)
+	require.NoError(t, err, "Failed to open patch")
+	defer patch.Close()
+	require.False(t, patch.isBlockPatch(), "File patch recognized as a block patch")
+
+	require.NoError(t, applyPatch(restored, patch), "Failed to apply patch")
+	requireSameTree(t, container, restored)
+
+	// The tree of the image is left untouched when extracting the patch
+	rebuilt := filepath.Join(t.TempDir(), "rebuilt")
+	require.NoError(t, os.Mkdir(rebuilt, 0755))
+	buildImageTree(t, rebuilt)
+	requireSameTree(t, rebuilt, image)
+}
+
+func TestFilePatchUnchanged(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image")
+	container := filepath.Join(t.TempDir(), "container")
+	for _, root := range []string{image, container} {
+		require.NoError(t, os.Mkdir(root, 0755))
+		buildImageTree(t, root)
+	}
+
+	var patch bytes.Buffer
+	require.NoError(t, writeFilePatch(&patch, image, container))
+	require.Equal(t, filePatchMagic+string([]byte{byte(opEnd)}), patch.String(), "Patch of identical trees must be empty")
+}
+
+func TestFilePatchRejectsEscapes(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+
+	for _, path := range []string{"../outside", "/etc/passwd", "escape/file"} {
+		var patch bytes.Buffer
+		pw := &patchWriter{w: bufio.NewWriter(&patch)}
+		_, err := pw.w.WriteString(filePatchMagic)
+		require.NoError(t, err)
+		require.NoError(t, pw.writeEntry(&patchEntry{Op: opFile, Path: path, patchAttrs: patchAttrs{Mode: unix.S_IFREG | 0644, Size: 1}}, bytes.NewReader([]byte("x"))))
+		require.NoError(t, pw.w.WriteByte(byte(opEnd)))
+		require.NoError(t, pw.w.Flush())
+
+		require.Error(t, readFilePatch(&patch, root), "Patch path %s must be rejected", path)
+	}
+
+	entries, err := os.ReadDir(outside)
+	require.NoError(t, err)
+	require.Empty(t, entries, "Patch wrote outside of the root")
+}
+
+func TestFilePatchTruncated(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image")
+	container := filepath.Join(t.TempDir(), "container")
+	for _, root := range []string{image, container} {
+		require.NoError(t, os.Mkdir(root, 0755))
+		buildImageTree(t, root)
+	}
+	changeContainerTree(t, container)
+
+	var patch bytes.Buffer
+	require.NoError(t, writeFilePatch(&patch, image, container))
+
+	restored := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, os.Mkdir(restored, 0755))
+	buildImageTree(t, restored)
+	require.Error(t, readFilePatch(bytes.NewReader(patch.Bytes()[:patch.Len()-1]), restored), "Truncated patch must be rejected")
+	require.Error(t, readFilePatch(bytes.NewReader([]byte("VHBLKPT1")), restored), "Block patch must be rejected")
+}
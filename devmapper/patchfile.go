@@ -0,0 +1,173 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ErrCorruptPatch is returned when a patch file does not match the checksum recorded when it was created, e.g.,
+// because it was truncated by a crash while snapshotting
+var ErrCorruptPatch = errors.New("patch file corrupted")
+
+// patchFileWriter stores a patch compressed with zstd, while computing the checksum of the stored file
+type patchFileWriter struct {
+	f        *os.File
+	digester digest.Digester
+	zw       *zstd.Encoder
+}
+
+// createPatchFile creates a patch file that is readable by everyone, e.g., to upload it to remote storage
+func createPatchFile(patchPath string) (*patchFileWriter, error) {
+	f, err := os.OpenFile(patchPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &patchFileWriter{f: f, digester: digest.SHA256.Digester()}
+	if w.zw, err = zstd.NewWriter(io.MultiWriter(f, w.digester.Hash())); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *patchFileWriter) Write(p []byte) (int, error) {
+	return w.zw.Write(p)
+}
+
+// Commit flushes the compressed patch to disk and returns the checksum of the patch file
+func (w *patchFileWriter) Commit() (string, error) {
+	defer w.f.Close()
+
+	if err := w.zw.Close(); err != nil {
+		return "", err
+	}
+	if err := w.f.Sync(); err != nil {
+		return "", err
+	}
+	return w.digester.Digest().String(), nil
+}
+
+// Abort discards a patch that could not be written completely
+func (w *patchFileWriter) Abort() {
+	_ = w.zw.Close()
+	_ = w.f.Close()
+	_ = os.Remove(w.f.Name())
+}
+
+// verifyPatchFile checks the patch file against the checksum recorded when it was created
+func verifyPatchFile(patchPath, patchDigest string) error {
+	expected, err := digest.Parse(patchDigest)
+	if err != nil {
+		return errors.Wrapf(ErrCorruptPatch, "invalid checksum %q of %s", patchDigest, patchPath)
+	}
+
+	f, err := os.Open(patchPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.Wrapf(ErrCorruptPatch, "%s is missing", patchPath)
+		}
+		return err
+	}
+	defer f.Close()
+
+	actual, err := expected.Algorithm().FromReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "computing checksum of %s", patchPath)
+	}
+	if actual != expected {
+		return errors.Wrapf(ErrCorruptPatch, "checksum of %s is %s, expected %s", patchPath, actual, expected)
+	}
+	return nil
+}
+
+// patchFileReader decompresses a patch file
+type patchFileReader struct {
+	*bufio.Reader
+	f  *os.File
+	zr *zstd.Decoder
+}
+
+// openPatchFile verifies a patch file before returning a reader of its decompressed contents. The whole file is
+// checked before it is read, since patches are applied while being read
+func openPatchFile(patchPath, patchDigest string) (*patchFileReader, error) {
+	if err := verifyPatchFile(patchPath, patchDigest); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(patchPath)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(ErrCorruptPatch, "decompressing %s: %v", patchPath, err)
+	}
+
+	return &patchFileReader{Reader: bufio.NewReaderSize(zr, 1<<20), f: f, zr: zr}, nil
+}
+
+// isBlockPatch checks whether the patch was created in block mode
+func (r *patchFileReader) isBlockPatch() bool {
+	magic, err := r.Peek(len(blockPatchMagic))
+	return err == nil && string(magic) == blockPatchMagic
+}
+
+func (r *patchFileReader) Close() error {
+	r.zr.Close()
+	return r.f.Close()
+}
+
+// WritePatchFile stores the patch written by write in a patch file compressed with zstd, the format of the container
+// patches, and returns the checksum of the patch file to pass to ReadPatchFile
+func WritePatchFile(patchPath string, write func(w io.Writer) error) (string, error) {
+	w, err := createPatchFile(patchPath)
+	if err != nil {
+		return "", err
+	}
+	if err := write(w); err != nil {
+		w.Abort()
+		return "", errors.Wrapf(err, "writing patch %s", patchPath)
+	}
+	return w.Commit()
+}
+
+// ReadPatchFile passes the decompressed contents of a patch file written by WritePatchFile to read, once the patch
+// file is checked against its checksum. It fails with ErrCorruptPatch if it does not match
+func ReadPatchFile(patchPath, patchDigest string, read func(r io.Reader) error) error {
+	patch, err := openPatchFile(patchPath, patchDigest)
+	if err != nil {
+		return err
+	}
+	defer patch.Close()
+
+	return read(patch)
+}
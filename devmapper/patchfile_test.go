@@ -0,0 +1,111 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestPatch stores contents as a patch file and returns its checksum
+func writeTestPatch(t *testing.T, patchPath string, contents []byte) string {
+	w, err := createPatchFile(patchPath)
+	require.NoError(t, err, "Failed to create patch file")
+	_, err = w.Write(contents)
+	require.NoError(t, err, "Failed to write patch file")
+	patchDigest, err := w.Commit()
+	require.NoError(t, err, "Failed to commit patch file")
+	return patchDigest
+}
+
+func TestPatchFile(t *testing.T) {
+	patchPath := filepath.Join(t.TempDir(), "patch")
+	contents := append([]byte(filePatchMagic), bytes.Repeat([]byte("compressible"), 1<<16)...)
+
+	patchDigest := writeTestPatch(t, patchPath, contents)
+	require.Regexp(t, "^sha256:[0-9a-f]{64}$", patchDigest)
+
+	info, err := os.Stat(patchPath)
+	require.NoError(t, err)
+	require.Less(t, info.Size(), int64(len(contents)/10), "Patch file must be compressed")
+
+	r, err := openPatchFile(patchPath, patchDigest)
+	require.NoError(t, err, "Failed to open patch file")
+	defer r.Close()
+	require.False(t, r.isBlockPatch(), "File patch recognized as a block patch")
+
+	read, err := io.ReadAll(r)
+	require.NoError(t, err, "Failed to read patch file")
+	require.True(t, bytes.Equal(contents, read), "Patch file contents differ")
+}
+
+func TestPatchFileCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	patchPath := filepath.Join(dir, "patch")
+	patchDigest := writeTestPatch(t, patchPath, bytes.Repeat([]byte("patch"), 1<<12))
+
+	stored, err := os.ReadFile(patchPath)
+	require.NoError(t, err)
+
+	flipped := append([]byte{}, stored...)
+	flipped[len(flipped)/2] ^= 0xff
+
+	for name, tc := range map[string]struct {
+		contents []byte
+		digest   string
+	}{
+		"truncated":      {contents: stored[:len(stored)/2], digest: patchDigest},
+		"empty":          {contents: nil, digest: patchDigest},
+		"modified":       {contents: flipped, digest: patchDigest},
+		"missing digest": {contents: stored, digest: ""},
+		"invalid digest": {contents: stored, digest: "sha256:1234"},
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, tc.contents, 0644))
+
+		_, err := openPatchFile(path, tc.digest)
+		require.True(t, errors.Is(err, ErrCorruptPatch), "%s patch must be rejected as corrupt, got %v", name, err)
+	}
+
+	_, err = openPatchFile(filepath.Join(dir, "missing"), patchDigest)
+	require.True(t, errors.Is(err, ErrCorruptPatch), "Missing patch must be rejected as corrupt, got %v", err)
+}
+
+func TestPatchFileAbort(t *testing.T) {
+	patchPath := filepath.Join(t.TempDir(), "patch")
+
+	w, err := createPatchFile(patchPath)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	require.NoError(t, err)
+	w.Abort()
+
+	_, err = os.Stat(patchPath)
+	require.True(t, os.IsNotExist(err), "Aborted patch file must be removed")
+}
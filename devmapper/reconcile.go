@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/go-multierror/multierror"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ownerLabel marks the snapshots and leases created by vHive, as opposed to the ones created by containerd for
+	// containers
+	ownerLabel = "vhive.io/owner"
+	ownerValue = "devmapper"
+)
+
+func ownerLabels() map[string]string {
+	return map[string]string{ownerLabel: ownerValue}
+}
+
+func isOwned(labels map[string]string) bool {
+	return labels[ownerLabel] == ownerValue
+}
+
+// ReconcileStats Reports the orphans removed by Reconcile
+type ReconcileStats struct {
+	// Snapshots is the number of orphaned snapshots removed, together with their lease if any
+	Snapshots int
+	// Leases is the number of orphaned leases removed, whose snapshot was gone already
+	Leases int
+}
+
+// Reconcile removes the snapshots created by CreateDeviceSnapshot and their leases, e.g., left behind by a crash or
+// by a failed removal, that are neither in use nor tracked. Snapshots in use are the ones whose key is in live, e.g.,
+// the container snapshots of the running VMs. Snapshots and leases created after Reconcile started, e.g., by a
+// CreateDeviceSnapshot racing with it, are kept as well.
+func (dmpr *DeviceMapper) Reconcile(ctx context.Context, live []string) (ReconcileStats, error) {
+	var stats ReconcileStats
+
+	keep := make(map[string]bool)
+	for _, snapKey := range live {
+		keep[snapKey] = true
+	}
+	// Snapshots created by this process are kept until removed. The ones created after this point are not tracked
+	// below, hence they are recognized by their creation time
+	start := time.Now()
+	dmpr.Lock()
+	for snapKey := range dmpr.leases {
+		keep[snapKey] = true
+	}
+	dmpr.Unlock()
+
+	filter := fmt.Sprintf("labels.%q==%s", ownerLabel, ownerValue)
+
+	var owned []snapshots.Info
+	if err := dmpr.snapshotService.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+		if isOwned(info.Labels) {
+			owned = append(owned, info)
+		}
+		return nil
+	}, filter); err != nil {
+		return stats, errors.Wrap(err, "listing devmapper snapshots")
+	}
+
+	snapshotKeys := make(map[string]bool)
+	inUse := make(map[string]bool) // patched origins of the snapshots kept
+	for _, info := range owned {
+		snapshotKeys[info.Name] = true
+		if info.Created.After(start) {
+			keep[info.Name] = true
+		}
+		if keep[info.Name] {
+			inUse[info.Parent] = true
+		}
+	}
+
+	// Patched origins can only be removed after their container snapshots
+	var orphans, orphanOrigins []string
+	for _, info := range owned {
+		switch {
+		case keep[info.Name] || inUse[info.Name]:
+		case info.Kind == snapshots.KindCommitted:
+			orphanOrigins = append(orphanOrigins, info.Name)
+		default:
+			orphans = append(orphans, info.Name)
+		}
+	}
+	orphans = append(orphans, orphanOrigins...)
+
+	ownedLeases, err := dmpr.leaseManager.List(ctx, filter)
+	if err != nil {
+		return stats, errors.Wrap(err, "listing leases")
+	}
+
+	var errs []error
+	for _, snapKey := range orphans {
+		if err := dmpr.removeOwned(ctx, snapKey, leases.Lease{ID: snapKey}); err != nil {
+			errs = append(errs, errors.Wrapf(err, "removing orphaned snapshot %s", snapKey))
+			continue
+		}
+		stats.Snapshots++
+		log.WithField("snapKey", snapKey).Info("Removed orphaned device snapshot")
+	}
+
+	for _, lease := range ownedLeases {
+		if keep[lease.ID] || snapshotKeys[lease.ID] || lease.CreatedAt.After(start) {
+			continue
+		}
+		if err := dmpr.leaseManager.Delete(ctx, lease, leases.SynchronousDelete); err != nil && !errdefs.IsNotFound(err) {
+			errs = append(errs, errors.Wrapf(err, "removing orphaned lease %s", lease.ID))
+			continue
+		}
+		stats.Leases++
+		log.WithField("lease", lease.ID).Info("Removed orphaned lease")
+	}
+
+	if len(errs) > 0 {
+		return stats, multierror.Of(errs...)
+	}
+	return stats, nil
+}
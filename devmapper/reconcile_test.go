@@ -0,0 +1,192 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSnapshotter keeps snapshots in memory. Filters are ignored, callers check the labels themselves
+type fakeSnapshotter struct {
+	snapshots.Snapshotter
+	infos map[string]snapshots.Info
+}
+
+func (s *fakeSnapshotter) Stat(_ context.Context, key string) (snapshots.Info, error) {
+	info, ok := s.infos[key]
+	if !ok {
+		return snapshots.Info{}, errdefs.ErrNotFound
+	}
+	return info, nil
+}
+
+func (s *fakeSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, _ ...string) error {
+	for _, info := range s.infos {
+		if err := fn(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeSnapshotter) Remove(_ context.Context, key string) error {
+	if _, ok := s.infos[key]; !ok {
+		return errdefs.ErrNotFound
+	}
+	for _, info := range s.infos {
+		if info.Parent == key {
+			return errdefs.ErrFailedPrecondition
+		}
+	}
+	delete(s.infos, key)
+	return nil
+}
+
+// fakeLeaseManager keeps leases in memory. Filters are ignored, callers check the labels themselves
+type fakeLeaseManager struct {
+	leases.Manager
+	leases map[string]leases.Lease
+}
+
+func (m *fakeLeaseManager) List(context.Context, ...string) ([]leases.Lease, error) {
+	var list []leases.Lease
+	for _, lease := range m.leases {
+		if isOwned(lease.Labels) {
+			list = append(list, lease)
+		}
+	}
+	return list, nil
+}
+
+func (m *fakeLeaseManager) Delete(_ context.Context, lease leases.Lease, _ ...leases.DeleteOpt) error {
+	if _, ok := m.leases[lease.ID]; !ok {
+		return errdefs.ErrNotFound
+	}
+	delete(m.leases, lease.ID)
+	return nil
+}
+
+func newFakeDeviceMapper(owned, foreign []string) (*DeviceMapper, *fakeSnapshotter, *fakeLeaseManager) {
+	snapshotter := &fakeSnapshotter{infos: make(map[string]snapshots.Info)}
+	leaseManager := &fakeLeaseManager{leases: make(map[string]leases.Lease)}
+	for _, key := range owned {
+		snapshotter.infos[key] = snapshots.Info{Name: key, Labels: ownerLabels()}
+		leaseManager.leases[key] = leases.Lease{ID: key, Labels: ownerLabels()}
+	}
+	for _, key := range foreign {
+		snapshotter.infos[key] = snapshots.Info{Name: key}
+	}
+
+	dmpr := &DeviceMapper{
+		snapDevices:     make(map[string]*DeviceSnapshot),
+		snapshotService: snapshotter,
+		leaseManager:    leaseManager,
+		leases:          make(map[string]*leases.Lease),
+		patchMode:       PatchModeFile,
+	}
+	return dmpr, snapshotter, leaseManager
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	dmpr, snapshotter, leaseManager := newFakeDeviceMapper(
+		[]string{"live", "tracked", "orphan1", "orphan2"}, []string{"containerd"})
+	dmpr.leases["tracked"] = &leases.Lease{ID: "tracked"}
+	// Lease left behind by a crash between removing the snapshot and its lease
+	leaseManager.leases["stale"] = leases.Lease{ID: "stale", Labels: ownerLabels()}
+
+	stats, err := dmpr.Reconcile(ctx, []string{"live"})
+	require.NoError(t, err)
+	require.Equal(t, ReconcileStats{Snapshots: 2, Leases: 1}, stats)
+
+	require.ElementsMatch(t, []string{"live", "tracked", "containerd"}, keys(snapshotter.infos))
+	require.ElementsMatch(t, []string{"live", "tracked"}, keys(leaseManager.leases))
+
+	// Nothing is left to remove
+	stats, err = dmpr.Reconcile(ctx, []string{"live"})
+	require.NoError(t, err)
+	require.Equal(t, ReconcileStats{}, stats)
+}
+
+func TestReconcileOrigins(t *testing.T) {
+	ctx := context.Background()
+	dmpr, snapshotter, _ := newFakeDeviceMapper(nil, nil)
+	for _, key := range []string{"origin1", "origin2"} {
+		snapshotter.infos[key] = snapshots.Info{Name: key, Kind: snapshots.KindCommitted, Labels: ownerLabels()}
+	}
+	for key, parent := range map[string]string{"orphan1": "origin1", "orphan2": "origin1", "orphan3": "origin2", "live": "origin2"} {
+		snapshotter.infos[key] = snapshots.Info{Name: key, Parent: parent, Kind: snapshots.KindActive, Labels: ownerLabels()}
+	}
+
+	stats, err := dmpr.Reconcile(ctx, []string{"live"})
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.Snapshots)
+	require.ElementsMatch(t, []string{"origin2", "live"}, keys(snapshotter.infos))
+}
+
+func TestReconcileConcurrentCreate(t *testing.T) {
+	ctx := context.Background()
+	dmpr, snapshotter, leaseManager := newFakeDeviceMapper(nil, nil)
+	// Created by a CreateDeviceSnapshot racing with Reconcile, after the tracked leases were copied
+	created := time.Now().Add(time.Minute)
+	snapshotter.infos["origin"] = snapshots.Info{Name: "origin", Kind: snapshots.KindCommitted, Labels: ownerLabels()}
+	snapshotter.infos["new"] = snapshots.Info{Name: "new", Parent: "origin", Kind: snapshots.KindActive,
+		Labels: ownerLabels(), Created: created}
+	leaseManager.leases["new"] = leases.Lease{ID: "new", Labels: ownerLabels(), CreatedAt: created}
+	leaseManager.leases["creating"] = leases.Lease{ID: "creating", Labels: ownerLabels(), CreatedAt: created}
+
+	stats, err := dmpr.Reconcile(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, ReconcileStats{}, stats)
+	require.ElementsMatch(t, []string{"origin", "new"}, keys(snapshotter.infos))
+	require.ElementsMatch(t, []string{"new", "creating"}, keys(leaseManager.leases))
+}
+
+func TestRemoveUntrackedDeviceSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dmpr, snapshotter, leaseManager := newFakeDeviceMapper([]string{"owned"}, []string{"containerd"})
+
+	require.NoError(t, dmpr.RemoveDeviceSnapshot(ctx, "owned"))
+	require.NotContains(t, snapshotter.infos, "owned")
+	require.NotContains(t, leaseManager.leases, "owned")
+
+	require.Error(t, dmpr.RemoveDeviceSnapshot(ctx, "containerd"), "snapshots of containerd must be left alone")
+	require.Contains(t, snapshotter.infos, "containerd")
+
+	require.Error(t, dmpr.RemoveDeviceSnapshot(ctx, "missing"))
+}
+
+func keys[V any](m map[string]V) []string {
+	var list []string
+	for key := range m {
+		list = append(list, key)
+	}
+	return list
+}
@@ -0,0 +1,332 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+// ErrThinPoolFull is returned instead of creating VMs while the usage of the thin pool is above the high watermark
+var ErrThinPoolFull = errors.New("devmapper thin pool is full")
+
+// ThinPoolUsage Usage of the data and metadata blocks of a thin pool, as reported by dmsetup status
+type ThinPoolUsage struct {
+	UsedMetadataBlocks  uint64
+	TotalMetadataBlocks uint64
+	UsedDataBlocks      uint64
+	TotalDataBlocks     uint64
+	// Mode is rw, ro or out_of_data_space
+	Mode string
+	// NeedsCheck is set when the metadata of the pool must be repaired with thin_check
+	NeedsCheck bool
+	// MetadataSnapHeld is set while a snapshot of the metadata of the pool is reserved
+	MetadataSnapHeld bool
+}
+
+// DataUsage Returns the fraction of the data blocks in use
+func (u ThinPoolUsage) DataUsage() float64 {
+	if u.TotalDataBlocks == 0 {
+		return 0
+	}
+	return float64(u.UsedDataBlocks) / float64(u.TotalDataBlocks)
+}
+
+// MetadataUsage Returns the fraction of the metadata blocks in use
+func (u ThinPoolUsage) MetadataUsage() float64 {
+	if u.TotalMetadataBlocks == 0 {
+		return 0
+	}
+	return float64(u.UsedMetadataBlocks) / float64(u.TotalMetadataBlocks)
+}
+
+// MaxUsage Returns the highest of the data and metadata usage
+func (u ThinPoolUsage) MaxUsage() float64 {
+	return math.Max(u.DataUsage(), u.MetadataUsage())
+}
+
+// ToMap Returns the usage as metrics
+func (u ThinPoolUsage) ToMap() map[string]float64 {
+	return map[string]float64{
+		metrics.ThinPoolDataUsage:     u.DataUsage(),
+		metrics.ThinPoolMetadataUsage: u.MetadataUsage(),
+	}
+}
+
+// ThinPoolPolicy Configures the monitoring of the thin pool of the container snapshots
+type ThinPoolPolicy struct {
+	// Pool is the name of the thin pool, as listed by dmsetup ls
+	Pool string
+	// Interval between two reads of the usage
+	Interval time.Duration
+	// GCWatermark is the usage (between 0 and 1) of data or metadata above which the hooks are called to free space
+	GCWatermark float64
+	// HighWatermark is the usage above which the creation of VMs is refused
+	HighWatermark float64
+}
+
+func (p *ThinPoolPolicy) validate() error {
+	if p.Pool == "" {
+		return errors.New("thin pool monitor needs a pool")
+	}
+	if p.Interval <= 0 {
+		return errors.New("thin pool monitor interval must be positive")
+	}
+	if p.HighWatermark <= 0 || p.HighWatermark > 1 || p.GCWatermark < 0 || p.GCWatermark > p.HighWatermark {
+		return errors.Errorf("thin pool watermarks must satisfy 0 <= GC (%.2f) <= high (%.2f) <= 1", p.GCWatermark, p.HighWatermark)
+	}
+	return nil
+}
+
+// ThinPoolHook Frees space in the thin pool, e.g., by evicting unused images or snapshots. Hooks are called from the
+// monitor whenever the usage is above the GC watermark
+type ThinPoolHook func(ctx context.Context, usage ThinPoolUsage)
+
+// thinPoolMonitor holds the last usage read from the thin pool
+type thinPoolMonitor struct {
+	sync.Mutex
+	policy ThinPoolPolicy
+	usage  ThinPoolUsage
+	err    error
+	hooks  []ThinPoolHook
+	stop   chan struct{}
+}
+
+// StartThinPoolMonitor starts reading the usage of the thin pool periodically. Above the high watermark of the policy,
+// CheckThinPool fails, and above its GC watermark the hooks added with AddThinPoolHook are called.
+func (dmpr *DeviceMapper) StartThinPoolMonitor(policy ThinPoolPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	dmpr.monitor.Lock()
+	if dmpr.monitor.stop != nil {
+		dmpr.monitor.Unlock()
+		return errors.New("thin pool monitor is already running")
+	}
+	dmpr.monitor.policy = policy
+	dmpr.monitor.stop = make(chan struct{})
+	stop := dmpr.monitor.stop
+	dmpr.monitor.Unlock()
+
+	// Fail early if the pool cannot be read
+	if err := dmpr.checkThinPoolUsage(context.Background()); err != nil {
+		dmpr.StopThinPoolMonitor()
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(policy.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := dmpr.checkThinPoolUsage(context.Background()); err != nil {
+					log.WithError(err).Warn("Failed to read thin pool usage")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopThinPoolMonitor stops reading the usage of the thin pool, after which CheckThinPool always succeeds
+func (dmpr *DeviceMapper) StopThinPoolMonitor() {
+	dmpr.monitor.Lock()
+	defer dmpr.monitor.Unlock()
+
+	if dmpr.monitor.stop != nil {
+		close(dmpr.monitor.stop)
+		dmpr.monitor.stop = nil
+	}
+}
+
+// AddThinPoolHook adds a hook called by the monitor when the usage of the thin pool exceeds the GC watermark
+func (dmpr *DeviceMapper) AddThinPoolHook(hook ThinPoolHook) {
+	dmpr.monitor.Lock()
+	defer dmpr.monitor.Unlock()
+
+	dmpr.monitor.hooks = append(dmpr.monitor.hooks, hook)
+}
+
+// GetThinPoolUsage returns the usage of the thin pool last read by the monitor
+func (dmpr *DeviceMapper) GetThinPoolUsage() (ThinPoolUsage, error) {
+	dmpr.monitor.Lock()
+	defer dmpr.monitor.Unlock()
+
+	if dmpr.monitor.stop == nil {
+		return ThinPoolUsage{}, errors.New("thin pool monitor is not running")
+	}
+	return dmpr.monitor.usage, dmpr.monitor.err
+}
+
+// CheckThinPool fails with ErrThinPoolFull if the usage of the thin pool last read by the monitor is above the high
+// watermark, or if the pool ran out of space. VMs created regardless would get IO errors once their writes exhaust
+// the pool. Failures to read the usage do not block creations.
+func (dmpr *DeviceMapper) CheckThinPool() error {
+	dmpr.monitor.Lock()
+	defer dmpr.monitor.Unlock()
+
+	if dmpr.monitor.stop == nil || dmpr.monitor.err != nil {
+		return nil
+	}
+
+	usage, policy := dmpr.monitor.usage, dmpr.monitor.policy
+	switch {
+	case usage.Mode != "rw":
+		return errors.Wrapf(ErrThinPoolFull, "thin pool %s is in %s mode", policy.Pool, usage.Mode)
+	case usage.DataUsage() > policy.HighWatermark:
+		return errors.Wrapf(ErrThinPoolFull, "data usage of thin pool %s is %.2f, above %.2f", policy.Pool, usage.DataUsage(), policy.HighWatermark)
+	case usage.MetadataUsage() > policy.HighWatermark:
+		return errors.Wrapf(ErrThinPoolFull, "metadata usage of thin pool %s is %.2f, above %.2f", policy.Pool, usage.MetadataUsage(), policy.HighWatermark)
+	}
+	return nil
+}
+
+// checkThinPoolUsage reads the usage of the thin pool and frees space if it is above the GC watermark
+func (dmpr *DeviceMapper) checkThinPoolUsage(ctx context.Context) error {
+	dmpr.monitor.Lock()
+	policy := dmpr.monitor.policy
+	hooks := dmpr.monitor.hooks
+	dmpr.monitor.Unlock()
+
+	usage, err := dmpr.readThinPoolUsage(policy.Pool)
+	if err != nil {
+		return err
+	}
+
+	logger := log.WithFields(log.Fields{
+		"pool":     policy.Pool,
+		"data":     fmt.Sprintf("%.2f", usage.DataUsage()),
+		"metadata": fmt.Sprintf("%.2f", usage.MetadataUsage()),
+	})
+	logger.Debug("Read thin pool usage")
+	if usage.NeedsCheck {
+		logger.Warn("Thin pool metadata needs to be checked with thin_check")
+	}
+
+	if usage.MaxUsage() <= policy.GCWatermark {
+		return nil
+	}
+
+	logger.Info("Thin pool usage above the GC watermark, freeing space")
+	if dmpr.pool != nil {
+		dmpr.evictOrigins(ctx, 0)
+	}
+	for _, hook := range hooks {
+		hook(ctx, usage)
+	}
+
+	// Creations are refused until the next read otherwise
+	_, err = dmpr.readThinPoolUsage(policy.Pool)
+	return err
+}
+
+// readThinPoolUsage reads the usage of the thin pool and records it for CheckThinPool
+func (dmpr *DeviceMapper) readThinPoolUsage(pool string) (ThinPoolUsage, error) {
+	usage, err := ReadThinPoolUsage(pool)
+
+	dmpr.monitor.Lock()
+	defer dmpr.monitor.Unlock()
+	dmpr.monitor.usage, dmpr.monitor.err = usage, err
+
+	return usage, err
+}
+
+// ReadThinPoolUsage Reads the usage of a thin pool through dmsetup status
+func ReadThinPoolUsage(pool string) (ThinPoolUsage, error) {
+	out, err := exec.Command("dmsetup", "status", pool).Output()
+	if err != nil {
+		return ThinPoolUsage{}, errors.Wrapf(err, "getting status of thin pool %s", pool)
+	}
+
+	return parseThinPoolStatus(string(out))
+}
+
+// parseThinPoolStatus parses the status of a thin pool, e.g.,
+// "0 209715200 thin-pool 1 170/4161600 3520/1638400 - rw discard_passdown queue_if_no_space - 1024"
+func parseThinPoolStatus(status string) (ThinPoolUsage, error) {
+	var usage ThinPoolUsage
+
+	fields := strings.Fields(status)
+	if len(fields) < 3 || fields[2] != "thin-pool" {
+		return usage, errors.Errorf("unexpected thin pool status %q", status)
+	}
+	if len(fields) == 4 {
+		// Failed pools only report Fail or Error
+		usage.Mode = strings.ToLower(fields[3])
+		return usage, nil
+	}
+	if len(fields) < 8 {
+		return usage, errors.Errorf("unexpected thin pool status %q", status)
+	}
+
+	var err error
+	if usage.UsedMetadataBlocks, usage.TotalMetadataBlocks, err = parseBlockUsage(fields[4]); err != nil {
+		return usage, err
+	}
+	if usage.UsedDataBlocks, usage.TotalDataBlocks, err = parseBlockUsage(fields[5]); err != nil {
+		return usage, err
+	}
+	usage.MetadataSnapHeld = fields[6] != "-"
+	usage.Mode = fields[7]
+	for _, field := range fields[8:] {
+		if field == "needs_check" {
+			usage.NeedsCheck = true
+		}
+	}
+
+	return usage, nil
+}
+
+// parseBlockUsage parses used/total blocks
+func parseBlockUsage(field string) (uint64, uint64, error) {
+	used, total, found := strings.Cut(field, "/")
+	if !found {
+		return 0, 0, errors.Errorf("unexpected thin pool block usage %q", field)
+	}
+	usedBlocks, err := strconv.ParseUint(used, 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parsing thin pool block usage %q", field)
+	}
+	totalBlocks, err := strconv.ParseUint(total, 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parsing thin pool block usage %q", field)
+	}
+	return usedBlocks, totalBlocks, nil
+}
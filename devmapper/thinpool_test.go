@@ -0,0 +1,99 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseThinPoolStatus(t *testing.T) {
+	usage, err := parseThinPoolStatus("0 209715200 thin-pool 1 170/4161600 3520/1638400 - rw discard_passdown queue_if_no_space - 1024\n")
+	require.NoError(t, err)
+	require.Equal(t, ThinPoolUsage{
+		UsedMetadataBlocks:  170,
+		TotalMetadataBlocks: 4161600,
+		UsedDataBlocks:      3520,
+		TotalDataBlocks:     1638400,
+		Mode:                "rw",
+	}, usage)
+	require.InDelta(t, 3520.0/1638400, usage.DataUsage(), 1e-9)
+	require.InDelta(t, 170.0/4161600, usage.MetadataUsage(), 1e-9)
+	require.Equal(t, usage.DataUsage(), usage.MaxUsage())
+
+	usage, err = parseThinPoolStatus("0 209715200 thin-pool 7 4000/4096 1638400/1638400 - out_of_data_space discard_passdown queue_if_no_space needs_check 1024")
+	require.NoError(t, err)
+	require.Equal(t, "out_of_data_space", usage.Mode)
+	require.True(t, usage.NeedsCheck)
+	require.Equal(t, 1.0, usage.DataUsage())
+
+	usage, err = parseThinPoolStatus("0 209715200 thin-pool 2 180/4161600 3520/1638400 42 rw discard_passdown queue_if_no_space - 1024")
+	require.NoError(t, err)
+	require.True(t, usage.MetadataSnapHeld)
+
+	usage, err = parseThinPoolStatus("0 209715200 thin-pool Fail")
+	require.NoError(t, err)
+	require.Equal(t, "fail", usage.Mode)
+
+	for _, status := range []string{"", "0 209715200 linear", "0 209715200 thin-pool 1 170 3520/1638400 - rw", "0 209715200 thin-pool 1 170/4161600 x/1638400 - rw"} {
+		_, err := parseThinPoolStatus(status)
+		require.Error(t, err, status)
+	}
+}
+
+func TestCheckThinPool(t *testing.T) {
+	dmpr := &DeviceMapper{}
+	require.NoError(t, dmpr.CheckThinPool(), "pools that are not monitored are never full")
+
+	dmpr.monitor.policy = ThinPoolPolicy{Pool: "pool", Interval: 1, GCWatermark: 0.8, HighWatermark: 0.9}
+	dmpr.monitor.stop = make(chan struct{})
+
+	dmpr.monitor.usage = ThinPoolUsage{UsedDataBlocks: 85, TotalDataBlocks: 100, UsedMetadataBlocks: 1, TotalMetadataBlocks: 100, Mode: "rw"}
+	require.NoError(t, dmpr.CheckThinPool())
+
+	dmpr.monitor.usage.UsedDataBlocks = 95
+	require.ErrorIs(t, dmpr.CheckThinPool(), ErrThinPoolFull)
+
+	dmpr.monitor.usage.UsedDataBlocks = 10
+	dmpr.monitor.usage.UsedMetadataBlocks = 91
+	require.ErrorIs(t, dmpr.CheckThinPool(), ErrThinPoolFull)
+
+	dmpr.monitor.usage.UsedMetadataBlocks = 1
+	dmpr.monitor.usage.Mode = "out_of_data_space"
+	require.ErrorIs(t, dmpr.CheckThinPool(), ErrThinPoolFull)
+}
+
+func TestThinPoolPolicyValidate(t *testing.T) {
+	valid := ThinPoolPolicy{Pool: "pool", Interval: 1, GCWatermark: 0.8, HighWatermark: 0.9}
+	require.NoError(t, valid.validate())
+
+	for _, policy := range []ThinPoolPolicy{
+		{Interval: 1, GCWatermark: 0.8, HighWatermark: 0.9},
+		{Pool: "pool", GCWatermark: 0.8, HighWatermark: 0.9},
+		{Pool: "pool", Interval: 1, GCWatermark: 0.95, HighWatermark: 0.9},
+		{Pool: "pool", Interval: 1, GCWatermark: 0.8, HighWatermark: 1.5},
+	} {
+		require.Error(t, policy.validate(), "%+v", policy)
+	}
+}
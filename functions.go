@@ -43,6 +43,7 @@ import (
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/vhive-serverless/vhive/devmapper"
 	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
 	"github.com/vhive-serverless/vhive/metrics"
 	"github.com/vhive-serverless/vhive/snapshotting"
@@ -50,6 +51,16 @@ import (
 
 var isTestMode bool // set with a call to NewFuncPool
 
+// Time given to the instance operations unless the timeout profile sets their budget. Snapshots use the default
+// budget of the orchestrator
+const (
+	addInstanceTimeout  = 5 * time.Minute
+	loadInstanceTimeout = 60 * time.Second
+)
+
+// Time given to fetching the snapshot kept for a new function, e.g., from the snapshot store
+const pinSnapshotTimeout = 5 * time.Minute
+
 //////////////////////////////// FunctionPool type //////////////////////////////////////////
 
 // FuncPool Pool of functions
@@ -61,6 +72,8 @@ type FuncPool struct {
 	pinnedFuncNum   int
 	stats           *Stats
 	snapshotManager *snapshotting.SnapshotManager
+	balloonIdle     time.Duration
+	balloonMib      int64
 }
 
 // NewFuncPool Initializes a pool of functions. Functions can only be added
@@ -72,7 +85,17 @@ func NewFuncPool(saveMemoryMode bool, servedTh uint64, pinnedFuncNum int, testMo
 	p.servedTh = servedTh
 	p.pinnedFuncNum = pinnedFuncNum
 	p.stats = NewStats()
-	p.snapshotManager = snapshotting.NewSnapshotManager("/fccd/snapshots")
+	var snapshotOpts []snapshotting.SnapshotManagerOption
+	if orch != nil {
+		snapshotOpts = orch.GetSnapshotManagerOptions()
+	}
+	p.snapshotManager = snapshotting.NewSnapshotManager("/fccd/snapshots", snapshotOpts...)
+	if orch != nil {
+		// Previous versions hold their images, which the orchestrator evicts next to free space in the thin pool
+		orch.AddThinPoolHook(func(context.Context, devmapper.ThinPoolUsage) {
+			p.snapshotManager.EvictPreviousVersions()
+		})
+	}
 
 	if !testModeOn {
 		heartbeat := time.NewTicker(60 * time.Second)
@@ -90,8 +113,28 @@ func NewFuncPool(saveMemoryMode bool, servedTh uint64, pinnedFuncNum int, testMo
 	return p
 }
 
+// SetBalloonPolicy Makes functions inflate the balloon of their instance by amountMib
+// once it has been idle for idleTimeout, and deflate it on the next invocation.
+// An idleTimeout of 0 disables the policy
+func (p *FuncPool) SetBalloonPolicy(idleTimeout time.Duration, amountMib int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.balloonIdle = idleTimeout
+	p.balloonMib = amountMib
+}
+
 // getFunction Returns a ptr to a function or creates it unless it exists
 func (p *FuncPool) getFunction(fID, imageName string) *Function {
+	f := p.getOrCreateFunction(fID, imageName)
+
+	// The kept snapshot may be downloaded, which must not hold up the other functions of the pool
+	f.onceCheckSnapshot.Do(f.checkKeptSnapshot)
+
+	return f
+}
+
+func (p *FuncPool) getOrCreateFunction(fID, imageName string) *Function {
 	p.Lock()
 	defer p.Unlock()
 
@@ -109,6 +152,8 @@ func (p *FuncPool) getFunction(fID, imageName string) *Function {
 
 		logger.Debugf("Created function, pinned=%t, shut down after %d requests", isToPin, p.servedTh)
 		p.funcMap[fID] = NewFunction(fID, imageName, p.stats, p.servedTh, isToPin, p.snapshotManager)
+		p.funcMap[fID].balloonIdle = p.balloonIdle
+		p.funcMap[fID].balloonMib = p.balloonMib
 
 		if err := p.stats.CreateStats(fID); err != nil {
 			logger.Panic("GetFunction: Function exists")
@@ -177,12 +222,21 @@ type Function struct {
 	servedTh               uint64
 	sem                    *semaphore.Weighted
 	servedSyncCounter      int64
-	isSnapshotReady        bool // if ready, the orchestrator should load the instance rather than creating it
+	isSnapshotReady        bool          // if ready, the orchestrator should load the instance rather than creating it
+	bootTime               time.Duration // time to boot the last instance started from scratch
 	OnceCreateSnapInstance *sync.Once
+	onceCheckSnapshot      sync.Once
 	funcClient             *hpb.GreeterClient
 	conn                   *grpc.ClientConn
 	guestIP                string
 	snapshotManager        *snapshotting.SnapshotManager
+	balloonIdle            time.Duration // idle time after which the balloon is inflated, 0 if disabled
+	balloonMib             int64
+	balloonLock            sync.Mutex // guards the balloon state below and serializes the balloon RPCs
+	balloonVMID            string     // instance whose balloon is managed, empty once it is removed
+	balloonInflight        int        // requests being served, the idle timer only runs at 0
+	balloonTimer           *time.Timer
+	isBalloonInflated      bool
 }
 
 // NewFunction Initializes a function
@@ -223,6 +277,26 @@ func NewFunction(fID, imageName string, Stats *Stats, servedTh uint64, isToPin b
 	return f
 }
 
+// checkKeptSnapshot Makes the function load its instances from the snapshot kept from a previous run or taken on
+// another node, like from the ones taken by this run. Snapshots of another image are invalidated
+func (f *Function) checkKeptSnapshot() {
+	ctx, cancel := context.WithTimeout(context.Background(), pinSnapshotTimeout)
+	defer cancel()
+
+	snap, err := f.snapshotManager.PinSnapshot(ctx, f.fID)
+	if err != nil {
+		return
+	}
+	f.snapshotManager.UnpinSnapshot(snap, 0)
+
+	if snap.GetImage() == f.imageName {
+		f.isSnapshotReady = true
+		f.OnceCreateSnapInstance.Do(func() {})
+	} else if err := f.snapshotManager.InvalidateSnapshot(f.fID); err != nil {
+		log.WithError(err).WithField("fID", f.fID).Warn("Failed to invalidate snapshot of another image")
+	}
+}
+
 // Serve Service RPC request and response on behalf of a function, spinning
 // function instances when necessary.
 //
@@ -270,6 +344,13 @@ func (f *Function) Serve(ctx context.Context, fID, imageName, reqPayload string)
 			}
 		})
 
+	if metr := f.deflateBalloon(); metr != nil {
+		for k, v := range metr.MetricMap {
+			serveMetric.MetricMap[k] = v
+		}
+	}
+	defer f.scheduleBalloonInflation()
+
 	f.RLock()
 
 	// FIXME: keep a strict deadline for forwarding RPCs to a warm function
@@ -302,6 +383,22 @@ func (f *Function) Serve(ctx context.Context, fID, imageName, reqPayload string)
 		}
 	}
 
+	if isColdStart && orch.GetCgroupsEnabled() {
+		if res, err := orch.GetVMResources(f.vmID); err != nil {
+			logger.WithError(err).Warn("Failed to read the resources used by the instance")
+		} else {
+			serveMetric.ResourceMap = res.ToMap()
+		}
+	}
+	if isColdStart {
+		serveMetric.NodeMap = orch.GetNodeMetrics()
+		if orch.GetSnapshotsEnabled() {
+			for k, v := range f.snapshotManager.GetSnapshotMetrics() {
+				serveMetric.NodeMap[k] = v
+			}
+		}
+	}
+
 	if orch.GetSnapshotsEnabled() {
 		f.OnceCreateSnapInstance.Do(
 			func() {
@@ -356,7 +453,7 @@ func (f *Function) AddInstance() *metrics.Metric {
 
 	var metr *metrics.Metric = nil
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	ctx, cancel := context.WithTimeout(context.Background(), orch.GetTimeoutProfile().StartVM(addInstanceTimeout))
 	defer cancel()
 
 	if f.isSnapshotReady {
@@ -367,10 +464,12 @@ func (f *Function) AddInstance() *metrics.Metric {
 		f.vmID = f.getVMID()
 		f.lastInstanceID++
 	} else {
+		tStart := time.Now()
 		resp, _, err := orch.StartVM(ctx, f.getVMID(), f.imageName)
 		if err != nil {
 			log.Panic(err)
 		}
+		f.bootTime = time.Since(tStart)
 		f.guestIP = resp.GuestIP
 		f.vmID = f.getVMID()
 		f.lastInstanceID++
@@ -388,6 +487,10 @@ func (f *Function) AddInstance() *metrics.Metric {
 
 	f.stats.IncStarted(f.fID)
 
+	f.balloonLock.Lock()
+	f.balloonVMID = f.vmID
+	f.balloonLock.Unlock()
+
 	return metr
 }
 
@@ -421,6 +524,18 @@ func (f *Function) RemoveInstance(isSync bool) (string, error) {
 
 	f.OnceAddInstance = new(sync.Once)
 
+	f.balloonLock.Lock()
+	f.balloonVMID = ""
+	if f.balloonTimer != nil {
+		f.balloonTimer.Stop()
+		f.balloonTimer = nil
+	}
+	if f.isBalloonInflated {
+		f.isBalloonInflated = false
+		f.stats.SetReclaimedMib(f.fID, 0)
+	}
+	f.balloonLock.Unlock()
+
 	if isSync {
 		err = orch.StopSingleVM(context.Background(), f.vmID)
 	} else {
@@ -431,6 +546,94 @@ func (f *Function) RemoveInstance(isSync bool) (string, error) {
 	return r, err
 }
 
+// scheduleBalloonInflation Ends the serving of a request and (re)starts the idle timer of the function instance
+// once no request is being served
+func (f *Function) scheduleBalloonInflation() {
+	if f.balloonIdle <= 0 {
+		return
+	}
+
+	f.balloonLock.Lock()
+	defer f.balloonLock.Unlock()
+
+	if f.balloonInflight > 0 {
+		f.balloonInflight--
+	}
+	if f.balloonInflight > 0 || f.balloonVMID == "" || !orch.GetBalloonEnabled() {
+		return
+	}
+
+	vmID := f.balloonVMID
+	if f.balloonTimer != nil {
+		f.balloonTimer.Stop()
+	}
+	f.balloonTimer = time.AfterFunc(f.balloonIdle, func() { f.inflateBalloon(vmID) })
+}
+
+// inflateBalloon Reclaims the memory of the idle function instance
+func (f *Function) inflateBalloon(vmID string) {
+	f.balloonLock.Lock()
+	defer f.balloonLock.Unlock()
+
+	logger := log.WithFields(log.Fields{"fID": f.fID, "vmID": vmID})
+
+	// The instance has been removed, serves requests again or its balloon is already inflated
+	if f.balloonVMID != vmID || f.balloonInflight > 0 || f.isBalloonInflated {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	logger.Debugf("Instance is idle, inflating the balloon by %d MiB", f.balloonMib)
+	if _, err := orch.InflateBalloon(ctx, vmID, f.balloonMib); err != nil {
+		logger.WithError(err).Warn("Failed to inflate the balloon")
+		return
+	}
+	f.isBalloonInflated = true
+
+	if stats, err := orch.GetBalloonStats(ctx, vmID); err == nil {
+		f.stats.SetReclaimedMib(f.fID, stats.ActualMib)
+	}
+}
+
+// deflateBalloon Starts the serving of a request, giving the memory back to the instance if its balloon is inflated
+func (f *Function) deflateBalloon() *metrics.Metric {
+	if f.balloonIdle <= 0 {
+		return nil
+	}
+
+	// An inflation in progress completes first
+	f.balloonLock.Lock()
+	defer f.balloonLock.Unlock()
+
+	// The instance is busy, the timer is restarted once all the requests are served
+	f.balloonInflight++
+	if f.balloonTimer != nil {
+		f.balloonTimer.Stop()
+	}
+
+	if !f.isBalloonInflated {
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{"fID": f.fID, "vmID": f.balloonVMID})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	logger.Debug("Deflating the balloon before serving")
+	metr, err := orch.DeflateBalloon(ctx, f.balloonVMID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to deflate the balloon")
+		return nil
+	}
+	f.isBalloonInflated = false
+	f.stats.SetReclaimedMib(f.fID, 0)
+
+	return metr
+}
+
 // DumpUPFPageStats Dumps the memory manager's stats about the number of
 // the unique pages and the number of the pages that are reused across invocations
 func (f *Function) DumpUPFPageStats(functionName, metricsOutFilePath string) error {
@@ -448,7 +651,7 @@ func (f *Function) CreateInstanceSnapshot() {
 
 	logger.Debug("Creating instance snapshot")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), orch.GetTimeoutProfile().SnapshotVM(ctriface.DefaultSnapshotBudget))
 	defer cancel()
 
 	err := orch.PauseVM(ctx, f.vmID)
@@ -460,6 +663,7 @@ func (f *Function) CreateInstanceSnapshot() {
 	if err != nil {
 		log.Panic(err)
 	}
+	snap.BootTime = f.bootTime
 
 	err = orch.CreateSnapshot(ctx, f.vmID, snap)
 	if err != nil {
@@ -484,15 +688,33 @@ func (f *Function) LoadInstance(vmID string) (*ctriface.StartVMResponse, *metric
 
 	logger.Debug("Loading instance")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	ctx, cancel := context.WithTimeout(context.Background(), orch.GetTimeoutProfile().LoadVM(loadInstanceTimeout))
 	defer cancel()
 
-	snap, err := f.snapshotManager.AcquireSnapshot(f.fID)
+	snap, err := f.snapshotManager.PinSnapshot(ctx, f.fID)
 	if err != nil {
-		log.Panic(err)
+		// The snapshot was evicted to stay within the disk budget
+		logger.WithError(err).Info("Snapshot is no longer available")
+		return f.startInstance(vmID), nil
 	}
 
+	tStart := time.Now()
 	resp, loadMetr, err := orch.LoadSnapshot(ctx, vmID, snap)
+	if ctriface.IsSnapshotInvalid(err) {
+		f.snapshotManager.UnpinSnapshot(snap, 0)
+
+		// The image of the function changed or the snapshot is corrupted, boot it from scratch and snapshot it again
+		logger.WithError(err).Info("Invalidating snapshot")
+		if errors.Is(err, ctriface.ErrCorruptSnapshot) {
+			err = f.snapshotManager.InvalidateCorruptSnapshot(ctx, snap)
+		} else {
+			err = f.snapshotManager.InvalidateSnapshot(f.fID)
+		}
+		if err != nil {
+			logger.WithError(err).Warn("Failed to invalidate snapshot")
+		}
+		return f.startInstance(vmID), nil
+	}
 	if err != nil {
 		log.Panic(err)
 	}
@@ -501,6 +723,7 @@ func (f *Function) LoadInstance(vmID string) (*ctriface.StartVMResponse, *metric
 	if err != nil {
 		log.Panic(err)
 	}
+	f.snapshotManager.UnpinSnapshot(snap, time.Since(tStart))
 
 	for k, v := range resumeMetr.MetricMap {
 		loadMetr.MetricMap[k] = v
@@ -509,6 +732,25 @@ func (f *Function) LoadInstance(vmID string) (*ctriface.StartVMResponse, *metric
 	return resp, loadMetr
 }
 
+// startInstance Boots an instance from scratch instead of loading the snapshot of the function, which is taken
+// again at the next offload
+func (f *Function) startInstance(vmID string) *ctriface.StartVMResponse {
+	f.isSnapshotReady = false
+	f.OnceCreateSnapInstance = new(sync.Once)
+
+	ctx, cancel := context.WithTimeout(context.Background(), orch.GetTimeoutProfile().StartVM(addInstanceTimeout))
+	defer cancel()
+
+	tStart := time.Now()
+	resp, _, err := orch.StartVM(ctx, vmID, f.imageName)
+	if err != nil {
+		log.Panic(err)
+	}
+	f.bootTime = time.Since(tStart)
+
+	return resp
+}
+
 // GetStatServed Returns the served counter value
 func (f *Function) GetStatServed() uint64 {
 	return atomic.LoadUint64(&f.stats.statMap[f.fID].served)
@@ -37,11 +37,19 @@ import (
 const (
 	// FcResume Time it takes to resume a VM from containerd
 	FcResume = "FcResume"
+	// InflateBalloon Time it takes to ask the guest to inflate its balloon
+	InflateBalloon = "InflateBalloon"
+	// DeflateBalloon Time it takes for the guest to get its memory back from the balloon
+	DeflateBalloon = "DeflateBalloon"
 	// ConnectFuncClient Time it takes to reconnect function client
 	ConnectFuncClient = "ConnectFuncClient"
 
 	// LoadVMM Name of LoadVMM metric
 	LoadVMM = "LoadVMM"
+	// MergeMemLayers Time to merge the memory layers of a diff snapshot before loading it
+	MergeMemLayers = "MergeMemLayers"
+	// PrepareDevice Time to create the container device of a VM loaded from a snapshot, with its patch applied
+	PrepareDevice = "PrepareDevice"
 
 	// AddInstance Time to add instance - load snap or start vm
 	AddInstance = "AddInstance"
@@ -62,17 +70,69 @@ const (
 	TaskWait = "TaskWait"
 	// TaskStart Time to start task
 	TaskStart = "TaskStart"
+	// PrepareDrives Time to provision the extra drives of a VM
+	PrepareDrives = "PrepareDrives"
+	// ProbeReady Time for the guest to pass the readiness probe
+	ProbeReady = "ProbeReady"
+)
+
+const (
+	// CPUUsageUs CPU time consumed by a VM in microseconds
+	CPUUsageUs = "CPUUsageUs"
+	// MemoryCurrent Memory used by a VM in bytes
+	MemoryCurrent = "MemoryCurrent"
+	// MemoryPeak Highest memory usage of a VM in bytes
+	MemoryPeak = "MemoryPeak"
+	// IOReadBytes Bytes read from block devices by a VM
+	IOReadBytes = "IOReadBytes"
+	// IOWriteBytes Bytes written to block devices by a VM
+	IOWriteBytes = "IOWriteBytes"
+)
+
+const (
+	// ThinPoolDataUsage Fraction of the data blocks of the devmapper thin pool in use
+	ThinPoolDataUsage = "ThinPoolDataUsage"
+	// ThinPoolMetadataUsage Fraction of the metadata blocks of the devmapper thin pool in use
+	ThinPoolMetadataUsage = "ThinPoolMetadataUsage"
+	// DevicePoolOrigins Number of patched origins in the device pool
+	DevicePoolOrigins = "DevicePoolOrigins"
+	// DevicePoolHits Container snapshots created from an existing origin
+	DevicePoolHits = "DevicePoolHits"
+	// DevicePoolMisses Container snapshots for which an origin was created
+	DevicePoolMisses = "DevicePoolMisses"
+	// DevicePoolTimeSavedUs Time saved by the hits of the device pool in microseconds
+	DevicePoolTimeSavedUs = "DevicePoolTimeSavedUs"
+	// ImageGCRuns Image garbage collections
+	ImageGCRuns = "ImageGCRuns"
+	// ImageGCEvictedImages Images evicted by the image GC
+	ImageGCEvictedImages = "ImageGCEvictedImages"
+	// ImageGCEvictedBytes Size of the content of the images evicted by the image GC
+	ImageGCEvictedBytes = "ImageGCEvictedBytes"
+	// ImageGCFailures Images the image GC failed to evict
+	ImageGCFailures = "ImageGCFailures"
+	// Snapshots Committed snapshot versions on the node
+	Snapshots = "Snapshots"
+	// SnapshotBytes Size of the files of the committed snapshot versions
+	SnapshotBytes = "SnapshotBytes"
+	// SnapshotLoads Completed loads of the committed snapshot versions
+	SnapshotLoads = "SnapshotLoads"
 )
 
 // Metric A general metric
 type Metric struct {
 	MetricMap map[string]float64
+	// ResourceMap holds the resources used by the VM, which are not part of the total time
+	ResourceMap map[string]float64
+	// NodeMap holds the state of the node shared by all VMs, e.g., the usage of the thin pool
+	NodeMap map[string]float64
 }
 
 // NewMetric Create a new metric
 func NewMetric() *Metric {
 	m := new(Metric)
 	m.MetricMap = make(map[string]float64)
+	m.ResourceMap = make(map[string]float64)
+	m.NodeMap = make(map[string]float64)
 
 	return m
 }
@@ -98,6 +158,12 @@ func (m *Metric) PrintAll() {
 		fmt.Printf("%s:\t%.1f\n", k, v)
 	}
 	fmt.Printf("Total\t%.1f\n", m.Total())
+	for k, v := range m.ResourceMap {
+		fmt.Printf("%s:\t%.0f\n", k, v)
+	}
+	for k, v := range m.NodeMap {
+		fmt.Printf("%s:\t%.2f\n", k, v)
+	}
 }
 
 // PrintMeanStd prints the mean and standard
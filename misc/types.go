@@ -38,10 +38,13 @@ type VM struct {
 	ContainerSnapKey string
 	SnapBooted       bool
 	Image            *containerd.Image
+	ImageName        string // name of the image referenced by the VM, empty if none
+	IsLazy           bool   // the image is loaded lazily, Image is nil
 	Container        *containerd.Container
 	Task             *containerd.Task
 	TaskCh           <-chan containerd.ExitStatus
 	NetConfig        *networking.NetworkConfig
+	BalloonMib       int64 // target size of the balloon, 0 when deflated
 }
 
 // VMPool Pool of active VMs (can be in several states though)
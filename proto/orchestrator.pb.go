@@ -258,36 +258,196 @@ func (m *StartVMResp) GetProfile() string {
 	return ""
 }
 
+type PrePullReq struct {
+	Images               []string `protobuf:"bytes,1,rep,name=images,proto3" json:"images,omitempty"`
+	Wait                 bool     `protobuf:"varint,2,opt,name=wait,proto3" json:"wait,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PrePullReq) Reset()         { *m = PrePullReq{} }
+func (m *PrePullReq) String() string { return proto.CompactTextString(m) }
+func (*PrePullReq) ProtoMessage()    {}
+func (*PrePullReq) Descriptor() ([]byte, []int) {
+	return fileDescriptor_96b6e6782baaa298, []int{5}
+}
+
+func (m *PrePullReq) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PrePullReq.Unmarshal(m, b)
+}
+func (m *PrePullReq) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PrePullReq.Marshal(b, m, deterministic)
+}
+func (m *PrePullReq) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PrePullReq.Merge(m, src)
+}
+func (m *PrePullReq) XXX_Size() int {
+	return xxx_messageInfo_PrePullReq.Size(m)
+}
+func (m *PrePullReq) XXX_DiscardUnknown() {
+	xxx_messageInfo_PrePullReq.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PrePullReq proto.InternalMessageInfo
+
+func (m *PrePullReq) GetImages() []string {
+	if m != nil {
+		return m.Images
+	}
+	return nil
+}
+
+func (m *PrePullReq) GetWait() bool {
+	if m != nil {
+		return m.Wait
+	}
+	return false
+}
+
+type PrePullStatusReq struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PrePullStatusReq) Reset()         { *m = PrePullStatusReq{} }
+func (m *PrePullStatusReq) String() string { return proto.CompactTextString(m) }
+func (*PrePullStatusReq) ProtoMessage()    {}
+func (*PrePullStatusReq) Descriptor() ([]byte, []int) {
+	return fileDescriptor_96b6e6782baaa298, []int{6}
+}
+
+func (m *PrePullStatusReq) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PrePullStatusReq.Unmarshal(m, b)
+}
+func (m *PrePullStatusReq) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PrePullStatusReq.Marshal(b, m, deterministic)
+}
+func (m *PrePullStatusReq) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PrePullStatusReq.Merge(m, src)
+}
+func (m *PrePullStatusReq) XXX_Size() int {
+	return xxx_messageInfo_PrePullStatusReq.Size(m)
+}
+func (m *PrePullStatusReq) XXX_DiscardUnknown() {
+	xxx_messageInfo_PrePullStatusReq.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PrePullStatusReq proto.InternalMessageInfo
+
+type PrePullStatus struct {
+	Ready                bool     `protobuf:"varint,1,opt,name=ready,proto3" json:"ready,omitempty"`
+	Total                int32    `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
+	Pulled               int32    `protobuf:"varint,3,opt,name=pulled,proto3" json:"pulled,omitempty"`
+	Failed               int32    `protobuf:"varint,4,opt,name=failed,proto3" json:"failed,omitempty"`
+	Errors               []string `protobuf:"bytes,5,rep,name=errors,proto3" json:"errors,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PrePullStatus) Reset()         { *m = PrePullStatus{} }
+func (m *PrePullStatus) String() string { return proto.CompactTextString(m) }
+func (*PrePullStatus) ProtoMessage()    {}
+func (*PrePullStatus) Descriptor() ([]byte, []int) {
+	return fileDescriptor_96b6e6782baaa298, []int{7}
+}
+
+func (m *PrePullStatus) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PrePullStatus.Unmarshal(m, b)
+}
+func (m *PrePullStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PrePullStatus.Marshal(b, m, deterministic)
+}
+func (m *PrePullStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PrePullStatus.Merge(m, src)
+}
+func (m *PrePullStatus) XXX_Size() int {
+	return xxx_messageInfo_PrePullStatus.Size(m)
+}
+func (m *PrePullStatus) XXX_DiscardUnknown() {
+	xxx_messageInfo_PrePullStatus.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PrePullStatus proto.InternalMessageInfo
+
+func (m *PrePullStatus) GetReady() bool {
+	if m != nil {
+		return m.Ready
+	}
+	return false
+}
+
+func (m *PrePullStatus) GetTotal() int32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
+func (m *PrePullStatus) GetPulled() int32 {
+	if m != nil {
+		return m.Pulled
+	}
+	return 0
+}
+
+func (m *PrePullStatus) GetFailed() int32 {
+	if m != nil {
+		return m.Failed
+	}
+	return 0
+}
+
+func (m *PrePullStatus) GetErrors() []string {
+	if m != nil {
+		return m.Errors
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*StartVMReq)(nil), "proto.StartVMReq")
 	proto.RegisterType((*StopVMsReq)(nil), "proto.StopVMsReq")
 	proto.RegisterType((*StopSingleVMReq)(nil), "proto.StopSingleVMReq")
 	proto.RegisterType((*Status)(nil), "proto.Status")
 	proto.RegisterType((*StartVMResp)(nil), "proto.StartVMResp")
+	proto.RegisterType((*PrePullReq)(nil), "proto.PrePullReq")
+	proto.RegisterType((*PrePullStatusReq)(nil), "proto.PrePullStatusReq")
+	proto.RegisterType((*PrePullStatus)(nil), "proto.PrePullStatus")
 }
 
 func init() { proto.RegisterFile("orchestrator.proto", fileDescriptor_96b6e6782baaa298) }
 
 var fileDescriptor_96b6e6782baaa298 = []byte{
-	// 281 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x91, 0x51, 0x4b, 0xfb, 0x30,
-	0x14, 0xc5, 0xd7, 0xc1, 0xda, 0xff, 0xff, 0x3a, 0x95, 0x5d, 0x44, 0xcb, 0x40, 0xd0, 0x80, 0xe0,
-	0x8b, 0x7d, 0xa8, 0x82, 0xcf, 0xee, 0x7d, 0x38, 0x5a, 0xe8, 0xab, 0xc4, 0x2d, 0xd6, 0x40, 0x6a,
-	0x62, 0x6e, 0x26, 0x7e, 0x26, 0x3f, 0xa5, 0xa4, 0x5d, 0xd7, 0xa0, 0xf8, 0x14, 0xee, 0xcd, 0xfd,
-	0x9d, 0xdc, 0x73, 0x02, 0xa8, 0xed, 0xfa, 0x55, 0x90, 0xb3, 0xdc, 0x69, 0x9b, 0x19, 0xab, 0x9d,
-	0xc6, 0x49, 0x7b, 0xb0, 0x1c, 0xa0, 0x74, 0xdc, 0xba, 0x6a, 0x59, 0x88, 0x77, 0x3c, 0x81, 0x89,
-	0x6c, 0x78, 0x2d, 0xd2, 0xe8, 0x22, 0xba, 0xfe, 0x5f, 0x74, 0x05, 0x1e, 0xc1, 0x58, 0x6e, 0xd2,
-	0x71, 0xdb, 0x1a, 0xcb, 0x0d, 0xbb, 0xf2, 0x8c, 0x36, 0xd5, 0x92, 0x3c, 0x73, 0x06, 0x09, 0x57,
-	0xea, 0xe9, 0xa3, 0xa1, 0x96, 0xfa, 0x57, 0xc4, 0x5c, 0xa9, 0xaa, 0x21, 0x76, 0x09, 0xc7, 0x7e,
-	0xac, 0x94, 0x6f, 0xb5, 0x12, 0x9d, 0x7e, 0xa7, 0x14, 0xed, 0x95, 0x18, 0xc4, 0xa5, 0xe3, 0x6e,
-	0x4b, 0x98, 0x42, 0xd2, 0x08, 0xa2, 0xe1, 0xed, 0xbe, 0x64, 0x0f, 0x70, 0xb0, 0xdf, 0x90, 0xcc,
-	0xdf, 0x83, 0xfe, 0xc6, 0x58, 0xfd, 0x22, 0x95, 0xd8, 0xed, 0xda, 0x97, 0xf9, 0x57, 0x04, 0xd3,
-	0xc7, 0x20, 0x02, 0xcc, 0x21, 0xd9, 0x69, 0xe2, 0xac, 0xcb, 0x23, 0x1b, 0x52, 0x98, 0xe3, 0xcf,
-	0x16, 0x19, 0x36, 0xc2, 0x1b, 0xcf, 0xb4, 0xae, 0x03, 0xa6, 0x4f, 0x61, 0x7e, 0x38, 0x30, 0x6e,
-	0x4b, 0x6c, 0x84, 0xf7, 0x30, 0x0d, 0xdd, 0xe3, 0x69, 0xc0, 0x04, 0x91, 0xfc, 0x02, 0x17, 0x77,
-	0x70, 0x2e, 0x75, 0x56, 0x5b, 0xb3, 0xce, 0xc4, 0x27, 0x6f, 0x8c, 0x12, 0x94, 0x85, 0xff, 0xb7,
-	0x98, 0x85, 0x56, 0x56, 0x1e, 0x5e, 0x45, 0xcf, 0x71, 0xab, 0x72, 0xfb, 0x1d, 0x00, 0x00, 0xff,
-	0xff, 0x9e, 0x34, 0x34, 0xa7, 0xeb, 0x01, 0x00, 0x00,
+	// 406 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x53, 0x4b, 0x8f, 0xd3, 0x30,
+	0x18, 0xdc, 0x64, 0x37, 0xc9, 0xee, 0xc7, 0x2e, 0x6c, 0xad, 0xaa, 0x8d, 0x2a, 0x21, 0x81, 0x25,
+	0xa4, 0x5e, 0xc8, 0xa1, 0x54, 0x82, 0x2b, 0xe5, 0xc0, 0xa9, 0x22, 0x4a, 0xa5, 0x5e, 0x91, 0x69,
+	0xdc, 0x62, 0xc9, 0xc1, 0xae, 0xed, 0xf0, 0x38, 0xf3, 0x5b, 0xf8, 0x9f, 0xc8, 0x8f, 0x26, 0x29,
+	0x8f, 0x3d, 0xb5, 0x33, 0xf1, 0x8c, 0x27, 0x33, 0x0a, 0x20, 0xa1, 0x76, 0x9f, 0xa9, 0x36, 0x8a,
+	0x18, 0xa1, 0x0a, 0xa9, 0x84, 0x11, 0x28, 0x71, 0x3f, 0x78, 0x01, 0xb0, 0x31, 0x44, 0x99, 0xed,
+	0xba, 0xa2, 0x47, 0x34, 0x86, 0x84, 0x35, 0xe4, 0x40, 0xf3, 0xe8, 0x59, 0x34, 0xbf, 0xa9, 0x3c,
+	0x40, 0x8f, 0x21, 0x66, 0x75, 0x1e, 0x3b, 0x2a, 0x66, 0x35, 0x7e, 0x61, 0x35, 0x42, 0x6e, 0xd7,
+	0xda, 0x6a, 0xa6, 0x90, 0x11, 0xce, 0x3f, 0x7e, 0x6d, 0xb4, 0x53, 0x5d, 0x57, 0x29, 0xe1, 0x7c,
+	0xdb, 0x68, 0xfc, 0x1c, 0x9e, 0xd8, 0x63, 0x1b, 0xf6, 0xe5, 0xc0, 0xa9, 0xf7, 0xf7, 0x4e, 0x51,
+	0xe7, 0x84, 0x21, 0xdd, 0x18, 0x62, 0x5a, 0x8d, 0x72, 0xc8, 0x1a, 0xaa, 0x75, 0x7f, 0xf7, 0x09,
+	0xe2, 0xb7, 0xf0, 0xa8, 0x4b, 0xa8, 0xe5, 0xff, 0x0f, 0xda, 0x27, 0x52, 0x89, 0x3d, 0xe3, 0x34,
+	0x64, 0x3d, 0x41, 0xfc, 0x06, 0xa0, 0x54, 0xb4, 0x6c, 0x39, 0xb7, 0x21, 0x26, 0x90, 0xba, 0xf7,
+	0xb2, 0x79, 0x2f, 0xe7, 0x37, 0x55, 0x40, 0x08, 0xc1, 0xd5, 0x37, 0xc2, 0x8c, 0x13, 0x5f, 0x57,
+	0xee, 0x3f, 0x46, 0x70, 0x1f, 0x94, 0x3e, 0x67, 0x45, 0x8f, 0xf8, 0x67, 0x04, 0x77, 0x67, 0xa4,
+	0xad, 0x4d, 0x51, 0x52, 0xff, 0x08, 0x05, 0x78, 0x60, 0x59, 0x23, 0x0c, 0xe1, 0xce, 0x30, 0xa9,
+	0x3c, 0xb0, 0xb7, 0xcb, 0x96, 0x73, 0x5a, 0xe7, 0x97, 0x8e, 0x0e, 0xc8, 0xf2, 0x7b, 0xc2, 0x2c,
+	0x7f, 0xe5, 0x79, 0x8f, 0x2c, 0x4f, 0x95, 0x12, 0x4a, 0xe7, 0x89, 0x4f, 0xeb, 0xd1, 0xe2, 0x57,
+	0x0c, 0xb7, 0x1f, 0x06, 0xb3, 0xa2, 0x05, 0x64, 0xa1, 0x27, 0x34, 0xf2, 0x1b, 0x17, 0xfd, 0xb2,
+	0x33, 0xf4, 0x27, 0xa5, 0x25, 0xbe, 0x40, 0x2f, 0x21, 0x0b, 0x4b, 0x0e, 0x34, 0xa7, 0x65, 0x67,
+	0x77, 0xbd, 0xc6, 0xb4, 0x1a, 0x5f, 0xa0, 0xd7, 0x70, 0x3b, 0x5c, 0x14, 0x4d, 0x06, 0x9a, 0xc1,
+	0xcc, 0x7f, 0x0b, 0x97, 0x90, 0x85, 0xc6, 0xba, 0x7b, 0xfa, 0x41, 0x66, 0xe3, 0x73, 0xaa, 0x53,
+	0xbd, 0x83, 0xfb, 0xf7, 0xd4, 0x9c, 0x57, 0x3d, 0xfd, 0xd7, 0xd9, 0x07, 0x4c, 0x56, 0x4b, 0x78,
+	0xca, 0x44, 0x71, 0x50, 0x72, 0x57, 0xd0, 0xef, 0xa4, 0x91, 0x9c, 0xea, 0x62, 0xf8, 0x39, 0xac,
+	0x46, 0xc3, 0x16, 0x4b, 0xeb, 0x51, 0x46, 0x9f, 0x52, 0x67, 0xf6, 0xea, 0xf7, 0x00, 0x2f, 0x82,
+	0x57, 0x8b, 0x3a, 0x03, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -305,6 +465,8 @@ type OrchestratorClient interface {
 	StartVM(ctx context.Context, in *StartVMReq, opts ...grpc.CallOption) (*StartVMResp, error)
 	StopVMs(ctx context.Context, in *StopVMsReq, opts ...grpc.CallOption) (*Status, error)
 	StopSingleVM(ctx context.Context, in *StopSingleVMReq, opts ...grpc.CallOption) (*Status, error)
+	PrePull(ctx context.Context, in *PrePullReq, opts ...grpc.CallOption) (*PrePullStatus, error)
+	GetPrePullStatus(ctx context.Context, in *PrePullStatusReq, opts ...grpc.CallOption) (*PrePullStatus, error)
 }
 
 type orchestratorClient struct {
@@ -342,11 +504,31 @@ func (c *orchestratorClient) StopSingleVM(ctx context.Context, in *StopSingleVMR
 	return out, nil
 }
 
+func (c *orchestratorClient) PrePull(ctx context.Context, in *PrePullReq, opts ...grpc.CallOption) (*PrePullStatus, error) {
+	out := new(PrePullStatus)
+	err := c.cc.Invoke(ctx, "/proto.Orchestrator/PrePull", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orchestratorClient) GetPrePullStatus(ctx context.Context, in *PrePullStatusReq, opts ...grpc.CallOption) (*PrePullStatus, error) {
+	out := new(PrePullStatus)
+	err := c.cc.Invoke(ctx, "/proto.Orchestrator/GetPrePullStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // OrchestratorServer is the server API for Orchestrator service.
 type OrchestratorServer interface {
 	StartVM(context.Context, *StartVMReq) (*StartVMResp, error)
 	StopVMs(context.Context, *StopVMsReq) (*Status, error)
 	StopSingleVM(context.Context, *StopSingleVMReq) (*Status, error)
+	PrePull(context.Context, *PrePullReq) (*PrePullStatus, error)
+	GetPrePullStatus(context.Context, *PrePullStatusReq) (*PrePullStatus, error)
 }
 
 // UnimplementedOrchestratorServer can be embedded to have forward compatible implementations.
@@ -362,6 +544,12 @@ func (*UnimplementedOrchestratorServer) StopVMs(ctx context.Context, req *StopVM
 func (*UnimplementedOrchestratorServer) StopSingleVM(ctx context.Context, req *StopSingleVMReq) (*Status, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method StopSingleVM not implemented")
 }
+func (*UnimplementedOrchestratorServer) PrePull(ctx context.Context, req *PrePullReq) (*PrePullStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PrePull not implemented")
+}
+func (*UnimplementedOrchestratorServer) GetPrePullStatus(ctx context.Context, req *PrePullStatusReq) (*PrePullStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPrePullStatus not implemented")
+}
 
 func RegisterOrchestratorServer(s *grpc.Server, srv OrchestratorServer) {
 	s.RegisterService(&_Orchestrator_serviceDesc, srv)
@@ -421,6 +609,42 @@ func _Orchestrator_StopSingleVM_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Orchestrator_PrePull_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrePullReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrchestratorServer).PrePull(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Orchestrator/PrePull",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrchestratorServer).PrePull(ctx, req.(*PrePullReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Orchestrator_GetPrePullStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrePullStatusReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrchestratorServer).GetPrePullStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Orchestrator/GetPrePullStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrchestratorServer).GetPrePullStatus(ctx, req.(*PrePullStatusReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Orchestrator_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "proto.Orchestrator",
 	HandlerType: (*OrchestratorServer)(nil),
@@ -437,6 +661,14 @@ var _Orchestrator_serviceDesc = grpc.ServiceDesc{
 			MethodName: "StopSingleVM",
 			Handler:    _Orchestrator_StopSingleVM_Handler,
 		},
+		{
+			MethodName: "PrePull",
+			Handler:    _Orchestrator_PrePull_Handler,
+		},
+		{
+			MethodName: "GetPrePullStatus",
+			Handler:    _Orchestrator_GetPrePullStatus_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "orchestrator.proto",
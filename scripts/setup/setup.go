@@ -127,6 +127,16 @@ func SetupFirecrackerContainerd() error {
 		return err
 	}
 
+	// Copy `firecracker-runc-config.json` used by jailed VMs
+	configFilePath, err = utils.GetVHiveFilePath(path.Join(configsDir, "firecracker-runc-config.json"))
+	if !utils.CheckErrorWithMsg(err, "Failed to copy required files!\n") {
+		return err
+	}
+	err = utils.CopyToDir(configFilePath, "/etc/containerd/", true)
+	if !utils.CheckErrorWithTagAndMsg(err, "Failed to copy required files!\n") {
+		return err
+	}
+
 	return nil
 }
 
@@ -213,7 +223,7 @@ func SetupSystem() error {
 	if !utils.CheckErrorWithMsg(err, "Failed to install required dependencies!\n") {
 		return err
 	}
-	err = utils.InstallPackages("apt-transport-https gcc g++ make acl net-tools git-lfs bc gettext-base jq dmsetup gnupg-agent software-properties-common iproute2 nftables git-lfs")
+	err = utils.InstallPackages("apt-transport-https gcc g++ make acl net-tools git-lfs bc gettext-base jq dmsetup gnupg-agent software-properties-common iproute2 nftables git-lfs thin-provisioning-tools")
 	if !utils.CheckErrorWithTagAndMsg(err, "Failed to install required dependencies!\n") {
 		return err
 	}
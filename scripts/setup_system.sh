@@ -43,7 +43,7 @@ sudo apt-get -y install \
     software-properties-common \
     iproute2 \
     nftables \
-    rsync >> /dev/null
+    thin-provisioning-tools >> /dev/null
 
 # stack size, # of open files, # of pids
 sudo sh -c "echo \"* soft nofile 1000000\" >> /etc/security/limits.conf"
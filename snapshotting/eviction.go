@@ -0,0 +1,372 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+// EvictionPolicy Selects the snapshots evicted when the snapshots exceed the disk budget
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently loaded snapshots first
+	EvictLRU EvictionPolicy = "lru"
+	// EvictCostBenefit evicts the snapshots that save the least cold start time per byte first
+	EvictCostBenefit EvictionPolicy = "cost"
+)
+
+// ParseEvictionPolicy Parses the name of an eviction policy
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch policy := EvictionPolicy(name); policy {
+	case EvictLRU, EvictCostBenefit:
+		return policy, nil
+	default:
+		return "", errors.Errorf("unknown snapshot eviction policy %q", name)
+	}
+}
+
+// WithDiskBudget Evicts snapshots according to the policy whenever their size exceeds the budget in bytes
+func WithDiskBudget(budget int64, policy EvictionPolicy) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.budget = budget
+		mgr.evictionPolicy = policy
+	}
+}
+
+// SnapshotStats Usage of a version of a snapshot
+type SnapshotStats struct {
+	Revision   string
+	Generation uint64
+	// Current is whether new VMs are loaded from the version, and Pinned whether it stays current on commit
+	Current bool
+	Pinned  bool
+	// Size is the size of the files of the snapshot in bytes
+	Size int64
+	// Loads is the number of completed loads, and Loading the number of loads in progress
+	Loads   uint64
+	Loading int
+	// LastUsed is the time of the last load, or of the creation of the snapshot if never loaded
+	LastUsed time.Time
+	// SavedPerLoad is the cold start time a load saves, i.e., the boot time of the revision minus the mean load time
+	SavedPerLoad time.Duration
+}
+
+// PinSnapshot returns the snapshot for the specified revision to load a VM from it, downloading it from the store
+// if it is missing on the node. The snapshot is not evicted until UnpinSnapshot is called
+func (mgr *SnapshotManager) PinSnapshot(ctx context.Context, revision string) (*Snapshot, error) {
+	if err := mgr.fetchSnapshot(ctx, revision); err != nil {
+		return nil, errors.Wrapf(err, "fetching snapshot for revision %s", revision)
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	var snap *Snapshot
+	if rev, ok := mgr.revisions[revision]; ok {
+		snap = rev.currentSnapshot()
+	}
+	if snap == nil {
+		return nil, errors.Errorf("Pin: Snapshot for revision %s is not available", revision)
+	}
+	snap.loading++
+	snap.lastUsed = time.Now()
+
+	return snap, nil
+}
+
+// UnpinSnapshot records the end of a load of the snapshot, which took loadTime, 0 if the load failed. The snapshot
+// is removed if it was retired meanwhile and this was its last load
+func (mgr *SnapshotManager) UnpinSnapshot(snap *Snapshot, loadTime time.Duration) {
+	if loadTime > 0 && snap.IsDiff() {
+		// The first load of a diff snapshot merges its memory layers
+		mgr.updateSize(snap)
+	}
+
+	mgr.Lock()
+	if snap.loading > 0 {
+		snap.loading--
+	}
+	if loadTime > 0 {
+		snap.loads++
+		snap.loadTime += loadTime
+	}
+	retired := snap.retired && snap.loading == 0
+	mgr.Unlock()
+
+	if retired {
+		if err := mgr.removeRetired([]*Snapshot{snap}); err != nil {
+			log.WithError(err).WithField("revision", snap.GetId()).Warn("Failed to remove retired snapshot")
+		}
+	}
+
+	mgr.evictSnapshots()
+}
+
+// updateSize measures the files of the snapshot again after they changed
+func (mgr *SnapshotManager) updateSize(snap *Snapshot) {
+	size := dirSize(snap.snapDir)
+
+	mgr.Lock()
+	snap.size = size
+	mgr.Unlock()
+}
+
+// GetSnapshotStats returns the usage of the committed versions of the snapshots
+func (mgr *SnapshotManager) GetSnapshotStats() []SnapshotStats {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	var stats []SnapshotStats
+	for _, rev := range mgr.revisions {
+		for _, snap := range rev.committedSnapshots() {
+			stats = append(stats, rev.getStats(snap))
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Revision != stats[j].Revision {
+			return stats[i].Revision < stats[j].Revision
+		}
+		return stats[i].Generation < stats[j].Generation
+	})
+
+	return stats
+}
+
+// GetSnapshotMetrics returns the number, size and loads of the committed versions of the snapshots as metrics
+func (mgr *SnapshotManager) GetSnapshotMetrics() map[string]float64 {
+	snapshotMetrics := map[string]float64{metrics.Snapshots: 0, metrics.SnapshotBytes: 0, metrics.SnapshotLoads: 0}
+	for _, stats := range mgr.GetSnapshotStats() {
+		snapshotMetrics[metrics.Snapshots]++
+		snapshotMetrics[metrics.SnapshotBytes] += float64(stats.Size)
+		snapshotMetrics[metrics.SnapshotLoads] += float64(stats.Loads)
+	}
+	return snapshotMetrics
+}
+
+func (rev *revision) getStats(snp *Snapshot) SnapshotStats {
+	stats := SnapshotStats{
+		Revision:   rev.name,
+		Generation: snp.Generation,
+		Current:    snp.Generation == rev.current,
+		Pinned:     snp.Generation == rev.current && rev.pinned,
+		Size:       snp.size,
+		Loads:      snp.loads,
+		Loading:    snp.loading,
+		LastUsed:   snp.lastUsed,
+	}
+
+	stats.SavedPerLoad = snp.BootTime
+	if snp.loads > 0 {
+		stats.SavedPerLoad -= snp.loadTime / time.Duration(snp.loads)
+	}
+	if stats.SavedPerLoad < 0 {
+		stats.SavedPerLoad = 0
+	}
+
+	return stats
+}
+
+// score orders the snapshots by eviction priority, lowest first. The benefit of a snapshot is the cold start time it
+// saves, counting the load that motivated its creation, and its cost is its size
+func (stats SnapshotStats) score() float64 {
+	if stats.Size == 0 {
+		return 0
+	}
+	return float64(stats.Loads+1) * stats.SavedPerLoad.Seconds() / float64(stats.Size)
+}
+
+// evictSnapshots removes committed snapshots while the snapshots exceed the disk budget. Previous versions are
+// evicted before current ones, and snapshots being loaded and the parents of diff snapshots are kept
+func (mgr *SnapshotManager) evictSnapshots() {
+	if mgr.budget <= 0 {
+		return
+	}
+
+	type candidate struct {
+		SnapshotStats
+		rev  *revision
+		snap *Snapshot
+	}
+
+	mgr.Lock()
+	var (
+		total      int64
+		candidates []candidate
+	)
+	for _, rev := range mgr.revisions {
+		for _, snap := range rev.versions {
+			stats := rev.getStats(snap)
+			total += stats.Size
+			if snap.ready && snap.loading == 0 && !mgr.isParent(snap) {
+				candidates = append(candidates, candidate{SnapshotStats: stats, rev: rev, snap: snap})
+			}
+		}
+	}
+
+	if total <= mgr.budget {
+		mgr.Unlock()
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Current != b.Current {
+			return !a.Current
+		}
+		if mgr.evictionPolicy == EvictCostBenefit && a.score() != b.score() {
+			return a.score() < b.score()
+		}
+		return a.LastUsed.Before(b.LastUsed)
+	})
+
+	var (
+		evicted []*Snapshot
+		emptied = make(map[*revision]bool)
+	)
+	for _, c := range candidates {
+		if total <= mgr.budget {
+			break
+		}
+		evicted = append(evicted, c.rev.retire(c.snap))
+		if len(c.rev.versions) == 0 {
+			c.rev.removeDir()
+			emptied[c.rev] = true
+		}
+		total -= c.Size
+	}
+	mgr.Unlock()
+
+	for _, snap := range evicted {
+		logger := log.WithFields(log.Fields{"revision": snap.GetId(), "generation": snap.GetGeneration()})
+		if err := mgr.removeRetired([]*Snapshot{snap}); err != nil {
+			logger.WithError(err).Warn("Failed to remove evicted snapshot")
+			// The generations of the files left behind must not be reused
+			for rev := range emptied {
+				if rev.name == snap.GetId() {
+					delete(emptied, rev)
+				}
+			}
+			continue
+		}
+		logger.Info("Evicted snapshot to stay within the disk budget")
+	}
+
+	mgr.forgetRevisions(emptied)
+	if total > mgr.budget {
+		log.Warnf("Snapshots use %d bytes, above the budget of %d bytes, but are all in use", total, mgr.budget)
+	}
+}
+
+// forgetRevisions deletes the revisions whose last versions were evicted, unless versions were added meanwhile. The
+// revisions are kept until the files of their versions are removed, so that new versions do not reuse their
+// generations.
+func (mgr *SnapshotManager) forgetRevisions(revs map[*revision]bool) {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	for rev := range revs {
+		if len(rev.versions) > 0 || mgr.revisions[rev.name] != rev {
+			continue
+		}
+		if _, downloading := mgr.downloads[rev.name]; downloading {
+			continue
+		}
+		delete(mgr.revisions, rev.name)
+		// The snapshot is read from the store again, if any
+		delete(mgr.checked, rev.name)
+	}
+}
+
+// EvictPreviousVersions removes the committed versions of the snapshots that are not current, which are only kept to
+// roll back, e.g., to release their images when the thin pool runs short of space. Versions being loaded and the
+// parents of diff snapshots are kept. It returns the number of versions removed
+func (mgr *SnapshotManager) EvictPreviousVersions() int {
+	mgr.Lock()
+	var evicted []*Snapshot
+	for _, rev := range mgr.revisions {
+		for _, snap := range rev.committedSnapshots() {
+			if snap.Generation != rev.current && snap.loading == 0 && !mgr.isParent(snap) {
+				evicted = append(evicted, rev.retire(snap))
+			}
+		}
+		if len(rev.versions) == 0 {
+			rev.removeDir()
+		}
+	}
+	mgr.Unlock()
+
+	for _, snap := range evicted {
+		logger := log.WithFields(log.Fields{"revision": snap.GetId(), "generation": snap.GetGeneration()})
+		if err := mgr.removeRetired([]*Snapshot{snap}); err != nil {
+			logger.WithError(err).Warn("Failed to remove evicted snapshot")
+			continue
+		}
+		logger.Info("Evicted previous snapshot version to free space")
+	}
+
+	return len(evicted)
+}
+
+// isParent returns whether a diff snapshot depends on the memory files of the snapshot
+func (mgr *SnapshotManager) isParent(parent *Snapshot) bool {
+	prefix := parent.snapDir + string(filepath.Separator)
+	for _, rev := range mgr.revisions {
+		for _, snap := range rev.versions {
+			if snap == parent {
+				continue
+			}
+			for _, path := range append([]string{snap.BaseMemFile}, snap.MemLayers...) {
+				if strings.HasPrefix(path, prefix) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// dirSize returns the size of the files in the directory
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,176 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/metrics"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// commitSizedSnapshot takes a committed snapshot of the revision whose memory file has the given size in KiB
+func commitSizedSnapshot(t *testing.T, mgr *snapshotting.SnapshotManager, revision string, sizeKib int, bootTime time.Duration) *snapshotting.Snapshot {
+	snap, err := mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err)
+	snap.BootTime = bootTime
+	require.NoError(t, os.WriteFile(snap.GetMemFilePath(), bytes.Repeat([]byte{1}, sizeKib*1024), 0644))
+	require.NoError(t, mgr.CommitSnapshot(revision))
+	return snap
+}
+
+func revisions(mgr *snapshotting.SnapshotManager) []string {
+	var list []string
+	for _, stats := range mgr.GetSnapshotStats() {
+		list = append(list, stats.Revision)
+	}
+	return list
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for _, policy := range []snapshotting.EvictionPolicy{snapshotting.EvictLRU, snapshotting.EvictCostBenefit} {
+		parsed, err := snapshotting.ParseEvictionPolicy(string(policy))
+		require.NoError(t, err)
+		require.Equal(t, policy, parsed)
+	}
+	_, err := snapshotting.ParseEvictionPolicy("fifo")
+	require.Error(t, err)
+}
+
+func TestSnapshotEvictionLRU(t *testing.T) {
+	dir := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(dir, snapshotting.WithDiskBudget(300*1024, snapshotting.EvictLRU))
+
+	commitSizedSnapshot(t, mgr, "first", 100, time.Second)
+	commitSizedSnapshot(t, mgr, "second", 100, time.Second)
+	commitSizedSnapshot(t, mgr, "third", 100, time.Second)
+	require.Equal(t, []string{"first", "second", "third"}, revisions(mgr))
+
+	// Loads make the first snapshot the most recently used
+	snap, err := mgr.PinSnapshot(context.Background(), "first")
+	require.NoError(t, err)
+	mgr.UnpinSnapshot(snap, 10*time.Millisecond)
+
+	commitSizedSnapshot(t, mgr, "fourth", 100, time.Second)
+	require.Equal(t, []string{"first", "fourth", "third"}, revisions(mgr))
+
+	_, err = mgr.AcquireSnapshot(context.Background(), "second")
+	require.Error(t, err, "Evicted snapshot should not be acquired")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3, "Files of the evicted snapshot should be removed")
+
+	stats := mgr.GetSnapshotStats()[0]
+	require.Equal(t, uint64(1), stats.Loads)
+	require.Equal(t, time.Second-10*time.Millisecond, stats.SavedPerLoad)
+	require.GreaterOrEqual(t, stats.Size, int64(100*1024))
+}
+
+func TestSnapshotEvictionForgetsRevisions(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithDiskBudget(150*1024, snapshotting.EvictLRU))
+
+	first := commitSizedSnapshot(t, mgr, "first", 100, time.Second)
+	commitSizedSnapshot(t, mgr, "second", 100, time.Second)
+	require.Equal(t, []string{"second"}, revisions(mgr))
+
+	// The revision of the evicted snapshot is started over
+	snap, err := mgr.InitSnapshot("first", "testImage")
+	require.NoError(t, err)
+	require.Equal(t, first.GetGeneration(), snap.GetGeneration())
+}
+
+func TestSnapshotEvictionPinned(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithDiskBudget(250*1024, snapshotting.EvictLRU))
+
+	commitSizedSnapshot(t, mgr, "loading", 100, time.Second)
+	commitSizedSnapshot(t, mgr, "idle", 100, time.Second)
+	snap, err := mgr.PinSnapshot(context.Background(), "loading")
+	require.NoError(t, err)
+	// Make the snapshot being loaded the least recently used
+	snap, err = mgr.PinSnapshot(context.Background(), "idle")
+	require.NoError(t, err)
+	mgr.UnpinSnapshot(snap, time.Millisecond)
+	loading, err := mgr.AcquireSnapshot(context.Background(), "loading")
+	require.NoError(t, err)
+
+	// Snapshots being loaded are kept
+	commitSizedSnapshot(t, mgr, "new", 100, time.Second)
+	require.Equal(t, []string{"loading", "new"}, revisions(mgr))
+
+	mgr.UnpinSnapshot(loading, time.Millisecond)
+	require.Equal(t, []string{"loading", "new"}, revisions(mgr), "Snapshots within the budget should be kept")
+}
+
+func TestSnapshotEvictionCostBenefit(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithDiskBudget(350*1024, snapshotting.EvictCostBenefit))
+
+	// The big snapshot saves the most time, but the least per byte
+	commitSizedSnapshot(t, mgr, "cheap", 50, 500*time.Millisecond)
+	commitSizedSnapshot(t, mgr, "big", 200, 1500*time.Millisecond)
+	commitSizedSnapshot(t, mgr, "small", 50, time.Second)
+	require.Equal(t, []string{"big", "cheap", "small"}, revisions(mgr))
+
+	commitSizedSnapshot(t, mgr, "new", 100, time.Second)
+	require.Equal(t, []string{"cheap", "new", "small"}, revisions(mgr))
+}
+
+func TestSnapshotEvictionKeepsParents(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithDiskBudget(250*1024, snapshotting.EvictLRU))
+
+	commitSizedSnapshot(t, mgr, "parent", 100, time.Second)
+	child, err := mgr.InitDiffSnapshot(context.Background(), "child", "parent", "testImage")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(child.GetMemDiffFilePath(), bytes.Repeat([]byte{1}, 100*1024), 0644))
+	require.NoError(t, mgr.CommitSnapshot("child"))
+
+	// The child is evicted first, since the parent holds its base memory
+	commitSizedSnapshot(t, mgr, "new", 100, time.Second)
+	require.Equal(t, []string{"new", "parent"}, revisions(mgr))
+}
+
+func TestEvictPreviousVersions(t *testing.T) {
+	var released []string
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithRetainedVersions(2),
+		snapshotting.WithImageReferences(func(string) {}, func(image string) { released = append(released, image) }))
+
+	commitSizedSnapshot(t, mgr, "versioned", 10, time.Second)
+	commitSizedSnapshot(t, mgr, "versioned", 10, time.Second)
+	commitSizedSnapshot(t, mgr, "single", 10, time.Second)
+	snapshotMetrics := mgr.GetSnapshotMetrics()
+	require.Equal(t, 3.0, snapshotMetrics[metrics.Snapshots])
+	require.GreaterOrEqual(t, snapshotMetrics[metrics.SnapshotBytes], 30*1024.0)
+
+	require.Equal(t, 1, mgr.EvictPreviousVersions())
+	require.Equal(t, []string{"single", "versioned"}, revisions(mgr))
+	for _, stats := range mgr.GetSnapshotStats() {
+		require.True(t, stats.Current, "Current versions should be kept")
+	}
+	require.Equal(t, []string{"testImage"}, released, "The image of the evicted version should be released")
+
+	require.Zero(t, mgr.EvictPreviousVersions())
+}
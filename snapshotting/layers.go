@@ -0,0 +1,349 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Memory diff layers store the guest memory pages that differ from the parent snapshot. The firecracker-containerd
+// API only produces full memory files, so layers are computed by comparing the new memory file with the memory of
+// the parent page by page. A layer file starts with a header followed by (page index, page content) records.
+
+const (
+	memLayerMagic    = "VHMEMDIF"
+	memLayerVersion  = uint32(1)
+	memLayerPageSize = 4096
+)
+
+type memLayerHeader struct {
+	Magic    [8]byte
+	Version  uint32
+	PageSize uint32
+	MemSize  uint64
+}
+
+// CreateMemDiff Writes the pages of memPath that differ from parentMemPath to diffPath. Both memory files must have
+// the same size. Returns the number of pages written to the layer
+func CreateMemDiff(parentMemPath, memPath, diffPath string) (int, error) {
+	return CreateLayeredMemDiff(parentMemPath, nil, memPath, diffPath)
+}
+
+// CreateLayeredMemDiff Writes the pages of memPath that differ from the memory obtained by applying parentLayers on
+// top of baseMemPath to diffPath. The parent memory is read through the layers, without being merged
+func CreateLayeredMemDiff(baseMemPath string, parentLayers []string, memPath, diffPath string) (int, error) {
+	parent, err := openLayeredMem(baseMemPath, parentLayers)
+	if err != nil {
+		return 0, errors.Wrapf(err, "opening parent memory")
+	}
+	defer parent.Close()
+
+	mem, err := os.Open(memPath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "opening memory file")
+	}
+	defer mem.Close()
+
+	memInfo, err := mem.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if parent.size != memInfo.Size() {
+		return 0, errors.Errorf("memory size %d differs from parent memory size %d", memInfo.Size(), parent.size)
+	}
+
+	out, err := os.Create(diffPath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating memory diff file")
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	header := memLayerHeader{Version: memLayerVersion, PageSize: memLayerPageSize, MemSize: uint64(memInfo.Size())}
+	copy(header.Magic[:], memLayerMagic)
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return 0, err
+	}
+
+	var (
+		parentR    = bufio.NewReader(io.NewSectionReader(parent, 0, parent.size))
+		memR       = bufio.NewReader(mem)
+		parentPage = make([]byte, memLayerPageSize)
+		memPage    = make([]byte, memLayerPageSize)
+		changed    int
+	)
+
+	for idx := uint64(0); ; idx++ {
+		n, err := io.ReadFull(memR, memPage)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, errors.Wrapf(err, "reading memory file")
+		}
+		if _, err := io.ReadFull(parentR, parentPage[:n]); err != nil {
+			return 0, errors.Wrapf(err, "reading parent memory file")
+		}
+
+		if bytes.Equal(parentPage[:n], memPage[:n]) {
+			continue
+		}
+
+		// A trailing partial page is padded with zeroes, the merge truncates the result to MemSize
+		for i := n; i < memLayerPageSize; i++ {
+			memPage[i] = 0
+		}
+		if err := binary.Write(w, binary.LittleEndian, idx); err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(memPage); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	return changed, out.Sync()
+}
+
+// MergeMemLayers Writes the memory obtained by applying the given diff layers, in order, on top of baseMemPath
+// to outPath
+func MergeMemLayers(baseMemPath string, layers []string, outPath string) error {
+	base, err := os.Open(baseMemPath)
+	if err != nil {
+		return errors.Wrapf(err, "opening base memory file")
+	}
+	defer base.Close()
+
+	baseInfo, err := base.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := outPath + ".merging"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "creating merged memory file")
+	}
+	defer func() { _ = os.Remove(tmpPath) }()
+	defer out.Close()
+
+	if _, err := io.Copy(out, base); err != nil {
+		return errors.Wrapf(err, "copying base memory file")
+	}
+
+	for _, layer := range layers {
+		if err := applyMemLayer(out, layer, uint64(baseInfo.Size())); err != nil {
+			return errors.Wrapf(err, "applying memory layer %s", layer)
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, outPath)
+}
+
+// readMemLayerHeader Reads the header of a layer, which must describe a memory of memSize bytes
+func readMemLayerHeader(r io.Reader, memSize uint64) (memLayerHeader, error) {
+	var header memLayerHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return header, errors.Wrapf(err, "reading layer header")
+	}
+	if string(header.Magic[:]) != memLayerMagic || header.Version != memLayerVersion {
+		return header, errors.New("not a memory diff layer")
+	}
+	if header.PageSize == 0 {
+		return header, errors.New("layer has no page size")
+	}
+	if header.MemSize != memSize {
+		return header, errors.Errorf("layer memory size %d does not match base memory size %d", header.MemSize, memSize)
+	}
+	return header, nil
+}
+
+func applyMemLayer(out *os.File, layerPath string, memSize uint64) error {
+	layer, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	r := bufio.NewReader(layer)
+
+	header, err := readMemLayerHeader(r, memSize)
+	if err != nil {
+		return err
+	}
+
+	page := make([]byte, header.PageSize)
+	for {
+		var idx uint64
+		if err := binary.Read(r, binary.LittleEndian, &idx); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrapf(err, "reading page index")
+		}
+		if _, err := io.ReadFull(r, page); err != nil {
+			return errors.Wrapf(err, "reading page %d", idx)
+		}
+
+		offset := idx * uint64(header.PageSize)
+		if offset >= memSize {
+			return errors.Errorf("page %d is out of bounds", idx)
+		}
+		length := uint64(header.PageSize)
+		if offset+length > memSize {
+			length = memSize - offset
+		}
+		if _, err := out.WriteAt(page[:length], int64(offset)); err != nil {
+			return err
+		}
+	}
+}
+
+// layeredMem Reads the memory obtained by applying diff layers on top of a base memory file, looking up each page in
+// the last layer holding it
+type layeredMem struct {
+	base   *os.File
+	layers []*os.File
+	size   int64
+	// pages maps the index of the pages found in layers to their position
+	pages map[uint64]layerPage
+}
+
+type layerPage struct {
+	layer  int
+	offset int64
+}
+
+func openLayeredMem(baseMemPath string, layers []string) (*layeredMem, error) {
+	base, err := os.Open(baseMemPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening base memory file")
+	}
+	info, err := base.Stat()
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+
+	mem := &layeredMem{base: base, size: info.Size(), pages: make(map[uint64]layerPage)}
+	for _, layerPath := range layers {
+		if err := mem.indexLayer(layerPath); err != nil {
+			mem.Close()
+			return nil, errors.Wrapf(err, "indexing memory layer %s", layerPath)
+		}
+	}
+
+	return mem, nil
+}
+
+// indexLayer Records the position of the pages of a layer, which supersede those of the previous layers
+func (m *layeredMem) indexLayer(layerPath string) error {
+	layer, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	m.layers = append(m.layers, layer)
+
+	r := bufio.NewReader(layer)
+	header, err := readMemLayerHeader(r, uint64(m.size))
+	if err != nil {
+		return err
+	}
+	if header.PageSize != memLayerPageSize {
+		return errors.Errorf("unsupported page size %d", header.PageSize)
+	}
+
+	offset := int64(binary.Size(header))
+	for {
+		var idx uint64
+		if err := binary.Read(r, binary.LittleEndian, &idx); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrapf(err, "reading page index")
+		}
+		offset += int64(binary.Size(idx))
+		if idx*memLayerPageSize >= uint64(m.size) {
+			return errors.Errorf("page %d is out of bounds", idx)
+		}
+		if _, err := r.Discard(memLayerPageSize); err != nil {
+			return errors.Wrapf(err, "reading page %d", idx)
+		}
+		m.pages[idx] = layerPage{layer: len(m.layers) - 1, offset: offset}
+		offset += memLayerPageSize
+	}
+}
+
+// ReadAt Reads the memory at off, page by page
+func (m *layeredMem) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		if off >= m.size {
+			return read, io.EOF
+		}
+
+		idx, within := uint64(off/memLayerPageSize), off%memLayerPageSize
+		n := int64(len(p) - read)
+		if n > memLayerPageSize-within {
+			n = memLayerPageSize - within
+		}
+		if n > m.size-off {
+			n = m.size - off
+		}
+
+		var err error
+		if page, ok := m.pages[idx]; ok {
+			_, err = m.layers[page.layer].ReadAt(p[read:read+int(n)], page.offset+within)
+		} else {
+			_, err = m.base.ReadAt(p[read:read+int(n)], off)
+		}
+		if err != nil {
+			return read, err
+		}
+
+		read += int(n)
+		off += n
+	}
+	return read, nil
+}
+
+func (m *layeredMem) Close() {
+	m.base.Close()
+	for _, layer := range m.layers {
+		layer.Close()
+	}
+}
@@ -0,0 +1,190 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/metrics"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+const testMemSize = 64*4096 + 100 // not page aligned on purpose
+
+func writeMem(t *testing.T, path string, mem []byte) {
+	require.NoError(t, os.WriteFile(path, mem, 0644), "Failed to write memory file")
+}
+
+func dirtyPages(mem []byte, pages ...int) []byte {
+	dirty := append([]byte{}, mem...)
+	for _, p := range pages {
+		off := p * 4096
+		end := off + 4096
+		if end > len(dirty) {
+			end = len(dirty)
+		}
+		rand.Read(dirty[off:end])
+	}
+	return dirty
+}
+
+func TestMemDiffMerge(t *testing.T) {
+	dir := t.TempDir()
+
+	base := make([]byte, testMemSize)
+	rand.Read(base)
+	gen1 := dirtyPages(base, 0, 7, 64)
+	gen2 := dirtyPages(gen1, 7, 30)
+
+	basePath := filepath.Join(dir, "base")
+	writeMem(t, basePath, base)
+	writeMem(t, filepath.Join(dir, "gen1"), gen1)
+	writeMem(t, filepath.Join(dir, "gen2"), gen2)
+
+	changed, err := snapshotting.CreateMemDiff(basePath, filepath.Join(dir, "gen1"), filepath.Join(dir, "layer1"))
+	require.NoError(t, err, "Failed to create first layer")
+	require.Equal(t, 3, changed, "First layer should contain the dirtied pages")
+
+	changed, err = snapshotting.CreateMemDiff(filepath.Join(dir, "gen1"), filepath.Join(dir, "gen2"), filepath.Join(dir, "layer2"))
+	require.NoError(t, err, "Failed to create second layer")
+	require.Equal(t, 2, changed, "Second layer should contain the dirtied pages")
+
+	layers := []string{filepath.Join(dir, "layer1"), filepath.Join(dir, "layer2")}
+	require.NoError(t, snapshotting.MergeMemLayers(basePath, layers, filepath.Join(dir, "merged")), "Failed to merge layers")
+
+	merged, err := os.ReadFile(filepath.Join(dir, "merged"))
+	require.NoError(t, err, "Failed to read merged memory")
+	require.Equal(t, gen2, merged, "Merged memory differs from the last generation")
+
+	writeMem(t, filepath.Join(dir, "short"), base[:4096])
+	_, err = snapshotting.CreateMemDiff(filepath.Join(dir, "short"), filepath.Join(dir, "gen1"), filepath.Join(dir, "bad"))
+	require.Error(t, err, "Diff between memories of different sizes should fail")
+}
+
+func TestDiffSnapshotCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	parent := snapshotting.NewSnapshot("parent", dir, "testImage")
+	require.NoError(t, parent.CreateSnapDir(), "Failed to create parent snapshot dir")
+	base := make([]byte, testMemSize)
+	rand.Read(base)
+	writeMem(t, parent.GetMemFilePath(), base)
+
+	child := snapshotting.NewSnapshot("child", dir, "testImage")
+	require.NoError(t, child.CreateSnapDir(), "Failed to create child snapshot dir")
+	child.SetParent(parent)
+	require.True(t, child.IsDiff(), "Child should be a diff snapshot")
+
+	mem := dirtyPages(base, 1, 2, 64)
+	writeMem(t, child.GetMemFilePath(), mem)
+	require.NoError(t, child.CreateMemLayer(), "Failed to create memory layer")
+	_, err := os.Stat(child.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Full memory file should be replaced by the layer")
+
+	grandchild := snapshotting.NewSnapshot("grandchild", dir, "testImage")
+	require.NoError(t, grandchild.CreateSnapDir(), "Failed to create grandchild snapshot dir")
+	grandchild.SetParent(child)
+	require.Equal(t, parent.GetMemFilePath(), grandchild.BaseMemFile, "Chain should start at the full snapshot")
+	require.Len(t, grandchild.MemLayers, 2, "Grandchild should have two layers")
+
+	// The layer of the grandchild is computed against the memory of the child read through its layer
+	mem2 := dirtyPages(mem, 2, 3)
+	writeMem(t, grandchild.GetMemFilePath(), mem2)
+	require.NoError(t, grandchild.CreateMemLayer(), "Failed to create memory layer")
+	layerInfo, err := os.Stat(grandchild.GetMemDiffFilePath())
+	require.NoError(t, err)
+	require.Less(t, layerInfo.Size(), int64(3*4096), "Layer should only hold the pages changed since the child")
+
+	_, err = os.Stat(grandchild.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Only the memory layers should be written")
+
+	memFilePath, err := grandchild.PrepareMemFile()
+	require.NoError(t, err, "Failed to merge memory layers")
+	merged, err := os.ReadFile(memFilePath)
+	require.NoError(t, err, "Failed to read merged memory")
+	require.Equal(t, mem2, merged, "Merged memory is incorrect")
+
+	// Later loads reuse the merged memory
+	info, err := os.Stat(memFilePath)
+	require.NoError(t, err)
+	again, err := grandchild.PrepareMemFile()
+	require.NoError(t, err, "Failed to prepare memory of second load")
+	require.Equal(t, memFilePath, again, "Loads should share the merged memory")
+	againInfo, err := os.Stat(again)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(info, againInfo), "Merged memory should not be written again")
+
+	require.NoError(t, grandchild.Compact(), "Failed to compact snapshot")
+	require.False(t, grandchild.IsDiff(), "Compacted snapshot should not depend on its parents")
+	memFilePath, err = grandchild.PrepareMemFile()
+	require.NoError(t, err, "Failed to prepare memory of compacted snapshot")
+	require.Equal(t, grandchild.GetMemFilePath(), memFilePath, "Compacted snapshot should load its memory file")
+	compactedInfo, err := os.Stat(memFilePath)
+	require.NoError(t, err, "Memory file of a compacted snapshot should be kept")
+	require.True(t, os.SameFile(info, compactedInfo), "Compaction should reuse the merged memory")
+
+	loaded := snapshotting.NewSnapshot("grandchild", dir, "testImage")
+	require.NoError(t, loaded.LoadSnapInfo(grandchild.GetInfoFilePath()), "Failed to load snapshot info")
+	require.False(t, loaded.IsDiff(), "Compaction should be persisted")
+}
+
+func TestDiffSnapshotRefresh(t *testing.T) {
+	ctx := context.Background()
+	mgr := snapshotting.NewSnapshotManager(t.TempDir())
+
+	base := make([]byte, testMemSize)
+	rand.Read(base)
+	first, err := mgr.InitSnapshot("refreshed", "testImage")
+	require.NoError(t, err)
+	commitTestSnapshot(t, mgr, first, base)
+
+	// The revision is refreshed with a diff snapshot of a VM loaded from its current version
+	mem := dirtyPages(base, 4, 5)
+	refreshed, err := mgr.InitDiffSnapshot(ctx, "refreshed", "refreshed", "testImage")
+	require.NoError(t, err, "Failed to refresh snapshot")
+	commitTestSnapshot(t, mgr, refreshed, mem)
+
+	snap, err := mgr.PinSnapshot(ctx, "refreshed")
+	require.NoError(t, err)
+	require.Equal(t, refreshed.GetGeneration(), snap.GetGeneration(), "The refreshed version should be current")
+	sizeBefore := mgr.GetSnapshotMetrics()[metrics.SnapshotBytes]
+
+	_, err = os.Stat(snap.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Only the memory layer of the refreshed version should be written")
+
+	memFilePath, err := snap.PrepareMemFile()
+	require.NoError(t, err)
+	merged, err := os.ReadFile(memFilePath)
+	require.NoError(t, err)
+	require.Equal(t, mem, merged, "Refreshed memory is incorrect")
+	mgr.UnpinSnapshot(snap, time.Millisecond)
+
+	require.Equal(t, sizeBefore+testMemSize, mgr.GetSnapshotMetrics()[metrics.SnapshotBytes],
+		"The memory merged by the first load should be accounted")
+}
@@ -23,10 +23,14 @@
 package snapshotting
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -35,87 +39,380 @@ import (
 type SnapshotManager struct {
 	sync.Mutex
 	// Stored snapshots (identified by the function instance revision, which is provided by the `K_REVISION` environment
-	// variable of knative).
-	snapshots  map[string]*Snapshot
-	baseFolder string
+	// variable of knative), each revision having a current version and the previous versions retained.
+	revisions        map[string]*revision
+	baseFolder       string
+	keepOnStart      bool
+	retainedVersions int
+
+	// Snapshots are evicted according to evictionPolicy once their size exceeds budget, if positive
+	budget         int64
+	evictionPolicy EvictionPolicy
+
+	// Committed snapshots are uploaded to store, if set, and missing snapshots downloaded from it
+	store     SnapshotStore
+	downloads map[string]*download
+	// checked records when the current versions of the revisions were last read from the store
+	checked            map[string]time.Time
+	storeCheckInterval time.Duration
+	// uploads are the uploads in progress, by revision, which run in the background for at most uploadTimeout
+	uploads       map[string]chan struct{}
+	uploadsWg     sync.WaitGroup
+	uploadTimeout time.Duration
+
+	// The images of the committed snapshots are retained while the snapshots are kept on the node
+	retainImage  func(image string)
+	releaseImage func(image string)
+}
+
+// SnapshotManagerOption Options to pass to SnapshotManager
+type SnapshotManagerOption func(*SnapshotManager)
+
+// WithKeepOnStart Keeps the committed snapshots found in the base folder at start, e.g., left by a previous run of
+// the daemon, instead of purging the base folder
+func WithKeepOnStart(keep bool) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.keepOnStart = keep
+	}
+}
+
+// WithImageReferences Calls retain with the image of each snapshot committed, downloaded or recovered, and release
+// once the snapshot is removed, e.g., to protect the images of the snapshots from garbage collection
+func WithImageReferences(retain, release func(image string)) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.retainImage = retain
+		mgr.releaseImage = release
+	}
 }
 
 // Snapshot identified by VM id
 
-func NewSnapshotManager(baseFolder string) *SnapshotManager {
+func NewSnapshotManager(baseFolder string, opts ...SnapshotManagerOption) *SnapshotManager {
 	manager := new(SnapshotManager)
-	manager.snapshots = make(map[string]*Snapshot)
+	manager.revisions = make(map[string]*revision)
 	manager.baseFolder = baseFolder
+	manager.retainedVersions = DefaultRetainedVersions
+	manager.downloads = make(map[string]*download)
+	manager.checked = make(map[string]time.Time)
+	manager.storeCheckInterval = DefaultStoreCheckInterval
+	manager.uploads = make(map[string]chan struct{})
+	manager.uploadTimeout = DefaultUploadTimeout
+
+	for _, opt := range opts {
+		opt(manager)
+	}
 
-	// Clean & init basefolder
-	_ = os.RemoveAll(manager.baseFolder)
+	if manager.keepOnStart {
+		manager.recoverSnapshots()
+	} else {
+		// Clean & init basefolder
+		_ = os.RemoveAll(manager.baseFolder)
+	}
 	_ = os.MkdirAll(manager.baseFolder, os.ModePerm)
 
 	return manager
 }
 
-// AcquireSnapshot returns a snapshot for the specified revision if it is available.
-func (mgr *SnapshotManager) AcquireSnapshot(revision string) (*Snapshot, error) {
+// recoverSnapshots loads the snapshots committed in the base folder from their info files. Snapshots whose creation
+// did not complete, i.e., without info file, or whose files are missing are removed
+func (mgr *SnapshotManager) recoverSnapshots() {
+	entries, err := os.ReadDir(mgr.baseFolder)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("Failed to scan snapshots folder")
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		rev := newRevision(entry.Name(), mgr.baseFolder)
+		mgr.revisions[rev.name] = rev
+
+		versions, err := os.ReadDir(rev.dir)
+		if err != nil {
+			log.WithError(err).WithField("revision", rev.name).Warn("Failed to scan snapshot versions")
+			continue
+		}
+		for _, version := range versions {
+			generation, err := strconv.ParseUint(version.Name(), 10, 64)
+			if !version.IsDir() || err != nil || generation == 0 {
+				continue
+			}
+			if generation > rev.last {
+				rev.last = generation
+			}
+
+			snap := newSnapshotVersion(rev.name, mgr.baseFolder, "", generation)
+			if err := snap.LoadSnapInfo(snap.GetInfoFilePath()); err != nil {
+				mgr.discardSnapshot(snap, err)
+				continue
+			}
+			snap.ready = true
+			snap.removeStaleMemFiles()
+			snap.size = dirSize(snap.snapDir)
+			if info, err := os.Stat(snap.GetInfoFilePath()); err == nil {
+				snap.lastUsed = info.ModTime()
+			}
+			rev.versions[generation] = snap
+		}
+	}
+
+	// Diff snapshots depend on the memory files of their parents, which may have been discarded in turn
+	for discarded := true; discarded; {
+		discarded = false
+		for _, rev := range mgr.revisions {
+			for generation, snap := range rev.versions {
+				if err := snap.validate(); err != nil {
+					delete(rev.versions, generation)
+					mgr.discardSnapshot(snap, err)
+					discarded = true
+				}
+			}
+		}
+	}
+
+	recovered := 0
+	for name, rev := range mgr.revisions {
+		if len(rev.versions) == 0 {
+			// Also removes the snapshots stored before versioning, directly in the directory of their revision
+			_ = os.RemoveAll(rev.dir)
+			delete(mgr.revisions, name)
+			continue
+		}
+		rev.recoverCurrent()
+		recovered += len(rev.versions)
+		for _, snap := range rev.versions {
+			mgr.retain(snap)
+		}
+	}
+
+	log.Infof("Recovered %d snapshots from %s", recovered, mgr.baseFolder)
+
+	// The budget may have been lowered since the previous run
+	mgr.evictSnapshots()
+}
+
+func (mgr *SnapshotManager) discardSnapshot(snap *Snapshot, reason error) {
+	logger := log.WithFields(log.Fields{"revision": snap.GetId(), "generation": snap.GetGeneration()})
+	logger.WithError(reason).Warn("Discarding incomplete snapshot")
+	if err := snap.Cleanup(); err != nil {
+		logger.WithError(err).Warn("Failed to remove incomplete snapshot")
+	}
+}
+
+// ListSnapshots returns the revisions of the committed snapshots
+func (mgr *SnapshotManager) ListSnapshots() []string {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	var revisions []string
+	for name, rev := range mgr.revisions {
+		if rev.currentSnapshot() != nil {
+			revisions = append(revisions, name)
+		}
+	}
+	sort.Strings(revisions)
+
+	return revisions
+}
+
+// AcquireSnapshot returns the current snapshot for the specified revision if it is available, downloading it from
+// the store if it is missing on the node. The snapshot is not pinned and may be evicted at any time, readers of its
+// files must use PinSnapshot instead.
+func (mgr *SnapshotManager) AcquireSnapshot(ctx context.Context, revision string) (*Snapshot, error) {
+	if err := mgr.fetchSnapshot(ctx, revision); err != nil {
+		return nil, errors.Wrapf(err, "fetching snapshot for revision %s", revision)
+	}
+
 	mgr.Lock()
 	defer mgr.Unlock()
 
 	// Check if idle snapshot is available for the given image
-	snap, ok := mgr.snapshots[revision]
-	if !ok {
+	rev, ok := mgr.revisions[revision]
+	if !ok || len(rev.versions) == 0 {
 		return nil, errors.New(fmt.Sprintf("Get: Snapshot for revision %s does not exist", revision))
 	}
 
 	// Snapshot registered in manager but creation not finished yet
-	if !snap.ready {
+	snap := rev.currentSnapshot()
+	if snap == nil {
 		return nil, errors.New("Snapshot is not yet usable")
 	}
 
 	// Return snapshot for supplied revision
-	return mgr.snapshots[revision], nil
+	return snap, nil
 }
 
-// InitSnapshot initializes a snapshot by adding its metadata to the SnapshotManager. Once the snapshot has
-// been created, CommitSnapshot must be run to finalize the snapshot creation and make the snapshot available for use.
+// InitSnapshot initializes a new version of the snapshot of a revision by adding its metadata to the
+// SnapshotManager. Once the snapshot has been created, CommitSnapshot must be run to finalize the snapshot creation
+// and make the snapshot available for use. A revision has at most one version being created.
 func (mgr *SnapshotManager) InitSnapshot(revision, image string) (*Snapshot, error) {
 	mgr.Lock()
 
 	logger := log.WithFields(log.Fields{"revision": revision, "image": image})
 	logger.Debug("Initializing snapshot corresponding to revision and image")
 
-	if _, present := mgr.snapshots[revision]; present {
+	rev, ok := mgr.revisions[revision]
+	if !ok {
+		rev = newRevision(revision, mgr.baseFolder)
+		mgr.revisions[revision] = rev
+	}
+	if rev.pendingSnapshot() != nil {
 		mgr.Unlock()
 		return nil, errors.New(fmt.Sprintf("Add: Snapshot for revision %s already exists", revision))
 	}
+	if _, downloading := mgr.downloads[revision]; downloading {
+		mgr.Unlock()
+		return nil, errors.New(fmt.Sprintf("Add: Snapshot for revision %s is being downloaded", revision))
+	}
 
 	// Create snapshot object and move into creating state
-	snap := NewSnapshot(revision, mgr.baseFolder, image)
-	mgr.snapshots[snap.GetId()] = snap
+	rev.last++
+	snap := newSnapshotVersion(revision, mgr.baseFolder, image, rev.last)
+	rev.versions[snap.Generation] = snap
 	mgr.Unlock()
 
 	// Create directory to store snapshot data
 	err := snap.CreateSnapDir()
 	if err != nil {
+		mgr.Lock()
+		delete(rev.versions, snap.Generation)
+		mgr.Unlock()
 		return nil, errors.Wrapf(err, "creating snapDir for snapshots %s", revision)
 	}
 
 	return snap, nil
 }
 
-// CommitSnapshot finalizes the snapshot creation and makes it available for use.
-func (mgr *SnapshotManager) CommitSnapshot(revision string) error {
+// InitDiffSnapshot initializes a snapshot for the revision whose guest memory is stored as a diff layer on top of
+// the current snapshot of parentRevision
+func (mgr *SnapshotManager) InitDiffSnapshot(ctx context.Context, revision, parentRevision, image string) (*Snapshot, error) {
+	// The parent is pinned until the diff snapshot is registered as depending on it
+	parent, err := mgr.PinSnapshot(ctx, parentRevision)
+	if err != nil {
+		return nil, errors.Wrapf(err, "acquiring parent snapshot %s", parentRevision)
+	}
+	defer mgr.UnpinSnapshot(parent, 0)
+
+	snap, err := mgr.InitSnapshot(revision, image)
+	if err != nil {
+		return nil, err
+	}
+	mgr.Lock()
+	snap.SetParent(parent)
+	mgr.Unlock()
+
+	return snap, nil
+}
+
+// CompactSnapshot squashes the memory layers of the snapshot for the revision into a full memory file
+func (mgr *SnapshotManager) CompactSnapshot(ctx context.Context, revision string) error {
+	snap, err := mgr.PinSnapshot(ctx, revision)
+	if err != nil {
+		return err
+	}
+	defer mgr.UnpinSnapshot(snap, 0)
+
+	if err := snap.Compact(); err != nil {
+		return err
+	}
+
+	// Loads pinned the snapshot before it was compacted may still open its merged memory
+	mgr.Lock()
+	unused := snap.loading == 1
+	mgr.Unlock()
+	if unused {
+		snap.removeStaleMemFiles()
+	}
+	mgr.updateSize(snap)
+
+	return nil
+}
+
+// InvalidateSnapshot removes all the versions of the snapshot of the revision from the node, e.g., because the
+// image of the revision changed. Versions being loaded are removed once their loads complete. The store keeps the
+// snapshot for the other nodes, see PurgeSnapshot
+func (mgr *SnapshotManager) InvalidateSnapshot(revision string) error {
+	retired, err := mgr.retireRevision(revision)
+	if err != nil {
+		return err
+	}
+
+	return mgr.removeRetired(retired)
+}
+
+// retireRevision retires all the versions of the snapshot of the revision, which the caller removes
+func (mgr *SnapshotManager) retireRevision(revision string) ([]*Snapshot, error) {
 	mgr.Lock()
 	defer mgr.Unlock()
 
-	snap, ok := mgr.snapshots[revision]
-	if !ok {
+	rev, ok := mgr.revisions[revision]
+	if !ok || len(rev.versions) == 0 {
+		return nil, errors.New(fmt.Sprintf("Snapshot for revision %s to invalidate does not exist", revision))
+	}
+
+	var retired []*Snapshot
+	for _, snap := range rev.versions {
+		retired = append(retired, rev.retire(snap))
+	}
+	rev.current = 0
+	rev.pinned = false
+	rev.removeDir()
+	// The store may hold a valid copy
+	delete(mgr.checked, revision)
+
+	return retired, nil
+}
+
+// CommitSnapshot finalizes the creation of the version of the snapshot being created and makes it available for
+// use. The version becomes the current one unless the revision is pinned to another version, and the previous
+// versions beyond the retained ones are removed. The snapshot is kept on the node and uploaded to the store, if any,
+// in the background, see WaitUploads. Committed snapshots are evicted, least valuable first, if the snapshots exceed
+// the disk budget.
+func (mgr *SnapshotManager) CommitSnapshot(revision string) error {
+	mgr.Lock()
+
+	rev, ok := mgr.revisions[revision]
+	if !ok || len(rev.versions) == 0 {
+		mgr.Unlock()
 		return errors.New(fmt.Sprintf("Snapshot for revision %s to commit does not exist", revision))
 	}
 
-	if snap.ready {
+	snap := rev.pendingSnapshot()
+	if snap == nil {
+		mgr.Unlock()
 		return errors.New(fmt.Sprintf("Snapshot for revision %s has already been committed", revision))
 	}
 
 	snap.ready = true
+	snap.lastUsed = time.Now()
+	snap.size = dirSize(snap.snapDir)
+	mgr.retain(snap)
+	promoted := !rev.pinned
+	if promoted {
+		if err := rev.setCurrent(snap.Generation, false); err != nil {
+			log.WithError(err).WithField("revision", revision).Warn("Failed to persist current snapshot version")
+		}
+	}
+	retired := mgr.retainVersions(rev)
+	if mgr.store != nil {
+		// The snapshot is pinned during the upload, so that it is not evicted meanwhile
+		snap.loading++
+	}
+	mgr.Unlock()
+
+	if err := mgr.removeRetired(retired); err != nil {
+		log.WithError(err).WithField("revision", revision).Warn("Failed to remove previous snapshot versions")
+	}
+
+	if mgr.store != nil {
+		mgr.startUpload(snap, promoted, retired)
+	} else {
+		mgr.evictSnapshots()
+	}
 
 	return nil
 }
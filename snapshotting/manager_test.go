@@ -23,12 +23,14 @@
 package snapshotting_test
 
 import (
+	"context"
 	"fmt"
 	ctrdlog "github.com/containerd/containerd/log"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"github.com/vhive-serverless/vhive/snapshotting"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 )
@@ -63,9 +65,9 @@ func testSnapshotManager(t *testing.T, mgr *snapshotting.SnapshotManager, revisi
 	require.Error(t, err, fmt.Sprintf("Commit should fail when no snapshots are created for %s", revision))
 
 	// Use snapshot
-	_, err = mgr.AcquireSnapshot(snap.GetId())
+	_, err = mgr.AcquireSnapshot(context.Background(), snap.GetId())
 	require.NoError(t, err, fmt.Sprintf("Failed to acquire snapshot for %s", imageName))
-	_, err = mgr.AcquireSnapshot("non-existing-revision")
+	_, err = mgr.AcquireSnapshot(context.Background(), "non-existing-revision")
 	require.Error(t, err, fmt.Sprintf("Acquire should fail when no snapshots are available for %s", imageName))
 }
 
@@ -97,3 +99,95 @@ func TestSnapshotManagerConcurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestSnapshotManagerInvalidate(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(snapshotsDir)
+
+	revision := "myrevision-stale"
+	snap, err := mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	require.NoError(t, mgr.CommitSnapshot(revision), "Failed to commit snapshot")
+
+	require.NoError(t, mgr.InvalidateSnapshot(revision), "Failed to invalidate snapshot")
+	_, err = mgr.AcquireSnapshot(context.Background(), revision)
+	require.Error(t, err, "Invalidated snapshot should not be acquired")
+	_, err = os.Stat(snap.GetInfoFilePath())
+	require.True(t, os.IsNotExist(err), "Snapshot files should be removed")
+
+	require.Error(t, mgr.InvalidateSnapshot(revision), "Invalidating twice should fail")
+
+	_, err = mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err, "Snapshot of the revision should be created again")
+}
+
+// createTestSnapshot takes a committed snapshot of the revision with the given files
+func createTestSnapshot(t *testing.T, mgr *snapshotting.SnapshotManager, revision string, parent string, files ...func(*snapshotting.Snapshot) string) *snapshotting.Snapshot {
+	var (
+		snap *snapshotting.Snapshot
+		err  error
+	)
+	if parent == "" {
+		snap, err = mgr.InitSnapshot(revision, "testImage")
+	} else {
+		snap, err = mgr.InitDiffSnapshot(context.Background(), revision, parent, "testImage")
+	}
+	require.NoError(t, err, "Failed to create snapshot")
+
+	for _, file := range files {
+		require.NoError(t, os.WriteFile(file(snap), []byte(revision), 0644))
+	}
+	snap.PatchDigest = "sha256:" + revision
+	require.NoError(t, snap.SerializeSnapInfo(), "Failed to serialize snapshot info")
+	require.NoError(t, mgr.CommitSnapshot(revision), "Failed to commit snapshot")
+
+	return snap
+}
+
+func TestSnapshotManagerKeepOnStart(t *testing.T) {
+	dir := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(dir)
+
+	full := []func(*snapshotting.Snapshot) string{
+		(*snapshotting.Snapshot).GetSnapshotFilePath,
+		(*snapshotting.Snapshot).GetPatchFilePath,
+		(*snapshotting.Snapshot).GetMemFilePath,
+	}
+	diff := []func(*snapshotting.Snapshot) string{
+		(*snapshotting.Snapshot).GetSnapshotFilePath,
+		(*snapshotting.Snapshot).GetPatchFilePath,
+		(*snapshotting.Snapshot).GetMemDiffFilePath,
+	}
+
+	complete := createTestSnapshot(t, mgr, "complete", "", full...)
+	createTestSnapshot(t, mgr, "diff", "complete", diff...)
+	missing := createTestSnapshot(t, mgr, "missing", "", full...)
+	createTestSnapshot(t, mgr, "orphan", "missing", diff...)
+	require.NoError(t, os.Remove(missing.GetMemFilePath()))
+	// Snapshot whose creation was interrupted
+	_, err := mgr.InitSnapshot("interrupted", "testImage")
+	require.NoError(t, err)
+
+	mgr = snapshotting.NewSnapshotManager(dir, snapshotting.WithKeepOnStart(true))
+	require.Equal(t, []string{"complete", "diff"}, mgr.ListSnapshots())
+
+	snap, err := mgr.AcquireSnapshot(context.Background(), "complete")
+	require.NoError(t, err, "Kept snapshot should be usable")
+	require.Equal(t, complete.GetContainerSnapName(), snap.GetContainerSnapName())
+	require.Equal(t, complete.GetMemFilePath(), snap.GetMemFilePath())
+	require.Equal(t, "sha256:complete", snap.PatchDigest)
+
+	snap, err = mgr.AcquireSnapshot(context.Background(), "diff")
+	require.NoError(t, err)
+	require.True(t, snap.IsDiff())
+
+	for _, revision := range []string{"missing", "orphan", "interrupted"} {
+		_, err := os.Stat(filepath.Join(dir, revision))
+		require.True(t, os.IsNotExist(err), "Incomplete snapshot %s should be removed", revision)
+	}
+
+	mgr = snapshotting.NewSnapshotManager(dir)
+	require.Empty(t, mgr.ListSnapshots())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "Snapshots should be purged")
+}
@@ -0,0 +1,602 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultStoreCheckInterval is how long the current version of a revision read from the store is trusted, so that
+// the cold starts of a revision, e.g., of one without a snapshot, do not all wait for the store
+const DefaultStoreCheckInterval = 10 * time.Second
+
+// DefaultUploadTimeout bounds the upload of a committed snapshot to the store unless configured otherwise
+const DefaultUploadTimeout = 10 * time.Minute
+
+// download of a snapshot from the store, which the concurrent acquisitions of the snapshot wait for
+type download struct {
+	done chan struct{}
+	err  error
+}
+
+// WithStore Uploads the committed snapshots to the store and downloads the snapshots missing on the node from it,
+// so that the snapshots taken on a node can be loaded on the others
+func WithStore(store SnapshotStore) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.store = store
+	}
+}
+
+// WithStoreCheckInterval Reads the current version of a revision from the store again once the interval has elapsed
+// since the last read
+func WithStoreCheckInterval(interval time.Duration) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.storeCheckInterval = interval
+	}
+}
+
+// WithUploadTimeout Bounds the upload of each committed snapshot to the store, including the deletion of the versions
+// it replaces
+func WithUploadTimeout(timeout time.Duration) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.uploadTimeout = timeout
+	}
+}
+
+// WaitUploads waits for the uploads of the committed snapshots to the store to complete
+func (mgr *SnapshotManager) WaitUploads() {
+	mgr.uploadsWg.Wait()
+}
+
+// startUpload uploads a committed snapshot in the background, after the previous uploads of the revision so that the
+// current version recorded in the store is the last one committed. The versions it retired are then deleted from the
+// store, and the snapshot unpinned
+func (mgr *SnapshotManager) startUpload(snap *Snapshot, promoted bool, retired []*Snapshot) {
+	revision := snap.GetId()
+	logger := log.WithFields(log.Fields{"revision": revision, "generation": snap.GetGeneration()})
+
+	mgr.Lock()
+	prev := mgr.uploads[revision]
+	done := make(chan struct{})
+	mgr.uploads[revision] = done
+	mgr.Unlock()
+
+	mgr.uploadsWg.Add(1)
+	go func() {
+		defer mgr.uploadsWg.Done()
+		defer func() {
+			mgr.Lock()
+			if mgr.uploads[revision] == done {
+				delete(mgr.uploads, revision)
+			}
+			mgr.Unlock()
+			close(done)
+		}()
+		defer mgr.UnpinSnapshot(snap, 0)
+
+		if prev != nil {
+			<-prev
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), mgr.uploadTimeout)
+		defer cancel()
+
+		if err := mgr.uploadSnapshot(ctx, snap, promoted); err != nil {
+			logger.WithError(err).Warn("Failed to upload snapshot to the store")
+		}
+		if len(retired) > 0 {
+			if err := mgr.deleteRemoteSnapshots(ctx, retired); err != nil {
+				logger.WithError(err).Warn("Failed to delete previous snapshot versions from the store")
+			}
+		}
+	}()
+}
+
+// storeKey returns the key of a file of the snapshots in the store, i.e., its path relative to the base folder
+func (mgr *SnapshotManager) storeKey(path string) (string, error) {
+	rel, err := filepath.Rel(mgr.baseFolder, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", errors.Errorf("snapshot file %s is outside of %s", path, mgr.baseFolder)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// localPath maps a path recorded by another node, whose base folder may differ, to the base folder of the manager.
+// The files of the snapshots are stored at <revision>/<generation>/<file>
+func (mgr *SnapshotManager) localPath(path string) string {
+	version := filepath.Dir(path)
+	return filepath.Join(mgr.baseFolder, filepath.Base(filepath.Dir(version)), filepath.Base(version), filepath.Base(path))
+}
+
+// uploadSnapshot stores the files of the snapshot, the info file last since it marks the snapshot as complete, then
+// the current file of its revision if the snapshot was promoted. The memory files of the parents of diff snapshots
+// are uploaded with the parents
+func (mgr *SnapshotManager) uploadSnapshot(ctx context.Context, snap *Snapshot, promoted bool) error {
+	var files []string
+	for _, path := range snap.files() {
+		if filepath.Dir(path) == snap.snapDir {
+			files = append(files, path)
+		}
+	}
+
+	files = append(files, snap.GetInfoFilePath())
+	if promoted {
+		files = append(files, filepath.Join(mgr.baseFolder, snap.GetId(), currentFileName))
+	}
+
+	for _, path := range files {
+		if err := mgr.uploadFile(ctx, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishCurrent uploads the current file of the revision, so that the other nodes download its current version
+func (mgr *SnapshotManager) publishCurrent(revision string) {
+	if mgr.store == nil {
+		return
+	}
+
+	if err := mgr.uploadFile(context.Background(), filepath.Join(mgr.baseFolder, revision, currentFileName)); err != nil {
+		log.WithError(err).WithField("revision", revision).Warn("Failed to upload current snapshot version to the store")
+	}
+}
+
+func (mgr *SnapshotManager) uploadFile(ctx context.Context, path string) error {
+	key, err := mgr.storeKey(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return mgr.store.Put(ctx, key, file, info.Size())
+}
+
+// fetchSnapshot makes the current version of the snapshot of the revision in the store current on the node,
+// downloading it if the node does not have it, so that the versions committed, rolled back or pinned by the other
+// nodes are loaded. The store is read again once the check interval has elapsed, and concurrent calls for a revision
+// share a single download. Snapshots missing in the store are not an error, nor are failures of the store if the
+// node has a current version
+func (mgr *SnapshotManager) fetchSnapshot(ctx context.Context, revision string) error {
+	if mgr.store == nil {
+		return nil
+	}
+
+	mgr.Lock()
+	var hasCurrent bool
+	if rev, ok := mgr.revisions[revision]; ok {
+		if rev.pendingSnapshot() != nil {
+			// The version being created becomes current once committed
+			mgr.Unlock()
+			return nil
+		}
+		hasCurrent = rev.currentSnapshot() != nil
+	}
+	if checked, ok := mgr.checked[revision]; ok && time.Since(checked) < mgr.storeCheckInterval {
+		mgr.Unlock()
+		return nil
+	}
+	if dl, ok := mgr.downloads[revision]; ok {
+		mgr.Unlock()
+		select {
+		case <-dl.done:
+			return dl.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	dl := &download{done: make(chan struct{})}
+	mgr.downloads[revision] = dl
+	mgr.Unlock()
+
+	start := time.Now()
+	current, snap, parents, err := mgr.downloadCurrent(ctx, revision)
+	missing := errors.Is(err, ErrNotInStore)
+	if missing {
+		err = nil
+	}
+
+	var retired []*Snapshot
+	mgr.Lock()
+	delete(mgr.downloads, revision)
+	if err == nil {
+		mgr.checked[revision] = time.Now()
+	}
+	if err == nil && !missing {
+		rev, ok := mgr.revisions[revision]
+		if !ok {
+			rev = newRevision(revision, mgr.baseFolder)
+			mgr.revisions[revision] = rev
+		}
+		if snap != nil {
+			if rev.register(snap) {
+				mgr.retain(snap)
+			} else {
+				// The version was downloaded concurrently as the parent of a diff snapshot
+				snap = nil
+			}
+		}
+		if version, ok := rev.versions[current.Generation]; ok && version.ready &&
+			(rev.current != current.Generation || rev.pinned != current.Pinned) {
+			if err := rev.setCurrent(current.Generation, current.Pinned); err != nil {
+				log.WithError(err).WithField("revision", revision).Warn("Failed to persist current snapshot version")
+			}
+			retired = mgr.retainVersions(rev)
+		}
+	}
+	if err != nil && hasCurrent {
+		log.WithError(err).WithField("revision", revision).Warn("Failed to check the current snapshot version in the store")
+		err = nil
+	}
+	dl.err = err
+	mgr.Unlock()
+	close(dl.done)
+
+	// The diff snapshot now depends on its parents, which no longer need to be pinned
+	for _, parent := range parents {
+		mgr.UnpinSnapshot(parent, 0)
+	}
+	if err := mgr.removeRetired(retired); err != nil {
+		log.WithError(err).WithField("revision", revision).Warn("Failed to remove previous snapshot versions")
+	}
+	if snap != nil {
+		log.WithFields(log.Fields{"revision": revision, "generation": current.Generation}).Infof("Downloaded snapshot in %s", time.Since(start))
+		mgr.evictSnapshots()
+	}
+
+	return err
+}
+
+// remoteCurrent reads the current version of the snapshot of the revision in the store
+func (mgr *SnapshotManager) remoteCurrent(ctx context.Context, revision string) (currentVersion, error) {
+	var current currentVersion
+
+	contents, err := mgr.store.Get(ctx, revision+"/"+currentFileName)
+	if err != nil {
+		return current, err
+	}
+	defer contents.Close()
+
+	if err := gob.NewDecoder(contents).Decode(&current); err != nil {
+		return current, errors.Wrapf(err, "decoding current version of revision %s", revision)
+	}
+	return current, nil
+}
+
+// downloadCurrent reads the current version of the snapshot of the revision in the store, and downloads it unless
+// the node has it already. The versions holding the memory files of the parents of a downloaded diff snapshot are
+// returned pinned
+func (mgr *SnapshotManager) downloadCurrent(ctx context.Context, revision string) (currentVersion, *Snapshot, []*Snapshot, error) {
+	current, err := mgr.remoteCurrent(ctx, revision)
+	if err != nil {
+		return current, nil, nil, err
+	}
+
+	mgr.Lock()
+	var local bool
+	if rev, ok := mgr.revisions[revision]; ok {
+		snap, ok := rev.versions[current.Generation]
+		local = ok && snap.ready
+	}
+	mgr.Unlock()
+	if local {
+		return current, nil, nil, nil
+	}
+
+	snap, parents, err := mgr.downloadSnapshot(ctx, revision, current.Generation)
+	return current, snap, parents, err
+}
+
+// downloadVersion returns the version of the snapshot of the revision pinned, downloading it first if the node does
+// not have it, along with the pinned versions it depends on
+func (mgr *SnapshotManager) downloadVersion(ctx context.Context, revision string, generation uint64) ([]*Snapshot, error) {
+	pinLocal := func() *Snapshot {
+		if rev, ok := mgr.revisions[revision]; ok {
+			if snap, ok := rev.versions[generation]; ok && snap.ready {
+				snap.loading++
+				return snap
+			}
+		}
+		return nil
+	}
+
+	mgr.Lock()
+	snap := pinLocal()
+	mgr.Unlock()
+	if snap != nil {
+		return []*Snapshot{snap}, nil
+	}
+
+	downloaded, parents, err := mgr.downloadSnapshot(ctx, revision, generation)
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.Lock()
+	// Concurrent downloads of the version write the same files
+	if snap := pinLocal(); snap != nil {
+		mgr.Unlock()
+		return append(parents, snap), nil
+	}
+	rev, ok := mgr.revisions[revision]
+	if !ok {
+		rev = newRevision(revision, mgr.baseFolder)
+		mgr.revisions[revision] = rev
+	}
+	rev.register(downloaded)
+	mgr.retain(downloaded)
+	downloaded.loading++
+	mgr.Unlock()
+
+	return append(parents, downloaded), nil
+}
+
+// downloadSnapshot fetches the info file of the version of the snapshot of the revision, then the files it
+// references that are missing on the node. The versions holding the memory files of the parents of a diff snapshot
+// are downloaded and registered like the other versions, and returned pinned until the diff snapshot is registered
+// as depending on them. It returns ErrNotInStore if the version is not in the store
+func (mgr *SnapshotManager) downloadSnapshot(ctx context.Context, revision string, generation uint64) (_ *Snapshot, parents []*Snapshot, retErr error) {
+	snap := newSnapshotVersion(revision, mgr.baseFolder, "", generation)
+	infoKey, err := mgr.storeKey(snap.GetInfoFilePath())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The snapshot directory is only created once the info file is found
+	tmpInfo := snap.GetInfoFilePath() + ".remote"
+	if err := mgr.downloadFile(ctx, infoKey, tmpInfo); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = os.Remove(tmpInfo)
+		if retErr != nil {
+			_ = snap.Cleanup()
+			for _, parent := range parents {
+				mgr.UnpinSnapshot(parent, 0)
+			}
+		}
+	}()
+	if err := snap.LoadSnapInfo(tmpInfo); err != nil {
+		return nil, nil, err
+	}
+
+	if snap.IsDiff() {
+		snap.BaseMemFile = mgr.localPath(snap.BaseMemFile)
+		for i, layer := range snap.MemLayers {
+			snap.MemLayers[i] = mgr.localPath(layer)
+		}
+
+		// The last layer is the one of the snapshot, the other memory files belong to its parents
+		for _, path := range append([]string{snap.BaseMemFile}, snap.MemLayers[:len(snap.MemLayers)-1]...) {
+			parentRevision, parentGeneration, err := versionOf(path)
+			if err != nil {
+				return nil, parents, err
+			}
+			pinned, err := mgr.downloadVersion(ctx, parentRevision, parentGeneration)
+			parents = append(parents, pinned...)
+			if err != nil {
+				return nil, parents, errors.Wrapf(err, "downloading parent snapshot of revision %s", revision)
+			}
+		}
+	}
+
+	for _, path := range snap.files() {
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		key, err := mgr.storeKey(path)
+		if err != nil {
+			return nil, parents, err
+		}
+		if err := mgr.downloadFile(ctx, key, path); err != nil {
+			return nil, parents, errors.Wrapf(err, "downloading snapshot of revision %s", revision)
+		}
+	}
+
+	// The info file records the paths of the memory files on this node
+	if err := snap.SerializeSnapInfo(); err != nil {
+		return nil, parents, err
+	}
+	snap.ready = true
+	snap.lastUsed = time.Now()
+	snap.size = dirSize(snap.snapDir)
+
+	return snap, parents, nil
+}
+
+// versionOf returns the revision and the generation of the version holding the file at the local path
+func versionOf(path string) (string, uint64, error) {
+	version := filepath.Dir(path)
+	generation, err := strconv.ParseUint(filepath.Base(version), 10, 64)
+	if err != nil {
+		return "", 0, errors.Errorf("snapshot file %s is not in a version directory", path)
+	}
+	return filepath.Base(filepath.Dir(version)), generation, nil
+}
+
+// downloadFile writes the contents stored under the key to a temporary file first, such that a failed download never
+// leaves a partial file at path
+func (mgr *SnapshotManager) downloadFile(ctx context.Context, key, path string) error {
+	contents, err := mgr.store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := io.Copy(tmp, contents); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "downloading %s", key)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// PurgeSnapshot removes all the versions of the snapshot of the revision from the node and from the store, so that
+// no node loads them anymore. The versions that this node does not hold stay in the store, unreferenced
+func (mgr *SnapshotManager) PurgeSnapshot(ctx context.Context, revision string) error {
+	retired, err := mgr.retireRevision(revision)
+	if err != nil {
+		return err
+	}
+
+	if mgr.store != nil {
+		if err := mgr.deleteRemoteRevision(ctx, revision, retired); err != nil {
+			log.WithError(err).WithField("revision", revision).Warn("Failed to delete snapshot from the store")
+		}
+	}
+
+	return mgr.removeRetired(retired)
+}
+
+// InvalidateCorruptSnapshot removes the snapshot of the revision of snap from the node after its patch failed
+// verification. The version is also deleted from the store if the stored patch fails verification too, since the
+// copy of the node may have been corrupted locally, e.g., by a crash
+func (mgr *SnapshotManager) InvalidateCorruptSnapshot(ctx context.Context, snap *Snapshot) error {
+	err := mgr.InvalidateSnapshot(snap.GetId())
+
+	if mgr.store != nil && snap.PatchDigest != "" {
+		logger := log.WithFields(log.Fields{"revision": snap.GetId(), "generation": snap.GetGeneration()})
+		corrupt, verifyErr := mgr.remotePatchCorrupt(ctx, snap)
+		if verifyErr != nil {
+			logger.WithError(verifyErr).Warn("Failed to verify the patch of the snapshot in the store")
+		} else if corrupt {
+			logger.Info("Deleting corrupt snapshot from the store")
+			if err := mgr.deleteRemoteVersion(ctx, snap); err != nil {
+				logger.WithError(err).Warn("Failed to delete snapshot from the store")
+			}
+		}
+	}
+
+	return err
+}
+
+// remotePatchCorrupt returns whether the patch of the version in the store does not match the checksum recorded in
+// the snapshot
+func (mgr *SnapshotManager) remotePatchCorrupt(ctx context.Context, snap *Snapshot) (bool, error) {
+	expected, err := digest.Parse(snap.PatchDigest)
+	if err != nil {
+		return true, nil
+	}
+	key, err := mgr.storeKey(snap.GetPatchFilePath())
+	if err != nil {
+		return false, err
+	}
+
+	contents, err := mgr.store.Get(ctx, key)
+	if errors.Is(err, ErrNotInStore) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer contents.Close()
+
+	actual, err := expected.Algorithm().FromReader(contents)
+	if err != nil {
+		return false, errors.Wrapf(err, "reading %s", key)
+	}
+	return actual != expected, nil
+}
+
+// deleteRemoteVersion removes the version from the store, after the current file of its revision if the version is
+// the current one
+func (mgr *SnapshotManager) deleteRemoteVersion(ctx context.Context, snap *Snapshot) error {
+	current, err := mgr.remoteCurrent(ctx, snap.GetId())
+	if err != nil && !errors.Is(err, ErrNotInStore) {
+		return err
+	}
+	if err == nil && current.Generation == snap.GetGeneration() {
+		if err := mgr.store.Delete(ctx, snap.GetId()+"/"+currentFileName); err != nil {
+			return err
+		}
+	}
+
+	return mgr.deleteRemoteSnapshots(ctx, []*Snapshot{snap})
+}
+
+// deleteRemoteRevision removes the snapshots of the revision from the store, the current file first so that the
+// revision is no longer downloaded
+func (mgr *SnapshotManager) deleteRemoteRevision(ctx context.Context, revision string, snaps []*Snapshot) error {
+	if err := mgr.store.Delete(ctx, revision+"/"+currentFileName); err != nil {
+		return err
+	}
+	return mgr.deleteRemoteSnapshots(ctx, snaps)
+}
+
+// deleteRemoteSnapshots removes the versions from the store, the info file first so that a version is no longer
+// downloaded
+func (mgr *SnapshotManager) deleteRemoteSnapshots(ctx context.Context, snaps []*Snapshot) error {
+	for _, snap := range snaps {
+		files := []string{snap.GetInfoFilePath()}
+		for _, path := range snap.files() {
+			if filepath.Dir(path) == snap.snapDir {
+				files = append(files, path)
+			}
+		}
+
+		for _, path := range files {
+			key, err := mgr.storeKey(path)
+			if err != nil {
+				return err
+			}
+			if err := mgr.store.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
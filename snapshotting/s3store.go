@@ -0,0 +1,268 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+)
+
+// DefaultS3Timeout bounds the requests to the object store unless configured otherwise
+const DefaultS3Timeout = 5 * time.Minute
+
+// S3Config Locates a bucket of an S3-compatible object store, e.g., MinIO
+type S3Config struct {
+	// Endpoint is the URL of the object store, e.g., http://localhost:9000
+	Endpoint string
+	Bucket   string
+	// Region defaults to us-east-1, which MinIO uses unless configured otherwise
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to the keys of the objects, so that the snapshots can share a bucket
+	Prefix string
+	// Timeout bounds each request, including the transfer of the object, and defaults to DefaultS3Timeout
+	Timeout time.Duration
+	// Client defaults to a client with the timeout above
+	Client *http.Client
+}
+
+// S3Store Stores snapshots in an existing bucket of an S3-compatible object store. Objects are addressed with path-style
+// URLs, which MinIO supports out of the box, and requests are signed with AWS signature version 4
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+}
+
+// NewS3Store Creates a store in the bucket described by cfg
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is not set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultS3Timeout
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Timeout}
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	return &S3Store{cfg: cfg, endpoint: endpoint}, nil
+}
+
+// Put uploads the file as an object. The payload is not signed, so that the file is streamed in a single pass
+func (s *S3Store) Put(ctx context.Context, key string, file io.Reader, size int64) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "uploading %s", key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads the object stored under the key
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "downloading %s", key)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object stored under the key
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req)
+	if errors.Is(err, ErrNotInStore) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "deleting %s", key)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	objectPath := "/" + s.cfg.Bucket + "/"
+	if s.cfg.Prefix != "" {
+		objectPath += s.cfg.Prefix + "/"
+	}
+	objectPath += strings.TrimLeft(key, "/")
+
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + objectPath
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, s3UnsignedPayload, time.Now())
+
+	return req, nil
+}
+
+// do sends the request and turns the error responses of the object store into errors
+func (s *S3Store) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.Wrapf(ErrNotInStore, "%s", req.URL.Path)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, errors.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign adds the AWS signature version 4 of the request to its headers. All the headers of the request at this point
+// are signed, along with its host
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(s3DateFormat), s.cfg.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3TimeFormat), scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := []byte("AWS4" + s.cfg.SecretKey)
+	for _, part := range []string{now.Format(s3DateFormat), s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath URI-encodes every byte of the path except the unreserved characters and the slashes
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '/' && keepSlash || c == '-' || c == '_' || c == '.' || c == '~' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -27,19 +27,67 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
+// SnapshotDrive Describes an extra drive of the snapshotted VM
+type SnapshotDrive struct {
+	Type     string
+	Source   string
+	SizeMib  int64
+	VMPath   string
+	ReadOnly bool
+	// HostPath is the path of the drive recorded by Firecracker, at which it must be found when loading the snapshot
+	HostPath string
+	// PatchDigest is the checksum of the block patch holding the changes of a writable thin drive to its image
+	PatchDigest string
+}
+
 // Snapshot identified by revision
 // Only capitalized fields are serialised / deserialised
 type Snapshot struct {
+	memLock           sync.Mutex // serializes merging and compaction of memory layers
 	id                string
 	ready             bool
 	ContainerSnapName string
 	snapDir           string
 	Image             string
+	// ImageDigest is the digest the image resolved to when the snapshot was taken
+	ImageDigest string
+	// PatchDigest is the checksum of the compressed container patch file, verified before the patch is restored
+	PatchDigest string
+	// Lazy is whether the root file system is an overlay of a lazily loaded image, whose changed blocks the patch
+	// file holds
+	Lazy bool
+	// Generation numbers the versions of the snapshots of a revision, starting at 1
+	Generation uint64
+
+	// Diff snapshots only store the memory pages that changed since their parent. BaseMemFile is the full memory
+	// file at the root of the chain and MemLayers lists the diff layers to apply on top of it, the last one being
+	// the layer of this snapshot. Both are empty for full snapshots.
+	BaseMemFile string
+	MemLayers   []string
+
+	// Drives are the extra drives of the VM. The contents of the writable ones are stored in the snapshot
+	Drives []SnapshotDrive
+
+	// BootTime is the time to boot the revision from scratch, i.e., the cold start time a load of the snapshot saves
+	BootTime time.Duration
+
+	// Usage of the snapshot, guarded by the lock of its manager
+	loading  int // loads in progress, which prevent the eviction of the snapshot
+	loads    uint64
+	loadTime time.Duration // total time of the completed loads
+	lastUsed time.Time
+	size     int64 // size of the files of the snapshot, measured when they change
+	// retired versions are no longer acquired, and removed once their loads complete
+	retired bool
+	removed bool
 }
 
 func NewSnapshot(id, baseFolder, image string) *Snapshot {
@@ -54,12 +102,18 @@ func NewSnapshot(id, baseFolder, image string) *Snapshot {
 	return s
 }
 
+// newSnapshotVersion Creates the given version of the snapshot of a revision, stored in a directory named after its
+// generation in the directory of the revision
+func newSnapshotVersion(id, baseFolder, image string, generation uint64) *Snapshot {
+	s := NewSnapshot(id, baseFolder, image)
+	s.Generation = generation
+	s.snapDir = filepath.Join(baseFolder, id, strconv.FormatUint(generation, 10))
+
+	return s
+}
+
 func (snp *Snapshot) CreateSnapDir() error {
-	err := os.Mkdir(snp.snapDir, 0755)
-	if err != nil && os.IsExist(err) {
-		return nil
-	}
-	return err
+	return os.MkdirAll(snp.snapDir, 0755)
 }
 
 func (snp *Snapshot) GetImage() string {
@@ -70,6 +124,11 @@ func (snp *Snapshot) GetId() string {
 	return snp.id
 }
 
+// GetGeneration Returns the version of the snapshot among the snapshots of its revision
+func (snp *Snapshot) GetGeneration() uint64 {
+	return snp.Generation
+}
+
 func (snp *Snapshot) GetContainerSnapName() string {
 	return snp.ContainerSnapName
 }
@@ -86,25 +145,152 @@ func (snp *Snapshot) GetPatchFilePath() string {
 	return filepath.Join(snp.snapDir, "patch_file")
 }
 
+func (snp *Snapshot) GetMemDiffFilePath() string {
+	return filepath.Join(snp.snapDir, "mem_diff_file")
+}
+
+// GetDriveFilePath Returns the path of the contents of the extra drive with the given index
+func (snp *Snapshot) GetDriveFilePath(idx int) string {
+	return filepath.Join(snp.snapDir, fmt.Sprintf("drive_file_%d", idx))
+}
+
+// SetParent Turns the snapshot into a diff snapshot layered on top of parent
+func (snp *Snapshot) SetParent(parent *Snapshot) {
+	if parent.IsDiff() {
+		snp.BaseMemFile = parent.BaseMemFile
+	} else {
+		snp.BaseMemFile = parent.GetMemFilePath()
+	}
+	snp.MemLayers = append(append([]string{}, parent.MemLayers...), snp.GetMemDiffFilePath())
+}
+
+// IsDiff Returns whether the snapshot memory is stored as a diff layer on top of a parent
+func (snp *Snapshot) IsDiff() bool {
+	return len(snp.MemLayers) > 0
+}
+
+// GetParentMemLayers Returns the layers making up the memory of the parent snapshot
+func (snp *Snapshot) GetParentMemLayers() []string {
+	if !snp.IsDiff() {
+		return nil
+	}
+	return snp.MemLayers[:len(snp.MemLayers)-1]
+}
+
+// CreateMemLayer Replaces the full memory file written by Firecracker with a diff layer against the parent memory
+func (snp *Snapshot) CreateMemLayer() error {
+	if !snp.IsDiff() {
+		return nil
+	}
+
+	_, err := CreateLayeredMemDiff(snp.BaseMemFile, snp.GetParentMemLayers(), snp.GetMemFilePath(), snp.GetMemDiffFilePath())
+	if err != nil {
+		return errors.Wrapf(err, "creating memory diff layer")
+	}
+
+	return os.Remove(snp.GetMemFilePath())
+}
+
+// GetMergedMemFilePath Returns the path of the memory of a diff snapshot merged from its layer chain
+func (snp *Snapshot) GetMergedMemFilePath() string {
+	return filepath.Join(snp.snapDir, "mem_file_merged")
+}
+
+// PrepareMemFile Returns the memory file to load the snapshot from. The layer chain of a diff snapshot is merged
+// once, by the first load, into a memory file that the following loads reuse
+func (snp *Snapshot) PrepareMemFile() (string, error) {
+	snp.memLock.Lock()
+	defer snp.memLock.Unlock()
+
+	if !snp.IsDiff() {
+		return snp.GetMemFilePath(), nil
+	}
+
+	memFilePath := snp.GetMergedMemFilePath()
+	if _, err := os.Stat(memFilePath); err == nil {
+		return memFilePath, nil
+	}
+	if err := MergeMemLayers(snp.BaseMemFile, snp.MemLayers, memFilePath); err != nil {
+		return "", err
+	}
+
+	return memFilePath, nil
+}
+
+// removeStaleMemFiles Removes the memory files left behind by merges that were interrupted, and the merged memory
+// of snapshots compacted since
+func (snp *Snapshot) removeStaleMemFiles() {
+	stale, _ := filepath.Glob(filepath.Join(snp.snapDir, "*.merging"))
+	if !snp.IsDiff() {
+		stale = append(stale, snp.GetMergedMemFilePath())
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", path).Warn("Failed to remove partially merged memory file")
+		}
+	}
+}
+
+// Compact Squashes the layer chain of a diff snapshot into a full memory file, so that the snapshot no longer
+// depends on its parents
+func (snp *Snapshot) Compact() error {
+	snp.memLock.Lock()
+	defer snp.memLock.Unlock()
+
+	if !snp.IsDiff() {
+		return nil
+	}
+
+	// The memory merged for the loads is the compacted memory. It is linked rather than moved, since loads in
+	// progress may still open it
+	if err := os.Link(snp.GetMergedMemFilePath(), snp.GetMemFilePath()); err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "reusing merged memory file")
+		}
+		if err := MergeMemLayers(snp.BaseMemFile, snp.MemLayers, snp.GetMemFilePath()); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(snp.GetMemDiffFilePath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "removing memory diff layer")
+	}
+
+	snp.BaseMemFile = ""
+	snp.MemLayers = nil
+
+	return snp.SerializeSnapInfo()
+}
+
 func (snp *Snapshot) GetInfoFilePath() string {
 	return filepath.Join(snp.snapDir, "info_file")
 }
 
-// SerializeSnapInfo serializes the snapshot info using gob. This can be useful for remote snapshots
+// SerializeSnapInfo serializes the snapshot info using gob. This can be useful for remote snapshots. The info file
+// is replaced atomically, since it marks the snapshot as complete when the snapshots are recovered at start
 func (snp *Snapshot) SerializeSnapInfo() error {
-	file, err := os.Create(snp.GetInfoFilePath())
+	tmpPath := snp.GetInfoFilePath() + ".tmp"
+	file, err := os.Create(tmpPath)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create snapinfo file")
 	}
-	defer file.Close()
+	defer func() { _ = os.Remove(tmpPath) }()
 
 	encoder := gob.NewEncoder(file)
 
-	err = encoder.Encode(*snp)
-	if err != nil {
+	if err := encoder.Encode(snp); err != nil {
+		file.Close()
 		return errors.Wrapf(err, "failed to encode snapinfo")
 	}
-	return nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to sync snapinfo file")
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close snapinfo file")
+	}
+
+	return os.Rename(tmpPath, snp.GetInfoFilePath())
 }
 
 // LoadSnapInfo loads the snapshot info from a file. This can be useful for remote snapshots.
@@ -125,6 +311,32 @@ func (snp *Snapshot) LoadSnapInfo(infoPath string) error {
 	return nil
 }
 
+// files returns the paths of the files the snapshot is loaded from
+func (snp *Snapshot) files() []string {
+	files := []string{snp.GetSnapshotFilePath(), snp.GetPatchFilePath()}
+	if snp.IsDiff() {
+		files = append(append(files, snp.BaseMemFile), snp.MemLayers...)
+	} else {
+		files = append(files, snp.GetMemFilePath())
+	}
+	for i, drive := range snp.Drives {
+		if !drive.ReadOnly {
+			files = append(files, snp.GetDriveFilePath(i))
+		}
+	}
+	return files
+}
+
+// validate checks that the files the snapshot is loaded from exist
+func (snp *Snapshot) validate() error {
+	for _, path := range snp.files() {
+		if _, err := os.Stat(path); err != nil {
+			return errors.Wrapf(err, "snapshot file of revision %s", snp.id)
+		}
+	}
+	return nil
+}
+
 func (snp *Snapshot) Cleanup() error {
 	return os.RemoveAll(snp.snapDir)
 }
@@ -0,0 +1,145 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotInStore is returned by the stores for the files they do not hold
+var ErrNotInStore = errors.New("snapshot file not found in store")
+
+// SnapshotStore Stores the files of committed snapshots, so that the snapshots taken on a node can be loaded on
+// others. Keys are the paths of the files relative to the snapshots folder, e.g., myrev/mem_file
+type SnapshotStore interface {
+	// Put stores the contents of the file of the given size under the key
+	Put(ctx context.Context, key string, file io.Reader, size int64) error
+	// Get returns the contents stored under the key, or ErrNotInStore
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the contents stored under the key, if any
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalStore Stores snapshots in a directory, e.g., a file system shared by the nodes
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore Creates a store in the given directory
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "creating snapshot store %s", dir)
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", errors.Errorf("invalid snapshot store key %q", key)
+	}
+	return path, nil
+}
+
+// Put writes the file to a temporary file first, such that readers never see partial files
+func (s *LocalStore) Put(_ context.Context, key string, file io.Reader, _ int64) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := io.Copy(tmp, file); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "storing %s", key)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get opens the file stored under the key
+func (s *LocalStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(ErrNotInStore, "%s", key)
+	}
+	return file, err
+}
+
+// Delete removes the file stored under the key
+func (s *LocalStore) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Directories of snapshots are removed with their last file
+	_ = os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// NewStore Opens the store at the given URL, either file:///path/to/dir or s3://bucket/prefix, in which case the
+// endpoint and credentials of cfg are used
+func NewStore(storeURL string, cfg S3Config) (SnapshotStore, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing snapshot store URL")
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewLocalStore(u.Path)
+	case "s3":
+		cfg.Bucket = u.Host
+		cfg.Prefix = strings.Trim(u.Path, "/")
+		return NewS3Store(cfg)
+	default:
+		return nil, errors.Errorf("unsupported snapshot store %q, valid schemes are file and s3", storeURL)
+	}
+}
@@ -0,0 +1,342 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// fakeS3 stands in for a MinIO server holding a single bucket
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	gets    map[string]int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, snapshotting.S3Config) {
+	s3 := &fakeS3{bucket: bucket, objects: make(map[string][]byte), gets: make(map[string]int)}
+	server := httptest.NewServer(s3)
+	t.Cleanup(server.Close)
+
+	return s3, snapshotting.S3Config{
+		Endpoint:  server.URL,
+		Bucket:    bucket,
+		AccessKey: "minio",
+		SecretKey: "minio123",
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+s.bucket+"/")
+	if key == r.URL.Path {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = data
+	case http.MethodGet:
+		s.gets[key]++
+		data, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) getCount(key string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.gets[key]
+}
+
+// commitTestSnapshot takes a committed snapshot of the revision with random contents
+func commitTestSnapshot(t *testing.T, mgr *snapshotting.SnapshotManager, snap *snapshotting.Snapshot, mem []byte) {
+	writeMem(t, snap.GetSnapshotFilePath(), []byte("snap of "+snap.GetId()))
+	writeMem(t, snap.GetPatchFilePath(), []byte("patch of "+snap.GetId()))
+	writeMem(t, snap.GetMemFilePath(), mem)
+	require.NoError(t, snap.CreateMemLayer())
+	require.NoError(t, snap.SerializeSnapInfo())
+	require.NoError(t, mgr.CommitSnapshot(snap.GetId()))
+	mgr.WaitUploads()
+}
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := snapshotting.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(ctx, "rev/mem_file", strings.NewReader("memory"), 6))
+	contents, err := store.Get(ctx, "rev/mem_file")
+	require.NoError(t, err)
+	data, err := io.ReadAll(contents)
+	contents.Close()
+	require.NoError(t, err)
+	require.Equal(t, "memory", string(data))
+
+	require.NoError(t, store.Delete(ctx, "rev/mem_file"))
+	_, err = store.Get(ctx, "rev/mem_file")
+	require.ErrorIs(t, err, snapshotting.ErrNotInStore)
+	require.NoError(t, store.Delete(ctx, "rev/mem_file"), "Deleting a missing file should succeed")
+
+	require.Error(t, store.Put(ctx, "../escape", strings.NewReader(""), 0), "Keys should stay in the store")
+}
+
+func TestNewStore(t *testing.T) {
+	store, err := snapshotting.NewStore("file://"+t.TempDir(), snapshotting.S3Config{})
+	require.NoError(t, err)
+	require.IsType(t, &snapshotting.LocalStore{}, store)
+
+	store, err = snapshotting.NewStore("s3://mybucket/snapshots", snapshotting.S3Config{Endpoint: "http://localhost:9000"})
+	require.NoError(t, err)
+	require.IsType(t, &snapshotting.S3Store{}, store)
+
+	_, err = snapshotting.NewStore("s3://mybucket", snapshotting.S3Config{})
+	require.Error(t, err, "S3 store without endpoint should fail")
+	_, err = snapshotting.NewStore("ftp://host/dir", snapshotting.S3Config{})
+	require.Error(t, err, "Unsupported scheme should fail")
+}
+
+func TestRemoteSnapshot(t *testing.T) {
+	s3, cfg := newFakeS3(t, "mybucket")
+	cfg.Prefix = "snapshots"
+	store, err := snapshotting.NewS3Store(cfg)
+	require.NoError(t, err)
+
+	// Nodes use different base folders
+	producer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(store))
+	consumer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(store))
+
+	mem := make([]byte, testMemSize)
+	rand.Read(mem)
+	snap, err := producer.InitSnapshot("rev", "testImage")
+	require.NoError(t, err)
+	commitTestSnapshot(t, producer, snap, mem)
+	require.Contains(t, s3.objects, "snapshots/rev/1/info_file", "Committed snapshot should be uploaded")
+	require.Contains(t, s3.objects, "snapshots/rev/current_file", "Committed snapshot should be current")
+
+	var (
+		wg    sync.WaitGroup
+		snaps = make([]*snapshotting.Snapshot, 8)
+	)
+	for i := range snaps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			snap, err := consumer.AcquireSnapshot(context.Background(), "rev")
+			require.NoError(t, err, "Failed to acquire remote snapshot")
+			snaps[i] = snap
+		}(i)
+	}
+	wg.Wait()
+
+	for _, snap := range snaps {
+		require.Same(t, snaps[0], snap, "Concurrent acquisitions should share the snapshot")
+	}
+	require.Equal(t, 1, s3.getCount("snapshots/rev/1/mem_file"), "Concurrent acquisitions should download once")
+	require.Equal(t, "testImage", snaps[0].GetImage())
+
+	downloaded, err := os.ReadFile(snaps[0].GetMemFilePath())
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(mem, downloaded), "Downloaded memory differs")
+	require.Equal(t, []string{"rev"}, consumer.ListSnapshots())
+
+	for i := 0; i < 2; i++ {
+		_, err = consumer.AcquireSnapshot(context.Background(), "other")
+		require.Error(t, err, "Snapshot missing in the store should not be acquired")
+	}
+	require.Equal(t, 1, s3.getCount("snapshots/other/current_file"), "Missing snapshots should not be looked up again")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(store)).AcquireSnapshot(ctx, "rev")
+	require.ErrorIs(t, err, context.Canceled, "Downloads should stop with the context of the caller")
+
+	require.NoError(t, consumer.InvalidateSnapshot("rev"))
+	require.Contains(t, s3.objects, "snapshots/rev/current_file", "Invalidation should only remove the copy of the node")
+
+	require.NoError(t, producer.PurgeSnapshot(context.Background(), "rev"))
+	require.Empty(t, s3.objects, "Purged snapshot should be deleted from the store")
+}
+
+func TestRemoteCorruptSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s3, cfg := newFakeS3(t, "mybucket")
+	store, err := snapshotting.NewS3Store(cfg)
+	require.NoError(t, err)
+
+	producer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(store))
+	consumer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(store))
+
+	snap, err := producer.InitSnapshot("rev", "testImage")
+	require.NoError(t, err)
+	snap.PatchDigest = digest.FromString("patch of rev").String()
+	commitTestSnapshot(t, producer, snap, make([]byte, testMemSize))
+
+	// The patch of the node is corrupted locally, the stored one is intact
+	snap, err = consumer.AcquireSnapshot(context.Background(), "rev")
+	require.NoError(t, err)
+	require.NoError(t, consumer.InvalidateCorruptSnapshot(ctx, snap))
+	require.Contains(t, s3.objects, "rev/1/info_file", "Intact snapshot should be kept in the store")
+
+	snap, err = consumer.AcquireSnapshot(context.Background(), "rev")
+	require.NoError(t, err, "Intact snapshot should be downloaded again")
+	s3.objects["rev/1/patch_file"] = []byte("truncated")
+	require.NoError(t, consumer.InvalidateCorruptSnapshot(ctx, snap))
+	require.NotContains(t, s3.objects, "rev/current_file", "Corrupt snapshot should no longer be current")
+	require.NotContains(t, s3.objects, "rev/1/info_file", "Corrupt snapshot should be deleted from the store")
+}
+
+func TestRemoteDiffSnapshot(t *testing.T) {
+	store, err := snapshotting.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	producer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(store))
+	consumerDir := t.TempDir()
+	consumer := snapshotting.NewSnapshotManager(consumerDir, snapshotting.WithStore(store))
+
+	base := make([]byte, testMemSize)
+	rand.Read(base)
+	parent, err := producer.InitSnapshot("parent", "testImage")
+	require.NoError(t, err)
+	commitTestSnapshot(t, producer, parent, base)
+
+	mem := dirtyPages(base, 1, 2)
+	child, err := producer.InitDiffSnapshot(context.Background(), "child", "parent", "testImage")
+	require.NoError(t, err)
+	commitTestSnapshot(t, producer, child, mem)
+
+	snap, err := consumer.PinSnapshot(context.Background(), "child")
+	require.NoError(t, err, "Failed to pin remote diff snapshot")
+	defer consumer.UnpinSnapshot(snap, 0)
+	require.True(t, strings.HasPrefix(snap.BaseMemFile, consumerDir), "Memory layers should be local")
+
+	memFilePath, err := snap.PrepareMemFile()
+	require.NoError(t, err)
+	merged, err := os.ReadFile(memFilePath)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(mem, merged), "Merged memory of the remote snapshot differs")
+	require.Len(t, consumer.GetSnapshotVersions("parent"), 1, "Parent of the remote diff snapshot should be registered")
+}
+
+func TestRemoteCurrentVersion(t *testing.T) {
+	ctx := context.Background()
+	store, err := snapshotting.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	producer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(store))
+	consumer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(store),
+		snapshotting.WithStoreCheckInterval(0))
+
+	for i := 0; i < 2; i++ {
+		snap, err := producer.InitSnapshot("rev", "testImage")
+		require.NoError(t, err)
+		commitTestSnapshot(t, producer, snap, make([]byte, testMemSize))
+	}
+	snap, err := consumer.AcquireSnapshot(ctx, "rev")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, snap.GetGeneration())
+
+	_, err = producer.RollbackSnapshot("rev")
+	require.NoError(t, err)
+	snap, err = consumer.AcquireSnapshot(ctx, "rev")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, snap.GetGeneration(), "Rollback on another node should be loaded")
+
+	require.NoError(t, producer.PinSnapshotVersion("rev", 2))
+	snap, err = consumer.AcquireSnapshot(ctx, "rev")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, snap.GetGeneration(), "Pin on another node should be loaded")
+	versions := consumer.GetSnapshotVersions("rev")
+	require.True(t, versions[len(versions)-1].Pinned, "Pinned version should be pinned on all nodes")
+}
+
+// stalledStore is a store whose uploads hang until their context is done
+type stalledStore struct {
+	snapshotting.LocalStore
+}
+
+func (s *stalledStore) Put(ctx context.Context, key string, file io.Reader, size int64) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestUploadInBackground(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithStore(&stalledStore{}),
+		snapshotting.WithUploadTimeout(500*time.Millisecond))
+
+	snap, err := mgr.InitSnapshot("rev", "testImage")
+	require.NoError(t, err)
+	writeMem(t, snap.GetSnapshotFilePath(), []byte("snap"))
+	writeMem(t, snap.GetPatchFilePath(), []byte("patch"))
+	writeMem(t, snap.GetMemFilePath(), make([]byte, testMemSize))
+	require.NoError(t, snap.SerializeSnapInfo())
+
+	start := time.Now()
+	require.NoError(t, mgr.CommitSnapshot("rev"))
+	require.Less(t, time.Since(start), 500*time.Millisecond, "Commit should not wait for the upload")
+
+	acquired, err := mgr.AcquireSnapshot(context.Background(), "rev")
+	require.NoError(t, err, "Snapshot should be usable while it is uploaded")
+	require.Equal(t, snap.GetGeneration(), acquired.GetGeneration())
+
+	mgr.WaitUploads()
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond, "Upload should run until its timeout")
+	_, err = os.Stat(snap.GetInfoFilePath())
+	require.NoError(t, err, "Snapshot should be kept on the node")
+}
@@ -0,0 +1,343 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRetainedVersions is the number of previous versions of the snapshot of a revision kept by default, to which
+// the revision can be rolled back
+const DefaultRetainedVersions = 1
+
+// currentFileName is the file recording the current version of the snapshot of a revision
+const currentFileName = "current_file"
+
+// WithRetainedVersions Keeps the given number of previous versions of the snapshot of each revision besides the
+// current one
+func WithRetainedVersions(versions int) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.retainedVersions = versions
+	}
+}
+
+// currentVersion is the content of the current file of a revision
+type currentVersion struct {
+	Generation uint64
+	Pinned     bool
+}
+
+// revision holds the versions of the snapshot of a revision, guarded by the lock of the manager
+type revision struct {
+	name     string
+	dir      string
+	versions map[uint64]*Snapshot
+	// current is the generation of the version loaded by new VMs, which does not change on commit if pinned
+	current uint64
+	pinned  bool
+	// last is the last generation created, so that the generations of removed versions are not reused
+	last uint64
+}
+
+func newRevision(name, baseFolder string) *revision {
+	return &revision{
+		name:     name,
+		dir:      filepath.Join(baseFolder, name),
+		versions: make(map[uint64]*Snapshot),
+	}
+}
+
+// currentSnapshot returns the current version, nil if none is committed
+func (rev *revision) currentSnapshot() *Snapshot {
+	if snap, ok := rev.versions[rev.current]; ok && snap.ready {
+		return snap
+	}
+	return nil
+}
+
+// pendingSnapshot returns the version being created, if any
+func (rev *revision) pendingSnapshot() *Snapshot {
+	for _, snap := range rev.versions {
+		if !snap.ready {
+			return snap
+		}
+	}
+	return nil
+}
+
+// committedSnapshots returns the committed versions, newest first
+func (rev *revision) committedSnapshots() []*Snapshot {
+	var snaps []*Snapshot
+	for _, snap := range rev.versions {
+		if snap.ready {
+			snaps = append(snaps, snap)
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Generation > snaps[j].Generation })
+	return snaps
+}
+
+// register adds a version downloaded from the store, unless a concurrent download registered it first. It returns
+// whether the version was added
+func (rev *revision) register(snap *Snapshot) bool {
+	if registered, ok := rev.versions[snap.Generation]; ok && registered.ready {
+		return false
+	}
+	rev.versions[snap.Generation] = snap
+	if snap.Generation > rev.last {
+		rev.last = snap.Generation
+	}
+	return true
+}
+
+func (rev *revision) currentFilePath() string {
+	return filepath.Join(rev.dir, currentFileName)
+}
+
+// setCurrent promotes the version to current. The current file is replaced atomically, so that a crash leaves either
+// the previous or the new version current
+func (rev *revision) setCurrent(generation uint64, pinned bool) error {
+	rev.current = generation
+	rev.pinned = pinned
+
+	tmpPath := rev.currentFilePath() + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create current file")
+	}
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	if err := gob.NewEncoder(file).Encode(currentVersion{Generation: generation, Pinned: pinned}); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to encode current version")
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to sync current file")
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close current file")
+	}
+
+	return os.Rename(tmpPath, rev.currentFilePath())
+}
+
+// recoverCurrent restores the current version from the current file, falling back to the newest version if the
+// recorded one was discarded
+func (rev *revision) recoverCurrent() {
+	var current currentVersion
+	if file, err := os.Open(rev.currentFilePath()); err == nil {
+		if err := gob.NewDecoder(file).Decode(&current); err != nil {
+			log.WithError(err).WithField("revision", rev.name).Warn("Failed to decode current snapshot version")
+		}
+		file.Close()
+	}
+
+	if _, ok := rev.versions[current.Generation]; ok {
+		rev.current = current.Generation
+		rev.pinned = current.Pinned
+		return
+	}
+
+	if snaps := rev.committedSnapshots(); len(snaps) > 0 {
+		if err := rev.setCurrent(snaps[0].Generation, false); err != nil {
+			log.WithError(err).WithField("revision", rev.name).Warn("Failed to persist current snapshot version")
+		}
+	}
+}
+
+// retire removes the version from the revision. Its files are removed once it is no longer loaded
+func (rev *revision) retire(snap *Snapshot) *Snapshot {
+	delete(rev.versions, snap.Generation)
+	snap.retired = true
+	return snap
+}
+
+// removeDir removes the directory of a revision without versions. It is left in place while the files of retired
+// versions are still in use, and removed with the last of them
+func (rev *revision) removeDir() {
+	_ = os.Remove(rev.currentFilePath())
+	_ = os.Remove(rev.dir)
+}
+
+// retainVersions retires the previous versions of the revision beyond the retained ones. Versions holding the memory
+// layers of diff snapshots are kept
+func (mgr *SnapshotManager) retainVersions(rev *revision) []*Snapshot {
+	var (
+		retired  []*Snapshot
+		retained int
+	)
+	for _, snap := range rev.committedSnapshots() {
+		if snap.Generation == rev.current {
+			continue
+		}
+		if retained < mgr.retainedVersions || mgr.isParent(snap) {
+			retained++
+			continue
+		}
+		retired = append(retired, rev.retire(snap))
+	}
+	return retired
+}
+
+// retain takes a reference to the image of the committed snapshot. It is called with the lock of the manager held, so
+// that the snapshot is not removed meanwhile
+func (mgr *SnapshotManager) retain(snap *Snapshot) {
+	if mgr.retainImage != nil {
+		mgr.retainImage(snap.GetImage())
+	}
+}
+
+// removeRetired removes the files of the retired versions that are not being loaded
+func (mgr *SnapshotManager) removeRetired(snaps []*Snapshot) error {
+	var firstErr error
+	for _, snap := range snaps {
+		mgr.Lock()
+		remove := snap.loading == 0 && !snap.removed
+		if remove {
+			snap.removed = true
+		}
+		mgr.Unlock()
+		if !remove {
+			continue
+		}
+
+		if err := snap.Cleanup(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if snap.ready && mgr.releaseImage != nil {
+			mgr.releaseImage(snap.GetImage())
+		}
+		// The directory of the revision is removed with its last version
+		_ = os.Remove(filepath.Dir(snap.snapDir))
+	}
+	return firstErr
+}
+
+// RollbackSnapshot makes the newest version older than the current one the current version of the snapshot of the
+// revision, e.g., because the current version is faulty. Loads in progress keep using the version they acquired
+func (mgr *SnapshotManager) RollbackSnapshot(revision string) (*Snapshot, error) {
+	mgr.Lock()
+	rev, ok := mgr.revisions[revision]
+	if !ok {
+		mgr.Unlock()
+		return nil, errors.New(fmt.Sprintf("Rollback: Snapshot for revision %s does not exist", revision))
+	}
+	if rev.pinned {
+		mgr.Unlock()
+		return nil, errors.Errorf("Rollback: Snapshot for revision %s is pinned to version %d", revision, rev.current)
+	}
+
+	var previous *Snapshot
+	for _, snap := range rev.committedSnapshots() {
+		if snap.Generation < rev.current {
+			previous = snap
+			break
+		}
+	}
+	if previous == nil {
+		mgr.Unlock()
+		return nil, errors.Errorf("Rollback: Snapshot for revision %s has no version older than %d", revision, rev.current)
+	}
+
+	err := rev.setCurrent(previous.Generation, false)
+	mgr.Unlock()
+	if err != nil {
+		return nil, errors.Wrapf(err, "rolling back snapshot of revision %s", revision)
+	}
+
+	log.WithFields(log.Fields{"revision": revision, "generation": previous.Generation}).Info("Rolled back snapshot")
+	mgr.publishCurrent(revision)
+
+	return previous, nil
+}
+
+// PinSnapshotVersion makes the given version the current version of the snapshot of the revision, and keeps it
+// current when new versions are committed until UnpinSnapshotVersion is called
+func (mgr *SnapshotManager) PinSnapshotVersion(revision string, generation uint64) error {
+	mgr.Lock()
+	rev, ok := mgr.revisions[revision]
+	if !ok {
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Pin: Snapshot for revision %s does not exist", revision))
+	}
+	if snap, ok := rev.versions[generation]; !ok || !snap.ready {
+		mgr.Unlock()
+		return errors.Errorf("Pin: Snapshot for revision %s has no version %d", revision, generation)
+	}
+
+	err := rev.setCurrent(generation, true)
+	mgr.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "pinning snapshot of revision %s", revision)
+	}
+
+	mgr.publishCurrent(revision)
+
+	return nil
+}
+
+// UnpinSnapshotVersion lets the versions of the snapshot of the revision committed from now on become current
+func (mgr *SnapshotManager) UnpinSnapshotVersion(revision string) error {
+	mgr.Lock()
+	rev, ok := mgr.revisions[revision]
+	if !ok {
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Unpin: Snapshot for revision %s does not exist", revision))
+	}
+
+	err := rev.setCurrent(rev.current, false)
+	mgr.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "unpinning snapshot of revision %s", revision)
+	}
+
+	mgr.publishCurrent(revision)
+
+	return nil
+}
+
+// GetSnapshotVersions returns the usage of the committed versions of the snapshot of the revision, oldest first
+func (mgr *SnapshotManager) GetSnapshotVersions(revision string) []SnapshotStats {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	rev, ok := mgr.revisions[revision]
+	if !ok {
+		return nil
+	}
+
+	var stats []SnapshotStats
+	for _, snap := range rev.committedSnapshots() {
+		stats = append([]SnapshotStats{rev.getStats(snap)}, stats...)
+	}
+
+	return stats
+}
@@ -0,0 +1,168 @@
+// MIT License
+//
+// Copyright (c) 2024 vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+var fullSnapshotFiles = []func(*snapshotting.Snapshot) string{
+	(*snapshotting.Snapshot).GetSnapshotFilePath,
+	(*snapshotting.Snapshot).GetPatchFilePath,
+	(*snapshotting.Snapshot).GetMemFilePath,
+}
+
+func generations(mgr *snapshotting.SnapshotManager, revision string) (list []uint64, current uint64) {
+	for _, stats := range mgr.GetSnapshotVersions(revision) {
+		list = append(list, stats.Generation)
+		if stats.Current {
+			current = stats.Generation
+		}
+	}
+	return list, current
+}
+
+func TestSnapshotVersions(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithRetainedVersions(1))
+
+	first := createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	second := createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	require.Equal(t, uint64(1), first.GetGeneration())
+	require.Equal(t, uint64(2), second.GetGeneration())
+	require.NotEqual(t, first.GetMemFilePath(), second.GetMemFilePath(), "Versions should not share files")
+
+	snap, err := mgr.AcquireSnapshot(context.Background(), "rev")
+	require.NoError(t, err)
+	require.Same(t, second, snap, "Committed version should become current")
+
+	createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	list, current := generations(mgr, "rev")
+	require.Equal(t, []uint64{2, 3}, list, "Only one previous version should be retained")
+	require.Equal(t, uint64(3), current)
+	_, err = os.Stat(first.GetInfoFilePath())
+	require.True(t, os.IsNotExist(err), "Files of the removed version should be removed")
+	require.Equal(t, []string{"rev"}, mgr.ListSnapshots())
+}
+
+func TestSnapshotVersionLoading(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithRetainedVersions(0))
+
+	first := createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	loading, err := mgr.PinSnapshot(context.Background(), "rev")
+	require.NoError(t, err)
+	require.Same(t, first, loading)
+
+	second := createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	snap, err := mgr.AcquireSnapshot(context.Background(), "rev")
+	require.NoError(t, err)
+	require.Same(t, second, snap, "New loads should use the new version")
+	list, _ := generations(mgr, "rev")
+	require.Equal(t, []uint64{2}, list)
+
+	_, err = os.Stat(first.GetMemFilePath())
+	require.NoError(t, err, "Files of the version being loaded should be kept")
+	mgr.UnpinSnapshot(loading, 0)
+	_, err = os.Stat(first.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Files of the retired version should be removed after its last load")
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	dir := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(dir, snapshotting.WithRetainedVersions(1))
+
+	first := createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+
+	snap, err := mgr.RollbackSnapshot("rev")
+	require.NoError(t, err, "Failed to roll back snapshot")
+	require.Same(t, first, snap)
+	snap, err = mgr.AcquireSnapshot(context.Background(), "rev")
+	require.NoError(t, err)
+	require.Same(t, first, snap, "Rolled back version should be current")
+
+	_, err = mgr.RollbackSnapshot("rev")
+	require.Error(t, err, "Rollback without older version should fail")
+	_, err = mgr.RollbackSnapshot("other")
+	require.Error(t, err, "Rollback of unknown revision should fail")
+
+	// The current version survives restarts
+	mgr = snapshotting.NewSnapshotManager(dir, snapshotting.WithKeepOnStart(true), snapshotting.WithRetainedVersions(1))
+	snap, err = mgr.AcquireSnapshot(context.Background(), "rev")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), snap.GetGeneration(), "Rollback should be persisted")
+
+	third := createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	require.Equal(t, uint64(3), third.GetGeneration(), "Generations should not be reused")
+	list, current := generations(mgr, "rev")
+	require.Equal(t, []uint64{2, 3}, list)
+	require.Equal(t, uint64(3), current)
+}
+
+func TestSnapshotPinVersion(t *testing.T) {
+	dir := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(dir, snapshotting.WithRetainedVersions(2))
+
+	createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	require.Error(t, mgr.PinSnapshotVersion("rev", 5), "Pinning a missing version should fail")
+	require.NoError(t, mgr.PinSnapshotVersion("rev", 1), "Failed to pin version")
+
+	createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	_, current := generations(mgr, "rev")
+	require.Equal(t, uint64(1), current, "Pinned version should stay current")
+	_, err := mgr.RollbackSnapshot("rev")
+	require.Error(t, err, "Rollback of a pinned revision should fail")
+
+	mgr = snapshotting.NewSnapshotManager(dir, snapshotting.WithKeepOnStart(true), snapshotting.WithRetainedVersions(2))
+	stats := mgr.GetSnapshotVersions("rev")
+	require.Len(t, stats, 3)
+	require.True(t, stats[0].Pinned, "Pin should be persisted")
+
+	require.NoError(t, mgr.UnpinSnapshotVersion("rev"))
+	createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	list, current := generations(mgr, "rev")
+	require.Equal(t, uint64(4), current, "Versions committed after unpinning should become current")
+	require.Equal(t, []uint64{2, 3, 4}, list, "Previous versions beyond the retained ones should be removed")
+}
+
+func TestSnapshotImageReferences(t *testing.T) {
+	dir := t.TempDir()
+	refs := make(map[string]int)
+	imageRefs := snapshotting.WithImageReferences(func(image string) { refs[image]++ }, func(image string) { refs[image]-- })
+	mgr := snapshotting.NewSnapshotManager(dir, snapshotting.WithRetainedVersions(0), imageRefs)
+
+	createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	require.Equal(t, 1, refs["testImage"], "Committed snapshot should retain its image")
+	createTestSnapshot(t, mgr, "rev", "", fullSnapshotFiles...)
+	require.Equal(t, 1, refs["testImage"], "Removed version should release its image")
+
+	mgr = snapshotting.NewSnapshotManager(dir, snapshotting.WithKeepOnStart(true), imageRefs)
+	require.Equal(t, 2, refs["testImage"], "Recovered snapshot should retain its image")
+	require.NoError(t, mgr.InvalidateSnapshot("rev"))
+	require.Equal(t, 1, refs["testImage"], "Invalidated snapshot should release its image")
+}
@@ -32,8 +32,9 @@ import (
 
 // FuncStat Per-function stats
 type FuncStat struct {
-	served  uint64
-	started uint64
+	served       uint64
+	started      uint64
+	reclaimedMib int64 // memory currently held by the balloon of the instance
 }
 
 // Stats Stats for the cold functions in the function pool
@@ -70,10 +71,24 @@ func (cs *Stats) IncServed(fID string) {
 	atomic.AddUint64(&cs.statMap[fID].served, 1)
 }
 
+// SetReclaimedMib Records the memory reclaimed from the instance of the function
+func (cs *Stats) SetReclaimedMib(fID string, mib int64) {
+	atomic.StoreInt64(&cs.statMap[fID].reclaimedMib, mib)
+}
+
+// GetReclaimedMib Returns the memory reclaimed from the instances of all functions
+func (cs *Stats) GetReclaimedMib() int64 {
+	var total int64
+	for _, stat := range cs.statMap {
+		total += atomic.LoadInt64(&stat.reclaimedMib)
+	}
+	return total
+}
+
 // SprintStats Prints all stats
 func (cs *Stats) SprintStats() string {
 	var s = "==== Stats by cold functions ====\n"
-	s += "fID, #started, #served\n"
+	s += "fID, #started, #served, reclaimed MiB\n"
 
 	funcs := make([]string, 0, len(cs.statMap))
 	for fID := range cs.statMap {
@@ -86,9 +101,10 @@ func (cs *Stats) SprintStats() string {
 	})
 
 	for _, fID := range funcs {
-		s += fmt.Sprintf("%s, %d, %d\n", fID,
+		s += fmt.Sprintf("%s, %d, %d, %d\n", fID,
 			atomic.LoadUint64(&cs.statMap[fID].started),
-			atomic.LoadUint64(&cs.statMap[fID].served))
+			atomic.LoadUint64(&cs.statMap[fID].served),
+			atomic.LoadInt64(&cs.statMap[fID].reclaimedMib))
 	}
 
 	s += "==================================="
@@ -30,6 +30,7 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"time"
 
 	ctrdlog "github.com/containerd/containerd/log"
 	log "github.com/sirupsen/logrus"
@@ -37,8 +38,11 @@ import (
 	fccri "github.com/vhive-serverless/vhive/cri/firecracker"
 	gvcri "github.com/vhive-serverless/vhive/cri/gvisor"
 	ctriface "github.com/vhive-serverless/vhive/ctriface"
+	"github.com/vhive-serverless/vhive/ctriface/image"
+	"github.com/vhive-serverless/vhive/devmapper"
 	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
 	pb "github.com/vhive-serverless/vhive/proto"
+	"github.com/vhive-serverless/vhive/snapshotting"
 	"google.golang.org/grpc"
 )
 
@@ -64,6 +68,47 @@ var (
 	criSock            *string
 	hostIface          *string
 	netPoolSize        *int
+	probeType          *string
+	probePort          *int
+	probePath          *string
+	probeTimeout       *time.Duration
+	cpuPolicy          *string
+	isBalloon          *bool
+	balloonIdle        *time.Duration
+	balloonMib         *int64
+	isCgroups          *bool
+	isJailer           *bool
+	jailerUID          *uint
+	jailerGID          *uint
+	jailerIDs          *uint
+	timeoutProfile     *string
+	imageGCHigh        *float64
+	imageGCLow         *float64
+	imageGCQuota       *int64
+	thinPool           *string
+	warmSet            *string
+	prePullWorkers     *int
+	registriesConfig   *string
+	registries         *image.Registries
+	pullPolicy         *string
+	pullAttempts       *int
+	isLazyPull         *bool
+	lazyFetchTimeout   *time.Duration
+	lazyCacheBudget    *int64
+	patchMode          *string
+	devicePoolSize     *int
+	thinPoolHigh       *float64
+	thinPoolGC         *float64
+	keepSnapshots      *bool
+	snapshotBudget     *int64
+	snapshotEviction   *string
+	snapshotStore      *string
+	snapshotVersions   *int
+	resnapshotLoads    *int
+	driveImageRoot     *string
+	s3Endpoint         *string
+	s3Region           *string
+	s3Timeout          *time.Duration
 )
 
 func main() {
@@ -83,6 +128,47 @@ func main() {
 	criSock = flag.String("criSock", "/etc/vhive-cri/vhive-cri.sock", "Socket address for CRI service")
 	hostIface = flag.String("hostIface", "", "Host net-interface for the VMs to bind to for internet access")
 	netPoolSize = flag.Int("netPoolSize", 10, "Amount of network configs to preallocate in a pool")
+	probeType = flag.String("probe", "none", "Readiness probe run before StartVM returns, valid options: none, tcp, grpc, http")
+	probePort = flag.Int("probePort", 50051, "Guest port checked by the readiness probe")
+	probePath = flag.String("probePath", "/", "URL path requested by the http readiness probe")
+	probeTimeout = flag.Duration("probeTimeout", 0, "Time for a guest to pass the readiness probe before the VM is torn down, overrides the Probe timeout of the profile")
+	cpuPolicy = flag.String("cpuPolicy", "none", "Placement of VM vCPUs on host CPUs (requires -cgroups), valid options: none, packed, spread, isolated")
+	isBalloon = flag.Bool("balloon", false, "Attach a memory balloon device to the VMs")
+	balloonIdle = flag.Duration("balloonIdle", 0, "Inflate the balloon of an instance after being idle for this long (0 to disable)")
+	balloonMib = flag.Int64("balloonMib", 128, "Amount of memory (MiB) reclaimed from an idle instance by its balloon")
+	isCgroups = flag.Bool("cgroups", false, "Account the resources used by each VM in a dedicated cgroup (requires cgroup v2 and -jailer)")
+	isJailer = flag.Bool("jailer", false, "Run the Firecracker process of each VM under the jailer")
+	jailerUID = flag.Uint("jailerUID", 10000, "UID of the first jailed Firecracker process, each VM runs as its own user")
+	jailerGID = flag.Uint("jailerGID", 10000, "GID shared by the jailed Firecracker processes, the only group that can read the snapshots they load")
+	jailerIDs = flag.Uint("jailerIDs", 1024, "Number of consecutive UIDs from -jailerUID, one per jailed VM")
+	timeoutProfile = flag.String("timeoutProfile", "", "JSON file with the timeouts of the VM lifecycle stages, e.g., {\"Snapshot\": \"2m\"}")
+	imageGCHigh = flag.Float64("imageGCHigh", 0, "Evict unused images when the disk usage exceeds this fraction (0 to disable)")
+	imageGCLow = flag.Float64("imageGCLow", 0.7, "Stop evicting unused images once the disk usage falls below this fraction")
+	imageGCQuota = flag.Int64("imageGCQuota", 0, "Size (bytes) of the containerd content store considered by the image GC (0 to ignore)")
+	thinPool = flag.String("thinPool", "fc-dev-thinpool", "Devmapper thin pool of the Firecracker VMs considered by the image GC and the thin pool monitor (empty to ignore)")
+	thinPoolHigh = flag.Float64("thinPoolHigh", 0, "Refuse to create VMs while the data or metadata usage of the thin pool exceeds this fraction (0 to disable)")
+	thinPoolGC = flag.Float64("thinPoolGC", 0.8, "Free space, e.g., by evicting unused images, while the usage of the thin pool exceeds this fraction")
+	warmSet = flag.String("warmSet", "", "File listing the images to pull in the background at startup, one per line")
+	prePullWorkers = flag.Int("prePullWorkers", 4, "Number of images of the warm set pulled in parallel")
+	registriesConfig = flag.String("registries", "", "JSON file with the credentials and TLS options of the image registries")
+	pullPolicy = flag.String("pullPolicy", "IfNotPresent", "When to query the registry for function images, valid options: IfNotPresent, Always, DigestOnly")
+	pullAttempts = flag.Int("pullAttempts", 4, "Attempts of the image pulls that fail for transient reasons, with exponential backoff")
+	isLazyPull = flag.Bool("lazyPull", false, "Boot the VMs of eStargz images while fetching their files on demand (requires the nbd module)")
+	lazyFetchTimeout = flag.Duration("lazyFetchTimeout", image.DefaultLazyFetchTimeout, "Time the reads of lazily loaded images wait for the registry before failing")
+	lazyCacheBudget = flag.Int64("lazyCacheBudget", 10<<30, "Size (bytes) of the files of lazily loaded images cached on the node, above which the least recently used are dropped (0 for no limit)")
+	patchMode = flag.String("patchMode", "file", "How the changes of a VM to its root file system are stored in snapshots, valid options: file, block")
+	keepSnapshots = flag.Bool("keepSnapshots", false, "Keep the snapshots of the previous run at start instead of purging them")
+	snapshotBudget = flag.Int64("snapshotBudget", 0, "Size (bytes) of the snapshots kept on disk, above which snapshots are evicted (0 for no limit)")
+	snapshotEviction = flag.String("snapshotEviction", "lru", "Which snapshots are evicted first when exceeding the budget, valid options: lru, cost")
+	snapshotVersions = flag.Int("snapshotVersions", snapshotting.DefaultRetainedVersions, "Number of previous snapshot versions kept per revision, to which the revision can be rolled back")
+	driveImageRoot = flag.String("driveImageRoot", "", "Directory holding the image files that the image drives of workloads may use (empty to refuse image drives)")
+	resnapshotLoads = flag.Int("resnapshotLoads", 0, "Number of loads of a snapshot after which it is refreshed with a diff snapshot of a warm VM (0 to disable)")
+	snapshotStore = flag.String("snapshotStore", "", "Store sharing the snapshots between nodes, file:///path/to/dir or s3://bucket/prefix (empty for none)")
+	s3Endpoint = flag.String("s3Endpoint", "", "Endpoint of the S3-compatible snapshot store, e.g., http://minio:9000, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	s3Region = flag.String("s3Region", "us-east-1", "Region of the S3-compatible snapshot store")
+	s3Timeout = flag.Duration("s3Timeout", snapshotting.DefaultS3Timeout, "Time for a request to the S3-compatible snapshot store, including the transfer of the file")
+	devicePoolSize = flag.Int("devicePoolSize", 0, "Number of snapshot container devices kept with their patch applied, to load VMs from them without applying the patch (0 disables the pool)")
+	gvisorSnapshotter := flag.String("gvisorSnapshotter", "overlayfs", "Snapshotter the images of gVisor containers are unpacked into")
 	sandbox := flag.String("sandbox", "firecracker", "Sandbox tech to use, valid options: firecracker, gvisor")
 	flag.Parse()
 
@@ -126,29 +212,177 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	readinessProbeType, err := ctriface.ParseProbeType(*probeType)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	cpuPlacementPolicy, err := ctriface.ParseCPUPolicy(*cpuPolicy)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	regCfg := image.RegistriesConfig{}
+	if *registriesConfig != "" {
+		if regCfg, err = image.LoadRegistriesConfig(*registriesConfig); err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+	if registries, err = image.NewRegistries(regCfg); err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	imagePullPolicy, err := image.ParsePullPolicy(*pullPolicy)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	rootfsPatchMode, err := devmapper.ParsePatchMode(*patchMode)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	evictionPolicy, err := snapshotting.ParseEvictionPolicy(*snapshotEviction)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	var store snapshotting.SnapshotStore
+	if *snapshotStore != "" {
+		store, err = snapshotting.NewStore(*snapshotStore, snapshotting.S3Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Timeout:   *s3Timeout,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+		if err != nil {
+			log.Fatalln(err)
+			return
+		}
+	}
+
+	pullRetries := image.DefaultRetryPolicy()
+	pullRetries.Attempts = *pullAttempts
+
 	if *isSaveMemory {
 		log.Info(fmt.Sprintf("Creating orchestrator for pinned=%d functions", *pinnedFuncNum))
 	}
 
+	// The policies of the image manager are the same for both sandboxes
+	gcPolicy := image.GCPolicy{
+		Interval:      time.Minute,
+		HighWatermark: *imageGCHigh,
+		LowWatermark:  *imageGCLow,
+		ContentQuota:  *imageGCQuota,
+	}
+	var warmSetImages []string
+	if *warmSet != "" {
+		if warmSetImages, err = image.LoadWarmSet(*warmSet); err != nil {
+			log.Fatalf("Failed to load the warm set: %v", err)
+		}
+	}
+
 	switch *sandbox {
 	case "firecracker":
 		testModeOn := false
-		orch = ctriface.NewOrchestrator(
-			*snapshotter,
-			*hostIface,
+		orchOpts := []ctriface.OrchestratorOption{
 			ctriface.WithTestModeOn(testModeOn),
 			ctriface.WithSnapshots(*isSnapshotsEnabled),
+			ctriface.WithKeepSnapshots(*keepSnapshots),
+			ctriface.WithSnapshotBudget(*snapshotBudget, evictionPolicy),
+			ctriface.WithSnapshotVersions(*snapshotVersions),
+			ctriface.WithDiffSnapshots(*resnapshotLoads),
+			ctriface.WithDriveImageRoot(*driveImageRoot),
+			ctriface.WithSnapshotStore(store),
 			ctriface.WithUPF(*isUPFEnabled),
 			ctriface.WithMetricsMode(*isMetricsMode),
 			ctriface.WithLazyMode(*isLazyMode),
 			ctriface.WithNetPoolSize(*netPoolSize),
-		)
+			ctriface.WithReadinessProbe(ctriface.ReadinessProbe{
+				Type: readinessProbeType,
+				Port: *probePort,
+				Path: *probePath,
+			}),
+			ctriface.WithCPUPlacement(cpuPlacementPolicy),
+			ctriface.WithBalloon(*isBalloon),
+			ctriface.WithCgroups(*isCgroups),
+			ctriface.WithRegistries(registries),
+			ctriface.WithPullPolicy(imagePullPolicy),
+			ctriface.WithPullRetries(pullRetries),
+			ctriface.WithLazyPull(*isLazyPull),
+			ctriface.WithLazyPullLimits(*lazyFetchTimeout, *lazyCacheBudget),
+			ctriface.WithPatchMode(rootfsPatchMode),
+			ctriface.WithDevicePool(devmapper.DevicePoolPolicy{MaxOrigins: *devicePoolSize}),
+		}
+		profile := ctriface.DefaultTimeoutProfile()
+		if *timeoutProfile != "" {
+			if profile, err = ctriface.LoadTimeoutProfile(*timeoutProfile); err != nil {
+				log.Fatalf("Failed to load the timeout profile: %v", err)
+			}
+		}
+		if *probeTimeout > 0 {
+			profile.Probe = *probeTimeout
+		}
+		orchOpts = append(orchOpts, ctriface.WithTimeoutProfile(profile))
+		if *isCgroups && !*isJailer {
+			log.Fatal("-cgroups requires -jailer, which spawns Firecracker in the cgroup of its VM")
+		}
+		if cpuPlacementPolicy != ctriface.CPUPolicyNone && !*isCgroups {
+			log.Fatal("-cpuPolicy requires -cgroups, VMs being confined to their CPUs by the cpuset of their cgroup")
+		}
+		if *isJailer {
+			orchOpts = append(orchOpts, ctriface.WithJailer(ctriface.JailerConfig{
+				UID:          uint32(*jailerUID),
+				GID:          uint32(*jailerGID),
+				IDs:          uint32(*jailerIDs),
+				SeccompLevel: ctriface.SeccompAdvanced,
+			}))
+		}
+		if *imageGCHigh > 0 {
+			gcPolicy.ThinPool = *thinPool
+			orchOpts = append(orchOpts, ctriface.WithImageGC(gcPolicy))
+		}
+		if *thinPoolHigh > 0 && *thinPool != "" {
+			orchOpts = append(orchOpts, ctriface.WithThinPoolMonitor(devmapper.ThinPoolPolicy{
+				Pool:          *thinPool,
+				Interval:      10 * time.Second,
+				GCWatermark:   *thinPoolGC,
+				HighWatermark: *thinPoolHigh,
+			}))
+		}
+		if len(warmSetImages) > 0 {
+			orchOpts = append(orchOpts, ctriface.WithWarmSet(warmSetImages, *prePullWorkers))
+		}
+		orch = ctriface.NewOrchestrator(*snapshotter, *hostIface, orchOpts...)
 		funcPool = NewFuncPool(*isSaveMemory, *servedThreshold, *pinnedFuncNum, testModeOn)
+		funcPool.SetBalloonPolicy(*balloonIdle, *balloonMib)
 		go setupFirecrackerCRI()
 		go orchServe()
 		fwdServe()
 	case "gvisor":
-		setupGVisorCRI()
+		gvOpts := []gvcri.Option{
+			gvcri.WithSnapshotter(*gvisorSnapshotter),
+			gvcri.WithImageManagerOptions(
+				image.WithRegistries(registries),
+				image.WithPullPolicy(imagePullPolicy),
+				image.WithRetryPolicy(pullRetries),
+			),
+		}
+		if *imageGCHigh > 0 {
+			gvOpts = append(gvOpts, gvcri.WithImageGC(gcPolicy))
+		}
+		if len(warmSetImages) > 0 {
+			gvOpts = append(gvOpts, gvcri.WithWarmSet(warmSetImages, *prePullWorkers))
+		}
+		setupGVisorCRI(gvOpts...)
 	}
 }
 
@@ -254,6 +488,39 @@ func (s *server) StopVMs(ctx context.Context, in *pb.StopVMsReq) (*pb.Status, er
 	return &pb.Status{Message: "Stopped VMs"}, nil
 }
 
+// PrePull adds images to the warm set of the node, optionally waiting for them to be pulled
+func (s *server) PrePull(ctx context.Context, in *pb.PrePullReq) (*pb.PrePullStatus, error) {
+	log.WithFields(log.Fields{"images": in.GetImages()}).Info("Received PrePull")
+
+	orch.PrePullImages(in.GetImages())
+	if in.GetWait() {
+		if err := orch.WaitPrePull(ctx); err != nil {
+			log.WithError(err).Warn("Pre-pull incomplete")
+		}
+	}
+
+	return toPrePullStatus(orch.GetPrePullStatus()), nil
+}
+
+// GetPrePullStatus reports the progress of the pre-pull of the warm set
+func (s *server) GetPrePullStatus(ctx context.Context, in *pb.PrePullStatusReq) (*pb.PrePullStatus, error) {
+	return toPrePullStatus(orch.GetPrePullStatus()), nil
+}
+
+func toPrePullStatus(status image.PrePullStatus) *pb.PrePullStatus {
+	resp := &pb.PrePullStatus{
+		Ready:  status.Ready(),
+		Total:  int32(status.Total),
+		Pulled: int32(status.Pulled),
+		Failed: int32(status.Failed),
+	}
+	for imageName, reason := range status.Errors {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %s", imageName, reason))
+	}
+
+	return resp
+}
+
 func (s *fwdServer) FwdHello(ctx context.Context, in *hpb.FwdHelloReq) (*hpb.FwdHelloResp, error) {
 	fID := in.GetId()
 	imageName := in.GetImage()
@@ -266,7 +533,7 @@ func (s *fwdServer) FwdHello(ctx context.Context, in *hpb.FwdHelloReq) (*hpb.Fwd
 	return resp, err
 }
 
-func setupGVisorCRI() {
+func setupGVisorCRI(opts ...gvcri.Option) {
 	lis, err := net.Listen("unix", *criSock)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
@@ -274,7 +541,7 @@ func setupGVisorCRI() {
 
 	s := grpc.NewServer()
 
-	gvService, err := gvcri.NewGVisorService()
+	gvService, err := gvcri.NewGVisorService(opts...)
 	if err != nil {
 		log.Fatalf("failed to create gVisor service %v", err)
 	}